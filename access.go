@@ -0,0 +1,108 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Interface AccessReporter is implemented by storages that can report which files and chunks
+// are retrieved most often, e.g. for deciding which content to pin or move to a faster tier.
+type AccessReporter interface {
+	// Returns up to n of the keys retrieved most often by Get, most accessed first, or nil if
+	// access accounting is disabled. Keys accessed equally often are ordered by last access.
+	HotChunks(n int) []AccessStat
+}
+
+// Type AccessStat describes how often a key has been accessed.
+type AccessStat struct {
+	Key        SKey
+	Count      int64
+	LastAccess time.Time
+}
+
+// Type AccessCounter counts accesses per key. It is meant to be used by storage implementations
+// and is safe for concurrent use. Accessing a key already counted doesn't take a lock.
+// A nil *AccessCounter counts nothing.
+type AccessCounter struct {
+	counts sync.Map // Maps SKey to *accessCount
+}
+
+type accessCount struct {
+	count int64
+	last  int64 // Time of last access in Unix nanoseconds
+}
+
+// Returns a new counter if `enabled` is set, nil otherwise.
+func NewAccessCounter(enabled bool) *AccessCounter {
+	if !enabled {
+		return nil
+	}
+	return &AccessCounter{}
+}
+
+// Function Record counts an access to `key`.
+func (c *AccessCounter) Record(key SKey) {
+	if c == nil {
+		return
+	}
+	v, ok := c.counts.Load(key)
+	if !ok {
+		v, _ = c.counts.LoadOrStore(key, new(accessCount))
+	}
+	a := v.(*accessCount)
+	atomic.AddInt64(&a.count, 1)
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// Function Forget drops the statistics of `key`, e.g. when it has been removed from the storage.
+func (c *AccessCounter) Forget(key SKey) {
+	if c == nil {
+		return
+	}
+	c.counts.Delete(key)
+}
+
+// Returns up to n of the keys accessed most often. See AccessReporter.
+func (c *AccessCounter) Top(n int) []AccessStat {
+	if c == nil {
+		return nil
+	}
+	var result []AccessStat
+	c.counts.Range(func(k, v interface{}) bool {
+		a := v.(*accessCount)
+		result = append(result, AccessStat{
+			Key:        k.(SKey),
+			Count:      atomic.LoadInt64(&a.count),
+			LastAccess: time.Unix(0, atomic.LoadInt64(&a.last)),
+		})
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].LastAccess.After(result[j].LastAccess)
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
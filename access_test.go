@@ -0,0 +1,49 @@
+package cafs
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestAccessCounter(t *testing.T) {
+	var nilCounter *AccessCounter
+	nilCounter.Record(SKey{1})
+	if top := nilCounter.Top(10); top != nil {
+		t.Errorf("Expected nil counter to report nothing, got %v", top)
+	}
+
+	c := NewAccessCounter(true)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Record(SKey{'a'})
+				if j%2 == 0 {
+					c.Record(SKey{'b'})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	c.Record(SKey{'c'})
+	c.Record(SKey{'d'})
+
+	top := c.Top(3)
+	if len(top) != 3 {
+		t.Fatalf("Expected 3 keys, got %v", top)
+	}
+	if top[0].Key != (SKey{'a'}) || top[0].Count != 400 || top[1].Key != (SKey{'b'}) || top[1].Count != 200 {
+		t.Errorf("Unexpected top keys: %v", top)
+	}
+	// Equal counts are ordered by last access
+	if top[2].Key != (SKey{'d'}) {
+		t.Errorf("Expected most recently accessed key d, got %v", top[2])
+	}
+
+	c.Forget(SKey{'a'})
+	if top := c.Top(1); len(top) != 1 || top[0].Key != (SKey{'b'}) {
+		t.Errorf("Expected b to be the hottest key after forgetting a, got %v", top)
+	}
+}
@@ -0,0 +1,121 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Type ArchiveEntry describes a file to be written into an archive by WriteTar or WriteZip.
+type ArchiveEntry struct {
+	Name    string      // The path of the file within the archive
+	File    File        // The file's content
+	Mode    os.FileMode // The permission bits of the file. Defaults to 0644.
+	ModTime time.Time   // The modification time of the file. Defaults to the current time.
+}
+
+func (e *ArchiveEntry) mode() os.FileMode {
+	if e.Mode == 0 {
+		return 0644
+	}
+	return e.Mode.Perm()
+}
+
+func (e *ArchiveEntry) modTime(now time.Time) time.Time {
+	if e.ModTime.IsZero() {
+		return now
+	}
+	return e.ModTime
+}
+
+// Function WriteTar streams the content of the given files into `tw`, one regular file per entry,
+// without buffering them. The sizes in the headers are taken from File.Size(). The tar writer is
+// not closed, so that more files can be added.
+func WriteTar(tw *tar.Writer, entries []ArchiveEntry) error {
+	now := time.Now()
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     e.Name,
+			Size:     e.File.Size(),
+			Mode:     int64(e.mode()),
+			ModTime:  e.modTime(now),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("%v: %w", e.Name, err)
+		}
+		if err := copyEntry(tw, &e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Function WriteZip streams the content of the given files into `zw`, compressing them with
+// Deflate. The zip writer is not closed, so that more files can be added.
+func WriteZip(zw *zip.Writer, entries []ArchiveEntry) error {
+	now := time.Now()
+	for _, e := range entries {
+		hdr := &zip.FileHeader{
+			Name:               e.Name,
+			Method:             zip.Deflate,
+			Modified:           e.modTime(now),
+			UncompressedSize64: uint64(e.File.Size()),
+		}
+		hdr.SetMode(e.mode())
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return fmt.Errorf("%v: %w", e.Name, err)
+		}
+		if err := copyEntry(w, &e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies the content of the entry's file to `w`. Files implementing ExtentFile are read directly
+// from their extents, unless their data isn't stored in extents. Returns an error if the content
+// doesn't match the file's size.
+func copyEntry(w io.Writer, e *ArchiveEntry) error {
+	var n int64
+	err := ErrNoExtents
+	if ef, ok := e.File.(ExtentFile); ok {
+		err = ef.WalkExtents(func(src *os.File, offset, length int64) error {
+			m, err := io.Copy(w, io.NewSectionReader(src, offset, length))
+			n += m
+			return err
+		})
+	}
+	if err == ErrNoExtents && n == 0 {
+		r := e.File.Open()
+		n, err = io.Copy(w, r)
+		r.Close()
+	}
+	if err == nil && n != e.File.Size() {
+		err = fmt.Errorf("read %d bytes, expected %d", n, e.File.Size())
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %w", e.Name, err)
+	}
+	return nil
+}
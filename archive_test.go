@@ -0,0 +1,86 @@
+package cafs_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"io"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	s := ram.NewRamStorage(8 * 1024 * 1024)
+	var entries []ArchiveEntry
+	expected := make(map[string][]byte)
+	for i, size := range []int{0, 1000, 300000} {
+		f := addRandomData(t, s, size)
+		defer f.Dispose()
+		name := fmt.Sprintf("dir/file-%d", i)
+		entries = append(entries, ArchiveEntry{Name: name, File: f, Mode: 0600})
+		r := f.Open()
+		expected[name], _ = io.ReadAll(r)
+		r.Close()
+	}
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	if err := WriteTar(tw, entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&tarBuf)
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		n++
+		if content, err := io.ReadAll(tr); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(content, expected[hdr.Name]) || hdr.Size != int64(len(content)) {
+			t.Errorf("tar: content of %v differs", hdr.Name)
+		}
+		if hdr.Mode != 0600 {
+			t.Errorf("tar: expected mode 0600 for %v, got %o", hdr.Name, hdr.Mode)
+		}
+	}
+	if n != len(entries) {
+		t.Errorf("tar: expected %d entries, got %d", len(entries), n)
+	}
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	if err := WriteZip(zw, entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(zipBuf.Bytes()), int64(zipBuf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(entries) {
+		t.Errorf("zip: expected %d entries, got %d", len(entries), len(zr.File))
+	}
+	for _, zf := range zr.File {
+		r, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content, err := io.ReadAll(r); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(content, expected[zf.Name]) || zf.UncompressedSize64 != uint64(len(content)) {
+			t.Errorf("zip: content of %v differs", zf.Name)
+		}
+		r.Close()
+	}
+}
@@ -0,0 +1,371 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package audit implements a storage wrapper that records an audit trail of all mutations, e.g.
+// for compliance. Files are ingested, pinned and evicted exactly as by the wrapped storage.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/indyjo/cafs"
+	"io"
+	"sync"
+	"time"
+)
+
+// Returned by the optional interfaces implemented by an audited storage and its temporaries, e.g.
+// cafs.Repairer, if the wrapped storage or temporary doesn't implement them.
+var ErrNotSupported = errors.New("Not supported by the wrapped storage")
+
+// Operations recorded in the audit trail.
+const (
+	OpStore     = "store"      // A file has been ingested
+	OpReject    = "reject"     // An ingest failed
+	OpGet       = "get"        // A file has been retrieved, if reads are audited
+	OpPin       = "pin"        // A file has been pinned
+	OpUnpin     = "unpin"      // A file has been unpinned
+	OpEvict     = "evict"      // The storage has removed an object
+	OpFreeCache = "free cache" // The storage's cache has been cleared
+	OpBind      = "bind"       // A name has been bound to a file (see Namespace)
+	OpUnbind    = "unbind"     // A name has been removed (see Namespace)
+	OpRepair    = "repair"     // The data stored under a key has been replaced
+	OpSnapshot  = "snapshot"   // A snapshot of an ingest in progress has been stored
+	OpPause     = "pause"      // An ingest has been paused
+	OpResume    = "resume"     // An ingest has been resumed
+	OpLost      = "lost"       // Events that couldn't be recorded because the sink didn't keep up
+)
+
+// Type Record is an entry of the audit trail.
+//
+// Record implements json.Marshaler. The field names of the JSON object are stable:
+//
+//	time    time of the operation, in RFC 3339 format
+//	op      the operation (see the Op constants)
+//	key     key of the file concerned as a hex string, if any
+//	name    name concerned, if any
+//	info    info string of the file concerned, if known
+//	size    number of bytes concerned, if any
+//	error   the error the operation failed with, if any
+type Record struct {
+	Time  time.Time
+	Op    string
+	Key   cafs.SKey
+	Name  string
+	Info  string
+	Size  int64
+	Error string
+}
+
+func (r Record) MarshalJSON() ([]byte, error) {
+	var key string
+	if r.Key != (cafs.SKey{}) {
+		key = r.Key.String()
+	}
+	return json.Marshal(struct {
+		Time  time.Time `json:"time"`
+		Op    string    `json:"op"`
+		Key   string    `json:"key,omitempty"`
+		Name  string    `json:"name,omitempty"`
+		Info  string    `json:"info,omitempty"`
+		Size  int64     `json:"size,omitempty"`
+		Error string    `json:"error,omitempty"`
+	}{r.Time, r.Op, key, r.Name, r.Info, r.Size, r.Error})
+}
+
+// Type Sink receives the records of the audit trail. It is never called concurrently.
+type Sink func(r Record)
+
+// Returns a sink writing each record to `w` as a line of JSON. Write errors are ignored.
+func WriterSink(w io.Writer) Sink {
+	enc := json.NewEncoder(w)
+	return func(r Record) {
+		_ = enc.Encode(r)
+	}
+}
+
+// Type Options contains optional settings for an audited storage.
+// The zero value selects the default behavior.
+type Options struct {
+	// If set, retrievals via Get are recorded as well.
+	AuditReads bool
+	// Returns the time recorded with each record. Defaults to time.Now.
+	Clock func() time.Time
+}
+
+// Type Storage wraps a BoundedStorage and records all mutations. Evictions are learned from the
+// wrapped storage's events and are recorded asynchronously. Close must be called when the storage
+// is no longer needed. Storage implements cafs.Repairer and cafs.Resumer, and its temporaries
+// implement cafs.Snapshotter, cafs.Finalizer and cafs.Pauser, if the wrapped ones do.
+type Storage struct {
+	cafs.BoundedStorage
+	opts Options
+
+	mutex      sync.Mutex // Serializes calls of sink
+	sink       Sink
+	namespaces []*cafs.Subscription // Reports the changes of audited namespaces
+
+	events *cafs.Subscription
+	done   chan struct{}
+	names  sync.WaitGroup // Goroutines recording names
+}
+
+// Number of events buffered while waiting to be recorded
+const eventBufferSize = 4096
+
+// Returns a storage that behaves like `delegate`, recording every mutation with `sink`.
+func NewStorage(delegate cafs.BoundedStorage, sink Sink, opts Options) *Storage {
+	if opts.Clock == nil {
+		opts.Clock = time.Now
+	}
+	s := &Storage{
+		BoundedStorage: delegate,
+		opts:           opts,
+		sink:           sink,
+		events:         delegate.Subscribe(eventBufferSize),
+		done:           make(chan struct{}),
+	}
+	go s.recordEvents()
+	return s
+}
+
+func (s *Storage) record(r Record) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r.Time = s.opts.Clock()
+	s.sink(r)
+}
+
+func (s *Storage) recordEvents() {
+	defer close(s.done)
+	for e := range s.events.C {
+		if e.Type == cafs.EventEvicted {
+			s.record(Record{Op: OpEvict, Key: e.Key, Info: e.Info, Size: e.Size})
+		}
+	}
+}
+
+func (s *Storage) recordNames(sub *cafs.Subscription) {
+	defer s.names.Done()
+	for e := range sub.C {
+		switch e.Type {
+		case cafs.EventNamed:
+			s.record(Record{Op: OpBind, Key: e.Key, Name: e.Name, Size: e.Size})
+		case cafs.EventUnnamed:
+			s.record(Record{Op: OpUnbind, Key: e.Key, Name: e.Name, Size: e.Size})
+		}
+	}
+}
+
+// Stops recording evictions and names, after recording those that have happened so far.
+func (s *Storage) Close() {
+	s.events.Close()
+	<-s.done
+	lost := s.events.Dropped()
+	s.mutex.Lock()
+	namespaces := s.namespaces
+	s.namespaces = nil
+	s.mutex.Unlock()
+	for _, sub := range namespaces {
+		sub.Close()
+	}
+	s.names.Wait()
+	for _, sub := range namespaces {
+		lost += sub.Dropped()
+	}
+	if lost > 0 {
+		s.record(Record{Op: OpLost, Size: lost})
+	}
+}
+
+func (s *Storage) Create(info string) cafs.Temporary {
+	return s.CreateWithOptions(info, cafs.CreateOptions{})
+}
+
+func (s *Storage) CreateWithOptions(info string, opts cafs.CreateOptions) cafs.Temporary {
+	return &temporary{Temporary: s.BoundedStorage.CreateWithOptions(info, opts), storage: s, info: info}
+}
+
+func (s *Storage) Get(key *cafs.SKey) (cafs.File, error) {
+	f, err := s.BoundedStorage.Get(key)
+	if s.opts.AuditReads {
+		r := Record{Op: OpGet, Key: *key}
+		if err != nil {
+			r.Error = err.Error()
+		} else {
+			r.Size = f.Size()
+		}
+		s.record(r)
+	}
+	return f, err
+}
+
+func (s *Storage) Pin(file cafs.File) error {
+	return s.recordFileOp(OpPin, file, s.BoundedStorage.Pin(file))
+}
+
+func (s *Storage) Unpin(file cafs.File) error {
+	return s.recordFileOp(OpUnpin, file, s.BoundedStorage.Unpin(file))
+}
+
+func (s *Storage) recordFileOp(op string, file cafs.File, err error) error {
+	r := Record{Op: op, Key: file.Key(), Size: file.Size()}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	s.record(r)
+	return err
+}
+
+func (s *Storage) FreeCache() int64 {
+	n := s.BoundedStorage.FreeCache()
+	s.record(Record{Op: OpFreeCache, Size: n})
+	return n
+}
+
+// Implements cafs.Repairer.
+func (s *Storage) Repair(key *cafs.SKey, data []byte) error {
+	err := ErrNotSupported
+	if r, ok := s.BoundedStorage.(cafs.Repairer); ok {
+		err = r.Repair(key, data)
+	}
+	r := Record{Op: OpRepair, Key: *key, Size: int64(len(data))}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	s.record(r)
+	return err
+}
+
+// Implements cafs.Resumer. The resumed temporary is audited as well.
+func (s *Storage) Resume(checkpoint *cafs.Checkpoint, info string, opts cafs.CreateOptions) (cafs.Temporary, error) {
+	var t cafs.Temporary
+	err := ErrNotSupported
+	if r, ok := s.BoundedStorage.(cafs.Resumer); ok {
+		t, err = r.Resume(checkpoint, info, opts)
+	}
+	r := Record{Op: OpResume, Info: info}
+	if err != nil {
+		r.Error = err.Error()
+		s.record(r)
+		return nil, err
+	}
+	s.record(r)
+	return &temporary{Temporary: t, storage: s, info: info}, nil
+}
+
+// Type temporary records the outcome of an ingest. An ingest is rejected by the first Write or
+// Close failing. Temporaries disposed without being closed aren't recorded.
+type temporary struct {
+	cafs.Temporary
+	storage  *Storage
+	info     string
+	rejected bool
+}
+
+func (t *temporary) reject(err error) {
+	if !t.rejected {
+		t.rejected = true
+		t.storage.record(Record{Op: OpReject, Info: t.info, Error: err.Error()})
+	}
+}
+
+func (t *temporary) Write(b []byte) (int, error) {
+	n, err := t.Temporary.Write(b)
+	if err != nil {
+		t.reject(err)
+	}
+	return n, err
+}
+
+func (t *temporary) Close() error {
+	err := t.Temporary.Close()
+	if err != nil {
+		t.reject(err)
+		return err
+	}
+	f := t.Temporary.File()
+	defer f.Dispose()
+	t.storage.record(Record{Op: OpStore, Key: f.Key(), Info: t.info, Size: f.Size()})
+	return nil
+}
+
+// Implements cafs.Finalizer, recording the ingest like Close.
+func (t *temporary) Finalize() (cafs.SKey, error) {
+	key, err := cafs.Finalize(t.Temporary)
+	if err != nil {
+		t.reject(err)
+		return key, err
+	}
+	r := Record{Op: OpStore, Key: key, Info: t.info}
+	if stat, err := t.storage.BoundedStorage.StatByKey(&key); err == nil {
+		r.Size = stat.Size
+	}
+	t.storage.record(r)
+	return key, nil
+}
+
+// Implements cafs.Snapshotter.
+func (t *temporary) Snapshot() (cafs.File, error) {
+	var f cafs.File
+	err := ErrNotSupported
+	if s, ok := t.Temporary.(cafs.Snapshotter); ok {
+		f, err = s.Snapshot()
+	}
+	r := Record{Op: OpSnapshot, Info: t.info}
+	if err != nil {
+		r.Error = err.Error()
+	} else {
+		r.Key, r.Size = f.Key(), f.Size()
+	}
+	t.storage.record(r)
+	return f, err
+}
+
+// Implements cafs.Pauser.
+func (t *temporary) Pause() (*cafs.Checkpoint, error) {
+	var cp *cafs.Checkpoint
+	err := ErrNotSupported
+	if p, ok := t.Temporary.(cafs.Pauser); ok {
+		cp, err = p.Pause()
+	}
+	r := Record{Op: OpPause, Info: t.info}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	t.storage.record(r)
+	return cp, err
+}
+
+// Type Namespace wraps a cafs.Namespace and records names being bound and removed, including names
+// removed because the namespace exceeds its MaxFiles option. Changes are learned from the
+// namespace's events and are recorded asynchronously, until the storage is closed.
+type Namespace struct {
+	*cafs.Namespace
+	storage *Storage
+}
+
+// Returns a namespace that behaves like `ns`, recording changes with the sink of `s`. Must not
+// be called after Close.
+func (s *Storage) Namespace(ns *cafs.Namespace) *Namespace {
+	sub := ns.Subscribe(eventBufferSize)
+	s.mutex.Lock()
+	s.namespaces = append(s.namespaces, sub)
+	s.mutex.Unlock()
+	s.names.Add(1)
+	go s.recordNames(sub)
+	return &Namespace{ns, s}
+}
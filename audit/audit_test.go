@@ -0,0 +1,188 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"testing"
+	"time"
+)
+
+func store(t *testing.T, s cafs.FileStorage, info string, data []byte, opts cafs.CreateOptions) (cafs.File, error) {
+	temp := s.CreateWithOptions(info, opts)
+	defer temp.Dispose()
+	if _, err := temp.Write(data); err != nil {
+		return nil, err
+	}
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	return temp.File(), nil
+}
+
+func TestAudit(t *testing.T) {
+	var records []Record
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewStorage(ram.NewRamStorage(1<<20), func(r Record) {
+		records = append(records, r)
+	}, Options{AuditReads: true, Clock: func() time.Time { return now }})
+
+	data := bytes.Repeat([]byte("audit"), 100)
+	f, err := store(t, s, "first", data, cafs.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Dispose()
+	if _, err := store(t, s, "second", data, cafs.CreateOptions{Profile: "unknown"}); err != cafs.ErrUnknownProfile {
+		t.Fatalf("Expected ErrUnknownProfile, got %v", err)
+	}
+	if err := s.Pin(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Unpin(f); err != nil {
+		t.Fatal(err)
+	}
+	key := f.Key()
+	if g, err := s.Get(&key); err != nil {
+		t.Fatal(err)
+	} else {
+		g.Dispose()
+	}
+
+	// The optional interfaces of the wrapped storage and its temporaries are available
+	if err := s.Repair(&key, data); err != nil {
+		t.Fatal(err)
+	}
+	growing := s.Create("growing")
+	if _, err := growing.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot, err := growing.(cafs.Snapshotter).Snapshot(); err != nil {
+		t.Fatal(err)
+	} else {
+		snapshot.Dispose()
+	}
+	cp, err := growing.(cafs.Pauser).Pause()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := s.Resume(cp, "resumed", cafs.CreateOptions{})
+	growing.Dispose()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, err := resumed.(cafs.Finalizer).Finalize(); err != nil || k != key {
+		t.Fatalf("Finalize returned %v, %v", k, err)
+	}
+	resumed.Dispose()
+
+	ns := s.Namespace(cafs.NewNamespace(s, cafs.NamespaceOptions{Policy: cafs.NameVersion, MaxFiles: 2}))
+	if err := ns.SetName("a", f); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := ns.Bind("a", f); err != nil || name != "a.1" {
+		t.Fatalf("Bind returned %v, %v", name, err)
+	}
+	// Exceeds MaxFiles, removing "a"
+	if err := ns.SetName("b", f); err != nil {
+		t.Fatal(err)
+	}
+	if !ns.Remove("a.1") {
+		t.Fatal("Remove failed")
+	}
+	if ns.Remove("a") {
+		t.Fatal("Removing an unbound name succeeded")
+	}
+	ns.Clear()
+	f.Dispose()
+	freed := s.FreeCache()
+	s.Close()
+
+	// Evictions and names are recorded asynchronously and are checked separately
+	var ops, names, evictions []Record
+	for _, r := range records {
+		if !r.Time.Equal(now) {
+			t.Errorf("Record %v has time %v", r.Op, r.Time)
+		}
+		if r.Op == OpEvict {
+			evictions = append(evictions, r)
+		} else if r.Op == OpBind || r.Op == OpUnbind {
+			names = append(names, r)
+		} else {
+			ops = append(ops, r)
+		}
+	}
+
+	expected := []Record{
+		{Op: OpStore, Key: key, Info: "first", Size: int64(len(data))},
+		{Op: OpReject, Info: "second", Error: cafs.ErrUnknownProfile.Error()},
+		{Op: OpPin, Key: key, Size: int64(len(data))},
+		{Op: OpUnpin, Key: key, Size: int64(len(data))},
+		{Op: OpGet, Key: key, Size: int64(len(data))},
+		{Op: OpRepair, Key: key, Size: int64(len(data))},
+		{Op: OpSnapshot, Key: key, Info: "growing", Size: int64(len(data))},
+		{Op: OpPause, Info: "growing"},
+		{Op: OpResume, Info: "resumed"},
+		{Op: OpStore, Key: key, Info: "resumed", Size: int64(len(data))},
+		{Op: OpFreeCache, Size: freed},
+	}
+	checkRecords := func(records, expected []Record) {
+		t.Helper()
+		if len(records) != len(expected) {
+			t.Fatalf("Expected %d records, got %d: %v", len(expected), len(records), records)
+		}
+		for i, r := range records {
+			r.Time = time.Time{}
+			if r != expected[i] {
+				t.Errorf("Record %d: expected %v, got %v", i, expected[i], r)
+			}
+		}
+	}
+	checkRecords(ops, expected)
+	size := int64(len(data))
+	checkRecords(names, []Record{
+		{Op: OpBind, Key: key, Name: "a", Size: size},
+		{Op: OpBind, Key: key, Name: "a.1", Size: size},
+		{Op: OpBind, Key: key, Name: "b", Size: size},
+		{Op: OpUnbind, Key: key, Name: "a", Size: size},
+		{Op: OpUnbind, Key: key, Name: "a.1", Size: size},
+		{Op: OpUnbind, Key: key, Name: "b", Size: size},
+	})
+
+	var evicted int64
+	for _, r := range evictions {
+		evicted += r.Size
+	}
+	if len(evictions) == 0 || evicted != freed {
+		t.Errorf("Recorded %d evictions of %d bytes, expected %d bytes", len(evictions), evicted, freed)
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := WriterSink(&buf)
+	key := cafs.SKey{1, 2, 3}
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	sink(Record{Time: now, Op: OpBind, Key: key, Name: "a"})
+	sink(Record{Time: now, Op: OpFreeCache, Size: 42})
+
+	dec := json.NewDecoder(&buf)
+	var lines []map[string]interface{}
+	for dec.More() {
+		var m map[string]interface{}
+		if err := dec.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, m)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(lines))
+	}
+	if lines[0]["op"] != OpBind || lines[0]["key"] != key.String() || lines[0]["name"] != "a" || lines[0]["time"] != "2018-01-01T00:00:00Z" {
+		t.Errorf("Unexpected first line: %v", lines[0])
+	}
+	if _, ok := lines[1]["key"]; ok || lines[1]["size"] != float64(42) {
+		t.Errorf("Unexpected second line: %v", lines[1])
+	}
+}
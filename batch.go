@@ -0,0 +1,100 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"io"
+	"runtime"
+	"sync"
+)
+
+// Type BatchInput is a single input to IngestBatch.
+type BatchInput struct {
+	// The info string of the temporary the input is written into.
+	Info string
+	// The content to ingest. It is closed after ingesting if it implements io.Closer.
+	Reader io.Reader
+}
+
+// Type BatchResult is the result of ingesting a single BatchInput.
+type BatchResult struct {
+	// The ingested file, which must be disposed by the caller, or nil if ingesting failed.
+	File File
+	// The key of the ingested file.
+	Key SKey
+	// The error that occurred while ingesting, if any.
+	Err error
+}
+
+// Type BatchOptions contains optional settings for IngestBatch.
+// The zero value selects the default behavior.
+type BatchOptions struct {
+	// Number of inputs ingested concurrently. Defaults to GOMAXPROCS.
+	Workers int
+	// Options used for creating each temporary.
+	CreateOptions CreateOptions
+}
+
+// Function IngestBatch ingests many inputs into `storage` on a shared pool of goroutines, which
+// saves the overhead of creating a goroutine per input when ingesting many small objects.
+// Returns one result per input, in the order of `inputs`. Identical inputs, and inputs sharing
+// chunks, are de-duplicated by the storage as usual. Failing inputs don't affect the others.
+func IngestBatch(storage FileStorage, inputs []BatchInput, opts BatchOptions) []BatchResult {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, len(inputs))
+
+	results := make([]BatchResult, len(inputs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range next {
+				results[idx] = ingestOne(storage, inputs[idx], opts.CreateOptions)
+			}
+		}()
+	}
+	for idx := range inputs {
+		next <- idx
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+func ingestOne(storage FileStorage, input BatchInput, opts CreateOptions) (result BatchResult) {
+	if c, ok := input.Reader.(io.Closer); ok {
+		defer c.Close()
+	}
+	temp := storage.CreateWithOptions(input.Info, opts)
+	defer temp.Dispose()
+	if _, err := io.Copy(temp, input.Reader); err != nil {
+		result.Err = err
+		return
+	}
+	if err := temp.Close(); err != nil {
+		result.Err = err
+		return
+	}
+	result.File = temp.File()
+	result.Key = result.File.Key()
+	return
+}
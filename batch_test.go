@@ -0,0 +1,63 @@
+package cafs_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestIngestBatch(t *testing.T) {
+	s := ram.NewRamStorage(4 * 1024 * 1024)
+	reference := ram.NewRamStorage(4 * 1024 * 1024)
+	var distinct [][]byte
+	for i := 0; i < 20; i++ {
+		data := make([]byte, 100+i*50)
+		rand.Read(data)
+		distinct = append(distinct, data)
+		addBytes(t, reference, data).Dispose()
+	}
+	var inputs []BatchInput
+	for i := 0; i < 500; i++ {
+		inputs = append(inputs, BatchInput{Info: fmt.Sprintf("input %d", i), Reader: bytes.NewReader(distinct[i%len(distinct)])})
+	}
+	inputs = append(inputs, BatchInput{Info: "failing", Reader: failingReader{}})
+
+	results := IngestBatch(s, inputs, BatchOptions{Workers: 8})
+	if len(results) != len(inputs) {
+		t.Fatalf("Expected %d results, got %d", len(inputs), len(results))
+	}
+	for i, r := range results[:len(results)-1] {
+		if r.Err != nil {
+			t.Fatalf("Input %d: %v", i, r.Err)
+		}
+		if expected := SKey(sha256.Sum256(distinct[i%len(distinct)])); r.Key != expected || r.File.Key() != expected {
+			t.Errorf("Input %d: expected key %v, got %v", i, expected, r.Key)
+		}
+	}
+	if r := results[len(results)-1]; r.Err != io.ErrUnexpectedEOF || r.File != nil {
+		t.Errorf("Expected failing input to report its error, got %v", r.Err)
+	}
+
+	// Identical inputs are stored once
+	if ui, expected := s.GetUsageInfo(), reference.GetUsageInfo(); ui.Used != expected.Used {
+		t.Errorf("Expected %d bytes used, got %d", expected.Used, ui.Used)
+	}
+	for _, r := range results[:len(results)-1] {
+		r.File.Dispose()
+	}
+	s.FreeCache()
+	if ui := s.GetUsageInfo(); ui.Used != 0 {
+		t.Errorf("Expected storage to be empty after disposing results: %v", ui)
+	}
+}
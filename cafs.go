@@ -19,15 +19,21 @@
 package cafs
 
 import (
+	"bytes"
 	"encoding/hex"
 	"errors"
 	"io"
+	"sort"
 )
 
 var ErrNotFound = errors.New("Not found")
 var ErrStillOpen = errors.New("Temporary still open")
 var ErrInvalidState = errors.New("Invalid temporary state")
 var ErrNotEnoughSpace = errors.New("Not enough space")
+var ErrForeignFile = errors.New("File belongs to another storage")
+var ErrNotPinned = errors.New("File not pinned")
+var ErrKeyMismatch = errors.New("Data doesn't match key")
+var ErrKeyCollision = errors.New("Different content stored under the same key")
 
 var LoggingEnabled = false
 
@@ -39,12 +45,79 @@ type FileStorage interface {
 	// informational purposes.
 	Create(info string) Temporary
 
+	// Like Create, but allows for specifying options that influence how the data is ingested.
+	CreateWithOptions(info string, opts CreateOptions) Temporary
+
 	// Queries a file from the storage that can be read from. If the file exists, a File
 	// interface is returned that has been locked once and that must be released correctly.
 	// If the file does not exist, then (nil, ErrNotFound) is returned.
+	// Get is atomic with respect to eviction: a file that is returned can't be evicted until
+	// it is disposed, even if the storage was about to evict it concurrently.
 	Get(key *SKey) (File, error)
 
+	// Returns metadata about the file with the given key without opening or locking it.
+	// If the file does not exist, then ErrNotFound is returned.
+	StatByKey(key *SKey) (FileStat, error)
+	// Pins a file retrieved from this storage, including its chunks, so that it isn't evicted
+	// even after all handles have been disposed. Pinned bytes count as locked. Returns
+	// ErrForeignFile if the file belongs to another storage.
+	Pin(file File) error
+	// Reverts one call to Pin. Returns ErrNotPinned if the file isn't pinned.
+	Unpin(file File) error
+
 	DumpStatistics(log Printer)
+
+	// Subscribes to storage lifecycle events. The subscription's channel buffers up to
+	// `bufferSize` events. Events are dropped when the buffer is full. The subscription
+	// must be closed when no longer needed.
+	Subscribe(bufferSize int) *Subscription
+}
+
+// Interface KeyEnumerator is implemented by storages that can list the keys of all files and
+// chunks they contain.
+type KeyEnumerator interface {
+	// Calls f for every key in the storage, in ascending byte order and without duplicates, until
+	// f returns false. The order is stable, so that two storages holding the same content enumerate
+	// the same sequence of keys. Function f must not call into the storage.
+	EnumerateKeys(f func(key SKey) bool)
+}
+
+// Function SortKeys sorts `keys` in the order reported by KeyEnumerator and removes duplicates.
+// Returns the shortened slice.
+func SortKeys(keys []SKey) []SKey {
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+	result := keys[:0]
+	for i := range keys {
+		if i == 0 || keys[i] != keys[i-1] {
+			result = append(result, keys[i])
+		}
+	}
+	return result
+}
+
+// Interface Repairer is implemented by storages that can replace the data stored under a key,
+// e.g. after it has been found to be corrupt.
+type Repairer interface {
+	// Replaces the data of the chunk or unchunked file stored as `key` with `data`, which must
+	// hash to `key` and be of the stored size. Returns ErrNotFound if no such entry exists, and
+	// ErrKeyMismatch if `data` isn't the content belonging to `key`.
+	Repair(key *SKey, data []byte) error
+}
+
+// Interface Localizer is implemented by storages that know where data is located physically,
+// e.g. on disk. Reading chunks in ascending order of their locality minimizes seeks.
+type Localizer interface {
+	// Returns the locality of the chunk or file stored as `key`, or false if it isn't known.
+	Locality(key *SKey) (int64, bool)
+}
+
+// Type FileStat contains metadata about a stored file, as returned by FileStorage.StatByKey.
+type FileStat struct {
+	Size      int64 // The size of the file in bytes
+	NumChunks int64 // The number of chunks, or 1 if the file is not chunked
+	Resident  bool  // Whether all of the file's data is present in the storage
 }
 
 type File interface {
@@ -56,6 +129,9 @@ type File interface {
 	Dispose()
 	Key() SKey
 	Open() io.ReadCloser
+	// Like Open(), but applies `transform` to the content stream. Closing the returned
+	// reader closes the transformed reader (if it is an io.Closer) and the original one.
+	OpenTransformed(transform TransformFunc) io.ReadCloser
 	Size() int64
 	// Creates a new handle to the same file that must be Dispose()'d
 	// independently.
@@ -68,6 +144,38 @@ type File interface {
 	Chunks() FileIterator
 	// Returns the number of chunks in this file, or 1 if file is not chunked
 	NumChunks() int64
+
+	// Returns the MIME type of the file's content as detected on ingest, or the empty string
+	// if content type detection was not requested (see CreateOptions).
+	ContentType() string
+}
+
+// Type CreateOptions contains optional settings for creating a Temporary.
+// The zero value selects the default behavior.
+type CreateOptions struct {
+	// If set, the beginning of the content is examined using http.DetectContentType and
+	// the result is stored with the file, retrievable via File.ContentType().
+	SniffContentType bool
+	// If set, the ingest is checked against the given guard (see DedupGuard).
+	DedupGuard *DedupGuard
+	// Offsets into the content, in ascending order, at which chunk boundaries are preferred,
+	// e.g. the record boundaries of a structured format (see chunking.NewHinted).
+	BoundaryHints []int64
+	// If greater than 1, chunks are hashed by this many goroutines in parallel while chunking
+	// continues, which speeds up large ingests on multiple cores. The hash over the whole file is still
+	// computed sequentially. The resulting file is the same as with sequential hashing.
+	HashWorkers int
+	// If greater than 0, files of up to this many bytes are stored as a single chunk without being
+	// scanned for chunk boundaries. Larger files are chunked as usual.
+	InlineThreshold int64
+	// If set, the chunker parameters are taken from the storage's chunking profile of this name
+	// (see ChunkingProfiles). Writing fails with ErrUnknownProfile if there is no such profile.
+	Profile string
+	// If set, called with the data of each chunk before it is stored, e.g. for scanning the content
+	// for malware. The data must not be modified. If an error is returned, the ingest is rejected:
+	// writing fails with that error and chunks stored by the ingest so far are removed, unless they
+	// are in use otherwise.
+	Scan func(data []byte) error
 }
 
 // Iterate over a set of files or chunks.
@@ -110,6 +218,36 @@ type Temporary interface {
 	Dispose()
 }
 
+// Interface Snapshotter is implemented by temporaries that can store the data written so far
+// as a file while writing continues, e.g. for ingesting continuously growing input like logs.
+type Snapshotter interface {
+	// Stores the data written so far and returns it as a file, which must be disposed. Chunks
+	// are shared with previous and subsequent snapshots. Must not be called after Close().
+	Snapshot() (File, error)
+}
+
+// Interface Finalizer is implemented by temporaries that can report the key of the stored file
+// without creating a handle to it, for callers that only need to record the address.
+type Finalizer interface {
+	// Like Close(), but returns the key of the stored file. File() may still be called afterwards.
+	Finalize() (SKey, error)
+}
+
+// Function Finalize closes temporary `t` and returns the key of the stored file. Uses
+// Finalizer if implemented by `t`. Otherwise, a file handle is created and disposed right away.
+// The temporary must still be disposed.
+func Finalize(t Temporary) (SKey, error) {
+	if f, ok := t.(Finalizer); ok {
+		return f.Finalize()
+	}
+	if err := t.Close(); err != nil {
+		return SKey{}, err
+	}
+	file := t.File()
+	defer file.Dispose()
+	return file.Key(), nil
+}
+
 func (k SKey) String() string {
 	return hex.EncodeToString(k[:])
 }
@@ -129,6 +267,20 @@ func ParseKey(s string) (*SKey, error) {
 	return &result, nil
 }
 
+// Encodes the key as a hex string, e.g. in JSON documents.
+func (k SKey) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *SKey) UnmarshalText(text []byte) error {
+	key, err := ParseKey(string(text))
+	if err != nil {
+		return err
+	}
+	*k = *key
+	return nil
+}
+
 func MustParseKey(s string) *SKey {
 	if key, err := ParseKey(s); err != nil {
 		panic(err)
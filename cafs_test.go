@@ -0,0 +1,94 @@
+package cafs_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"math/rand"
+	"testing"
+)
+
+func TestFinalize(t *testing.T) {
+	s := ram.NewRamStorage(1024 * 1024)
+	for _, size := range []int{0, 1000, 100000} {
+		data := make([]byte, size)
+		rand.Read(data)
+		temp := s.Create("finalized")
+		if _, err := temp.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		key, err := Finalize(temp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != SKey(sha256.Sum256(data)) {
+			t.Errorf("Size %d: unexpected key %v", size, key)
+		}
+		f := temp.File()
+		if f.Key() != key {
+			t.Errorf("Size %d: finalized key %v doesn't match file key %v", size, key, f.Key())
+		}
+		f.Dispose()
+		temp.Dispose()
+	}
+	s.FreeCache()
+	if ui := s.GetUsageInfo(); ui.Used != 0 {
+		t.Errorf("Expected all references to be released: %v", ui)
+	}
+}
+
+func TestScanHook(t *testing.T) {
+	errInfected := fmt.Errorf("Infected")
+	signature := []byte("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR")
+	var scanned int
+	scan := func(data []byte) error {
+		scanned += len(data)
+		if bytes.Contains(data, signature) {
+			return errInfected
+		}
+		return nil
+	}
+	ingest := func(s FileStorage, data []byte) error {
+		temp := s.CreateWithOptions("scanned", CreateOptions{Scan: scan})
+		defer temp.Dispose()
+		if _, err := temp.Write(data); err != nil {
+			return err
+		}
+		if err := temp.Close(); err != nil {
+			return err
+		}
+		temp.File().Dispose()
+		return nil
+	}
+
+	s := ram.NewRamStorage(1024 * 1024)
+	clean := make([]byte, 200000)
+	rand.Read(clean)
+	if err := ingest(s, clean); err != nil {
+		t.Fatalf("Clean content was rejected: %v", err)
+	}
+	if scanned != len(clean) {
+		t.Errorf("Expected %d bytes to be scanned, got %d", len(clean), scanned)
+	}
+	cleanUsage := s.GetUsageInfo().Used
+
+	for _, size := range []int{1000, 200000} {
+		// The infected content shares its first half with the clean content
+		infected := make([]byte, size)
+		copy(infected, clean[:size/2])
+		rand.Read(infected[size/2:])
+		copy(infected[size*3/4:], signature)
+		if err := ingest(s, infected); err != errInfected {
+			t.Errorf("Size %d: expected ingest to be rejected, got %v", size, err)
+		}
+		if ui := s.GetUsageInfo(); ui.Used != cleanUsage {
+			t.Errorf("Size %d: expected rejected ingest to leave no chunks behind, got %v (before: %d)", size, ui, cleanUsage)
+		}
+		key := SKey(sha256.Sum256(infected))
+		if _, err := s.StatByKey(&key); err != ErrNotFound {
+			t.Errorf("Size %d: expected rejected file not to be stored, got %v", size, err)
+		}
+	}
+}
@@ -8,6 +8,7 @@
 // to support using Adler-32 as a chunking algorithm.
 //
 // Adler-32 is defined in RFC 1950:
+//
 //	Adler-32 is composed of two sums accumulated per byte: s1 is
 //	the sum of all bytes, s2 is the sum of all s1 values. Both sums
 //	are done modulo 65521. s1 is initialized to 1, s2 to zero.  The
@@ -30,6 +31,11 @@ const (
 	WINDOW_SIZE = 48
 	MIN_CHUNK   = 128
 	MAX_CHUNK   = 131072
+
+	// A boundary is found where the checksum modulo DIVISOR equals the remainder below
+	// (both are prime), which yields chunks of DIVISOR bytes on average.
+	DIVISOR   = 8191
+	remainder = 4159
 )
 
 // type Adler32Chunker implements the Chunker interface based on the Adler-32 checksum.
@@ -37,11 +43,24 @@ type Adler32Chunker struct {
 	a      uint32
 	n, p   int
 	window [WINDOW_SIZE]byte
+	params Params
+}
+
+// Type Params contains the parameters of an Adler32Chunker.
+type Params struct {
+	MinChunk int    // Chunks are at least this long, except for the last one
+	MaxChunk int    // Chunks are at most this long
+	Divisor  uint32 // Roughly the average length beyond MinChunk of chunks not cut at MaxChunk
 }
 
 // Function NewChunker returns a new Chunker.
 func NewChunker() *Adler32Chunker {
-	var c = Adler32Chunker{a: 1}
+	return NewChunkerWithParams(Params{MIN_CHUNK, MAX_CHUNK, DIVISOR})
+}
+
+// Function NewChunkerWithParams returns a new Chunker using the given parameters.
+func NewChunkerWithParams(params Params) *Adler32Chunker {
+	var c = Adler32Chunker{a: 1, params: params}
 	return &c
 }
 
@@ -73,10 +92,10 @@ func (c *Adler32Chunker) Scan(data []byte) int {
 		c.a = pushBack(c.a, data[i:i+1])
 		c.n++
 
-		// Chunk boundary at MAX_CHUNK or if hash is 4159 modulo 8191 (both are prime)
-		if c.n > MIN_CHUNK && 4159 == (c.a%8191) || c.n > MAX_CHUNK {
+		// Chunk boundary at MaxChunk or if hash is 4159 modulo 8191 (by default)
+		if c.n > c.params.MinChunk && remainder%c.params.Divisor == (c.a%c.params.Divisor) || c.n > c.params.MaxChunk {
 			// Reset chunker and return position in data
-			*c = Adler32Chunker{a: 1}
+			*c = Adler32Chunker{a: 1, params: c.params}
 			return i + prefixLen // Byte will become beginning of next segment
 		}
 
@@ -30,3 +30,36 @@ type Chunker interface {
 func New() Chunker {
 	return adler32.NewChunker()
 }
+
+// Type Config contains the parameters of a chunker, allowing for chunk sizes tuned to the kind of
+// content, e.g. smaller chunks for source code or larger ones for video.
+// The zero value selects the default parameters.
+type Config struct {
+	// Chunks are at least this long, except for the last one. Defaults to adler32.MIN_CHUNK.
+	MinChunk int
+	// Chunks are at most this long. Defaults to and must not exceed adler32.MAX_CHUNK, which is
+	// the largest chunk receivers accept.
+	MaxChunk int
+	// The average number of bytes after MinChunk until a content-defined boundary is found.
+	// Defaults to adler32.DIVISOR.
+	AvgChunk int
+}
+
+func (c Config) params() adler32.Params {
+	p := adler32.Params{MinChunk: c.MinChunk, MaxChunk: c.MaxChunk, Divisor: uint32(c.AvgChunk)}
+	if p.MinChunk <= 0 {
+		p.MinChunk = adler32.MIN_CHUNK
+	}
+	if p.MaxChunk <= 0 || p.MaxChunk > adler32.MAX_CHUNK {
+		p.MaxChunk = adler32.MAX_CHUNK
+	}
+	if c.AvgChunk <= 0 {
+		p.Divisor = adler32.DIVISOR
+	}
+	return p
+}
+
+// Function NewWithConfig returns a new chunker using the parameters given in `c`.
+func NewWithConfig(c Config) Chunker {
+	return adler32.NewChunkerWithParams(c.params())
+}
@@ -48,3 +48,33 @@ func TestSingleByteBlocks(t *testing.T) {
 		t.Logf("Test produced %v blocks (avg size: %d)", blocks, size/blocks)
 	}
 }
+
+func TestHinted(t *testing.T) {
+	data := make([]byte, 1<<20)
+	r := rand.New(rand.NewSource(0))
+	r.Read(data)
+	hints := []int64{0, 100, 1000, 1050, 5000, 5001, 300000, 300001, 700000}
+	expected := map[int64]bool{1000: true, 5000: true, 300000: true, 700000: true}
+
+	// Scan in blocks of varying size
+	chunker := NewHinted(hints)
+	var pos, last int64
+	for pos < int64(len(data)) {
+		block := data[pos:]
+		if len(block) > 777 {
+			block = block[:r.Intn(777)+1]
+		}
+		n := chunker.Scan(block)
+		pos += int64(n)
+		if n < len(block) {
+			if pos-last < 128 {
+				t.Errorf("Chunk of only %d bytes at %d", pos-last, last)
+			}
+			delete(expected, pos)
+			last = pos
+		}
+	}
+	for hint := range expected {
+		t.Errorf("No boundary at hint %d", hint)
+	}
+}
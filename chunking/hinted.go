@@ -0,0 +1,68 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package chunking
+
+// Type hintedChunker cuts at caller-provided offsets in addition to content-defined boundaries.
+type hintedChunker struct {
+	config   Config
+	inner    Chunker
+	hints    []int64 // Remaining hints, ascending
+	pos      int64   // Stream offset of the next byte to scan
+	chunkLen int64   // Number of bytes in the current chunk
+}
+
+// Function NewHinted returns a chunker that prefers cutting at the given stream offsets, which must
+// be in ascending order. This lets format-aware callers align chunk boundaries with record boundaries
+// (e.g. of a tar stream), which improves de-duplication when records are re-ordered or modified.
+// Between hints, chunk boundaries are content-defined. Hints closer than adler32.MIN_CHUNK bytes
+// to the previous boundary are ignored.
+func NewHinted(hints []int64) Chunker {
+	return NewHintedWithConfig(Config{}, hints)
+}
+
+// Like NewHinted, but the content-defined boundaries are determined using `c`. Hints closer than
+// c.MinChunk bytes to the previous boundary are ignored.
+func NewHintedWithConfig(c Config, hints []int64) Chunker {
+	return &hintedChunker{config: c, inner: NewWithConfig(c), hints: hints}
+}
+
+func (c *hintedChunker) Scan(data []byte) int {
+	// Drop hints that are behind us or too close to the beginning of the current chunk
+	minChunk := int64(c.config.params().MinChunk)
+	for len(c.hints) > 0 && (c.hints[0] < c.pos || c.hints[0]-(c.pos-c.chunkLen) < minChunk) {
+		c.hints = c.hints[1:]
+	}
+	limit := len(data)
+	if len(c.hints) > 0 && c.hints[0]-c.pos < int64(len(data)) {
+		limit = int(c.hints[0] - c.pos)
+	}
+
+	n := c.inner.Scan(data[:limit])
+	if n == limit && limit < len(data) {
+		// Cut at the hint. The inner chunker must start over.
+		c.inner = NewWithConfig(c.config)
+		c.hints = c.hints[1:]
+	} else if n == len(data) {
+		// No boundary found
+		c.pos += int64(n)
+		c.chunkLen += int64(n)
+		return n
+	}
+	c.pos += int64(n)
+	c.chunkLen = 0
+	return n
+}
@@ -0,0 +1,92 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"errors"
+	"log"
+)
+
+var ErrDedupTooLow = errors.New("Deduplication ratio below threshold")
+
+// Type DedupGuard configures a safety check for ingesting content that is expected to
+// de-duplicate well against the storage. If, after a warm-up number of chunks, the fraction
+// of chunks already present in the storage falls below a threshold, the ingest is aborted
+// with ErrDedupTooLow, or a warning is logged. This catches misconfigurations early,
+// instead of silently bloating the storage.
+type DedupGuard struct {
+	// Minimum fraction (between 0 and 1) of chunks that must already be present in the storage.
+	MinRatio float64
+	// Number of chunks to ingest before the ratio is first checked.
+	WarmupChunks int
+	// If set, the guard logs a warning instead of aborting the ingest.
+	WarnOnly bool
+}
+
+// Type DedupCounter keeps track of the chunks ingested into a single Temporary and applies
+// a DedupGuard to them. It is meant to be used by storage implementations. A nil *DedupCounter
+// counts nothing and never trips.
+type DedupCounter struct {
+	guard            DedupGuard
+	info             string
+	chunks, recycled int
+	warned           bool
+}
+
+// Returns a counter applying `guard` to the ingest identified by `info`, or nil if `guard` is nil.
+func NewDedupCounter(guard *DedupGuard, info string) *DedupCounter {
+	if guard == nil {
+		return nil
+	}
+	return &DedupCounter{guard: *guard, info: info}
+}
+
+// Function Count registers an ingested chunk. `recycled` tells whether the chunk already existed
+// in the storage. Returns ErrDedupTooLow if the guard trips and is not configured to only warn.
+func (c *DedupCounter) Count(recycled bool) error {
+	if c == nil {
+		return nil
+	}
+	c.chunks++
+	if recycled {
+		c.recycled++
+	}
+	if c.chunks < c.guard.WarmupChunks {
+		return nil
+	}
+	ratio := float64(c.recycled) / float64(c.chunks)
+	if ratio >= c.guard.MinRatio {
+		return nil
+	}
+	if !c.guard.WarnOnly {
+		return ErrDedupTooLow
+	}
+	if !c.warned {
+		c.warned = true
+		log.Printf("[%v] Warning: only %d of %d chunks de-duplicated (ratio %.2f < %.2f)",
+			c.info, c.recycled, c.chunks, ratio, c.guard.MinRatio)
+	}
+	return nil
+}
+
+// Returns the number of chunks counted so far and how many of them already existed in the storage.
+func (c *DedupCounter) Stats() (chunks, recycled int) {
+	if c == nil {
+		return
+	}
+	return c.chunks, c.recycled
+}
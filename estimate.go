@@ -0,0 +1,79 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"crypto/sha256"
+	"github.com/indyjo/cafs/chunking"
+	"io"
+)
+
+// Type IngestEstimate describes what storing some content would require, as computed by EstimateIngest.
+type IngestEstimate struct {
+	Chunks    int64 // The number of chunks the content would be split into
+	Bytes     int64 // The total size of the content
+	NewChunks int64 // The number of distinct chunks not yet present in the storage
+	NewBytes  int64 // The total size of those chunks, i.e. the data that would have to be stored
+}
+
+// Function EstimateIngest reads `r` until EOF and splits it into chunks the way storages do by
+// default (see CreateOptions), without storing anything. Chunks occurring more than once in the
+// content count as new only once. The estimate doesn't include the storage's overhead for
+// metadata like lists of chunks, and it may be outdated by the time the content is actually
+// stored, e.g. because chunks have been evicted in the meantime.
+func EstimateIngest(storage FileStorage, r io.Reader) (IngestEstimate, error) {
+	var result IngestEstimate
+	chunker := chunking.New()
+	seen := NewKeySet(0)
+	var chunk []byte
+	flush := func() {
+		key := SKey(sha256.Sum256(chunk))
+		result.Chunks++
+		if seen.Add(key) {
+			if _, err := storage.StatByKey(&key); err == ErrNotFound {
+				result.NewChunks++
+				result.NewBytes += int64(len(chunk))
+			}
+		}
+		chunk = chunk[:0]
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := r.Read(buf)
+		result.Bytes += int64(n)
+		for b := buf[:n]; len(b) > 0; {
+			nBoundary := chunker.Scan(b)
+			chunk = append(chunk, b[:nBoundary]...)
+			if nBoundary == len(b) {
+				break
+			}
+			flush()
+			b = b[nBoundary:]
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return result, err
+		}
+	}
+	if len(chunk) > 0 || result.Chunks == 0 {
+		// The last chunk, or the whole content if it's empty
+		flush()
+	}
+	return result, nil
+}
@@ -0,0 +1,63 @@
+package cafs_test
+
+import (
+	"bytes"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"math/rand"
+	"testing"
+)
+
+func TestEstimateIngest(t *testing.T) {
+	s := ram.NewRamStorage(16 * 1024 * 1024)
+	present := make([]byte, 1024*1024)
+	rand.Read(present)
+	f := addBytes(t, s, present)
+	defer f.Dispose()
+
+	// The content consists of data already present, followed by new data
+	content := make([]byte, len(present)+512*1024)
+	copy(content, present)
+	rand.Read(content[len(present):])
+	usage := s.GetUsageInfo()
+	est, err := EstimateIngest(s, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ui := s.GetUsageInfo(); ui != usage {
+		t.Errorf("Estimating changed the storage: %v -> %v", usage, ui)
+	}
+	if est.Bytes != int64(len(content)) || est.NewBytes < 512*1024 || est.NewBytes >= est.Bytes/2 {
+		t.Errorf("Implausible estimate for %d bytes with %d new: %+v", len(content), 512*1024, est)
+	}
+
+	// Actually storing the content must match the estimate exactly
+	before := make(map[SKey]bool)
+	s.(KeyEnumerator).EnumerateKeys(func(key SKey) bool {
+		before[key] = true
+		return true
+	})
+	g := addBytes(t, s, content)
+	defer g.Dispose()
+	var newChunks, newBytes int64
+	iter := g.Chunks()
+	for iter.Next() {
+		if !before[iter.Key()] {
+			before[iter.Key()] = true
+			newChunks++
+			newBytes += iter.Size()
+		}
+	}
+	iter.Dispose()
+	if est.Chunks != g.NumChunks() || est.NewChunks != newChunks || est.NewBytes != newBytes {
+		t.Errorf("Estimate %+v doesn't match ingest of %d chunks, %d new with %d bytes", est, g.NumChunks(), newChunks, newBytes)
+	}
+
+	// Nothing is new anymore
+	if est, err = EstimateIngest(s, bytes.NewReader(content)); err != nil || est.NewChunks != 0 || est.NewBytes != 0 {
+		t.Errorf("Expected nothing new, got %+v (%v)", est, err)
+	}
+	if est, err = EstimateIngest(s, bytes.NewReader(nil)); err != nil || est.Chunks != 1 || est.NewChunks != 1 {
+		t.Errorf("Unexpected estimate for empty content: %+v (%v)", est, err)
+	}
+}
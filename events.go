@@ -0,0 +1,126 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Type EventType enumerates the kinds of storage lifecycle events.
+type EventType int
+
+const (
+	// An object (file or chunk) has been newly added to the storage.
+	EventStored EventType = iota
+	// An object has been removed from the storage in order to free space.
+	EventEvicted
+	// The storage's cache has been cleared by FreeCache. Size holds the number of bytes freed.
+	EventCacheFreed
+	// A name has been bound to a file (see Namespace.Subscribe).
+	EventNamed
+	// A name has been removed, or rebound to another file, releasing the file formerly bound to it.
+	EventUnnamed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventStored:
+		return "stored"
+	case EventEvicted:
+		return "evicted"
+	case EventCacheFreed:
+		return "cache freed"
+	case EventNamed:
+		return "named"
+	case EventUnnamed:
+		return "unnamed"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Type Event describes something that happened in a FileStorage.
+type Event struct {
+	Type EventType
+	Key  SKey   // The key of the affected object, if any
+	Size int64  // The number of bytes concerned
+	Info string // The info string of the affected object, if any
+	Name string // The name concerned by a naming event
+}
+
+// Type Subscription delivers storage events to a subscriber. Events are delivered
+// through channel C. If the subscriber doesn't keep up and the channel's buffer is full,
+// events are dropped rather than stalling the storage.
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	dropped int64 // accessed atomically
+	broker  *EventBroker
+}
+
+// Returns the number of events that have been dropped because the subscriber didn't keep up.
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Ends the subscription and closes channel C. It's ok to call Close() more than once.
+func (s *Subscription) Close() {
+	s.broker.unsubscribe(s)
+}
+
+// Type EventBroker distributes events to any number of subscriptions. It is meant to be
+// used by FileStorage implementations. The zero value is ready to use.
+type EventBroker struct {
+	mutex         sync.Mutex
+	subscriptions map[*Subscription]struct{}
+}
+
+// Creates a new subscription whose channel buffers up to `bufferSize` events.
+func (b *EventBroker) Subscribe(bufferSize int) *Subscription {
+	c := make(chan Event, bufferSize)
+	s := &Subscription{C: c, c: c, broker: b}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subscriptions == nil {
+		b.subscriptions = make(map[*Subscription]struct{})
+	}
+	b.subscriptions[s] = struct{}{}
+	return s
+}
+
+// Delivers an event to all subscriptions. Never blocks.
+func (b *EventBroker) Publish(e Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for s := range b.subscriptions {
+		select {
+		case s.c <- e:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
+
+func (b *EventBroker) unsubscribe(s *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.subscriptions[s]; ok {
+		delete(b.subscriptions, s)
+		close(s.c)
+	}
+}
@@ -0,0 +1,257 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"container/heap"
+	"container/list"
+)
+
+// Interface EvictionPolicy decides which entries a storage evicts when it runs out of space. Only
+// entries that aren't referenced are candidates for eviction. The storage tells the policy when
+// entries become candidates and when candidates are accessed again. Methods are called while the
+// storage is locked and must not call into the storage. A policy may only be used by one storage.
+type EvictionPolicy interface {
+	// Adds an entry of `size` bytes that has become a candidate for eviction, because its last
+	// reference has been released.
+	Add(key SKey, size int64)
+	// Removes a candidate that is being referenced again, i.e. that has been accessed.
+	Remove(key SKey)
+	// Selects the next candidate to evict and removes it. Returns false if there are no candidates.
+	Evict() (SKey, bool)
+	// Forgets everything known about an entry that has been deleted other than by Evict, whether
+	// it is a candidate or not.
+	Forget(key SKey)
+}
+
+// Type lruPolicy evicts the candidate that has been released least recently.
+type lruPolicy struct {
+	order    list.List // Candidates, least recently released first
+	elements map[SKey]*list.Element
+}
+
+// Returns a policy evicting the least recently used entry first.
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{elements: make(map[SKey]*list.Element)}
+}
+
+func (p *lruPolicy) Add(key SKey, size int64) {
+	p.elements[key] = p.order.PushBack(key)
+}
+
+func (p *lruPolicy) Remove(key SKey) {
+	if e := p.elements[key]; e != nil {
+		p.order.Remove(e)
+		delete(p.elements, key)
+	}
+}
+
+func (p *lruPolicy) Forget(key SKey) {
+	p.Remove(key)
+}
+
+func (p *lruPolicy) Evict() (SKey, bool) {
+	e := p.order.Front()
+	if e == nil {
+		return SKey{}, false
+	}
+	key := p.order.Remove(e).(SKey)
+	delete(p.elements, key)
+	return key, true
+}
+
+// Type lfuPolicy evicts the candidate accessed least often, and the least recently released one
+// among those.
+type lfuPolicy struct {
+	counts     map[SKey]int // Number of accesses of all entries known to the policy
+	candidates lfuHeap
+	items      map[SKey]*lfuItem
+	seq        int64
+}
+
+type lfuItem struct {
+	key   SKey
+	count int
+	seq   int64 // Order of release
+	index int   // Position in heap
+}
+
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].seq < h[j].seq
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// Returns a policy evicting the least frequently used entry first. Access counts are kept for as
+// long as an entry is stored, which protects frequently used entries from being evicted by scans.
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{counts: make(map[SKey]int), items: make(map[SKey]*lfuItem)}
+}
+
+func (p *lfuPolicy) Add(key SKey, size int64) {
+	count := p.counts[key]
+	if count == 0 {
+		count = 1
+		p.counts[key] = count
+	}
+	p.seq++
+	item := &lfuItem{key: key, count: count, seq: p.seq}
+	p.items[key] = item
+	heap.Push(&p.candidates, item)
+}
+
+func (p *lfuPolicy) Remove(key SKey) {
+	if item := p.items[key]; item != nil {
+		heap.Remove(&p.candidates, item.index)
+		delete(p.items, key)
+		p.counts[key]++
+	}
+}
+
+func (p *lfuPolicy) Evict() (SKey, bool) {
+	if len(p.candidates) == 0 {
+		return SKey{}, false
+	}
+	item := heap.Pop(&p.candidates).(*lfuItem)
+	delete(p.items, item.key)
+	delete(p.counts, item.key)
+	return item.key, true
+}
+
+func (p *lfuPolicy) Forget(key SKey) {
+	if item := p.items[key]; item != nil {
+		heap.Remove(&p.candidates, item.index)
+		delete(p.items, key)
+	}
+	delete(p.counts, key)
+}
+
+// Type arcPolicy implements a variant of the Adaptive Replacement Cache. Candidates accessed once
+// (recent) and candidates accessed more than once (frequent) are kept in separate LRU lists. The
+// keys of evicted entries are remembered in ghost lists. When an entry comes back that has been
+// evicted from one of the lists, the target size of the recent list is adapted in its favor.
+type arcPolicy struct {
+	recent, frequent, recentGhosts, frequentGhosts list.List
+	elements                                       map[SKey]*list.Element
+	lists                                          map[SKey]*list.List // The list each key is in
+	frequentKeys                                   map[SKey]bool       // Referenced keys that go to the frequent list when released
+	target                                         int                 // Target size of the recent list
+	maxGhosts                                      int
+}
+
+// Returns a policy adapting between recency and frequency of use (ARC). Up to `maxGhosts` keys of
+// evicted entries are remembered in order to adapt the policy.
+func NewARCPolicy(maxGhosts int) EvictionPolicy {
+	return &arcPolicy{
+		elements:     make(map[SKey]*list.Element),
+		lists:        make(map[SKey]*list.List),
+		frequentKeys: make(map[SKey]bool),
+		maxGhosts:    maxGhosts,
+	}
+}
+
+func (p *arcPolicy) remove(key SKey) *list.List {
+	l := p.lists[key]
+	if l != nil {
+		l.Remove(p.elements[key])
+		delete(p.elements, key)
+		delete(p.lists, key)
+	}
+	return l
+}
+
+func (p *arcPolicy) push(key SKey, l *list.List) {
+	p.elements[key] = l.PushBack(key)
+	p.lists[key] = l
+}
+
+func (p *arcPolicy) Add(key SKey, size int64) {
+	switch p.lists[key] {
+	case &p.recentGhosts:
+		// An entry evicted from the recent list is needed again: the recent list should be larger
+		p.target = min(p.target+max(1, p.frequentGhosts.Len()/p.recentGhosts.Len()), p.maxGhosts)
+		p.remove(key)
+		p.push(key, &p.frequent)
+	case &p.frequentGhosts:
+		p.target = max(p.target-max(1, p.recentGhosts.Len()/p.frequentGhosts.Len()), 0)
+		p.remove(key)
+		p.push(key, &p.frequent)
+	default:
+		if p.frequentKeys[key] {
+			delete(p.frequentKeys, key)
+			p.push(key, &p.frequent)
+		} else {
+			p.push(key, &p.recent)
+		}
+	}
+}
+
+func (p *arcPolicy) Remove(key SKey) {
+	// The key of an evicted entry that is stored again stays a ghost until the entry is released
+	if l := p.lists[key]; l == &p.recent || l == &p.frequent {
+		// Accessed again while being a candidate
+		p.remove(key)
+		p.frequentKeys[key] = true
+	}
+}
+
+func (p *arcPolicy) Forget(key SKey) {
+	p.remove(key)
+	delete(p.frequentKeys, key)
+}
+
+func (p *arcPolicy) Evict() (SKey, bool) {
+	var from, ghosts *list.List
+	if p.recent.Len() > 0 && (p.recent.Len() > p.target || p.frequent.Len() == 0) {
+		from, ghosts = &p.recent, &p.recentGhosts
+	} else if p.frequent.Len() > 0 {
+		from, ghosts = &p.frequent, &p.frequentGhosts
+	} else {
+		return SKey{}, false
+	}
+	key := from.Front().Value.(SKey)
+	p.remove(key)
+	p.push(key, ghosts)
+	for p.recentGhosts.Len()+p.frequentGhosts.Len() > p.maxGhosts {
+		oldest := &p.recentGhosts
+		if oldest.Len() == 0 || p.frequentGhosts.Len() > p.recentGhosts.Len() {
+			oldest = &p.frequentGhosts
+		}
+		p.remove(oldest.Front().Value.(SKey))
+	}
+	return key, true
+}
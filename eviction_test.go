@@ -0,0 +1,92 @@
+package cafs
+
+import "testing"
+
+func evictAll(p EvictionPolicy) []byte {
+	var result []byte
+	for {
+		key, ok := p.Evict()
+		if !ok {
+			return result
+		}
+		result = append(result, key[0])
+	}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	k := func(b byte) SKey { return SKey{b} }
+	for _, test := range []struct {
+		name     string
+		policy   EvictionPolicy
+		expected string
+	}{
+		{"LRU", NewLRUPolicy(), "cdabe"},
+		{"LFU", NewLFUPolicy(), "cdeab"},
+		{"ARC", NewARCPolicy(4), "cdeab"},
+	} {
+		p := test.policy
+		for _, b := range []byte("abcd") {
+			p.Add(k(b), 1)
+		}
+		// b is accessed twice, a once, c and d aren't accessed again
+		for _, b := range []byte("bab") {
+			p.Remove(k(b))
+			p.Add(k(b), 1)
+		}
+		p.Add(k('e'), 1)
+		p.Remove(k('x')) // Unknown keys are ignored
+		if evicted := string(evictAll(p)); evicted != test.expected {
+			t.Errorf("%v: evicted in order %v, expected %v", test.name, evicted, test.expected)
+		}
+	}
+}
+
+func TestARCGhosts(t *testing.T) {
+	p := NewARCPolicy(2).(*arcPolicy)
+	p.Add(SKey{1}, 1)
+	p.Add(SKey{2}, 1)
+	p.Add(SKey{3}, 1)
+	evictAll(p)
+	if p.recentGhosts.Len() != 2 || p.lists[SKey{1}] != nil {
+		t.Fatalf("Expected the two latest keys to be remembered, got %d", p.recentGhosts.Len())
+	}
+	// An evicted entry that is stored again is considered frequently used
+	p.Add(SKey{3}, 1)
+	if p.lists[SKey{3}] != &p.frequent || p.target != 1 {
+		t.Errorf("Expected ghost hit to promote entry and enlarge the recent list, target is %d", p.target)
+	}
+}
+
+func TestPolicyBookkeeping(t *testing.T) {
+	lru, lfu, arc := NewLRUPolicy().(*lruPolicy), NewLFUPolicy().(*lfuPolicy), NewARCPolicy(16).(*arcPolicy)
+	sizes := map[string]func() int{
+		"LRU": func() int { return len(lru.elements) },
+		"LFU": func() int { return len(lfu.counts) + len(lfu.items) },
+		"ARC": func() int { return len(arc.elements) + len(arc.lists) + len(arc.frequentKeys) },
+	}
+	for name, p := range map[string]EvictionPolicy{"LRU": lru, "LFU": lfu, "ARC": arc} {
+		key := func(i int) SKey { return SKey{byte(i), byte(i >> 8)} }
+		// Many keys are stored, accessed and deleted, half of them while being referenced
+		for i := 0; i < 10000; i++ {
+			p.Add(key(i), 1)
+			p.Remove(key(i))
+			if i%2 == 0 {
+				p.Add(key(i), 1)
+			}
+			p.Forget(key(i))
+		}
+		if n := sizes[name](); n != 0 {
+			t.Errorf("%v: %d bookkeeping entries left after deleting all keys", name, n)
+		}
+		// Evicted keys are forgotten, except for ARC's bounded number of ghosts
+		for i := 0; i < 10000; i++ {
+			p.Add(key(i), 1)
+			p.Remove(key(i))
+			p.Add(key(i), 1)
+		}
+		evictAll(p)
+		if n := sizes[name](); n > 2*16 {
+			t.Errorf("%v: %d bookkeeping entries left after evicting all keys", name, n)
+		}
+	}
+}
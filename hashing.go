@@ -0,0 +1,78 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+// Type ChunkHasher computes the keys of chunks on a pool of goroutines while handing them out
+// in the order they were submitted. It is meant to be used by storage implementations to support
+// CreateOptions.HashWorkers. A nil *ChunkHasher holds no chunks.
+type ChunkHasher struct {
+	hash  func([]byte) SKey // Computes the key of a chunk. Called concurrently.
+	sem   chan struct{}     // Limits the number of hashes computed concurrently
+	queue []*hashJob        // Chunks submitted and not yet handed out, oldest first
+}
+
+type hashJob struct {
+	data []byte
+	key  SKey
+	done chan struct{}
+}
+
+// Returns a hasher computing keys using `hash` on `workers` goroutines, or nil if `workers` is
+// less than 2.
+func NewChunkHasher(workers int, hash func([]byte) SKey) *ChunkHasher {
+	if workers < 2 {
+		return nil
+	}
+	return &ChunkHasher{hash: hash, sem: make(chan struct{}, workers)}
+}
+
+// Function Submit starts hashing `data`, which must not be modified afterwards.
+// Blocks while all workers are busy.
+func (h *ChunkHasher) Submit(data []byte) {
+	job := &hashJob{data: data, done: make(chan struct{})}
+	h.queue = append(h.queue, job)
+	h.sem <- struct{}{}
+	go func() {
+		job.key = h.hash(job.data)
+		<-h.sem
+		close(job.done)
+	}()
+}
+
+// Returns the number of chunks submitted and not yet handed out.
+func (h *ChunkHasher) Pending() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.queue)
+}
+
+// Returns true if enough chunks are pending to keep all workers busy, so the oldest one should
+// be handed out before submitting more. This bounds the memory held by the hasher.
+func (h *ChunkHasher) Full() bool {
+	return h.Pending() >= 2*cap(h.sem)
+}
+
+// Function Next waits for the oldest pending chunk to be hashed and returns its key and data.
+// Must only be called if chunks are pending.
+func (h *ChunkHasher) Next() (SKey, []byte) {
+	job := h.queue[0]
+	h.queue[0] = nil
+	h.queue = h.queue[1:]
+	<-job.done
+	return job.key, job.data
+}
@@ -0,0 +1,70 @@
+package cafs
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func sha256Key(data []byte) SKey {
+	return sha256.Sum256(data)
+}
+
+func TestChunkHasher(t *testing.T) {
+	if NewChunkHasher(1, sha256Key) != nil {
+		t.Error("Expected no hasher for a single worker")
+	}
+	h := NewChunkHasher(3, sha256Key)
+	r := rand.New(rand.NewSource(0))
+	var chunks [][]byte
+	check := func() {
+		key, data := h.Next()
+		if &data[0] != &chunks[0][0] {
+			t.Fatalf("Chunks handed out in wrong order")
+		}
+		if key != sha256.Sum256(chunks[0]) {
+			t.Fatalf("Wrong key %v", key)
+		}
+		chunks = chunks[1:]
+	}
+	for i := 0; i < 100; i++ {
+		data := make([]byte, 1+r.Intn(100000))
+		r.Read(data)
+		chunks = append(chunks, data)
+		h.Submit(data)
+		for h.Full() {
+			check()
+		}
+		if h.Pending() != len(chunks) || h.Pending() > 6 {
+			t.Fatalf("Unexpected number of pending chunks: %d", h.Pending())
+		}
+	}
+	for h.Pending() > 0 {
+		check()
+	}
+}
+
+func BenchmarkChunkHasher(b *testing.B) {
+	chunk := make([]byte, 8192)
+	rand.New(rand.NewSource(0)).Read(chunk)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(chunk)))
+			h := NewChunkHasher(workers, sha256Key)
+			for i := 0; i < b.N; i++ {
+				if h == nil {
+					_ = sha256.Sum256(chunk)
+					continue
+				}
+				h.Submit(chunk)
+				for h.Full() {
+					h.Next()
+				}
+			}
+			for h.Pending() > 0 {
+				h.Next()
+			}
+		})
+	}
+}
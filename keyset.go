@@ -0,0 +1,154 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import "encoding/binary"
+
+// Type KeySet is a set of keys, implemented as an open-addressed hash table. Compared to
+// map[SKey]struct{}, it uses considerably less memory and doesn't allocate except when growing.
+// The zero value is an empty set ready to use. A KeySet must not be used concurrently.
+type KeySet struct {
+	slots   []SKey // Hash table with linear probing. The zero key marks an empty slot.
+	n       int    // Number of keys in slots
+	hasZero bool   // Whether the zero key is an element
+}
+
+// Returns a new set with enough capacity for `capacity` keys.
+func NewKeySet(capacity int) *KeySet {
+	s := new(KeySet)
+	if capacity > 0 {
+		s.resize(capacity)
+	}
+	return s
+}
+
+// Keys are hashes already, so their first bytes can serve as index into the table.
+func (s *KeySet) index(key *SKey) int {
+	return int(binary.LittleEndian.Uint64(key[:8]) & uint64(len(s.slots)-1))
+}
+
+// Re-allocates the hash table so it can hold `capacity` keys at a load factor of at most 3/4.
+func (s *KeySet) resize(capacity int) {
+	size := 8
+	for size*3/4 < capacity {
+		size *= 2
+	}
+	old := s.slots
+	s.slots = make([]SKey, size)
+	for i := range old {
+		if old[i] != (SKey{}) {
+			s.insert(&old[i])
+		}
+	}
+}
+
+// Puts a non-zero key into its slot. Returns false if the key was already present.
+func (s *KeySet) insert(key *SKey) bool {
+	mask := len(s.slots) - 1
+	for i := s.index(key); ; i = (i + 1) & mask {
+		if s.slots[i] == *key {
+			return false
+		} else if s.slots[i] == (SKey{}) {
+			s.slots[i] = *key
+			return true
+		}
+	}
+}
+
+// Adds a key to the set. Returns true if the key wasn't contained before.
+func (s *KeySet) Add(key SKey) bool {
+	if key == (SKey{}) {
+		added := !s.hasZero
+		s.hasZero = true
+		return added
+	}
+	if (s.n+1)*4 > len(s.slots)*3 {
+		s.resize(s.n + 1)
+	}
+	if s.insert(&key) {
+		s.n++
+		return true
+	}
+	return false
+}
+
+// Returns true if the key is an element of the set.
+func (s *KeySet) Contains(key SKey) bool {
+	if key == (SKey{}) {
+		return s.hasZero
+	}
+	if s.n == 0 {
+		return false
+	}
+	mask := len(s.slots) - 1
+	for i := s.index(&key); ; i = (i + 1) & mask {
+		if s.slots[i] == key {
+			return true
+		} else if s.slots[i] == (SKey{}) {
+			return false
+		}
+	}
+}
+
+// Returns the number of keys in the set.
+func (s *KeySet) Len() int {
+	if s.hasZero {
+		return s.n + 1
+	}
+	return s.n
+}
+
+// Calls f for every key in the set, in no particular order, until f returns false.
+// The set must not be modified during the iteration.
+func (s *KeySet) Each(f func(key SKey) bool) {
+	if s.hasZero && !f(SKey{}) {
+		return
+	}
+	for i := range s.slots {
+		if s.slots[i] != (SKey{}) && !f(s.slots[i]) {
+			return
+		}
+	}
+}
+
+// Returns a new set containing the keys contained in either s or other.
+func (s *KeySet) Union(other *KeySet) *KeySet {
+	result := NewKeySet(s.Len() + other.Len())
+	add := func(key SKey) bool {
+		result.Add(key)
+		return true
+	}
+	s.Each(add)
+	other.Each(add)
+	return result
+}
+
+// Returns a new set containing the keys contained in both s and other.
+func (s *KeySet) Intersect(other *KeySet) *KeySet {
+	small, large := s, other
+	if small.Len() > large.Len() {
+		small, large = large, small
+	}
+	result := NewKeySet(small.Len())
+	small.Each(func(key SKey) bool {
+		if large.Contains(key) {
+			result.Add(key)
+		}
+		return true
+	})
+	return result
+}
@@ -0,0 +1,125 @@
+package cafs
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func randomKeys(n int, r *rand.Rand) []SKey {
+	keys := make([]SKey, n)
+	for i := range keys {
+		r.Read(keys[i][:])
+	}
+	return keys
+}
+
+func TestKeySet(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	keys := randomKeys(10000, r)
+	keys = append(keys, SKey{})
+
+	var s KeySet
+	m := make(map[SKey]bool)
+	for i, key := range keys {
+		if i%2 == 0 {
+			if !s.Add(key) {
+				t.Fatalf("Key %v reported as already present", key)
+			}
+			m[key] = true
+		}
+	}
+	// The zero key is a regular element
+	s.Add(SKey{})
+	m[SKey{}] = true
+	if s.Add(keys[0]) {
+		t.Errorf("Key %v added twice", keys[0])
+	}
+	if s.Len() != len(m) {
+		t.Errorf("Expected %d elements, got %d", len(m), s.Len())
+	}
+	for _, key := range keys {
+		if s.Contains(key) != m[key] {
+			t.Errorf("Contains(%v) returned %v", key, s.Contains(key))
+		}
+	}
+	n := 0
+	s.Each(func(key SKey) bool {
+		if !m[key] {
+			t.Errorf("Unexpected key %v", key)
+		}
+		n++
+		return true
+	})
+	if n != len(m) {
+		t.Errorf("Iterated %d keys, expected %d", n, len(m))
+	}
+}
+
+func TestKeySetOperations(t *testing.T) {
+	keys := randomKeys(3000, rand.New(rand.NewSource(2)))
+	a, b := NewKeySet(0), NewKeySet(2000)
+	for _, key := range keys[:2000] {
+		a.Add(key)
+	}
+	for _, key := range keys[1000:] {
+		b.Add(key)
+	}
+
+	union := a.Union(b)
+	intersection := a.Intersect(b)
+	if union.Len() != 3000 {
+		t.Errorf("Expected union of %d keys, got %d", 3000, union.Len())
+	}
+	if intersection.Len() != 1000 {
+		t.Errorf("Expected intersection of %d keys, got %d", 1000, intersection.Len())
+	}
+	for i, key := range keys {
+		if !union.Contains(key) {
+			t.Errorf("Key #%d missing from union", i)
+		}
+		if intersection.Contains(key) != (i >= 1000 && i < 2000) {
+			t.Errorf("Key #%d wrongly contained in intersection: %v", i, intersection.Contains(key))
+		}
+	}
+
+	var empty KeySet
+	if empty.Contains(keys[0]) || empty.Len() != 0 || empty.Intersect(a).Len() != 0 || empty.Union(a).Len() != a.Len() {
+		t.Errorf("Empty key set misbehaves")
+	}
+}
+
+const benchmarkKeys = 1000000
+
+func BenchmarkKeySet(b *testing.B) {
+	keys := randomKeys(benchmarkKeys, rand.New(rand.NewSource(3)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var s KeySet
+		for _, key := range keys {
+			s.Add(key)
+		}
+		for _, key := range keys {
+			if !s.Contains(key) {
+				b.Fatal("Key missing")
+			}
+		}
+	}
+}
+
+func BenchmarkKeyMap(b *testing.B) {
+	keys := randomKeys(benchmarkKeys, rand.New(rand.NewSource(3)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := make(map[SKey]struct{})
+		for _, key := range keys {
+			m[key] = struct{}{}
+		}
+		for _, key := range keys {
+			if _, ok := m[key]; !ok {
+				b.Fatal("Key missing")
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// Type LeakMode selects how storages react to file handles being garbage-collected without having
+// been disposed. Such a handle leaks a reference, which keeps the file from ever being evicted.
+type LeakMode int32
+
+const (
+	LeakIgnore  LeakMode = iota // Leaked handles aren't detected. This is the default.
+	LeakWarn                    // A warning is logged for every leaked handle.
+	LeakDispose                 // Like LeakWarn, but the leaked handle is disposed as well.
+)
+
+var leakMode int32
+var leakedHandles int64
+
+// Function SetLeakMode enables or disables the detection of leaked file handles. It only affects
+// handles created afterwards. Detection relies on finalizers and is meant as a debugging aid: a
+// leak is only reported when the garbage collector finds the handle, if ever. Disposing leaked
+// handles keeps a program running, but the code forgetting to dispose them still needs fixing.
+func SetLeakMode(mode LeakMode) {
+	atomic.StoreInt32(&leakMode, int32(mode))
+}
+
+// Returns the mode set by SetLeakMode.
+func GetLeakMode() LeakMode {
+	return LeakMode(atomic.LoadInt32(&leakMode))
+}
+
+// Returns the number of leaked file handles reported so far.
+func LeakedHandles() int64 {
+	return atomic.LoadInt64(&leakedHandles)
+}
+
+// Function ReportLeak is called by storage implementations when the finalizer of a file handle
+// finds it not disposed. Logs a warning and returns whether the handle should be disposed.
+func ReportLeak(key SKey, info string) bool {
+	log.Printf("Warning: file handle %v [%v] garbage-collected without being disposed", key, info)
+	atomic.AddInt64(&leakedHandles, 1)
+	return GetLeakMode() == LeakDispose
+}
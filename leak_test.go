@@ -0,0 +1,54 @@
+package cafs_test
+
+import (
+	"bytes"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"log"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeakDetection(t *testing.T) {
+	defer SetLeakMode(GetLeakMode())
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+
+	s := ram.NewRamStorage(1024 * 1024)
+	leak := func(mode LeakMode) SKey {
+		SetLeakMode(mode)
+		// The file is dropped without being disposed
+		key := addRandomData(t, s, 1000).Key()
+		leaked := LeakedHandles()
+		for i := 0; i < 100 && LeakedHandles() == leaked; i++ {
+			runtime.GC()
+			time.Sleep(time.Millisecond)
+		}
+		if LeakedHandles() == leaked {
+			t.Fatalf("Mode %v: leak not detected", mode)
+		}
+		return key
+	}
+
+	key := leak(LeakWarn)
+	if !strings.Contains(logged.String(), key.String()) {
+		t.Errorf("Expected warning about %v, got %q", key, logged.String())
+	}
+	if ui := s.GetUsageInfo(); ui.Locked == 0 {
+		t.Errorf("Expected leaked handle to keep holding its reference in warn-only mode: %v", ui)
+	}
+
+	// Disposing leaked handles releases their references
+	s = ram.NewRamStorage(1024 * 1024)
+	leak(LeakDispose)
+	for i := 0; i < 100 && s.FreeCache() == 0; i++ {
+		// The handle is disposed after the leak has been counted
+		time.Sleep(time.Millisecond)
+	}
+	if ui := s.GetUsageInfo(); ui.Used != 0 {
+		t.Errorf("Expected leaked handle to be disposed: %v", ui)
+	}
+}
@@ -0,0 +1,306 @@
+//	BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//	Copyright (C) 2013-2018  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//	This program is free software: you can redistribute it and/or modify
+//	it under the terms of the GNU General Public License as published by
+//	the Free Software Foundation, either version 3 of the License, or
+//	(at your option) any later version.
+//
+//	This program is distributed in the hope that it will be useful,
+//	but WITHOUT ANY WARRANTY; without even the implied warranty of
+//	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//	GNU General Public License for more details.
+//
+//	You should have received a copy of the GNU General Public License
+//	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Package manifest describes trees of files kept in a cafs storage, including file system
+// metadata like permissions, ownership and symbolic links. It allows for backing up a directory
+// tree into a storage and restoring it faithfully.
+package manifest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var ErrUnsupportedType = errors.New("Unsupported file type")
+var ErrInvalidManifest = errors.New("Invalid manifest")
+var ErrSymlinkParent = errors.New("Parent directory is a symbolic link")
+
+// Type EntryType specifies the kind of a manifest entry.
+type EntryType string
+
+const (
+	TypeFile    EntryType = "file"
+	TypeDir     EntryType = "dir"
+	TypeSymlink EntryType = "symlink"
+)
+
+// The mode bits preserved in a manifest.
+const modeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Type Entry describes a single file, directory or symbolic link. Only regular files have content.
+type Entry struct {
+	Path   string      `json:"path"` // Slash-separated path relative to the root
+	Type   EntryType   `json:"type"`
+	Mode   os.FileMode `json:"mode"` // Permission bits, plus setuid, setgid and sticky bits
+	UID    int         `json:"uid"`  // Owner, or -1 if unknown
+	GID    int         `json:"gid"`  // Group, or -1 if unknown
+	Size   int64       `json:"size,omitempty"`
+	Key    *cafs.SKey  `json:"key,omitempty"`    // Key of the content, for regular files
+	Target string      `json:"target,omitempty"` // Target of symbolic links
+}
+
+// Type Manifest lists the entries of a directory tree. Parents are listed before their children.
+type Manifest struct {
+	Entries []Entry `json:"entries"`
+}
+
+// Writes the manifest as JSON.
+func (m *Manifest) Encode(w io.Writer) error {
+	return json.NewEncoder(w).Encode(m)
+}
+
+// Reads a manifest encoded by Encode and validates it.
+func Decode(r io.Reader) (*Manifest, error) {
+	m := new(Manifest)
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Checks that all entries have a known type and a relative path that doesn't leave the root,
+// neither textually nor by passing through a symbolic link listed earlier. Returns an error
+// wrapping ErrInvalidManifest otherwise.
+func (m *Manifest) Validate() error {
+	symlinks := make(map[string]bool)
+	for _, e := range m.Entries {
+		if e.Path == "" || path.IsAbs(e.Path) || path.Clean(e.Path) != e.Path ||
+			e.Path == ".." || strings.HasPrefix(e.Path, "../") || strings.Contains(e.Path, "\\") {
+			return fmt.Errorf("%w: illegal path %q", ErrInvalidManifest, e.Path)
+		}
+		for parent := path.Dir(e.Path); parent != "."; parent = path.Dir(parent) {
+			if symlinks[parent] {
+				return fmt.Errorf("%w: parent of %q is a symbolic link", ErrInvalidManifest, e.Path)
+			}
+		}
+		switch e.Type {
+		case TypeFile:
+			if e.Key == nil {
+				return fmt.Errorf("%w: file %q has no key", ErrInvalidManifest, e.Path)
+			}
+		case TypeDir:
+		case TypeSymlink:
+			symlinks[e.Path] = true
+		default:
+			return fmt.Errorf("%w: entry %q has unknown type %q", ErrInvalidManifest, e.Path, e.Type)
+		}
+	}
+	return nil
+}
+
+// Stores the manifest as a file in `storage`. The returned file must be disposed.
+func Store(storage cafs.FileStorage, m *Manifest, info string) (cafs.File, error) {
+	temp := storage.Create(info)
+	defer temp.Dispose()
+	if err := m.Encode(temp); err != nil {
+		return nil, err
+	}
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	return temp.File(), nil
+}
+
+// Loads a manifest stored by Store.
+func Load(storage cafs.FileStorage, key *cafs.SKey) (*Manifest, error) {
+	f, err := storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Dispose()
+	r := f.Open()
+	defer r.Close()
+	return Decode(r)
+}
+
+// Ingests the directory tree at `root` into `storage` and returns a manifest describing it.
+// Regular files, directories and symbolic links are supported. Other kinds of files, like devices
+// or named pipes, cause an error wrapping ErrUnsupportedType.
+//
+// The content of the files is not protected from eviction. Callers must retrieve it while it is needed.
+func Backup(storage cafs.FileStorage, root string) (*Manifest, error) {
+	m := new(Manifest)
+	err := filepath.Walk(root, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		uid, gid := owner(fi)
+		e := Entry{Path: filepath.ToSlash(rel), Mode: fi.Mode() & modeMask, UID: uid, GID: gid}
+		switch {
+		case fi.Mode().IsDir():
+			e.Type = TypeDir
+		case fi.Mode().IsRegular():
+			e.Type = TypeFile
+			if e.Key, e.Size, err = ingest(storage, name, e.Path); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			e.Type = TypeSymlink
+			if e.Target, err = os.Readlink(name); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: %v (%v)", ErrUnsupportedType, name, fi.Mode().Type())
+		}
+		m.Entries = append(m.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func ingest(storage cafs.FileStorage, name, info string) (*cafs.SKey, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	temp := storage.Create(info)
+	defer temp.Dispose()
+	if _, err := io.Copy(temp, f); err != nil {
+		return nil, 0, err
+	}
+	if err := temp.Close(); err != nil {
+		return nil, 0, err
+	}
+	file := temp.File()
+	defer file.Dispose()
+	key := file.Key()
+	return &key, file.Size(), nil
+}
+
+// Type RestoreOptions contains optional settings for Restore.
+// The zero value selects the default behavior.
+type RestoreOptions struct {
+	// If set, the ownership of restored entries is set as recorded in the manifest.
+	// This usually requires superuser privileges.
+	Ownership bool
+}
+
+// Restores the tree described by manifest `m` into directory `dir`, which is created if
+// necessary. Existing files are not overwritten. Modes of directories are applied last, so that
+// read-only directories can be populated. Symbolic links are never followed below `dir`: an
+// entry whose parent is a symbolic link, e.g. one existing in `dir` beforehand, causes an error
+// wrapping ErrSymlinkParent.
+func Restore(storage cafs.FileStorage, m *Manifest, dir string, opts RestoreOptions) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var dirs []Entry
+	for _, e := range m.Entries {
+		name := filepath.Join(dir, filepath.FromSlash(e.Path))
+		if err := checkParents(dir, e.Path); err != nil {
+			return err
+		}
+		switch e.Type {
+		case TypeDir:
+			if err := os.Mkdir(name, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, e)
+			continue
+		case TypeFile:
+			if err := restoreFile(storage, &e, name); err != nil {
+				return err
+			}
+		case TypeSymlink:
+			if err := os.Symlink(e.Target, name); err != nil {
+				return err
+			}
+		}
+		if err := applyOwnership(&e, name, opts); err != nil {
+			return err
+		}
+	}
+	// Apply directory modes bottom-up
+	for i := len(dirs) - 1; i >= 0; i-- {
+		name := filepath.Join(dir, filepath.FromSlash(dirs[i].Path))
+		if err := applyOwnership(&dirs[i], name, opts); err != nil {
+			return err
+		}
+		if err := os.Chmod(name, dirs[i].Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns an error wrapping ErrSymlinkParent if any of the parent directories of the entry at
+// `rel` within `dir` is a symbolic link.
+func checkParents(dir, rel string) error {
+	for parent := path.Dir(rel); parent != "."; parent = path.Dir(parent) {
+		fi, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(parent)))
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %v", ErrSymlinkParent, parent)
+		}
+	}
+	return nil
+}
+
+func restoreFile(storage cafs.FileStorage, e *Entry, name string) error {
+	file, err := storage.Get(e.Key)
+	if err != nil {
+		return fmt.Errorf("%v: %w", e.Path, err)
+	}
+	defer file.Dispose()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	r := file.Open()
+	defer r.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// Chmod, in contrast to OpenFile, isn't subject to the umask
+	return os.Chmod(name, e.Mode)
+}
+
+func applyOwnership(e *Entry, name string, opts RestoreOptions) error {
+	if !opts.Ownership || e.UID < 0 || e.GID < 0 {
+		return nil
+	}
+	return os.Lchown(name, e.UID, e.GID)
+}
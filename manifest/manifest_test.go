@@ -0,0 +1,132 @@
+package manifest
+
+import (
+	"bytes"
+	"errors"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	src := t.TempDir()
+	check(t, os.MkdirAll(filepath.Join(src, "bin"), 0755))
+	check(t, os.Mkdir(filepath.Join(src, "empty"), 0700))
+	check(t, os.WriteFile(filepath.Join(src, "bin", "tool"), []byte("#!/bin/sh\necho hello\n"), 0755))
+	check(t, os.WriteFile(filepath.Join(src, "secret"), []byte("top secret"), 0600))
+	check(t, os.WriteFile(filepath.Join(src, "copy"), []byte("top secret"), 0644))
+	check(t, os.WriteFile(filepath.Join(src, "empty-file"), nil, 0640))
+	check(t, os.Symlink("bin/tool", filepath.Join(src, "link")))
+	check(t, os.Chmod(filepath.Join(src, "bin"), 0750))
+
+	storage := ram.NewRamStorage(1 << 20)
+	m, err := Backup(storage, src)
+	check(t, err)
+	if len(m.Entries) != 7 {
+		t.Fatalf("Expected 7 entries, got %d: %v", len(m.Entries), m.Entries)
+	}
+
+	file, err := Store(storage, m, "manifest")
+	check(t, err)
+	key := file.Key()
+	file.Dispose()
+	loaded, err := Load(storage, &key)
+	check(t, err)
+
+	dst := filepath.Join(t.TempDir(), "restored")
+	check(t, Restore(storage, loaded, dst, RestoreOptions{}))
+
+	for _, e := range m.Entries {
+		name := filepath.Join(dst, filepath.FromSlash(e.Path))
+		fi, err := os.Lstat(name)
+		check(t, err)
+		switch e.Type {
+		case TypeSymlink:
+			target, err := os.Readlink(name)
+			check(t, err)
+			if target != e.Target {
+				t.Errorf("%v: expected target %v, got %v", e.Path, e.Target, target)
+			}
+			continue
+		case TypeFile:
+			expected, err := os.ReadFile(filepath.Join(src, filepath.FromSlash(e.Path)))
+			check(t, err)
+			actual, err := os.ReadFile(name)
+			check(t, err)
+			if !bytes.Equal(expected, actual) {
+				t.Errorf("%v: content differs", e.Path)
+			}
+		}
+		if fi.Mode()&modeMask != e.Mode {
+			t.Errorf("%v: expected mode %v, got %v", e.Path, e.Mode, fi.Mode()&modeMask)
+		}
+	}
+
+	// Restoring into an existing tree must not overwrite anything
+	if err := Restore(storage, loaded, dst, RestoreOptions{}); err == nil {
+		t.Error("Expected error when restoring over existing tree")
+	}
+}
+
+func TestInvalidManifest(t *testing.T) {
+	key := cafs.SKey{}
+	for _, m := range []*Manifest{
+		{Entries: []Entry{{Path: "../escape", Type: TypeFile, Key: &key}}},
+		{Entries: []Entry{{Path: "/abs", Type: TypeDir}}},
+		{Entries: []Entry{{Path: "a/../../b", Type: TypeDir}}},
+		{Entries: []Entry{{Path: "dev", Type: "device"}}},
+		{Entries: []Entry{{Path: "nokey", Type: TypeFile}}},
+		{Entries: []Entry{{Path: "a", Type: TypeSymlink, Target: "/etc"}, {Path: "a/x", Type: TypeFile, Key: &key}}},
+		{Entries: []Entry{{Path: "a", Type: TypeSymlink, Target: "/etc"}, {Path: "a/b/x", Type: TypeDir}}},
+	} {
+		var buf bytes.Buffer
+		check(t, m.Encode(&buf))
+		if _, err := Decode(&buf); !errors.Is(err, ErrInvalidManifest) {
+			t.Errorf("Expected ErrInvalidManifest for %v, got %v", m.Entries, err)
+		}
+	}
+}
+
+func TestRestoreThroughSymlink(t *testing.T) {
+	storage := ram.NewRamStorage(1 << 20)
+	temp := storage.Create("x")
+	_, _ = temp.Write([]byte("escaped"))
+	check(t, temp.Close())
+	defer temp.Dispose()
+	file := temp.File()
+	defer file.Dispose()
+	key := file.Key()
+
+	// A manifest creating the symbolic link itself is rejected before anything is restored
+	m := &Manifest{Entries: []Entry{
+		{Path: "a", Type: TypeSymlink, Target: "/etc", UID: -1, GID: -1},
+		{Path: "a/x", Type: TypeFile, Key: &key, Mode: 0644, UID: -1, GID: -1},
+	}}
+	dst := t.TempDir()
+	if err := Restore(storage, m, dst, RestoreOptions{}); !errors.Is(err, ErrInvalidManifest) {
+		t.Errorf("Expected ErrInvalidManifest, got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "a")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be restored, got %v", err)
+	}
+
+	// A symbolic link existing in the target directory isn't followed either
+	outside := t.TempDir()
+	check(t, os.Symlink(outside, filepath.Join(dst, "a")))
+	m.Entries = m.Entries[1:]
+	if err := Restore(storage, m, dst, RestoreOptions{}); !errors.Is(err, ErrSymlinkParent) {
+		t.Errorf("Expected ErrSymlinkParent, got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "x")); !os.IsNotExist(err) {
+		t.Errorf("Expected no file outside of the target directory, got %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Returned by ExtentFile.WalkExtents if the file's data isn't stored as is, e.g. because it has been
+// compressed. No extent has been passed to the callback then.
+var ErrNoExtents = errors.New("Data not stored in extents")
+
+// Interface ExtentFile is implemented by files whose data resides in regular files on disk,
+// allowing for copying it without going through the file's reader.
+type ExtentFile interface {
+	// Calls `f` for each contiguous extent of the file's data, in order. The os.File holding
+	// the extent is only valid during the call and must not be closed.
+	WalkExtents(f func(src *os.File, offset, length int64) error) error
+}
+
+// Type MaterializeOptions contains optional settings for Materialize.
+// The zero value selects the default behavior.
+type MaterializeOptions struct {
+	// The permission bits of the created file. Defaults to 0644.
+	Mode os.FileMode
+
+	// If set and the file implements ExtentFile, extents are cloned using copy-on-write where
+	// the file system supports it (currently on Linux, e.g. with Btrfs or XFS) and the extents'
+	// alignment permits. Otherwise, the data is copied.
+	Reflink bool
+}
+
+// Function Materialize writes the content of `file` to a regular file at `path`, replacing any
+// existing file. The content is streamed into a temporary file in the same directory, which is
+// renamed to `path` on success, so that `path` never refers to an incomplete file.
+func Materialize(file File, path string, opts MaterializeOptions) error {
+	if opts.Mode == 0 {
+		opts.Mode = 0644
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly after the rename
+	err = writeContent(tmp, file, opts.Reflink)
+	if err == nil {
+		err = tmp.Chmod(opts.Mode)
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func writeContent(dst *os.File, file File, reflink bool) error {
+	ef, ok := file.(ExtentFile)
+	if !reflink || !ok {
+		r := file.Open()
+		defer r.Close()
+		_, err := io.Copy(dst, r)
+		return err
+	}
+	var pos int64
+	err := ef.WalkExtents(func(src *os.File, offset, length int64) error {
+		if err := cloneRange(dst, src, offset, length, pos); err != nil {
+			// Not supported, or not aligned
+			if _, err := io.Copy(io.NewOffsetWriter(dst, pos), io.NewSectionReader(src, offset, length)); err != nil {
+				return err
+			}
+		}
+		pos += length
+		return nil
+	})
+	if err == ErrNoExtents {
+		return writeContent(dst, file, false)
+	}
+	return err
+}
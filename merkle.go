@@ -0,0 +1,234 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sort"
+)
+
+// Returned by MerkleTree.VerifyRange for ranges not within the file.
+var ErrOutOfRange = errors.New("Range out of bounds")
+
+// Returned by LoadMerkleTree if the stored tree can't be decoded.
+var ErrInvalidMerkleTree = errors.New("Invalid Merkle tree")
+
+// Every stored Merkle tree starts with this byte sequence.
+const merkleMagic = "CAFSMT01"
+
+// Type MerkleTree is a binary hash tree over the chunks of a file. Each leaf hashes a chunk's key
+// and length, each inner node hashes its two children, and a node without a sibling is carried up
+// unchanged. Given a trusted root, ranges of the file can be verified without reading all of it.
+type MerkleTree struct {
+	keys   []SKey   // The key of each chunk
+	ends   []int64  // The position after each chunk
+	levels [][]SKey // Leaves first, with the root as the only node of the last level
+}
+
+func merkleLeaf(key SKey, length int64) SKey {
+	buf := make([]byte, 0, 1+len(key)+binary.MaxVarintLen64)
+	buf = append(buf, 0)
+	buf = append(buf, key[:]...)
+	buf = binary.AppendUvarint(buf, uint64(length))
+	return sha256.Sum256(buf)
+}
+
+func merkleNode(left, right SKey) SKey {
+	buf := make([]byte, 0, 1+2*len(left))
+	buf = append(buf, 1)
+	buf = append(buf, left[:]...)
+	buf = append(buf, right[:]...)
+	return sha256.Sum256(buf)
+}
+
+// Returns the Merkle tree over the chunks of `file`. Only the list of chunks is read.
+func NewMerkleTree(file File) *MerkleTree {
+	var keys []SKey
+	var ends []int64
+	var pos int64
+	iter := file.Chunks()
+	defer iter.Dispose()
+	for iter.Next() {
+		pos += iter.Size()
+		keys = append(keys, iter.Key())
+		ends = append(ends, pos)
+	}
+	return newMerkleTree(keys, ends)
+}
+
+func newMerkleTree(keys []SKey, ends []int64) *MerkleTree {
+	leaves := make([]SKey, len(keys))
+	var start int64
+	for i, key := range keys {
+		leaves[i] = merkleLeaf(key, ends[i]-start)
+		start = ends[i]
+	}
+	t := &MerkleTree{keys: keys, ends: ends, levels: [][]SKey{leaves}}
+	for level := leaves; len(level) > 1; {
+		next := make([]SKey, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		t.levels = append(t.levels, next)
+		level = next
+	}
+	return t
+}
+
+// Returns the root hash of the tree, which identifies the file's chunks and their order.
+func (t *MerkleTree) Root() SKey {
+	if len(t.ends) == 0 {
+		return SKey{}
+	}
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Returns the number of chunks covered by the tree.
+func (t *MerkleTree) NumChunks() int {
+	return len(t.ends)
+}
+
+// Function VerifyRange checks that the `length` bytes of `file` starting at `offset` are intact.
+// Only the chunks overlapping the range are read. The data of each chunk must hash to the key and
+// length of the respective chunk in the tree. The tree itself must be trusted, i.e. computed by
+// NewMerkleTree or loaded by LoadMerkleTree with a trusted root. Returns ErrKeyMismatch if the
+// data is corrupt or doesn't belong to the tree, and ErrOutOfRange if the range isn't within the file.
+func (t *MerkleTree) VerifyRange(file File, offset, length int64) error {
+	size := int64(0)
+	if len(t.ends) > 0 {
+		size = t.ends[len(t.ends)-1]
+	}
+	if offset < 0 || length < 0 || offset+length > size || file.Size() != size {
+		return ErrOutOfRange
+	}
+	if length == 0 {
+		return nil
+	}
+	first := sort.Search(len(t.ends), func(i int) bool { return t.ends[i] > offset })
+	last := sort.Search(len(t.ends), func(i int) bool { return t.ends[i] >= offset+length })
+
+	iter := file.Chunks()
+	defer iter.Dispose()
+	for idx := 0; idx <= last; idx++ {
+		if !iter.Next() {
+			return ErrKeyMismatch
+		}
+		if idx < first {
+			continue
+		}
+		if err := t.verifyChunk(idx, iter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hashes the data of the chunk at the iterator's position and verifies it as chunk `idx`.
+func (t *MerkleTree) verifyChunk(idx int, iter FileIterator) error {
+	chunk := iter.File()
+	defer chunk.Dispose()
+	h := sha256.New()
+	r := chunk.Open()
+	n, err := io.Copy(h, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	var key SKey
+	h.Sum(key[:0])
+	start := int64(0)
+	if idx > 0 {
+		start = t.ends[idx-1]
+	}
+	if key != t.keys[idx] || n != t.ends[idx]-start {
+		return ErrKeyMismatch
+	}
+	return nil
+}
+
+// Stores the tree as a file in `storage`, e.g. alongside the file it was computed for. Only the
+// chunk list is encoded; inner nodes are recomputed by LoadMerkleTree. The returned file must be disposed.
+func StoreMerkleTree(storage FileStorage, t *MerkleTree, info string) (File, error) {
+	temp := storage.Create(info)
+	defer temp.Dispose()
+	w := bufio.NewWriter(temp)
+	w.WriteString(merkleMagic)
+	w.Write(binary.AppendUvarint(nil, uint64(len(t.keys))))
+	for i, key := range t.keys {
+		w.Write(key[:])
+		w.Write(binary.AppendUvarint(nil, uint64(t.ends[i])))
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	return temp.File(), nil
+}
+
+// Loads a Merkle tree stored by StoreMerkleTree. Returns ErrKeyMismatch unless the tree's root is
+// `root`, which must come from a trusted source.
+func LoadMerkleTree(storage FileStorage, key *SKey, root SKey) (*MerkleTree, error) {
+	f, err := storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Dispose()
+	r := f.Open()
+	defer r.Close()
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(merkleMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != merkleMagic {
+		return nil, ErrInvalidMerkleTree
+	}
+	n, err := binary.ReadUvarint(br)
+	if err != nil || n > uint64(f.Size()) {
+		return nil, ErrInvalidMerkleTree
+	}
+	keys := make([]SKey, n)
+	ends := make([]int64, n)
+	var lastEnd uint64
+	for i := range keys {
+		if _, err := io.ReadFull(br, keys[i][:]); err != nil {
+			return nil, ErrInvalidMerkleTree
+		}
+		end, err := binary.ReadUvarint(br)
+		if err != nil || end <= lastEnd || end > math.MaxInt64 {
+			return nil, ErrInvalidMerkleTree
+		}
+		ends[i], lastEnd = int64(end), end
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return nil, ErrInvalidMerkleTree
+	}
+	t := newMerkleTree(keys, ends)
+	if t.Root() != root {
+		return nil, ErrKeyMismatch
+	}
+	return t, nil
+}
@@ -0,0 +1,86 @@
+package cafs_test
+
+import (
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"testing"
+)
+
+func TestMerkleTree(t *testing.T) {
+	s := ram.NewRamStorage(4 * 1024 * 1024)
+	f := addRandomData(t, s, 500000)
+	defer f.Dispose()
+	tree := NewMerkleTree(f)
+	if tree.NumChunks() < 4 {
+		t.Fatalf("Expected several chunks, got %v", tree.NumChunks())
+	}
+
+	// Locate chunks to corrupt and to verify
+	var keys []SKey
+	var starts []int64
+	var pos int64
+	iter := f.Chunks()
+	for iter.Next() {
+		keys = append(keys, iter.Key())
+		starts = append(starts, pos)
+		pos += iter.Size()
+	}
+	iter.Dispose()
+
+	if err := tree.VerifyRange(f, 0, f.Size()); err != nil {
+		t.Errorf("Verifying whole file: %v", err)
+	}
+	if err := tree.VerifyRange(f, starts[1]+10, starts[3]-starts[1]); err != nil {
+		t.Errorf("Verifying sub-range: %v", err)
+	}
+	if err := tree.VerifyRange(f, f.Size()-10, 11); err != ErrOutOfRange {
+		t.Errorf("Expected ErrOutOfRange, got %v", err)
+	}
+
+	// Store and load the tree
+	stored, err := StoreMerkleTree(s, tree, "merkle tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedKey := stored.Key()
+	stored.Dispose()
+	loaded, err := LoadMerkleTree(s, &storedKey, tree.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Root() != tree.Root() || loaded.NumChunks() != tree.NumChunks() {
+		t.Errorf("Loaded tree differs from stored tree")
+	}
+	if _, err := LoadMerkleTree(s, &keys[0], tree.Root()); err != ErrInvalidMerkleTree {
+		t.Errorf("Expected ErrInvalidMerkleTree when loading chunk data, got %v", err)
+	}
+
+	// A tree of another file is rejected given the trusted root, and doesn't verify this file
+	other := addRandomData(t, s, 500000)
+	defer other.Dispose()
+	otherTree := NewMerkleTree(other)
+	otherStored, err := StoreMerkleTree(s, otherTree, "other merkle tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey := otherStored.Key()
+	otherStored.Dispose()
+	if _, err := LoadMerkleTree(s, &otherKey, tree.Root()); err != ErrKeyMismatch {
+		t.Errorf("Expected ErrKeyMismatch when loading tree with wrong root, got %v", err)
+	}
+	if err := otherTree.VerifyRange(f, 0, f.Size()); err != ErrKeyMismatch {
+		t.Errorf("Expected file not to verify against another file's tree, got %v", err)
+	}
+
+	// Corrupting a chunk only affects ranges overlapping it
+	corrupt := damagedFile{f, map[int]bool{2: true}}
+	if err := loaded.VerifyRange(corrupt, starts[1]+10, starts[3]-starts[1]); err != ErrKeyMismatch {
+		t.Errorf("Expected corrupt chunk to be detected, got %v", err)
+	}
+	if err := loaded.VerifyRange(corrupt, starts[3], f.Size()-starts[3]); err != nil {
+		t.Errorf("Verifying range after corrupt chunk: %v", err)
+	}
+	if err := loaded.VerifyRange(corrupt, 0, starts[2]); err != nil {
+		t.Errorf("Verifying range before corrupt chunk: %v", err)
+	}
+}
@@ -0,0 +1,356 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Type Namespace maps names to files of a storage. A named file is retained, i.e. protected from
+// eviction, until its name is removed or bound to another file. Optionally, the number of named
+// files can be capped, which turns the namespace into a cache of the last N objects: when the cap
+// is exceeded, the least recently named or retrieved file loses its name. The storage then
+// reclaims chunks no longer referenced by any file.
+// It is safe to use a Namespace from multiple goroutines.
+type Namespace struct {
+	mutex   sync.Mutex
+	storage FileStorage
+	opts    NamespaceOptions
+	order   list.List // Named files, least recently used first
+	names   map[string]*list.Element
+	sorted  []string // The bound names in lexical order
+	events  EventBroker
+}
+
+// Returned by SetName if the name is already bound and the namespace's policy is NameFail.
+var ErrNameExists = errors.New("Name already bound")
+
+// Returned by SetAttr if the attributes of a name would exceed MaxAttrsSize.
+var ErrAttrsTooLarge = errors.New("Attributes too large")
+
+// The maximum total size of the keys and values of the attributes of a name.
+const MaxAttrsSize = 64 * 1024
+
+// Type NamePolicy determines what happens when a file is bound to a name that is already bound.
+type NamePolicy int
+
+const (
+	// The name is bound to the new file, releasing the file previously bound to it.
+	NameOverwrite NamePolicy = iota
+	// The name keeps its file and SetName returns ErrNameExists.
+	NameFail
+	// The new file is bound to the first free name of the sequence `name.1`, `name.2`, ...
+	NameVersion
+)
+
+// Type NamespaceOptions contains optional settings for a Namespace.
+// The zero value selects the default behavior.
+type NamespaceOptions struct {
+	// Maximum number of named files, or 0 for no limit.
+	MaxFiles int
+	// What to do when binding a name that is already bound. Defaults to NameOverwrite.
+	Policy NamePolicy
+}
+
+type namedFile struct {
+	name  string
+	file  File
+	attrs map[string]string // Attributes set by SetAttr, if any
+}
+
+// Returns an empty namespace for files of `storage`.
+func NewNamespace(storage FileStorage, opts NamespaceOptions) *Namespace {
+	return &Namespace{storage: storage, opts: opts, names: make(map[string]*list.Element)}
+}
+
+// Returns the storage the named files belong to.
+func (n *Namespace) Storage() FileStorage {
+	return n.storage
+}
+
+// Binds `name` to `file`. If the name is already bound, the namespace's policy decides whether it
+// is rebound, the call fails with ErrNameExists, or a versioned name is bound instead. The namespace
+// holds its own handle to the file, so the caller remains responsible for disposing `file`. If this
+// exceeds MaxFiles, the least recently used names are removed.
+func (n *Namespace) SetName(name string, file File) error {
+	_, err := n.Bind(name, file)
+	return err
+}
+
+// Like SetName, but returns the name the file was actually bound to, which differs from `name`
+// if the policy is NameVersion and `name` is already bound.
+func (n *Namespace) Bind(name string, file File) (string, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if e := n.names[name]; e != nil {
+		switch n.opts.Policy {
+		case NameFail:
+			return "", ErrNameExists
+		case NameVersion:
+			name = n.nextVersion(name)
+		default:
+			nf := e.Value.(*namedFile)
+			n.publish(EventUnnamed, nf)
+			nf.file.Dispose()
+			nf.file, nf.attrs = file.Duplicate(), nil
+			n.order.MoveToBack(e)
+			n.publish(EventNamed, nf)
+			return name, nil
+		}
+	}
+	nf := &namedFile{name: name, file: file.Duplicate()}
+	n.names[name] = n.order.PushBack(nf)
+	i := sort.SearchStrings(n.sorted, name)
+	n.sorted = append(n.sorted, "")
+	copy(n.sorted[i+1:], n.sorted[i:])
+	n.sorted[i] = name
+	n.publish(EventNamed, nf)
+	for n.opts.MaxFiles > 0 && len(n.names) > n.opts.MaxFiles {
+		n.remove(n.order.Front())
+	}
+	return name, nil
+}
+
+// Returns the first name of the sequence `name.1`, `name.2`, ... that isn't bound.
+func (n *Namespace) nextVersion(name string) string {
+	for i := 1; ; i++ {
+		if versioned := fmt.Sprintf("%v.%d", name, i); n.names[versioned] == nil {
+			return versioned
+		}
+	}
+}
+
+// Returns a new handle to the file bound to `name`, which must be disposed by the caller, and
+// marks the name as recently used. Returns ErrNotFound if the name isn't bound.
+func (n *Namespace) Get(name string) (File, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	e := n.names[name]
+	if e == nil {
+		return nil, ErrNotFound
+	}
+	n.order.MoveToBack(e)
+	return e.Value.(*namedFile).file.Duplicate(), nil
+}
+
+// Removes `name` and releases the file bound to it. Returns false if the name wasn't bound.
+func (n *Namespace) Remove(name string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	e := n.names[name]
+	if e == nil {
+		return false
+	}
+	n.remove(e)
+	return true
+}
+
+func (n *Namespace) remove(e *list.Element) {
+	nf := n.order.Remove(e).(*namedFile)
+	delete(n.names, nf.name)
+	i := sort.SearchStrings(n.sorted, nf.name)
+	n.sorted = append(n.sorted[:i], n.sorted[i+1:]...)
+	n.publish(EventUnnamed, nf)
+	nf.file.Dispose()
+}
+
+// Subscribes to the naming events of the namespace, i.e. EventNamed and EventUnnamed, which are
+// delivered like storage events (see FileStorage.Subscribe). Names removed because MaxFiles is
+// exceeded are reported as well.
+func (n *Namespace) Subscribe(bufferSize int) *Subscription {
+	return n.events.Subscribe(bufferSize)
+}
+
+// Must happen while mutex is held.
+func (n *Namespace) publish(typ EventType, nf *namedFile) {
+	n.events.Publish(Event{Type: typ, Key: nf.file.Key(), Size: nf.file.Size(), Name: nf.name})
+}
+
+// Sets the attribute `attr` of `name` to `value`. Attributes are small pieces of metadata, like
+// tags or a description, kept with the name and not affecting the file's key. Rebinding or removing
+// the name removes its attributes. Returns ErrNotFound if the name isn't bound, and ErrAttrsTooLarge
+// if the attributes of the name would exceed MaxAttrsSize.
+func (n *Namespace) SetAttr(name, attr, value string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	e := n.names[name]
+	if e == nil {
+		return ErrNotFound
+	}
+	nf := e.Value.(*namedFile)
+	size := len(attr) + len(value)
+	for k, v := range nf.attrs {
+		if k != attr {
+			size += len(k) + len(v)
+		}
+	}
+	if size > MaxAttrsSize {
+		return ErrAttrsTooLarge
+	}
+	if nf.attrs == nil {
+		nf.attrs = make(map[string]string)
+	}
+	nf.attrs[attr] = value
+	return nil
+}
+
+// Returns the value of the attribute `attr` of `name`. Returns ErrNotFound if the name isn't
+// bound or has no such attribute.
+func (n *Namespace) GetAttr(name, attr string) (string, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	e := n.names[name]
+	if e == nil {
+		return "", ErrNotFound
+	}
+	value, ok := e.Value.(*namedFile).attrs[attr]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+// Removes the attribute `attr` of `name`. Returns false if there was no such attribute.
+func (n *Namespace) RemoveAttr(name, attr string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	e := n.names[name]
+	if e == nil {
+		return false
+	}
+	nf := e.Value.(*namedFile)
+	if _, ok := nf.attrs[attr]; !ok {
+		return false
+	}
+	delete(nf.attrs, attr)
+	return true
+}
+
+// Returns the attributes of `name` in lexical order. Returns ErrNotFound if the name isn't bound.
+func (n *Namespace) ListAttrs(name string) ([]string, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	e := n.names[name]
+	if e == nil {
+		return nil, ErrNotFound
+	}
+	attrs := e.Value.(*namedFile).attrs
+	result := make([]string, 0, len(attrs))
+	for attr := range attrs {
+		result = append(result, attr)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Returns the bound names in lexical order.
+func (n *Namespace) Names() []string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return append([]string(nil), n.sorted...)
+}
+
+// Returns the number of bound names.
+func (n *Namespace) Len() int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return len(n.names)
+}
+
+// Removes all names and releases the files bound to them.
+func (n *Namespace) Clear() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for n.order.Len() > 0 {
+		n.remove(n.order.Front())
+	}
+}
+
+// Type InventoryEntry describes a named file, as reported by Inventory.
+type InventoryEntry struct {
+	Name   string
+	Key    SKey
+	Size   int64
+	Chunks int64 // Number of chunks, or 1 if the file isn't chunked
+}
+
+func (e InventoryEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name   string `json:"name"`
+		Key    string `json:"key"`
+		Size   int64  `json:"size"`
+		Chunks int64  `json:"chunks"`
+	}{e.Name, e.Key.String(), e.Size, e.Chunks})
+}
+
+// The number of entries Inventory collects at a time.
+const inventoryBatchSize = 256
+
+// Calls `f` for each named file in lexical order of the names, until `f` returns false. Entries
+// are collected in small batches, continuing after the last name reported, so that memory use
+// doesn't grow with the number of names and the files needn't be held while iterating. Each entry
+// is consistent by itself. Names bound or rebound concurrently are reported if they come after the
+// last name reported, names removed concurrently are skipped if they haven't been collected yet.
+// The namespace isn't locked while `f` runs, and the names aren't marked as used.
+func (n *Namespace) Inventory(f func(e InventoryEntry) bool) {
+	var batch []InventoryEntry
+	for cursor, first := "", true; ; first = false {
+		batch = n.inventoryBatch(cursor, first, batch[:0])
+		for _, e := range batch {
+			if !f(e) {
+				return
+			}
+		}
+		if len(batch) < inventoryBatchSize {
+			return
+		}
+		cursor = batch[len(batch)-1].Name
+	}
+}
+
+// Appends the entries of up to inventoryBatchSize names following `after`, or of the first names
+// if `first` is set, to `batch`.
+func (n *Namespace) inventoryBatch(after string, first bool, batch []InventoryEntry) []InventoryEntry {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	i := 0
+	if !first {
+		i = sort.Search(len(n.sorted), func(i int) bool { return n.sorted[i] > after })
+	}
+	for _, name := range n.sorted[i:min(i+inventoryBatchSize, len(n.sorted))] {
+		file := n.names[name].Value.(*namedFile).file
+		batch = append(batch, InventoryEntry{Name: name, Key: file.Key(), Size: file.Size(), Chunks: file.NumChunks()})
+	}
+	return batch
+}
+
+// Writes the inventory of the namespace (see Inventory) to `w`, one entry per line of JSON.
+func (n *Namespace) WriteInventory(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	var err error
+	n.Inventory(func(e InventoryEntry) bool {
+		err = enc.Encode(e)
+		return err == nil
+	})
+	return err
+}
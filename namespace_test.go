@@ -0,0 +1,347 @@
+package cafs_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestNamespaceMaxFiles(t *testing.T) {
+	s := ram.NewRamStorage(4 * 1024 * 1024)
+	ns := NewNamespace(s, NamespaceOptions{MaxFiles: 3})
+	shared := make([]byte, 64*1024)
+	rand.Read(shared)
+
+	// All files share their beginning, but end in unique data
+	chunkKeys := func(f File) map[SKey]bool {
+		result := make(map[SKey]bool)
+		iter := f.Chunks()
+		defer iter.Dispose()
+		for iter.Next() {
+			result[iter.Key()] = true
+		}
+		return result
+	}
+	var keys []SKey
+	var chunks []map[SKey]bool
+	for i := 0; i < 5; i++ {
+		unique := make([]byte, 64*1024)
+		rand.Read(unique)
+		temp := s.Create(fmt.Sprintf("File %d", i))
+		_, _ = temp.Write(shared)
+		_, _ = temp.Write(unique)
+		if err := temp.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f := temp.File()
+		temp.Dispose()
+		if err := ns.SetName(fmt.Sprintf("file-%d", i), f); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, f.Key())
+		chunks = append(chunks, chunkKeys(f))
+		f.Dispose()
+
+		// Using a name protects it from being evicted next
+		if i == 3 {
+			g, err := ns.Get("file-2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			g.Dispose()
+		}
+	}
+
+	if names := ns.Names(); fmt.Sprint(names) != "[file-2 file-3 file-4]" {
+		t.Errorf("Unexpected names after exceeding cap: %v", names)
+	}
+	if _, err := ns.Get("file-0"); err != ErrNotFound {
+		t.Errorf("Expected evicted name to be gone, got %v", err)
+	}
+
+	// Chunks only referenced by files that lost their names are reclaimed
+	s.FreeCache()
+	retained := make(map[SKey]bool)
+	for i := 2; i < 5; i++ {
+		for key := range chunks[i] {
+			retained[key] = true
+		}
+	}
+	for i, fileChunks := range chunks {
+		for key := range fileChunks {
+			f, err := s.Get(&key)
+			if retained[key] != (err == nil) {
+				t.Errorf("File %d, chunk %v: retained=%v, but got %v", i, key, retained[key], err)
+			}
+			if err == nil {
+				f.Dispose()
+			}
+		}
+		if f, err := s.Get(&keys[i]); (i >= 2) != (err == nil) {
+			t.Errorf("File %d: got %v", i, err)
+		} else if err == nil {
+			f.Dispose()
+		}
+	}
+
+	ns.Clear()
+	s.FreeCache()
+	if ui := s.GetUsageInfo(); ui.Used != 0 {
+		t.Errorf("Expected storage to be empty after clearing the namespace: %v", ui)
+	}
+}
+
+func TestNamespacePolicy(t *testing.T) {
+	for _, policy := range []NamePolicy{NameOverwrite, NameFail, NameVersion} {
+		s := ram.NewRamStorage(1024 * 1024)
+		ns := NewNamespace(s, NamespaceOptions{Policy: policy})
+		var keys []SKey
+		for i := 0; i < 3; i++ {
+			f := addRandomData(t, s, 1000+i)
+			keys = append(keys, f.Key())
+			name, err := ns.Bind("name", f)
+			f.Dispose()
+			switch {
+			case i == 0 || policy == NameOverwrite:
+				if err != nil || name != "name" {
+					t.Errorf("Policy %v, file %d: got %q, %v", policy, i, name, err)
+				}
+			case policy == NameFail:
+				if err != ErrNameExists {
+					t.Errorf("Policy %v, file %d: expected ErrNameExists, got %q, %v", policy, i, name, err)
+				}
+			case policy == NameVersion:
+				if expected := fmt.Sprintf("name.%d", i); err != nil || name != expected {
+					t.Errorf("Policy %v, file %d: expected %q, got %q, %v", policy, i, expected, name, err)
+				}
+			}
+		}
+
+		expected := map[NamePolicy]map[string]SKey{
+			NameOverwrite: {"name": keys[2]},
+			NameFail:      {"name": keys[0]},
+			NameVersion:   {"name": keys[0], "name.1": keys[1], "name.2": keys[2]},
+		}[policy]
+		if ns.Len() != len(expected) {
+			t.Errorf("Policy %v: unexpected names %v", policy, ns.Names())
+		}
+		for name, key := range expected {
+			if f, err := ns.Get(name); err != nil {
+				t.Errorf("Policy %v, name %v: %v", policy, name, err)
+			} else {
+				if f.Key() != key {
+					t.Errorf("Policy %v, name %v: bound to wrong file", policy, name)
+				}
+				f.Dispose()
+			}
+		}
+
+		// Only the files still bound are retained
+		s.FreeCache()
+		for _, key := range keys {
+			bound := false
+			for _, k := range expected {
+				bound = bound || k == key
+			}
+			if f, err := s.Get(&key); bound != (err == nil) {
+				t.Errorf("Policy %v, file %v: bound=%v, but got %v", policy, key, bound, err)
+			} else if err == nil {
+				f.Dispose()
+			}
+		}
+		ns.Clear()
+		s.FreeCache()
+		if ui := s.GetUsageInfo(); ui.Used != 0 {
+			t.Errorf("Policy %v: expected storage to be empty after clearing the namespace: %v", policy, ui)
+		}
+	}
+}
+
+func TestNamespaceAttrs(t *testing.T) {
+	s := ram.NewRamStorage(1024 * 1024)
+	ns := NewNamespace(s, NamespaceOptions{})
+	defer ns.Clear()
+	f := addRandomData(t, s, 1000)
+	defer f.Dispose()
+	if err := ns.SetAttr("doc", "schema", "1"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for unbound name, got %v", err)
+	}
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(ns.SetName("doc", f))
+	check(ns.SetAttr("doc", "schema", "1"))
+	check(ns.SetAttr("doc", "description", "A document"))
+	check(ns.SetAttr("doc", "schema", "2"))
+
+	if v, err := ns.GetAttr("doc", "schema"); err != nil || v != "2" {
+		t.Errorf("Expected schema 2, got %q, %v", v, err)
+	}
+	if _, err := ns.GetAttr("doc", "tags"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for missing attribute, got %v", err)
+	}
+	if attrs, err := ns.ListAttrs("doc"); err != nil || fmt.Sprint(attrs) != "[description schema]" {
+		t.Errorf("Unexpected attributes %v, %v", attrs, err)
+	}
+	if g, err := ns.Get("doc"); err != nil || g.Key() != f.Key() {
+		t.Errorf("Attributes must not affect the file: %v", err)
+	} else {
+		g.Dispose()
+	}
+
+	if err := ns.SetAttr("doc", "blob", strings.Repeat("x", MaxAttrsSize)); err != ErrAttrsTooLarge {
+		t.Errorf("Expected ErrAttrsTooLarge, got %v", err)
+	}
+	if !ns.RemoveAttr("doc", "description") || ns.RemoveAttr("doc", "description") {
+		t.Errorf("Expected attribute to be removed once")
+	}
+
+	// Rebinding the name clears its attributes
+	check(ns.SetName("doc", f))
+	if attrs, err := ns.ListAttrs("doc"); err != nil || len(attrs) != 0 {
+		t.Errorf("Expected no attributes after rebinding, got %v, %v", attrs, err)
+	}
+}
+
+func TestNamespaceEvents(t *testing.T) {
+	s := ram.NewRamStorage(1024 * 1024)
+	ns := NewNamespace(s, NamespaceOptions{MaxFiles: 2})
+	sub := ns.Subscribe(16)
+	defer sub.Close()
+	f, g := addRandomData(t, s, 100), addRandomData(t, s, 200)
+	defer f.Dispose()
+	defer g.Dispose()
+
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(ns.SetName("a", f))
+	check(ns.SetName("a", g)) // Rebinding releases f
+	check(ns.SetName("b", f))
+	check(ns.SetName("c", f)) // Exceeds MaxFiles, removing a
+	ns.Remove("b")
+	ns.Clear()
+
+	named := func(name string, file File) Event {
+		return Event{Type: EventNamed, Key: file.Key(), Size: file.Size(), Name: name}
+	}
+	unnamed := func(name string, file File) Event {
+		return Event{Type: EventUnnamed, Key: file.Key(), Size: file.Size(), Name: name}
+	}
+	expected := []Event{
+		named("a", f), unnamed("a", f), named("a", g), named("b", f),
+		named("c", f), unnamed("a", g), unnamed("b", f), unnamed("c", f),
+	}
+	for i, e := range expected {
+		select {
+		case actual := <-sub.C:
+			if actual != e {
+				t.Errorf("Event %d: expected %+v, got %+v", i, e, actual)
+			}
+		default:
+			t.Fatalf("Event %d missing, expected %+v", i, e)
+		}
+	}
+	if sub.Dropped() != 0 {
+		t.Errorf("%d events dropped", sub.Dropped())
+	}
+}
+
+func TestNamespaceInventory(t *testing.T) {
+	s := ram.NewRamStorage(4 * 1024 * 1024)
+	ns := NewNamespace(s, NamespaceOptions{})
+	defer ns.Clear()
+	var expected []InventoryEntry
+	for i, size := range []int{0, 100, 300000} {
+		f := addRandomData(t, s, size)
+		name := fmt.Sprintf("file-%d", i)
+		if err := ns.SetName(name, f); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, InventoryEntry{Name: name, Key: f.Key(), Size: int64(size), Chunks: f.NumChunks()})
+		f.Dispose()
+	}
+	if expected[2].Chunks < 2 {
+		t.Fatalf("Expected a chunked file, got %+v", expected[2])
+	}
+
+	var entries []InventoryEntry
+	ns.Inventory(func(e InventoryEntry) bool {
+		entries = append(entries, e)
+		return true
+	})
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d entries, got %v", len(expected), entries)
+	}
+	for i := range entries {
+		if entries[i] != expected[i] {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, expected[i], entries[i])
+		}
+	}
+
+	// Iteration stops early
+	entries = entries[:0]
+	ns.Inventory(func(e InventoryEntry) bool {
+		entries = append(entries, e)
+		return len(entries) < 2
+	})
+	if len(entries) != 2 {
+		t.Errorf("Unexpected entries: %v", entries)
+	}
+
+	// Large namespaces are iterated in batches, which reflect names bound and removed meanwhile
+	large := NewNamespace(s, NamespaceOptions{})
+	defer large.Clear()
+	f := addRandomData(t, s, 10)
+	for i := 0; i < 1000; i++ {
+		if err := large.SetName(fmt.Sprintf("%04d", i), f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var names []string
+	large.Inventory(func(e InventoryEntry) bool {
+		if len(names) == 0 {
+			large.Remove("0900")
+			_ = large.SetName("1000", f)
+		}
+		if len(names) > 0 && e.Name <= names[len(names)-1] {
+			t.Fatalf("Name %v reported after %v", e.Name, names[len(names)-1])
+		}
+		names = append(names, e.Name)
+		return true
+	})
+	f.Dispose()
+	if len(names) != 1000 || names[len(names)-1] != "1000" {
+		t.Errorf("Expected 1000 names ending in 1000, got %d ending in %v", len(names), names[len(names)-1])
+	}
+
+	// The written inventory lacks removed names
+	ns.Remove("file-1")
+	var buf bytes.Buffer
+	if err := ns.WriteInventory(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(&buf)
+	var lines []map[string]interface{}
+	for dec.More() {
+		var m map[string]interface{}
+		if err := dec.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, m)
+	}
+	if len(lines) != 2 || lines[1]["name"] != "file-2" || lines[1]["key"] != expected[2].Key.String() ||
+		lines[1]["size"] != float64(expected[2].Size) || lines[1]["chunks"] != float64(expected[2].Chunks) {
+		t.Errorf("Unexpected inventory lines: %v", lines)
+	}
+}
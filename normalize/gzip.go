@@ -0,0 +1,100 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package normalize
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+var errTrailingData = errors.New("Trailing data after gzip stream")
+
+// Normalizer Gzip stores single-member gzip streams in decompressed form. The original stream
+// can be restored if it was produced by a compressor equivalent to compress/gzip at one of its
+// compression levels.
+var Gzip Normalizer = gzipNormalizer{}
+
+type gzipNormalizer struct{}
+
+// Type gzipRecipe contains the parameters for recompressing a gzip stream.
+type gzipRecipe struct {
+	Level   int    `json:"level"`
+	Name    string `json:"name,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	Extra   []byte `json:"extra,omitempty"`
+	ModTime int64  `json:"mtime"` // Seconds since the epoch, or 0 if unset
+	OS      byte   `json:"os"`
+}
+
+// Compression levels to try, most common first
+var gzipLevels = []int{gzip.DefaultCompression, gzip.BestCompression, gzip.BestSpeed, 2, 3, 4, 5, 7, 8}
+
+func (gzipNormalizer) Name() string {
+	return "gzip"
+}
+
+func (gzipNormalizer) Normalize(w io.Writer, r io.Reader) ([][]byte, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	zr.Multistream(false)
+	if _, err := io.Copy(w, zr); err != nil {
+		return nil, err
+	}
+	if err := zr.Close(); err != nil {
+		return nil, err
+	}
+	// Trailing data after the first member can't be reproduced
+	if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+		return nil, errTrailingData
+	}
+	recipe := gzipRecipe{Name: zr.Name, Comment: zr.Comment, Extra: zr.Extra, OS: zr.OS}
+	if !zr.ModTime.IsZero() {
+		recipe.ModTime = zr.ModTime.Unix()
+	}
+	var recipes [][]byte
+	for _, level := range gzipLevels {
+		recipe.Level = level
+		if b, err := json.Marshal(&recipe); err == nil {
+			recipes = append(recipes, b)
+		}
+	}
+	return recipes, nil
+}
+
+func (gzipNormalizer) Restore(w io.Writer, canonical io.Reader, recipe []byte) error {
+	var params gzipRecipe
+	if err := json.Unmarshal(recipe, &params); err != nil {
+		return err
+	}
+	zw, err := gzip.NewWriterLevel(w, params.Level)
+	if err != nil {
+		return err
+	}
+	zw.Name, zw.Comment, zw.Extra, zw.OS = params.Name, params.Comment, params.Extra, params.OS
+	if params.ModTime != 0 {
+		zw.ModTime = time.Unix(params.ModTime, 0)
+	}
+	if _, err := io.Copy(zw, canonical); err != nil {
+		return err
+	}
+	return zw.Close()
+}
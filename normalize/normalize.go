@@ -0,0 +1,307 @@
+//	BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//	Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//	This program is free software: you can redistribute it and/or modify
+//	it under the terms of the GNU General Public License as published by
+//	the Free Software Foundation, either version 3 of the License, or
+//	(at your option) any later version.
+//
+//	This program is distributed in the hope that it will be useful,
+//	but WITHOUT ANY WARRANTY; without even the implied warranty of
+//	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//	GNU General Public License for more details.
+//
+//	You should have received a copy of the GNU General Public License
+//	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Package normalize stores content in a canonical form, so that logically identical content
+// is de-duplicated even if it is encoded differently, e.g. compressed and uncompressed. The
+// original bytes are restored exactly on read.
+package normalize
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"io"
+)
+
+// Returned by Open if restoring the original content failed to reproduce it exactly.
+var ErrRestoreMismatch = errors.New("Restored content doesn't match original")
+
+// Returned by Open if a descriptor names a normalizer that wasn't passed.
+var ErrUnknownNormalizer = errors.New("Unknown normalizer")
+
+// Interface Normalizer converts content into a canonical form and back.
+type Normalizer interface {
+	// Identifies the normalizer in descriptors.
+	Name() string
+	// Writes the canonical form of the content read from `r` into `w`. Returns candidate
+	// recipes for restoring the original, or an error if the content can't be normalized.
+	Normalize(w io.Writer, r io.Reader) (recipes [][]byte, err error)
+	// Writes the original content to `w`, given its canonical form and a recipe.
+	Restore(w io.Writer, canonical io.Reader, recipe []byte) error
+}
+
+// Descriptor files start with this byte sequence.
+const descriptorMagic = "CAFS-NORMALIZED-1\n"
+
+// Type descriptor is stored in place of normalized content and refers to its canonical form.
+// Raw content that happens to start with descriptorMagic is escaped by a descriptor without
+// normalizer, whose canonical form is the content itself.
+type descriptor struct {
+	Normalizer string    `json:"normalizer"`
+	Recipe     []byte    `json:"recipe"`
+	Canonical  cafs.SKey `json:"canonical"`
+	Original   cafs.SKey `json:"original"` // SHA-256 of the original content
+	Size       int64     `json:"size"`
+}
+
+// Stores the content read from `r` into `storage`. Each normalizer is tried in turn. If one
+// of them produces a canonical form from which the exact original can be restored, the canonical
+// form is stored and the returned file is a small descriptor referring to it. Otherwise, the
+// content is stored as is. Either way, Open returns the original content.
+//
+// The original is stored temporarily during normalization. It is not locked afterwards and will
+// be evicted when space is needed. The canonical form is locked for as long as the returned file
+// (or any duplicate of it) isn't disposed.
+func Ingest(storage cafs.FileStorage, r io.Reader, info string, normalizers ...Normalizer) (cafs.File, error) {
+	raw, err := store(storage, info, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range normalizers {
+		if desc, err := normalize(storage, raw, info, n); err != nil {
+			raw.Dispose()
+			return nil, err
+		} else if desc != nil {
+			raw.Dispose()
+			return desc, nil
+		}
+	}
+	if hasMagic(raw) {
+		// Mustn't be mistaken for a descriptor
+		desc, err := storeDescriptor(storage, info, raw, &descriptor{
+			Canonical: raw.Key(),
+			Original:  raw.Key(),
+			Size:      raw.Size(),
+		})
+		if err != nil {
+			raw.Dispose()
+		}
+		return desc, err
+	}
+	return raw, nil
+}
+
+// Tries to normalize `raw` using `n`. Returns the descriptor file on success, or nil if the
+// content can't be normalized faithfully.
+func normalize(storage cafs.FileStorage, raw cafs.File, info string, n Normalizer) (cafs.File, error) {
+	var recipes [][]byte
+	canonical, err := store(storage, info+" ("+n.Name()+" canonical)", func(w io.Writer) error {
+		r := raw.Open()
+		defer r.Close()
+		var err error
+		recipes, err = n.Normalize(w, bufio.NewReader(r))
+		return err
+	})
+	if err != nil {
+		// Not normalizable by n. Storage errors will show up again when storing the descriptor.
+		return nil, nil
+	}
+
+	for _, recipe := range recipes {
+		r := raw.Open()
+		c := canonical.Open()
+		cw := &compareWriter{r: bufio.NewReader(r)}
+		err := n.Restore(cw, c, recipe)
+		if err == nil {
+			err = cw.end()
+		}
+		c.Close()
+		r.Close()
+		if err != nil {
+			continue
+		}
+
+		desc, err := storeDescriptor(storage, info, canonical, &descriptor{
+			Normalizer: n.Name(),
+			Recipe:     recipe,
+			Canonical:  canonical.Key(),
+			Original:   raw.Key(),
+			Size:       raw.Size(),
+		})
+		if err != nil {
+			canonical.Dispose()
+		}
+		return desc, err
+	}
+	canonical.Dispose()
+	return nil, nil
+}
+
+// Stores `desc` and returns a file that keeps `canonical` locked along with the descriptor.
+// Takes over the handle to `canonical` on success.
+func storeDescriptor(storage cafs.FileStorage, info string, canonical cafs.File, desc *descriptor) (cafs.File, error) {
+	file, err := store(storage, info, func(w io.Writer) error {
+		if _, err := io.WriteString(w, descriptorMagic); err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(desc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &descriptorFile{File: file, canonical: canonical}, nil
+}
+
+// Type descriptorFile is a handle to a descriptor that also holds a handle to its canonical
+// form, so that the latter isn't evicted while the descriptor is in use.
+type descriptorFile struct {
+	cafs.File
+	canonical cafs.File
+}
+
+func (f *descriptorFile) Dispose() {
+	f.File.Dispose()
+	f.canonical.Dispose()
+}
+
+func (f *descriptorFile) Duplicate() cafs.File {
+	return &descriptorFile{File: f.File.Duplicate(), canonical: f.canonical.Duplicate()}
+}
+
+// Type verbatim restores escaped raw content, which is its own canonical form.
+type verbatim struct{}
+
+func (verbatim) Name() string {
+	return ""
+}
+
+func (verbatim) Normalize(w io.Writer, r io.Reader) ([][]byte, error) {
+	_, err := io.Copy(w, r)
+	return [][]byte{nil}, err
+}
+
+func (verbatim) Restore(w io.Writer, canonical io.Reader, recipe []byte) error {
+	_, err := io.Copy(w, canonical)
+	return err
+}
+
+// Type compareWriter checks that the bytes written to it match those read from r.
+type compareWriter struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+var errDiffers = errors.New("Content differs")
+
+func (w *compareWriter) Write(b []byte) (int, error) {
+	if cap(w.buf) < len(b) {
+		w.buf = make([]byte, len(b))
+	}
+	buf := w.buf[:len(b)]
+	if _, err := io.ReadFull(w.r, buf); err != nil || !bytes.Equal(buf, b) {
+		return 0, errDiffers
+	}
+	return len(b), nil
+}
+
+func (w *compareWriter) end() error {
+	if _, err := w.r.ReadByte(); err != io.EOF {
+		return errDiffers
+	}
+	return nil
+}
+
+func store(storage cafs.FileStorage, info string, write func(w io.Writer) error) (cafs.File, error) {
+	temp := storage.Create(info)
+	defer temp.Dispose()
+	if err := write(temp); err != nil {
+		return nil, err
+	}
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	return temp.File(), nil
+}
+
+// Returns true if the content of `file` starts with descriptorMagic.
+func hasMagic(file cafs.File) bool {
+	r := file.Open()
+	defer r.Close()
+	magic := make([]byte, len(descriptorMagic))
+	_, err := io.ReadFull(r, magic)
+	return err == nil && string(magic) == descriptorMagic
+}
+
+// Reads the descriptor from `file`, or returns nil if it isn't a descriptor.
+func readDescriptor(file cafs.File) (*descriptor, error) {
+	r := file.Open()
+	defer r.Close()
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(descriptorMagic)); err != nil || string(magic) != descriptorMagic {
+		return nil, nil
+	}
+	br.Discard(len(descriptorMagic))
+	desc := new(descriptor)
+	if err := json.NewDecoder(br).Decode(desc); err != nil {
+		return nil, fmt.Errorf("Invalid descriptor %v: %v", file.Key(), err)
+	}
+	return desc, nil
+}
+
+// Returns a reader over the original content of the file stored as `key` by Ingest. The
+// normalizers used for ingesting it must be passed. The restored content is verified while
+// it is read and ErrRestoreMismatch is returned at the end if it doesn't match the original.
+func Open(storage cafs.FileStorage, key *cafs.SKey, normalizers ...Normalizer) (io.ReadCloser, error) {
+	file, err := storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Dispose()
+	desc, err := readDescriptor(file)
+	if err != nil {
+		return nil, err
+	} else if desc == nil {
+		return file.Open(), nil
+	}
+
+	var n Normalizer
+	if desc.Normalizer == "" {
+		n = verbatim{}
+	}
+	for _, candidate := range normalizers {
+		if candidate.Name() == desc.Normalizer {
+			n = candidate
+		}
+	}
+	if n == nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownNormalizer, desc.Normalizer)
+	}
+	canonical, err := storage.Get(&desc.Canonical)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer canonical.Dispose()
+		c := canonical.Open()
+		defer c.Close()
+		h := sha256.New()
+		err := n.Restore(io.MultiWriter(pw, h), c, desc.Recipe)
+		if err == nil && !bytes.Equal(h.Sum(nil), desc.Original[:]) {
+			err = ErrRestoreMismatch
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
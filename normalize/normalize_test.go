@@ -0,0 +1,156 @@
+package normalize
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func compress(t *testing.T, data []byte, level int, name string) []byte {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Name = name
+	zw.ModTime = time.Unix(1500000000, 0)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func assertOriginal(t *testing.T, s cafs.FileStorage, key cafs.SKey, expected []byte) {
+	t.Helper()
+	r, err := Open(s, &key, Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, expected) {
+		t.Fatalf("Restored content differs from original")
+	}
+}
+
+func ingest(t *testing.T, s cafs.FileStorage, data []byte) cafs.File {
+	t.Helper()
+	f, err := Ingest(s, bytes.NewReader(data), "test", Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestGzip(t *testing.T) {
+	s := ram.NewRamStorage(64 << 20)
+	rgen := rand.New(rand.NewSource(1))
+	// Compressible, but not trivially
+	words := []string{"alpha ", "beta ", "gamma ", "delta ", "epsilon\n"}
+	var plain []byte
+	for len(plain) < 2<<20 {
+		plain = append(plain, words[rgen.Intn(len(words))]...)
+	}
+
+	plainFile := ingest(t, s, plain)
+	defer plainFile.Dispose()
+	if plainFile.Key() != cafs.SKey(sha256Sum(plain)) {
+		t.Errorf("Expected content that is not gzip-compressed to be stored as is")
+	}
+
+	for _, level := range []int{gzip.DefaultCompression, gzip.BestSpeed, gzip.BestCompression} {
+		compressed := compress(t, plain, level, "words.txt")
+		f := ingest(t, s, compressed)
+		// The descriptor refers to the same canonical content as the plain file
+		desc, err := readDescriptor(f)
+		if err != nil || desc == nil {
+			t.Fatalf("Expected level %d gzip to be normalized, got %v", level, err)
+		}
+		if desc.Canonical != plainFile.Key() {
+			t.Errorf("Expected canonical form to equal the uncompressed file")
+		}
+		assertOriginal(t, s, f.Key(), compressed)
+		f.Dispose()
+	}
+	s.FreeCache()
+	if ui := s.GetUsageInfo(); ui.Used > int64(len(plain))+int64(len(plain))/10 {
+		t.Errorf("Expected compressed versions to be de-duplicated: %v", ui)
+	}
+
+	// Streams that can't be reproduced are stored as is
+	huffman := compress(t, plain, gzip.HuffmanOnly, "")
+	trailing := append(compress(t, []byte("hello"), gzip.DefaultCompression, ""), "garbage"...)
+	for _, data := range [][]byte{huffman, trailing, {0x1f, 0x8b}} {
+		f := ingest(t, s, data)
+		if f.Key() != cafs.SKey(sha256Sum(data)) {
+			t.Errorf("Expected %d bytes to be stored as is", len(data))
+		}
+		assertOriginal(t, s, f.Key(), data)
+		f.Dispose()
+	}
+
+	// A descriptor can't be opened without its normalizer
+	f := ingest(t, s, compress(t, []byte("hello"), gzip.DefaultCompression, ""))
+	defer f.Dispose()
+	key := f.Key()
+	if _, err := Open(s, &key); err == nil {
+		t.Errorf("Expected error when opening without normalizer")
+	}
+}
+
+func sha256Sum(data []byte) [32]byte {
+	return sha256.Sum256(data)
+}
+
+func TestCanonicalLocked(t *testing.T) {
+	s := ram.NewRamStorage(4 << 20)
+	plain := bytes.Repeat([]byte("Highly compressible. "), 80000)
+	compressed := compress(t, plain, gzip.BestCompression, "")
+	f := ingest(t, s, compressed)
+	defer f.Dispose()
+	dup := f.Duplicate()
+	f.Dispose()
+	f = dup
+
+	// Filling the storage with other content must not evict the canonical form
+	rgen := rand.New(rand.NewSource(1))
+	for i := 0; i < 8; i++ {
+		data := make([]byte, 1<<20)
+		rgen.Read(data)
+		temp := s.Create("filler")
+		if _, err := temp.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := temp.Close(); err != nil {
+			t.Fatal(err)
+		}
+		temp.Dispose()
+	}
+	assertOriginal(t, s, f.Key(), compressed)
+}
+
+func TestEscapeMagic(t *testing.T) {
+	s := ram.NewRamStorage(1 << 20)
+	for _, data := range [][]byte{
+		[]byte(descriptorMagic),
+		[]byte(descriptorMagic + "not a descriptor"),
+		[]byte(descriptorMagic + `{"normalizer":"gzip","size":1}` + "\n"),
+	} {
+		f := ingest(t, s, data)
+		if f.Key() == cafs.SKey(sha256Sum(data)) {
+			t.Errorf("Expected content starting with the magic to be escaped: %q", data)
+		}
+		assertOriginal(t, s, f.Key(), data)
+		f.Dispose()
+	}
+}
@@ -0,0 +1,436 @@
+//	BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//	Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//	This program is free software: you can redistribute it and/or modify
+//	it under the terms of the GNU General Public License as published by
+//	the Free Software Foundation, either version 3 of the License, or
+//	(at your option) any later version.
+//
+//	This program is distributed in the hope that it will be useful,
+//	but WITHOUT ANY WARRANTY; without even the implied warranty of
+//	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//	GNU General Public License for more details.
+//
+//	You should have received a copy of the GNU General Public License
+//	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Package objectstore implements a storage that keeps all content durably in a remote object
+// store, like Amazon S3, using a local storage as a cache. Chunks are stored as individual
+// objects, so that content is de-duplicated across all users of the object store.
+package objectstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	. "github.com/indyjo/cafs"
+	"io"
+	"sync"
+	"time"
+)
+
+// Returned by Get if the content of an object doesn't match its key.
+var ErrCorruptObject = errors.New("Corrupt object")
+
+// Interface ObjectStore abstracts a remote object store. Objects are immutable once written:
+// an object stored under a name always has the same content. Implementations must be safe
+// for concurrent use.
+type ObjectStore interface {
+	// Stores an object. Storing an object that already exists has no effect.
+	Put(name string, data []byte) error
+	// Retrieves an object, or returns cafs.ErrNotFound if it doesn't exist.
+	Get(name string) ([]byte, error)
+	// Reports for each of the given names whether an object of that name exists. Stores with
+	// eventual consistency may report recently stored objects as missing.
+	Exists(names []string) ([]bool, error)
+}
+
+// Object types. Each object starts with one of these bytes. Data objects contain a chunk or
+// an unchunked file, list objects contain a sequence of (key, size as uvarint) pairs.
+const (
+	objectData = 'D'
+	objectList = 'L'
+)
+
+func objectName(key SKey) string {
+	return key.String()
+}
+
+// Type Options contains optional settings for an object storage.
+// The zero value selects the default behavior.
+type Options struct {
+	// The number of names passed to ObjectStore.Exists at once. Defaults to 100.
+	BatchSize int
+
+	// The number of times a failed object store operation is retried. Defaults to 3.
+	// Between attempts, the storage waits for Backoff (default 100ms), doubling the duration
+	// after each attempt. Chunks referenced by an existing list object are expected to exist
+	// and are retried on cafs.ErrNotFound as well, which compensates for eventual consistency.
+	Retries int
+	Backoff time.Duration
+}
+
+type objectStorage struct {
+	store ObjectStore
+	cache BoundedStorage
+	opts  Options
+
+	mutex    sync.Mutex
+	present  KeySet // Keys known to exist in the object store
+	uploads  int64
+	fetches  int64
+	uploaded int64 // Bytes
+	fetched  int64 // Bytes
+}
+
+// Returns a new storage keeping its content in `store` and caching it in `cache`.
+// Files are uploaded when their temporaries are closed. Files and chunks not found in the cache
+// are fetched from the object store.
+func NewObjectStorage(store ObjectStore, cache BoundedStorage, opts Options) BoundedStorage {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.Retries <= 0 {
+		opts.Retries = 3
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 100 * time.Millisecond
+	}
+	return &objectStorage{store: store, cache: cache, opts: opts}
+}
+
+// Calls f until it succeeds, retrying as configured. ErrNotFound is retried only if `mustExist` is set.
+func (s *objectStorage) retry(mustExist bool, f func() error) error {
+	backoff := s.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || (err == ErrNotFound && !mustExist) || attempt == s.opts.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *objectStorage) isPresent(key SKey) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.present.Contains(key)
+}
+
+func (s *objectStorage) markPresent(key SKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.present.Add(key)
+}
+
+func (s *objectStorage) put(key SKey, data []byte) error {
+	err := s.retry(false, func() error { return s.store.Put(objectName(key), data) })
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.present.Add(key)
+	s.uploads++
+	s.uploaded += int64(len(data))
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *objectStorage) get(key SKey, mustExist bool) (data []byte, err error) {
+	err = s.retry(mustExist, func() (err error) {
+		data, err = s.store.Get(objectName(key))
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || (data[0] != objectData && data[0] != objectList) {
+		return nil, fmt.Errorf("%v: %w", key, ErrCorruptObject)
+	}
+	s.mutex.Lock()
+	s.present.Add(key)
+	s.fetches++
+	s.fetched += int64(len(data))
+	s.mutex.Unlock()
+	return data, nil
+}
+
+// Returns those of `keys` not known to exist in the object store, checking in batches.
+func (s *objectStorage) missing(keys []SKey) ([]SKey, error) {
+	var unknown []SKey
+	for _, key := range keys {
+		if !s.isPresent(key) {
+			unknown = append(unknown, key)
+		}
+	}
+	var result []SKey
+	for len(unknown) > 0 {
+		batch := unknown
+		if len(batch) > s.opts.BatchSize {
+			batch = batch[:s.opts.BatchSize]
+		}
+		unknown = unknown[len(batch):]
+		names := make([]string, len(batch))
+		for i, key := range batch {
+			names[i] = objectName(key)
+		}
+		var exists []bool
+		err := s.retry(false, func() (err error) {
+			exists, err = s.store.Exists(names)
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range batch {
+			if exists[i] {
+				s.markPresent(key)
+			} else {
+				result = append(result, key)
+			}
+		}
+	}
+	return result, nil
+}
+
+// Uploads the chunks of `file` not yet present in the object store and then the file itself.
+// The list object is stored last, so that its existence implies the existence of all chunks.
+func (s *objectStorage) upload(file File) error {
+	if !file.IsChunked() {
+		if missing, err := s.missing([]SKey{file.Key()}); err != nil || len(missing) == 0 {
+			return err
+		}
+		return s.putData(file)
+	}
+
+	var keys []SKey
+	list := []byte{objectList}
+	chunks := file.Chunks()
+	defer chunks.Dispose()
+	for chunks.Next() {
+		key := chunks.Key()
+		keys = append(keys, key)
+		list = append(list, key[:]...)
+		list = binary.AppendUvarint(list, uint64(chunks.Size()))
+	}
+	if s.isPresent(file.Key()) {
+		return nil
+	}
+	missing, err := s.missing(append(keys, file.Key()))
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+	need := make(map[SKey]bool, len(missing))
+	for _, key := range missing {
+		need[key] = true
+	}
+	chunks = file.Chunks()
+	defer chunks.Dispose()
+	for chunks.Next() {
+		if key := chunks.Key(); need[key] {
+			delete(need, key)
+			chunk := chunks.File()
+			err := s.putData(chunk)
+			chunk.Dispose()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return s.put(file.Key(), list)
+}
+
+func (s *objectStorage) putData(file File) error {
+	r := file.Open()
+	defer r.Close()
+	var buf bytes.Buffer
+	buf.WriteByte(objectData)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return err
+	}
+	return s.put(file.Key(), buf.Bytes())
+}
+
+type chunkRef struct {
+	key  SKey
+	size int64
+}
+
+func decodeList(key SKey, data []byte) ([]chunkRef, error) {
+	var result []chunkRef
+	data = data[1:]
+	for len(data) > 0 {
+		var c chunkRef
+		if len(data) < len(c.key) {
+			return nil, fmt.Errorf("%v: %w", key, ErrCorruptObject)
+		}
+		copy(c.key[:], data)
+		data = data[len(c.key):]
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("%v: %w", key, ErrCorruptObject)
+		}
+		c.size = int64(v)
+		data = data[n:]
+		result = append(result, c)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%v: %w", key, ErrCorruptObject)
+	}
+	return result, nil
+}
+
+func (s *objectStorage) Create(info string) Temporary {
+	return s.CreateWithOptions(info, CreateOptions{})
+}
+
+func (s *objectStorage) CreateWithOptions(info string, opts CreateOptions) Temporary {
+	return &temporary{Temporary: s.cache.CreateWithOptions(info, opts), storage: s}
+}
+
+// Type temporary uploads the file to the object store when closed.
+type temporary struct {
+	Temporary
+	storage *objectStorage
+}
+
+// Closes the temporary and uploads its content. Returns an error if the upload failed, in
+// which case the file must not be used.
+func (t *temporary) Close() error {
+	if err := t.Temporary.Close(); err != nil {
+		return err
+	}
+	file := t.Temporary.File()
+	defer file.Dispose()
+	return t.storage.upload(file)
+}
+
+func (s *objectStorage) Get(key *SKey) (File, error) {
+	if f, err := s.cache.Get(key); err != ErrNotFound {
+		return f, err
+	}
+	return s.fetch(*key, false, "")
+}
+
+// Fetches a file or chunk from the object store into the cache.
+func (s *objectStorage) fetch(key SKey, mustExist bool, info string) (File, error) {
+	data, err := s.get(key, mustExist)
+	if err != nil {
+		return nil, err
+	}
+	if info == "" {
+		info = "fetched " + key.String()
+	}
+	if data[0] == objectData {
+		return s.cacheContent(key, info, CreateOptions{}, func(w io.Writer) error {
+			_, err := w.Write(data[1:])
+			return err
+		})
+	}
+	chunks, err := decodeList(key, data)
+	if err != nil {
+		return nil, err
+	}
+	// Reproduce the original chunk boundaries
+	hints := make([]int64, 0, len(chunks))
+	var pos int64
+	for _, c := range chunks {
+		pos += c.size
+		hints = append(hints, pos)
+	}
+	return s.cacheContent(key, info, CreateOptions{BoundaryHints: hints}, func(w io.Writer) error {
+		for i, c := range chunks {
+			chunk, err := s.cache.Get(&c.key)
+			if err == ErrNotFound {
+				chunk, err = s.fetch(c.key, true, fmt.Sprintf("%v #%d", info, i))
+			}
+			if err != nil {
+				return err
+			}
+			r := chunk.Open()
+			_, err = io.Copy(w, r)
+			r.Close()
+			chunk.Dispose()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Writes content into a new temporary of the cache and checks that the result matches `key`.
+func (s *objectStorage) cacheContent(key SKey, info string, opts CreateOptions, write func(w io.Writer) error) (File, error) {
+	temp := s.cache.CreateWithOptions(info, opts)
+	defer temp.Dispose()
+	if err := write(temp); err != nil {
+		return nil, err
+	}
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	file := temp.File()
+	if file.Key() != key {
+		file.Dispose()
+		return nil, fmt.Errorf("%v: %w", key, ErrCorruptObject)
+	}
+	return file, nil
+}
+
+// Returns metadata from the cache, or from the object store if the file isn't cached.
+func (s *objectStorage) StatByKey(key *SKey) (FileStat, error) {
+	if stat, err := s.cache.StatByKey(key); err != ErrNotFound {
+		return stat, err
+	}
+	data, err := s.get(*key, false)
+	if err != nil {
+		return FileStat{}, err
+	}
+	if data[0] == objectData {
+		return FileStat{Size: int64(len(data) - 1), NumChunks: 1}, nil
+	}
+	chunks, err := decodeList(*key, data)
+	if err != nil {
+		return FileStat{}, err
+	}
+	stat := FileStat{NumChunks: int64(len(chunks))}
+	for _, c := range chunks {
+		stat.Size += c.size
+	}
+	return stat, nil
+}
+
+// Pins the file in the cache.
+func (s *objectStorage) Pin(file File) error {
+	return s.cache.Pin(file)
+}
+
+func (s *objectStorage) Unpin(file File) error {
+	return s.cache.Unpin(file)
+}
+
+func (s *objectStorage) DumpStatistics(log Printer) {
+	s.mutex.Lock()
+	log.Printf("Object store: %d objects known, %d uploaded (%d bytes), %d fetched (%d bytes)",
+		s.present.Len(), s.uploads, s.uploaded, s.fetches, s.fetched)
+	s.mutex.Unlock()
+	log.Printf("Cache:")
+	s.cache.DumpStatistics(log)
+}
+
+// Subscribes to the events of the cache.
+func (s *objectStorage) Subscribe(bufferSize int) *Subscription {
+	return s.cache.Subscribe(bufferSize)
+}
+
+// Returns the usage info of the cache.
+func (s *objectStorage) GetUsageInfo() UsageInfo {
+	return s.cache.GetUsageInfo()
+}
+
+// Frees the cache. Content remains available in the object store.
+func (s *objectStorage) FreeCache() int64 {
+	return s.cache.FreeCache()
+}
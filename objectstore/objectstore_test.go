@@ -0,0 +1,187 @@
+package objectstore
+
+import (
+	"bytes"
+	"errors"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Type memStore is an in-memory ObjectStore simulating eventual consistency: newly stored
+// data objects are reported missing on the first access, while list objects are visible
+// immediately. Additionally, every `failEvery`th operation fails.
+type memStore struct {
+	mutex     sync.Mutex
+	objects   map[string][]byte
+	hidden    map[string]bool
+	failEvery int
+	ops       int
+	puts      int
+	maxBatch  int
+}
+
+var errTransient = errors.New("Transient error")
+
+func newMemStore(failEvery int) *memStore {
+	return &memStore{objects: make(map[string][]byte), hidden: make(map[string]bool), failEvery: failEvery}
+}
+
+func (m *memStore) fail() bool {
+	m.ops++
+	return m.failEvery > 0 && m.ops%m.failEvery == 0
+}
+
+// Reports whether an object is visible, revealing hidden objects for the next access.
+func (m *memStore) visible(name string) bool {
+	if m.hidden[name] {
+		delete(m.hidden, name)
+		return false
+	}
+	_, ok := m.objects[name]
+	return ok
+}
+
+func (m *memStore) Put(name string, data []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.fail() {
+		return errTransient
+	}
+	if _, ok := m.objects[name]; !ok {
+		m.objects[name] = append([]byte{}, data...)
+		m.hidden[name] = data[0] == objectData
+		m.puts++
+	}
+	return nil
+}
+
+func (m *memStore) Get(name string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.fail() {
+		return nil, errTransient
+	}
+	if !m.visible(name) {
+		return nil, ErrNotFound
+	}
+	return m.objects[name], nil
+}
+
+func (m *memStore) Exists(names []string) ([]bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.fail() {
+		return nil, errTransient
+	}
+	if len(names) > m.maxBatch {
+		m.maxBatch = len(names)
+	}
+	result := make([]bool, len(names))
+	for i, name := range names {
+		result[i] = m.visible(name)
+	}
+	return result, nil
+}
+
+func addData(t *testing.T, s FileStorage, data []byte) SKey {
+	temp := s.Create("test data")
+	defer temp.Dispose()
+	if _, err := temp.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := temp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f := temp.File()
+	defer f.Dispose()
+	return f.Key()
+}
+
+func assertContent(t *testing.T, s FileStorage, key SKey, data []byte) {
+	f, err := s.Get(&key)
+	if err != nil {
+		t.Fatalf("Error getting %v: %v", key, err)
+	}
+	defer f.Dispose()
+	r := f.Open()
+	defer r.Close()
+	if content, err := io.ReadAll(r); err != nil {
+		t.Fatalf("Error reading %v: %v", key, err)
+	} else if !bytes.Equal(content, data) {
+		t.Fatalf("Content mismatch for %v", key)
+	}
+}
+
+func TestObjectStorage(t *testing.T) {
+	store := newMemStore(7)
+	opts := Options{BatchSize: 16, Backoff: time.Millisecond}
+	a := NewObjectStorage(store, ram.NewRamStorage(16<<20), opts)
+
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	key := addData(t, a, data)
+	small := []byte("small file")
+	smallKey := addData(t, a, small)
+	puts := store.puts
+
+	// Appending to the file only uploads few new chunks
+	appended := append(append([]byte{}, data...), small...)
+	appendedKey := addData(t, a, appended)
+	if store.puts-puts > 4 {
+		t.Errorf("Expected few uploads for appended file, got %d", store.puts-puts)
+	}
+	if store.maxBatch > opts.BatchSize {
+		t.Errorf("Batch of %d names exceeds batch size", store.maxBatch)
+	}
+
+	// Another storage with an empty cache retrieves everything from the object store
+	b := NewObjectStorage(store, ram.NewRamStorage(16<<20), opts)
+	if stat, err := b.StatByKey(&key); err != nil || stat.Size != int64(len(data)) || stat.Resident {
+		t.Errorf("Unexpected stat %+v, %v", stat, err)
+	}
+	assertContent(t, b, key, data)
+	assertContent(t, b, appendedKey, appended)
+
+	// Unchunked files are looked up only once, so they may be missing until they become visible
+	if _, err := b.Get(&smallKey); err != ErrNotFound {
+		t.Errorf("Expected recently stored small file to be reported missing, got %v", err)
+	}
+	assertContent(t, b, smallKey, small)
+	if stat, err := b.StatByKey(&key); err != nil || !stat.Resident {
+		t.Errorf("Expected fetched file to be resident: %+v, %v", stat, err)
+	}
+
+	// Content remains available after the cache is freed
+	b.FreeCache()
+	assertContent(t, b, appendedKey, appended)
+	b.FreeCache()
+
+	var missing SKey
+	if _, err := b.Get(&missing); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	for _, s := range []BoundedStorage{a, b} {
+		s.FreeCache()
+		if ui := s.GetUsageInfo(); ui.Locked != 0 {
+			t.Errorf("Usage after test: %v", ui)
+		}
+	}
+}
+
+func TestCorruptObject(t *testing.T) {
+	store := newMemStore(0)
+	a := NewObjectStorage(store, ram.NewRamStorage(1<<20), Options{Backoff: time.Millisecond})
+	key := addData(t, a, []byte("original content"))
+	store.objects[objectName(key)] = append([]byte{objectData}, "tampered content"...)
+	delete(store.hidden, objectName(key))
+
+	b := NewObjectStorage(store, ram.NewRamStorage(1<<20), Options{Backoff: time.Millisecond})
+	if _, err := b.Get(&key); !errors.Is(err, ErrCorruptObject) {
+		t.Errorf("Expected ErrCorruptObject, got %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package objectstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Type S3Config specifies how to access a bucket of Amazon S3 or a compatible service, like MinIO.
+type S3Config struct {
+	Endpoint  string // Base URL of the service, e.g. "https://s3.eu-central-1.amazonaws.com"
+	Region    string // e.g. "eu-central-1"
+	Bucket    string
+	Prefix    string // Prepended to all object names, e.g. "cafs/"
+	AccessKey string
+	SecretKey string
+
+	// The HTTP client to use. Defaults to http.DefaultClient.
+	Client *http.Client
+	// The number of concurrent requests issued by Exists. Defaults to 8.
+	Concurrency int
+}
+
+type s3Store struct {
+	cfg S3Config
+}
+
+// Returns an ObjectStore accessing an S3 bucket using path-style requests signed with
+// AWS Signature Version 4.
+func NewS3Store(cfg S3Config) ObjectStore {
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 8
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	return &s3Store{cfg: cfg}
+}
+
+func (s *s3Store) do(method, name string, body []byte) (*http.Response, error) {
+	u, err := url.Parse(s.cfg.Endpoint + "/" + s.cfg.Bucket + "/" + s.cfg.Prefix + name)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	signV4(req, hashHex(body), s.cfg.Region, s.cfg.AccessKey, s.cfg.SecretKey, time.Now())
+	return s.cfg.Client.Do(req)
+}
+
+func statusError(method, name string, resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 %v %v: %v: %s", method, name, resp.Status, msg)
+}
+
+func (s *s3Store) Put(name string, data []byte) error {
+	resp, err := s.do(http.MethodPut, name, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError("PUT", name, resp)
+	}
+	return nil
+}
+
+func (s *s3Store) Get(name string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, cafs.ErrNotFound
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, statusError("GET", name, resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3Store) exists(name string) (bool, error) {
+	resp, err := s.do(http.MethodHead, name, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("S3 HEAD %v: %v", name, resp.Status)
+}
+
+// Issues concurrent HEAD requests, as S3 doesn't support querying several objects at once.
+func (s *s3Store) Exists(names []string) ([]bool, error) {
+	result := make([]bool, len(names))
+	errs := make([]error, len(names))
+	sem := make(chan struct{}, s.cfg.Concurrency)
+	var wg sync.WaitGroup
+	for i := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			result[i], errs[i] = s.exists(names[i])
+			<-sem
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func hashHex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Adds the headers required by AWS Signature Version 4 to `req`, signing all headers present.
+func signV4(req *http.Request, payloadHash, region, accessKey, secretKey string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" +
+		hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		accessKey, scope, signedHeaders, signature))
+}
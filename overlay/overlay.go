@@ -0,0 +1,174 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package overlay implements a storage that layers a writable in-memory storage on top of
+// a read-only base storage. Content ingested into the overlay never reaches the base and can
+// be discarded at once.
+package overlay
+
+import (
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"sync"
+)
+
+// Interface OverlayStorage is a BoundedStorage whose usage info refers to the overlay's top layer.
+type OverlayStorage interface {
+	BoundedStorage
+
+	// Discards all content written into the overlay, leaving an empty top layer. The base
+	// storage is not affected. Files retrieved from the top layer remain valid until disposed.
+	Dispose()
+}
+
+type overlayStorage struct {
+	base     FileStorage
+	maxBytes int64
+
+	events EventBroker
+
+	mutex     sync.Mutex
+	top       BoundedStorage
+	topEvents *Subscription // Forwards the top layer's events, once anybody subscribed
+}
+
+// Size of the buffer used for forwarding the top layer's events.
+const eventBufferSize = 1024
+
+// Returns a new overlay over `base`, storing up to `maxBytes` of new content in memory.
+// The overlay only ever reads from `base`.
+func NewOverlayStorage(base FileStorage, maxBytes int64) OverlayStorage {
+	return &overlayStorage{
+		base:     base,
+		maxBytes: maxBytes,
+		top:      ram.NewRamStorage(maxBytes),
+	}
+}
+
+func (s *overlayStorage) getTop() BoundedStorage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.top
+}
+
+func (s *overlayStorage) Create(info string) Temporary {
+	return s.getTop().Create(info)
+}
+
+func (s *overlayStorage) CreateWithOptions(info string, opts CreateOptions) Temporary {
+	return s.getTop().CreateWithOptions(info, opts)
+}
+
+func (s *overlayStorage) Get(key *SKey) (File, error) {
+	if f, err := s.getTop().Get(key); err != ErrNotFound {
+		return f, err
+	}
+	return s.base.Get(key)
+}
+
+func (s *overlayStorage) StatByKey(key *SKey) (FileStat, error) {
+	if stat, err := s.getTop().StatByKey(key); err != ErrNotFound {
+		return stat, err
+	}
+	return s.base.StatByKey(key)
+}
+
+// Pins the file in the layer it was retrieved from.
+func (s *overlayStorage) Pin(file File) error {
+	if err := s.getTop().Pin(file); err != ErrForeignFile {
+		return err
+	}
+	return s.base.Pin(file)
+}
+
+func (s *overlayStorage) Unpin(file File) error {
+	if err := s.getTop().Unpin(file); err != ErrForeignFile {
+		return err
+	}
+	return s.base.Unpin(file)
+}
+
+// Enumerates the keys of the top layer and those of the base, if it implements KeyEnumerator.
+func (s *overlayStorage) EnumerateKeys(f func(key SKey) bool) {
+	var keys []SKey
+	collect := func(key SKey) bool {
+		keys = append(keys, key)
+		return true
+	}
+	s.getTop().(KeyEnumerator).EnumerateKeys(collect)
+	if base, ok := s.base.(KeyEnumerator); ok {
+		base.EnumerateKeys(collect)
+	}
+	for _, key := range SortKeys(keys) {
+		if !f(key) {
+			return
+		}
+	}
+}
+
+func (s *overlayStorage) DumpStatistics(log Printer) {
+	log.Printf("Overlay:")
+	s.getTop().DumpStatistics(log)
+	log.Printf("Base:")
+	s.base.DumpStatistics(log)
+}
+
+// Subscribes to the events of the top layer. The subscription outlives Dispose: it receives
+// the evictions of the discarded layer, followed by the events of the fresh one.
+func (s *overlayStorage) Subscribe(bufferSize int) *Subscription {
+	s.mutex.Lock()
+	if s.topEvents == nil {
+		s.forwardL()
+	}
+	s.mutex.Unlock()
+	return s.events.Subscribe(bufferSize)
+}
+
+// Starts forwarding the events of the current top layer to the overlay's subscribers.
+// The forwarding ends when the top layer's subscription is closed. Must be called with
+// the mutex held.
+func (s *overlayStorage) forwardL() {
+	sub := s.top.Subscribe(eventBufferSize)
+	s.topEvents = sub
+	go func() {
+		for e := range sub.C {
+			s.events.Publish(e)
+		}
+	}()
+}
+
+func (s *overlayStorage) GetUsageInfo() UsageInfo {
+	return s.getTop().GetUsageInfo()
+}
+
+func (s *overlayStorage) FreeCache() int64 {
+	return s.getTop().FreeCache()
+}
+
+func (s *overlayStorage) Dispose() {
+	s.mutex.Lock()
+	old, oldEvents := s.top, s.topEvents
+	s.top = ram.NewRamStorage(s.maxBytes)
+	if oldEvents != nil {
+		s.forwardL()
+	}
+	s.mutex.Unlock()
+	old.FreeCache()
+	if oldEvents != nil {
+		// Events already buffered are still forwarded before the forwarding ends
+		oldEvents.Close()
+	}
+}
@@ -0,0 +1,125 @@
+package overlay
+
+import (
+	"bytes"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func addData(t *testing.T, s FileStorage, data []byte) SKey {
+	temp := s.Create("test data")
+	defer temp.Dispose()
+	if _, err := temp.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := temp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f := temp.File()
+	defer f.Dispose()
+	return f.Key()
+}
+
+func assertContent(t *testing.T, s FileStorage, key SKey, data []byte) {
+	f, err := s.Get(&key)
+	if err != nil {
+		t.Fatalf("Error getting %v: %v", key, err)
+	}
+	defer f.Dispose()
+	r := f.Open()
+	defer r.Close()
+	if content, err := io.ReadAll(r); err != nil {
+		t.Fatalf("Error reading %v: %v", key, err)
+	} else if !bytes.Equal(content, data) {
+		t.Fatalf("Content mismatch for %v", key)
+	}
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(rand.Int())
+	}
+	return data
+}
+
+func TestOverlay(t *testing.T) {
+	base := ram.NewRamStorage(4 * 1024 * 1024)
+	baseData := randomData(200000)
+	baseKey := addData(t, base, baseData)
+	baseUsage := base.GetUsageInfo()
+
+	s := NewOverlayStorage(base, 4*1024*1024)
+	topData := randomData(300000)
+	topKey := addData(t, s, topData)
+
+	// Both layers are visible through the overlay, but the base is untouched
+	assertContent(t, s, baseKey, baseData)
+	assertContent(t, s, topKey, topData)
+	if _, err := base.Get(&topKey); err != ErrNotFound {
+		t.Errorf("Expected content of overlay not to reach the base, got %v", err)
+	}
+	if stat, err := s.StatByKey(&baseKey); err != nil || stat.Size != int64(len(baseData)) {
+		t.Errorf("Unexpected stat of base file: %v (err: %v)", stat, err)
+	}
+	if s.GetUsageInfo().Used == 0 {
+		t.Errorf("Expected overlay to use memory: %v", s.GetUsageInfo())
+	}
+
+	// Hold a file of the top layer while discarding
+	f, err := s.Get(&topKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Dispose()
+	if _, err := s.Get(&topKey); err != ErrNotFound {
+		t.Errorf("Expected content of overlay to be discarded, got %v", err)
+	}
+	if f.Size() != int64(len(topData)) {
+		t.Errorf("Held file became invalid")
+	}
+	f.Dispose()
+
+	assertContent(t, s, baseKey, baseData)
+	if usage := base.GetUsageInfo(); usage != baseUsage {
+		t.Errorf("Base usage changed from %v to %v", baseUsage, usage)
+	}
+	if usage := s.GetUsageInfo(); usage.Used != 0 {
+		t.Errorf("Expected empty overlay after discarding, got %v", usage)
+	}
+}
+
+func TestOverlayEvents(t *testing.T) {
+	s := NewOverlayStorage(ram.NewRamStorage(1024*1024), 4*1024*1024)
+	sub := s.Subscribe(1024)
+	defer sub.Close()
+
+	// Waits for an event of the given type concerning the given key.
+	await := func(typ EventType, key SKey) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e := <-sub.C:
+				if e.Type == typ && e.Key == key {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("Timeout waiting for %v event of %v", typ, key)
+			}
+		}
+	}
+
+	before := addData(t, s, randomData(1000))
+	await(EventStored, before)
+	s.Dispose()
+	await(EventEvicted, before)
+
+	// Events of the new top layer reach the same subscription
+	after := addData(t, s, randomData(1000))
+	await(EventStored, after)
+}
@@ -0,0 +1,103 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pack
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+// Returned when reading data compressed with a codec the storage doesn't know.
+var ErrUnknownCodec = errors.New("Unknown compression codec")
+
+// Interface Codec compresses the data of chunks and unchunked files before it is written to a
+// pack file (see PackOptions.Codec). Keys are always computed over the uncompressed data.
+type Codec interface {
+	// Returns the byte identifying the codec in pack files. Must not be 0.
+	ID() byte
+	// Returns the compressed form of `data`.
+	Compress(data []byte) ([]byte, error)
+	// Returns the `size` bytes of data compressed by Compress.
+	Decompress(compressed []byte, size int64) ([]byte, error)
+}
+
+// Codec Flate compresses data using compress/flate at the default compression level.
+// Data compressed with it can always be read, whether or not it is the storage's codec.
+var Flate Codec = flateCodec{}
+
+type flateCodec struct{}
+
+func (flateCodec) ID() byte {
+	return 'f'
+}
+
+func (flateCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decompress(compressed []byte, size int64) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Returns the codec identified by `id`.
+func (s *packStorage) codec(id byte) (Codec, error) {
+	if s.opts.Codec != nil && s.opts.Codec.ID() == id {
+		return s.opts.Codec, nil
+	} else if id == Flate.ID() {
+		return Flate, nil
+	}
+	return nil, ErrUnknownCodec
+}
+
+// Returns the payload of the record storing `data`, which is compressed if a codec has been
+// configured and compressing saves space. Returns the record type, the codec used or 0, and the
+// offset of the (compressed) data within the payload.
+func (s *packStorage) encodeData(data []byte) (typ byte, payload []byte, codec byte, offset int) {
+	if s.opts.Codec == nil || len(data) == 0 {
+		return recordData, data, 0, 0
+	}
+	compressed, err := s.opts.Codec.Compress(data)
+	if err != nil {
+		// Stored uncompressed instead
+		return recordData, data, 0, 0
+	}
+	payload = append([]byte{s.opts.Codec.ID()}, appendUvarint(nil, uint64(len(data)))...)
+	if offset = len(payload); offset+len(compressed) >= len(data) {
+		// Incompressible
+		return recordData, data, 0, 0
+	}
+	return recordCompressed, append(payload, compressed...), s.opts.Codec.ID(), offset
+}
@@ -0,0 +1,395 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	. "github.com/indyjo/cafs"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Every pack file starts with this byte sequence.
+const packMagic = "CAFSPK01"
+
+// Record types. Each record starts with the type (1 byte) and the key (32 bytes), followed by
+// the info string, the content type string and the payload, each prefixed with its length as uvarint.
+// The payload of a list record is a sequence of (key, end position as uvarint) pairs.
+// The payload of a compressed data record is the codec's ID (1 byte), the size of the uncompressed
+// data as uvarint and the compressed data. Deletion records have neither info nor payload.
+const (
+	recordData       = 'D'
+	recordCompressed = 'Z'
+	recordList       = 'L'
+	recordDelete     = 'X'
+)
+
+// Upper bound for the length of info and content type strings
+const maxStringLen = 65536
+
+func packPath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("pack-%08d.pack", id))
+}
+
+// Starts a new pack file to which all subsequent records are appended.
+func (s *packStorage) startPack() error {
+	id := 1
+	if len(s.packs) > 0 {
+		id = s.packs[len(s.packs)-1].id + 1
+	}
+	if len(s.packs) > 0 {
+		s.sealPack(s.packs[len(s.packs)-1])
+	}
+	path := packPath(s.dir, id)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(packMagic)); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	s.packs = append(s.packs, &packFile{id: id, path: path, f: f, size: int64(len(packMagic))})
+	return nil
+}
+
+// Called when no more records will be appended to a pack file. Memory-maps the pack if requested.
+func (s *packStorage) sealPack(p *packFile) {
+	if !s.opts.Mmap || p.mapped != nil || p.size == 0 {
+		return
+	}
+	if mapped, err := mmap(p.f, p.size); err != nil {
+		if LoggingEnabled {
+			log.Printf("Not memory-mapping %v: %v", p.path, err)
+		}
+	} else {
+		p.mapped = mapped
+	}
+}
+
+// Appends an encoded record to the current pack file, starting a new pack file if necessary.
+// Returns the pack and the offset the record was written to.
+func (s *packStorage) appendRaw(record []byte) (*packFile, int64, error) {
+	if len(s.packs) == 0 || s.packs[len(s.packs)-1].size >= MaxPackSize {
+		if err := s.startPack(); err != nil {
+			return nil, 0, err
+		}
+	}
+	p := s.packs[len(s.packs)-1]
+	offset := p.size
+	if _, err := p.f.WriteAt(record, offset); err != nil {
+		return nil, 0, err
+	}
+	p.size += int64(len(record))
+	return p, offset, nil
+}
+
+// Encodes and appends a record. Returns the pack, the record's location and the offset of its payload.
+func (s *packStorage) appendRecord(typ byte, key *SKey, info, contentType string, payload []byte) (p *packFile, recordOffset, recordSize, payloadOffset int64, err error) {
+	if len(info) > maxStringLen {
+		info = info[:maxStringLen]
+	}
+	if len(contentType) > maxStringLen {
+		contentType = contentType[:maxStringLen]
+	}
+	record := make([]byte, 0, 1+len(key)+3*binary.MaxVarintLen64+len(info)+len(contentType)+len(payload))
+	record = append(record, typ)
+	record = append(record, key[:]...)
+	record = appendUvarint(record, uint64(len(info)))
+	record = append(record, info...)
+	record = appendUvarint(record, uint64(len(contentType)))
+	record = append(record, contentType...)
+	record = appendUvarint(record, uint64(len(payload)))
+	headerSize := len(record)
+	record = append(record, payload...)
+
+	p, recordOffset, err = s.appendRaw(record)
+	return p, recordOffset, int64(len(record)), recordOffset + int64(headerSize), err
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func encodeChunkList(chunks []chunkRef) []byte {
+	result := make([]byte, 0, len(chunks)*(32+4))
+	for _, c := range chunks {
+		result = append(result, c.key[:]...)
+		result = appendUvarint(result, uint64(c.nextPos))
+	}
+	return result
+}
+
+func decodeChunkList(payload []byte) ([]chunkRef, error) {
+	var result []chunkRef
+	var lastPos int64
+	for len(payload) > 0 {
+		var c chunkRef
+		if len(payload) < len(c.key) {
+			return nil, ErrCorruptPack
+		}
+		copy(c.key[:], payload)
+		payload = payload[len(c.key):]
+		v, n := binary.Uvarint(payload)
+		if n <= 0 || int64(v) <= lastPos {
+			return nil, ErrCorruptPack
+		}
+		c.nextPos, lastPos = int64(v), int64(v)
+		payload = payload[n:]
+		result = append(result, c)
+	}
+	if len(result) == 0 {
+		return nil, ErrCorruptPack
+	}
+	return result, nil
+}
+
+// Type recordReader reads records from a pack file while keeping track of the position.
+type recordReader struct {
+	r   *bufio.Reader
+	pos int64
+}
+
+func (r *recordReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.pos++
+	}
+	return b, err
+}
+
+func (r *recordReader) readFull(b []byte) error {
+	n, err := io.ReadFull(r.r, b)
+	r.pos += int64(n)
+	return err
+}
+
+func (r *recordReader) readString() (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if l > maxStringLen {
+		return "", ErrCorruptPack
+	}
+	b := make([]byte, l)
+	if err := r.readFull(b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Reads the header of a record and positions the reader at the payload.
+func (r *recordReader) readHeader() (typ byte, key SKey, info, contentType string, payloadSize int64, err error) {
+	if typ, err = r.ReadByte(); err != nil {
+		return
+	}
+	if typ != recordData && typ != recordCompressed && typ != recordList && typ != recordDelete {
+		err = ErrCorruptPack
+		return
+	}
+	if err = r.readFull(key[:]); err != nil {
+		return
+	}
+	if info, err = r.readString(); err != nil {
+		return
+	}
+	if contentType, err = r.readString(); err != nil {
+		return
+	}
+	var l uint64
+	if l, err = binary.ReadUvarint(r); err != nil {
+		return
+	}
+	payloadSize = int64(l)
+	return
+}
+
+// Opens an existing pack file and adds the records found in it to the index. An incomplete
+// record at the end of the file, which may be the result of a crash, is cut off.
+func (s *packStorage) loadPack(id int) error {
+	path := packPath(s.dir, id)
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	p := &packFile{id: id, path: path, f: f, size: fi.Size()}
+	s.packs = append(s.packs, p)
+
+	r := &recordReader{r: bufio.NewReader(io.NewSectionReader(f, 0, p.size))}
+	magic := make([]byte, len(packMagic))
+	if err := r.readFull(magic); err != nil || string(magic) != packMagic {
+		return fmt.Errorf("%v: %v", path, ErrCorruptPack)
+	}
+
+	for r.pos < p.size {
+		recordOffset := r.pos
+		typ, key, info, contentType, payloadSize, err := r.readHeader()
+		if err == nil && payloadSize > p.size-r.pos {
+			err = io.ErrUnexpectedEOF
+		}
+		var payload []byte
+		var codec byte
+		var dataSize uint64
+		var prefix int64 // Offset of the compressed data within the payload
+		payloadOffset := r.pos
+		if err == nil && typ == recordList {
+			payload = make([]byte, payloadSize)
+			err = r.readFull(payload)
+		} else if err == nil && typ == recordCompressed {
+			if codec, err = r.ReadByte(); err == nil {
+				dataSize, err = binary.ReadUvarint(r)
+			}
+			if prefix = r.pos - payloadOffset; err == nil && (codec == 0 || prefix > payloadSize) {
+				err = ErrCorruptPack
+			} else if err == nil {
+				_, err = r.r.Discard(int(payloadSize - prefix))
+				r.pos = payloadOffset + payloadSize
+			}
+		} else if err == nil {
+			_, err = r.r.Discard(int(payloadSize))
+			r.pos += payloadSize
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			log.Printf("%v: truncating incomplete record at position %d", path, recordOffset)
+			p.size = recordOffset
+			return f.Truncate(recordOffset)
+		} else if err != nil {
+			return fmt.Errorf("%v: %v at position %d", path, err, recordOffset)
+		}
+		recordSize := r.pos - recordOffset
+
+		if typ == recordDelete {
+			p.dead += recordSize
+			if entry := s.entries[key]; entry != nil {
+				entry.pack.dead += entry.recordSize
+				delete(s.entries, key)
+			}
+			continue
+		}
+
+		if s.entries[key] != nil {
+			// Duplicate record, e.g. left over from an interrupted repack
+			p.dead += recordSize
+			continue
+		}
+		entry := &packEntry{
+			info:         info,
+			contentType:  contentType,
+			pack:         p,
+			recordOffset: recordOffset,
+			recordSize:   recordSize,
+			dataOffset:   recordOffset + recordSize - payloadSize,
+		}
+		if typ == recordList {
+			if entry.chunks, err = decodeChunkList(payload); err != nil {
+				return fmt.Errorf("%v: %v at position %d", path, err, recordOffset)
+			}
+		} else if typ == recordCompressed {
+			entry.codec, entry.dataSize = codec, int64(dataSize)
+			entry.storedSize = payloadSize - prefix
+			entry.dataOffset += prefix
+		} else {
+			entry.dataSize, entry.storedSize = payloadSize, payloadSize
+		}
+		s.entries[key] = entry
+	}
+	return nil
+}
+
+// Loads all existing pack files in the storage directory and reconstructs the index.
+func (s *packStorage) load() error {
+	names, err := filepath.Glob(filepath.Join(s.dir, "pack-*.pack"))
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for _, name := range names {
+		var id int
+		if _, err := fmt.Sscanf(filepath.Base(name), "pack-%08d.pack", &id); err == nil && id > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if len(s.packs) > 0 {
+			s.sealPack(s.packs[len(s.packs)-1])
+		}
+		if err := s.loadPack(id); err != nil {
+			return err
+		}
+	}
+
+	// Lists whose chunks are missing can't be used
+	for key, entry := range s.entries {
+		for _, chunk := range entry.chunks {
+			if s.entries[chunk.key] == nil {
+				log.Printf("Dropping file %v [%v]: chunk %v is missing", key, entry.info, chunk.key)
+				entry.pack.dead += entry.recordSize
+				delete(s.entries, key)
+				break
+			}
+		}
+	}
+
+	// Chunks are referenced by the lists containing them
+	for _, entry := range s.entries {
+		s.bytesUsed += entry.storageSize()
+		for _, chunk := range entry.chunks {
+			chunkEntry := s.entries[chunk.key]
+			if chunkEntry.refs == 0 {
+				s.bytesLocked += chunkEntry.storageSize()
+			}
+			chunkEntry.refs++
+		}
+	}
+
+	// Unreferenced entries are put into the LRU chain in the order they were written
+	var keys []SKey
+	for key, entry := range s.entries {
+		if entry.refs == 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := s.entries[keys[i]], s.entries[keys[j]]
+		if a.pack != b.pack {
+			return a.pack.id < b.pack.id
+		}
+		return a.recordOffset < b.recordOffset
+	})
+	for i := range keys {
+		s.insertIntoChain(&keys[i], s.entries[keys[i]])
+	}
+
+	if s.bytesUsed > s.bytesMax {
+		return s.reserveBytes("Load", 0)
+	}
+	return nil
+}
@@ -0,0 +1,1100 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This package implements a content-addressable file storage that keeps its
+// data on disk, in a small number of append-only pack files.
+//
+// Every object (a chunk of data, or the list of chunks making up a file) is stored as a
+// record appended to the current pack file. When a pack file reaches MaxPackSize, a new one
+// is started. Removing an object from the storage appends a deletion record and leaves the
+// original record in place as dead space, which is reclaimed by Repack().
+//
+// The index mapping keys to records is kept in memory and rebuilt from the pack files
+// when the storage is opened.
+package pack
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	. "github.com/indyjo/cafs"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Pack files are rotated once they have grown beyond this number of bytes.
+var MaxPackSize int64 = 64 * 1024 * 1024
+
+var ErrCorruptPack = errors.New("Corrupt pack file")
+
+// Interface PackStorage describes a BoundedStorage kept in pack files.
+type PackStorage interface {
+	BoundedStorage
+
+	// Rewrites all pack files containing dead space, thereby reclaiming it.
+	// Blocks all other operations on the storage while running.
+	Repack() error
+
+	// Returns the number of pack files currently in use.
+	NumPacks() int
+
+	// Reports how much dead space the pack files contain, e.g. for deciding when to call Repack.
+	Fragmentation() Fragmentation
+
+	// Closes all pack files. The storage must not be used afterwards.
+	Close() error
+}
+
+// Type PackFragmentation describes the space occupied by records in one pack file, or in all of them.
+type PackFragmentation struct {
+	Name     string  // Base name of the pack file, or empty for the total
+	Live     int64   // Bytes occupied by records still in use
+	Dead     int64   // Bytes occupied by records no longer needed, which Repack reclaims
+	Fraction float64 // Dead / (Live + Dead), or 0 if there are no records
+}
+
+// Type Fragmentation is returned by PackStorage.Fragmentation.
+type Fragmentation struct {
+	Total PackFragmentation
+	Packs []PackFragmentation // In the order the pack files were written
+}
+
+// Type packFile represents one pack file on disk.
+type packFile struct {
+	id       int
+	path     string
+	f        *os.File
+	size     int64  // Number of bytes written to the pack file
+	dead     int64  // Number of bytes occupied by records that are no longer needed
+	users    int    // Number of reads currently in progress
+	obsolete bool   // Set when the pack has been repacked or the storage closed. File is closed when users reaches 0.
+	mapped   []byte // Memory mapping of the pack, if it is no longer appended to and mmap is enabled
+}
+
+// Closes the pack file and removes its memory mapping, if any. Must not happen while the pack is
+// being read from.
+func (p *packFile) close() error {
+	var err error
+	if p.mapped != nil {
+		if err = munmap(p.mapped); err != nil && LoggingEnabled {
+			log.Printf("Unmapping %v: %v", p.path, err)
+		}
+		p.mapped = nil
+	}
+	if e := p.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+type chunkRef struct {
+	key SKey
+	// Points to the byte position within the file immediately after this chunk
+	nextPos int64
+}
+
+type packEntry struct {
+	// Keys to the next older and next younger entry
+	younger, older SKey
+	info           string
+	// MIME type detected on ingest, if requested
+	contentType string
+	// Location of the entry's record
+	pack                     *packFile
+	recordOffset, recordSize int64
+	// Location of the data within the pack if entry is of simple kind. The data occupies
+	// storedSize bytes, which differs from dataSize if it has been compressed using codec.
+	dataOffset, dataSize int64
+	storedSize           int64
+	codec                byte
+	// Holds a list of chunk positions if entry is of chunk list type
+	chunks []chunkRef
+	refs   int
+	pins   int // Number of references held by Pin
+}
+
+type packStorage struct {
+	mutex               sync.Mutex
+	dir                 string
+	entries             map[SKey]*packEntry
+	packs               []*packFile // Ordered by id. The last one is being appended to.
+	bytesUsed, bytesMax int64
+	bytesLocked         int64
+	youngest, oldest    SKey
+	events              EventBroker
+	opts                PackOptions
+	access              *AccessCounter // Counts retrievals of files and chunks, if enabled
+}
+
+type storedFile struct {
+	storage  *packStorage
+	key      SKey
+	entry    *packEntry
+	disposed bool
+}
+
+type dataReader struct {
+	storage *packStorage
+	entry   *packEntry
+	data    []byte
+	loaded  bool
+	err     error
+}
+
+type chunkReader struct {
+	storage    *packStorage // Storage to read from
+	entry      *packEntry   // Entry containing the chunks
+	key        SKey         // SKey of that entry
+	chunksTail []chunkRef   // Remaining chunks
+	closed     bool         // Whether Close() has been called
+	dataReader io.ReadCloser
+}
+
+// Opens the pack storage in directory `dir`, creating the directory if necessary.
+// Objects found in existing pack files are re-indexed. If they occupy more than `maxBytes`,
+// the oldest ones are removed.
+func NewPackStorage(dir string, maxBytes int64) (PackStorage, error) {
+	return NewPackStorageWithOptions(dir, maxBytes, PackOptions{})
+}
+
+// Type PackOptions contains optional settings for a pack storage.
+// The zero value selects the default behavior.
+type PackOptions struct {
+	// If set, pack files that are no longer appended to are memory-mapped, which speeds up
+	// random reads considerably. On platforms without mmap, regular file I/O is used instead.
+	Mmap bool
+	// If set, retrievals of files and chunks, whether by Get or while reading a file, are counted
+	// per key and reported by HotChunks (see cafs.AccessReporter).
+	TrackAccess bool
+	// Named chunker configurations which can be selected through CreateOptions.Profile.
+	Profiles ChunkingProfiles
+	// If set, the data of chunks and unchunked files is compressed using this codec before being
+	// written, unless it is incompressible. Data is decompressed transparently when read. Files
+	// containing compressed data don't implement ExtentFile.WalkExtents (see ErrNoExtents).
+	Codec Codec
+}
+
+// Like NewPackStorage, but allows for specifying options.
+func NewPackStorageWithOptions(dir string, maxBytes int64, opts PackOptions) (PackStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &packStorage{
+		dir:      dir,
+		entries:  make(map[SKey]*packEntry),
+		bytesMax: maxBytes,
+		opts:     opts,
+		access:   NewAccessCounter(opts.TrackAccess),
+	}
+	if err := s.load(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *packStorage) GetUsageInfo() UsageInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return UsageInfo{Used: s.bytesUsed, Capacity: s.bytesMax, Locked: s.bytesLocked}
+}
+
+func (s *packStorage) FreeCache() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	oldBytesUsed := s.bytesUsed
+	if err := s.reserveBytes("FreeCache", s.bytesMax); err != nil && err != ErrNotEnoughSpace {
+		log.Printf("FreeCache: %v", err)
+	}
+	s.events.Publish(Event{Type: EventCacheFreed, Size: oldBytesUsed - s.bytesUsed})
+	return oldBytesUsed - s.bytesUsed
+}
+
+func (s *packStorage) Subscribe(bufferSize int) *Subscription {
+	return s.events.Subscribe(bufferSize)
+}
+
+func (s *packStorage) NumPacks() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.packs)
+}
+
+func (s *packStorage) Fragmentation() Fragmentation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var result Fragmentation
+	for _, p := range s.packs {
+		f := PackFragmentation{
+			Name: filepath.Base(p.path),
+			Live: p.size - int64(len(packMagic)) - p.dead,
+			Dead: p.dead,
+		}
+		f.Fraction = fraction(f.Dead, f.Live)
+		result.Packs = append(result.Packs, f)
+		result.Total.Live += f.Live
+		result.Total.Dead += f.Dead
+	}
+	result.Total.Fraction = fraction(result.Total.Dead, result.Total.Live)
+	return result
+}
+
+func fraction(dead, live int64) float64 {
+	if dead+live == 0 {
+		return 0
+	}
+	return float64(dead) / float64(dead+live)
+}
+
+func (s *packStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var err error
+	for _, p := range s.packs {
+		p.obsolete = true
+		if p.users > 0 {
+			// Closed by the last reader
+			continue
+		}
+		if e := p.close(); err == nil {
+			err = e
+		}
+	}
+	s.packs = nil
+	return err
+}
+
+func (s *packStorage) Get(key *SKey) (File, error) {
+	file, err := s.get(key)
+	if err == nil {
+		s.access.Record(*key)
+	}
+	return file, err
+}
+
+// Like Get, but doesn't count as an access.
+func (s *packStorage) get(key *SKey) (File, error) {
+	s.mutex.Lock()
+	entry, ok := s.entries[*key]
+	if ok {
+		s.lock(key, entry)
+	}
+	s.mutex.Unlock()
+	if ok {
+		f := &storedFile{s, *key, entry, false}
+		if GetLeakMode() != LeakIgnore {
+			runtime.SetFinalizer(f, (*storedFile).finalize)
+		}
+		return f, nil
+	} else {
+		return nil, ErrNotFound
+	}
+}
+
+func (s *packStorage) HotChunks(n int) []AccessStat {
+	return s.access.Top(n)
+}
+
+func (s *packStorage) StatByKey(key *SKey) (FileStat, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[*key]
+	if !ok {
+		return FileStat{}, ErrNotFound
+	}
+	// Chunks are kept alive by the entries referencing them, so a stored file is always complete.
+	stat := FileStat{Size: entry.dataSize, NumChunks: 1, Resident: true}
+	if len(entry.chunks) > 0 {
+		stat.Size = entry.chunks[len(entry.chunks)-1].nextPos
+		stat.NumChunks = int64(len(entry.chunks))
+	}
+	return stat, nil
+}
+
+func (s *packStorage) Pin(file File) error {
+	f, ok := file.(*storedFile)
+	if !ok || f.storage != s {
+		return ErrForeignFile
+	}
+	f.checkValid()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f.entry.pins++
+	s.lock(&f.key, f.entry)
+	return nil
+}
+
+func (s *packStorage) Unpin(file File) error {
+	f, ok := file.(*storedFile)
+	if !ok || f.storage != s {
+		return ErrForeignFile
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if f.entry.pins == 0 {
+		return ErrNotPinned
+	}
+	f.entry.pins--
+	s.release(&f.key, f.entry)
+	return nil
+}
+
+func (s *packStorage) EnumerateKeys(f func(key SKey) bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := make([]SKey, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	for _, key := range SortKeys(keys) {
+		if !f(key) {
+			return
+		}
+	}
+}
+
+// Localities are composed of the pack's id and the record's offset within the pack.
+func (s *packStorage) Locality(key *SKey) (int64, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := s.entries[*key]
+	if entry == nil {
+		return 0, false
+	}
+	return int64(entry.pack.id)<<40 | entry.recordOffset, true
+}
+
+func (s *packStorage) Create(info string) Temporary {
+	return s.CreateWithOptions(info, CreateOptions{})
+}
+
+func (s *packStorage) CreateWithOptions(info string, opts CreateOptions) Temporary {
+	return NewChunkingTemporary(packChunkStore{s}, sha256.New, s.opts.Profiles, info, opts)
+}
+
+func (s *packStorage) DumpStatistics(log Printer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	log.Printf("Bytes used: %d, locked: %d, oldest: %x, youngest: %x", s.bytesUsed, s.bytesLocked, s.oldest[:4], s.youngest[:4])
+	for _, p := range s.packs {
+		log.Printf("  Pack %v: %d bytes, %d dead", filepath.Base(p.path), p.size, p.dead)
+	}
+	for key, entry := range s.entries {
+		log.Printf("  [%x] refs=%d pins=%d size=%v [%v] in %v at %d (older: %x, younger: %x)",
+			key[:4], entry.refs, entry.pins, entry.storageSize(), entry.info, filepath.Base(entry.pack.path),
+			entry.recordOffset, entry.older[:4], entry.younger[:4])
+	}
+}
+
+func (s *packStorage) reserveBytes(info string, numBytes int64) error {
+	if numBytes > s.bytesMax {
+		return ErrNotEnoughSpace
+	}
+	bytesFree := s.bytesMax - s.bytesUsed
+	if bytesFree < numBytes && LoggingEnabled {
+		log.Printf("[%v] Need to free %v (currently unlocked %v) more bytes of CAFS space to store object of size %v",
+			info, numBytes-bytesFree, s.bytesUsed-s.bytesLocked, numBytes)
+	}
+	for bytesFree < numBytes {
+		oldestKey := s.oldest
+		oldestEntry := s.entries[oldestKey]
+		if oldestEntry == nil {
+			return ErrNotEnoughSpace
+		}
+		if err := s.deleteEntry(&oldestKey, oldestEntry); err != nil {
+			return err
+		}
+		bytesFree += oldestEntry.storageSize()
+		if LoggingEnabled {
+			log.Printf("[%v]   Deleted object of size %v bytes: [%v] %v", info, oldestEntry.storageSize(), oldestEntry.info, oldestKey)
+		}
+	}
+	return nil
+}
+
+// Removes an unreferenced entry from the storage by appending a deletion record.
+func (s *packStorage) deleteEntry(key *SKey, entry *packEntry) error {
+	p, _, recordSize, _, err := s.appendRecord(recordDelete, key, "", "", nil)
+	if err != nil {
+		return err
+	}
+	p.dead += recordSize
+	entry.pack.dead += entry.recordSize
+
+	s.removeFromChain(key, entry)
+	delete(s.entries, *key)
+	s.access.Forget(*key)
+	// Dereference all referenced chunks
+	for _, chunk := range entry.chunks {
+		s.release(&chunk.key, s.entries[chunk.key])
+	}
+	s.bytesUsed -= entry.storageSize()
+	s.events.Publish(Event{Type: EventEvicted, Key: *key, Size: entry.storageSize(), Info: entry.info})
+	return nil
+}
+
+// Returns the size of the content stored as either data of the given size, or chunks.
+func contentSize(dataSize int64, chunks []chunkRef) int64 {
+	if len(chunks) > 0 {
+		return chunks[len(chunks)-1].nextPos
+	}
+	return dataSize
+}
+
+// Puts an entry into the store. If an entry already exists, it must be identical to the old one.
+// The newly-created or recycled entry has been lock'ed once and must be release'd properly.
+// A non-empty contentType is recorded with the entry.
+// Returns true if an existing entry was recycled.
+func (s *packStorage) storeEntry(key *SKey, data []byte, chunks []chunkRef, info, contentType string) (bool, error) {
+	if len(data) > 0 && len(chunks) > 0 {
+		panic("Illegal entry")
+	}
+	var typ, codec byte
+	var payload []byte
+	var offset int
+	if len(chunks) > 0 {
+		typ, payload = recordList, encodeChunkList(chunks)
+	} else {
+		// Compressing happens outside of the lock
+		typ, payload, codec, offset = s.encodeData(data)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if oldEntry := s.entries[*key]; oldEntry != nil {
+		// The same content may be stored with different chunks, e.g. if stored inline (see
+		// CreateOptions.InlineThreshold). The existing entry is kept in that case.
+		if contentSize(oldEntry.dataSize, oldEntry.chunks) != contentSize(int64(len(data)), chunks) {
+			panic(fmt.Sprintf("[%v] Key collision: %v [%v]", info, key, oldEntry.info))
+		}
+		if LoggingEnabled {
+			log.Printf("[%v] Recycling key: %v [%v] (data: %d bytes, chunks: %d)", info, key, oldEntry.info, len(data), len(chunks))
+		}
+
+		// Ref the reused entry.
+		s.lock(key, oldEntry)
+
+		// Unref all referenced chunks
+		for _, chunk := range chunks {
+			s.release(&chunk.key, s.entries[chunk.key])
+		}
+		if contentType != "" {
+			oldEntry.contentType = contentType
+		}
+		return true, nil
+	}
+
+	newEntry := &packEntry{
+		info:        info,
+		contentType: contentType,
+		dataSize:    int64(len(data)),
+		chunks:      chunks,
+		refs:        1,
+	}
+	if len(chunks) == 0 {
+		newEntry.storedSize, newEntry.codec = int64(len(payload)-offset), codec
+	}
+	// Reserve the necessary space for storing the object
+	if err := s.reserveBytes(info, newEntry.storageSize()); err != nil {
+		return false, err
+	}
+
+	var err error
+	newEntry.pack, newEntry.recordOffset, newEntry.recordSize, newEntry.dataOffset, err =
+		s.appendRecord(typ, key, info, contentType, payload)
+	if err != nil {
+		return false, err
+	}
+	newEntry.dataOffset += int64(offset)
+
+	s.entries[*key] = newEntry
+	s.bytesUsed += newEntry.storageSize()
+	s.bytesLocked += newEntry.storageSize()
+	s.events.Publish(Event{Type: EventStored, Key: *key, Size: newEntry.storageSize(), Info: info})
+	if LoggingEnabled {
+		log.Printf("[%v] Stored key: %v (data: %d bytes, chunks: %d)", info, key, len(data), len(chunks))
+	}
+	return false, nil
+}
+
+// Appends a new record with the correct data, preceded by a deletion record so that loading the
+// pack files doesn't resurrect the corrupt record.
+func (s *packStorage) Repair(key *SKey, data []byte) error {
+	if sha256.Sum256(data) != *key {
+		return ErrKeyMismatch
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := s.entries[*key]
+	if entry == nil || len(entry.chunks) > 0 {
+		return ErrNotFound
+	} else if entry.dataSize != int64(len(data)) {
+		return ErrKeyMismatch
+	}
+	typ, payload, codec, offset := s.encodeData(data)
+	p, _, recordSize, _, err := s.appendRecord(recordDelete, key, "", "", nil)
+	if err != nil {
+		return err
+	}
+	p.dead += recordSize
+	oldPack, oldRecordSize := entry.pack, entry.recordSize
+	p, recordOffset, recordSize, dataOffset, err := s.appendRecord(typ, key, entry.info, entry.contentType, payload)
+	if err != nil {
+		return err
+	}
+	oldPack.dead += oldRecordSize
+	s.bytesUsed -= entry.storageSize()
+	if entry.refs > 0 {
+		s.bytesLocked -= entry.storageSize()
+	}
+	entry.pack, entry.recordOffset, entry.recordSize, entry.dataOffset = p, recordOffset, recordSize, dataOffset+int64(offset)
+	entry.storedSize, entry.codec = int64(len(payload)-offset), codec
+	s.bytesUsed += entry.storageSize()
+	if entry.refs > 0 {
+		s.bytesLocked += entry.storageSize()
+	}
+	if LoggingEnabled {
+		log.Printf("[%v] Repaired key: %v (data: %d bytes)", entry.info, key, len(data))
+	}
+	return nil
+}
+
+// Reads the data of an entry of simple kind from its pack file, decompressing it if necessary.
+func (s *packStorage) readData(entry *packEntry) ([]byte, error) {
+	s.mutex.Lock()
+	p, offset, size, codec := entry.pack, entry.dataOffset, entry.storedSize, entry.codec
+	// The mapping is assigned when the pack is sealed and only removed once there are no users
+	mapped := p.mapped
+	p.users++
+	s.mutex.Unlock()
+
+	data := make([]byte, size)
+	var err error
+	if offset+size <= int64(len(mapped)) {
+		copy(data, mapped[offset:])
+	} else {
+		_, err = p.f.ReadAt(data, offset)
+	}
+
+	s.mutex.Lock()
+	s.releasePack(p)
+	s.mutex.Unlock()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil || codec == 0 {
+		return data, err
+	}
+	c, err := s.codec(codec)
+	if err != nil {
+		return nil, err
+	}
+	return c.Decompress(data, entry.dataSize)
+}
+
+// Decrements the number of users of a pack and closes it if it has become obsolete.
+func (s *packStorage) releasePack(p *packFile) {
+	p.users--
+	if p.users == 0 && p.obsolete {
+		p.close()
+	}
+}
+
+func (s *packStorage) Repack() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var candidates []*packFile
+	isCandidate := make(map[*packFile]bool)
+	for _, p := range s.packs {
+		if p.dead > 0 {
+			candidates = append(candidates, p)
+			isCandidate[p] = true
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// Collect the entries to move, in the order in which they were written
+	var keys []SKey
+	for key, entry := range s.entries {
+		if isCandidate[entry.pack] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := s.entries[keys[i]], s.entries[keys[j]]
+		if a.pack != b.pack {
+			return a.pack.id < b.pack.id
+		}
+		return a.recordOffset < b.recordOffset
+	})
+
+	// Copy live records into fresh pack files
+	if err := s.startPack(); err != nil {
+		return err
+	}
+	firstNew := len(s.packs) - 1
+	for _, key := range keys {
+		entry := s.entries[key]
+		record := make([]byte, entry.recordSize)
+		if _, err := entry.pack.f.ReadAt(record, entry.recordOffset); err != nil {
+			return err
+		}
+		p, offset, err := s.appendRaw(record)
+		if err != nil {
+			return err
+		}
+		entry.dataOffset += offset - entry.recordOffset
+		entry.pack, entry.recordOffset = p, offset
+	}
+	for _, p := range s.packs[firstNew:] {
+		if err := p.f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	// Remove obsolete packs, oldest first. That way, a crash can't resurrect deleted records.
+	packs := s.packs[:0]
+	for _, p := range s.packs {
+		if !isCandidate[p] {
+			packs = append(packs, p)
+		}
+	}
+	s.packs = packs
+	for _, p := range candidates {
+		if LoggingEnabled {
+			log.Printf("Repack: removing %v (%d of %d bytes dead)", p.path, p.dead, p.size)
+		}
+		p.obsolete = true
+		if p.users == 0 {
+			p.close()
+		}
+		if err := os.Remove(p.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *packStorage) removeFromChain(key *SKey, entry *packEntry) {
+	if youngerEntry := s.entries[entry.younger]; youngerEntry != nil {
+		youngerEntry.older = entry.older
+	} else if s.youngest == *key {
+		s.youngest = entry.older
+	}
+	if olderEntry := s.entries[entry.older]; olderEntry != nil {
+		olderEntry.younger = entry.younger
+	} else if s.oldest == *key {
+		s.oldest = entry.younger
+	}
+	// clear outgoing links
+	entry.younger, entry.older = SKey{}, SKey{}
+}
+
+func (s *packStorage) insertIntoChain(key *SKey, entry *packEntry) {
+	entry.older = s.youngest
+	if youngestEntry := s.entries[s.youngest]; youngestEntry != nil {
+		// chain former youngest entry to new one
+		youngestEntry.younger = *key
+	} else {
+		// empty map, new entry will also be oldest
+		s.oldest = *key
+	}
+	s.youngest = *key
+}
+
+// Mutex lock-protected version of lock()
+func (s *packStorage) lockL(key *SKey, entry *packEntry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lock(key, entry)
+}
+
+func (s *packStorage) lock(key *SKey, entry *packEntry) {
+	if entry.refs == 0 {
+		s.removeFromChain(key, entry)
+		s.bytesLocked += entry.storageSize()
+	}
+	entry.refs++
+}
+
+// Mutex lock-protected version of release()
+func (s *packStorage) releaseL(key *SKey, entry *packEntry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.release(key, entry)
+}
+
+// Dereferences a single entry. Must happen while mutex is held.
+func (s *packStorage) release(key *SKey, entry *packEntry) {
+	if entry.refs == 0 {
+		panic(fmt.Sprintf("Can't release entry %v with 0 references", key))
+	}
+	entry.refs--
+	if entry.refs == 0 {
+		s.bytesLocked -= entry.storageSize()
+		s.insertIntoChain(key, entry)
+	}
+}
+
+// These are only estimates. Even an empty file consumes storage.
+const entrySize = 112
+const chunkSize = 40
+
+func (e *packEntry) storageSize() int64 {
+	return int64(entrySize) + e.storedSize + int64(chunkSize*len(e.chunks))
+}
+
+func (f *storedFile) Key() SKey {
+	return f.key
+}
+
+func (f *storedFile) Open() io.ReadCloser {
+	if len(f.entry.chunks) > 0 {
+		f.storage.lockL(&f.key, f.entry)
+		return &chunkReader{
+			storage:    f.storage,
+			entry:      f.entry,
+			key:        f.key,
+			chunksTail: f.entry.chunks,
+			closed:     false,
+		}
+	} else {
+		return &dataReader{storage: f.storage, entry: f.entry}
+	}
+}
+
+// Implements ExtentFile. Chunks and unchunked files are stored contiguously in pack files.
+// Returns ErrNoExtents if any of them has been compressed.
+func (f *storedFile) WalkExtents(fn func(src *os.File, offset, length int64) error) error {
+	f.checkValid()
+	entries := []*packEntry{f.entry}
+	// The chunks are locked by the file's entry
+	f.storage.mutex.Lock()
+	if len(f.entry.chunks) > 0 {
+		entries = make([]*packEntry, len(f.entry.chunks))
+		for i, c := range f.entry.chunks {
+			entries[i] = f.storage.entries[c.key]
+		}
+	}
+	for _, entry := range entries {
+		if entry.codec != 0 {
+			f.storage.mutex.Unlock()
+			return ErrNoExtents
+		}
+	}
+	f.storage.mutex.Unlock()
+	for _, entry := range entries {
+		s := f.storage
+		s.mutex.Lock()
+		p, offset, size := entry.pack, entry.dataOffset, entry.dataSize
+		p.users++
+		s.mutex.Unlock()
+		err := fn(p.f, offset, size)
+		s.mutex.Lock()
+		s.releasePack(p)
+		s.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *storedFile) OpenTransformed(transform TransformFunc) io.ReadCloser {
+	return OpenTransformed(f, transform)
+}
+
+func (f *storedFile) Size() int64 {
+	if len(f.entry.chunks) > 0 {
+		return f.entry.chunks[len(f.entry.chunks)-1].nextPos
+	} else {
+		return f.entry.dataSize
+	}
+}
+
+// Called by the garbage collector if leak detection is enabled (see cafs.SetLeakMode).
+func (f *storedFile) finalize() {
+	if !f.disposed && ReportLeak(f.key, f.entry.info) {
+		f.Dispose()
+	}
+}
+
+func (f *storedFile) Dispose() {
+	if !f.disposed {
+		f.disposed = true
+		f.storage.releaseL(&f.key, f.entry)
+	}
+}
+
+func (f *storedFile) checkValid() {
+	if f.disposed {
+		panic("Already disposed")
+	}
+}
+
+func (f *storedFile) Duplicate() File {
+	f.checkValid()
+	file, err := f.storage.get(&f.key)
+	if err != nil {
+		panic("Couldn't duplicate file")
+	}
+	return file
+}
+
+func (f *storedFile) IsChunked() bool {
+	f.checkValid()
+	return len(f.entry.chunks) > 0
+}
+
+func (f *storedFile) Chunks() FileIterator {
+	var chunks []chunkRef
+	if len(f.entry.chunks) > 0 {
+		chunks = f.entry.chunks
+	} else {
+		chunks = []chunkRef{{f.key, f.Size()}}
+	}
+	f.storage.lockL(&f.key, f.entry)
+	return &chunksIter{
+		storage:      f.storage,
+		entry:        f.entry,
+		key:          f.key,
+		chunks:       chunks,
+		lastChunkIdx: -1,
+	}
+}
+
+func (f *storedFile) NumChunks() int64 {
+	if len(f.entry.chunks) > 0 {
+		return int64(len(f.entry.chunks))
+	} else {
+		return 1
+	}
+}
+
+func (f *storedFile) ContentType() string {
+	f.storage.mutex.Lock()
+	defer f.storage.mutex.Unlock()
+	return f.entry.contentType
+}
+
+type chunksIter struct {
+	storage      *packStorage
+	key          SKey
+	entry        *packEntry
+	chunks       []chunkRef
+	chunkIdx     int
+	lastChunkIdx int
+	disposed     bool
+}
+
+func (ci *chunksIter) checkValid() {
+	if ci.disposed {
+		panic("Already disposed")
+	}
+}
+
+func (ci *chunksIter) Dispose() {
+	if !ci.disposed {
+		ci.disposed = true
+		ci.storage.releaseL(&ci.key, ci.entry)
+	}
+}
+
+func (ci *chunksIter) Duplicate() FileIterator {
+	ci.checkValid()
+	ci.storage.lockL(&ci.key, ci.entry)
+	return &chunksIter{
+		storage:      ci.storage,
+		key:          ci.key,
+		entry:        ci.entry,
+		chunks:       ci.chunks,
+		chunkIdx:     ci.chunkIdx,
+		lastChunkIdx: ci.lastChunkIdx,
+	}
+}
+
+func (ci *chunksIter) Next() bool {
+	ci.checkValid()
+	if ci.chunkIdx == len(ci.chunks) {
+		ci.Dispose()
+		return false
+	} else {
+		ci.lastChunkIdx = ci.chunkIdx
+		ci.chunkIdx++
+		return true
+	}
+}
+
+func (ci *chunksIter) Key() SKey {
+	ci.checkValid()
+	return ci.chunks[ci.lastChunkIdx].key
+}
+
+func (ci *chunksIter) Size() int64 {
+	ci.checkValid()
+	startPos := int64(0)
+	if ci.lastChunkIdx > 0 {
+		startPos = ci.chunks[ci.lastChunkIdx-1].nextPos
+	}
+	return ci.chunks[ci.lastChunkIdx].nextPos - startPos
+}
+
+func (ci *chunksIter) File() File {
+	ci.checkValid()
+	if f, err := ci.storage.Get(&ci.chunks[ci.lastChunkIdx].key); err != nil {
+		panic(err)
+	} else {
+		return f
+	}
+}
+
+// Data is read from the pack file lazily, on the first call to Read().
+func (r *dataReader) Read(b []byte) (n int, err error) {
+	if !r.loaded {
+		r.loaded = true
+		r.data, r.err = r.storage.readData(r.entry)
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n = copy(b, r.data)
+	r.data = r.data[n:]
+	return
+}
+
+func (r *dataReader) Close() error {
+	r.data = nil
+	return nil
+}
+
+func (r *chunkReader) Read(b []byte) (n int, err error) {
+	if r.closed {
+		err = ErrInvalidState
+		return
+	}
+	for n == 0 && err == nil {
+		if r.dataReader == nil {
+			if len(r.chunksTail) > 0 {
+				if f, e := r.storage.Get(&r.chunksTail[0].key); e != nil {
+					panic(e)
+				} else {
+					defer f.Dispose()
+					r.dataReader = f.Open()
+					r.chunksTail = r.chunksTail[1:]
+				}
+			} else {
+				return 0, io.EOF
+			}
+		}
+
+		n, err = r.dataReader.Read(b)
+		if err == io.EOF {
+			// never pass through delegate EOF
+			err = r.dataReader.Close()
+			r.dataReader = nil
+		}
+	}
+	return
+}
+
+func (r *chunkReader) Close() (err error) {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	r.storage.releaseL(&r.key, r.entry)
+
+	if r.dataReader != nil {
+		err = r.dataReader.Close()
+		r.dataReader = nil
+	}
+
+	return
+}
+
+// Implements Resumer.
+func (s *packStorage) Resume(cp *Checkpoint, info string, opts CreateOptions) (Temporary, error) {
+	t := NewChunkingTemporary(packChunkStore{s}, sha256.New, s.opts.Profiles, info, opts)
+	if err := t.Restore(cp); err != nil {
+		t.Dispose()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Type packChunkStore lets a ChunkingTemporary store into a pack storage.
+type packChunkStore struct {
+	*packStorage
+}
+
+func (s packChunkStore) StoreData(key *SKey, data []byte, info, contentType string) (bool, error) {
+	return s.storeEntry(key, data, nil, info, contentType)
+}
+
+func (s packChunkStore) StoreChunks(key *SKey, chunks []ChunkRef, info, contentType string) error {
+	refs := make([]chunkRef, len(chunks))
+	for i, chunk := range chunks {
+		refs[i] = chunkRef{key: chunk.Key, nextPos: chunk.NextPos}
+	}
+	_, err := s.storeEntry(key, nil, refs, info, contentType)
+	return err
+}
+
+func (s packChunkStore) LockChunk(key *SKey) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := s.entries[*key]
+	if entry == nil || len(entry.chunks) > 0 {
+		return 0, ErrNotFound
+	}
+	s.lock(key, entry)
+	return entry.dataSize, nil
+}
+
+func (s packChunkStore) Release(key *SKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.release(key, s.entries[*key])
+}
+
+func (s packChunkStore) Remove(key *SKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if entry := s.entries[*key]; entry != nil && entry.refs == 0 {
+		if err := s.deleteEntry(key, entry); err != nil {
+			log.Printf("Removing rejected chunk %v: %v", *key, err)
+		}
+	}
+}
+
+func (s packChunkStore) File(key *SKey) (File, error) {
+	return s.get(key)
+}
@@ -0,0 +1,809 @@
+package pack
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	. "github.com/indyjo/cafs"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func addRandomData(t testing.TB, s FileStorage, seed int64, size int) ([]byte, File) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	temp := s.Create("Random data")
+	defer temp.Dispose()
+	if _, err := temp.Write(data); err != nil {
+		t.Fatalf("Error on Write: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		t.Fatalf("Error on Close: %v", err)
+	}
+	return data, temp.File()
+}
+
+func assertContent(t *testing.T, s FileStorage, key SKey, expected []byte) {
+	f, err := s.Get(&key)
+	if err != nil {
+		t.Fatalf("Error getting %v: %v", key, err)
+	}
+	defer f.Dispose()
+	r := f.Open()
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error reading %v: %v", key, err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("Content of %v differs", key)
+	}
+}
+
+func packsSize(t *testing.T, dir string) (total int64) {
+	names, _ := filepath.Glob(filepath.Join(dir, "*.pack"))
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += fi.Size()
+	}
+	return
+}
+
+func TestPackStorage(t *testing.T) {
+	defer func(v int64) { MaxPackSize = v }(MaxPackSize)
+	MaxPackSize = 256 * 1024
+
+	dir := t.TempDir()
+	s, err := NewPackStorage(dir, 16*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data1, f1 := addRandomData(t, s, 1, 1024*1024)
+	data2, f2 := addRandomData(t, s, 2, 1024*1024)
+	key1, key2 := f1.Key(), f2.Key()
+	stat1 := FileStat{Size: f1.Size(), NumChunks: f1.NumChunks(), Resident: true}
+	if n := f1.NumChunks() + f2.NumChunks(); int64(s.NumPacks()) >= n/10 {
+		t.Errorf("Expected %d chunks to be stored in few packs, got %d", n, s.NumPacks())
+	}
+	assertContent(t, s, key1, data1)
+	assertContent(t, s, key2, data2)
+
+	// Reopen storage, check that both files are still there
+	f1.Dispose()
+	f2.Dispose()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = NewPackStorage(dir, 16*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := s.StatByKey(&key1); err != nil || stat != stat1 {
+		t.Errorf("StatByKey after reopening: expected %v, got %v (err: %v)", stat1, stat, err)
+	}
+	assertContent(t, s, key1, data1)
+	assertContent(t, s, key2, data2)
+
+	// Delete first file by clearing the cache while holding the second one
+	f2, _ = s.Get(&key2)
+	sizeBefore := packsSize(t, dir)
+	s.FreeCache()
+	if _, err := s.Get(&key1); err != ErrNotFound {
+		t.Fatalf("Expected file 1 to be deleted, got %v", err)
+	}
+	if err := s.Repack(); err != nil {
+		t.Fatalf("Error on repack: %v", err)
+	}
+	sizeAfter := packsSize(t, dir)
+	if reclaimed := sizeBefore - sizeAfter; reclaimed < int64(len(data1)) {
+		t.Errorf("Expected at least %d bytes to be reclaimed, got %d", len(data1), reclaimed)
+	}
+	assertContent(t, s, key2, data2)
+	f2.Dispose()
+
+	// Reopen again, check that the deletion persists
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = NewPackStorage(dir, 16*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Get(&key1); err != ErrNotFound {
+		t.Fatalf("Expected file 1 to be deleted after reopening, got %v", err)
+	}
+	if _, err := s.StatByKey(&key1); err != ErrNotFound {
+		t.Errorf("Expected StatByKey to return ErrNotFound, got %v", err)
+	}
+	assertContent(t, s, key2, data2)
+	if ui := s.GetUsageInfo(); ui.Used < int64(len(data2)) || ui.Used > int64(len(data1)+len(data2)) {
+		t.Errorf("Unexpected usage: %v", ui)
+	}
+}
+
+func TestPackStorageTruncated(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPackStorage(dir, 16*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data1, f1 := addRandomData(t, s, 1, 1000)
+	key1 := f1.Key()
+	f1.Dispose()
+	_, f2 := addRandomData(t, s, 2, 1000)
+	key2 := f2.Key()
+	f2.Dispose()
+	s.Close()
+
+	// Simulate a crash while writing the second record
+	path := packPath(dir, 1)
+	fi, _ := os.Stat(path)
+	if err := os.Truncate(path, fi.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err = NewPackStorage(dir, 16*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assertContent(t, s, key1, data1)
+	if _, err := s.Get(&key2); err != ErrNotFound {
+		t.Fatalf("Expected truncated file to be missing, got %v", err)
+	}
+	// Storage must be writable after truncation
+	data3, f3 := addRandomData(t, s, 3, 1000)
+	defer f3.Dispose()
+	assertContent(t, s, f3.Key(), data3)
+}
+
+func TestPackStorageLRU(t *testing.T) {
+	s, err := NewPackStorage(t.TempDir(), 3*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var keys []SKey
+	for i := int64(0); i < 4; i++ {
+		_, f := addRandomData(t, s, i, 1024*1024)
+		keys = append(keys, f.Key())
+		f.Dispose()
+	}
+	if _, err := s.Get(&keys[0]); err != ErrNotFound {
+		t.Errorf("Expected oldest file to be evicted, got %v", err)
+	}
+	if f, err := s.Get(&keys[3]); err != nil {
+		t.Errorf("Expected youngest file to be present, got %v", err)
+	} else {
+		f.Dispose()
+	}
+	s.FreeCache()
+	if ui := s.GetUsageInfo(); ui.Used != 0 || ui.Locked != 0 {
+		t.Errorf("Expected storage to be empty, got %v", ui)
+	}
+
+	// Pinned files aren't evicted
+	_, pinned := addRandomData(t, s, 10, 1024*1024)
+	key := pinned.Key()
+	if err := s.Pin(pinned); err != nil {
+		t.Fatal(err)
+	}
+	pinned.Dispose()
+	for i := int64(0); i < 4; i++ {
+		_, f := addRandomData(t, s, 20+i, 1024*1024)
+		f.Dispose()
+	}
+	s.FreeCache()
+	if f, err := s.Get(&key); err != nil {
+		t.Errorf("Expected pinned file to be present, got %v", err)
+	} else {
+		if err := s.Unpin(f); err != nil {
+			t.Error(err)
+		}
+		f.Dispose()
+	}
+	s.FreeCache()
+	if ui := s.GetUsageInfo(); ui.Used != 0 || ui.Locked != 0 {
+		t.Errorf("Expected storage to be empty after unpinning, got %v", ui)
+	}
+}
+
+func TestChunkListDedup(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPackStorage(dir, 16*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ns := NewNamespace(s, NamespaceOptions{Policy: NameVersion})
+	defer ns.Clear()
+
+	// Naming the same content many times stores its chunk list only once
+	var size int64
+	for i := 0; i < 20; i++ {
+		_, f := addRandomData(t, s, 1, 1024*1024)
+		if f.NumChunks() < 2 {
+			t.Fatalf("Expected a chunk list, got %d chunks", f.NumChunks())
+		}
+		if err := ns.SetName("data", f); err != nil {
+			t.Fatal(err)
+		}
+		f.Dispose()
+		if i == 0 {
+			size = packsSize(t, dir)
+		} else if packsSize(t, dir) != size {
+			t.Fatalf("Ingest %d grew the packs from %d to %d bytes", i, size, packsSize(t, dir))
+		}
+	}
+	if ns.Len() != 20 {
+		t.Errorf("Expected 20 names, got %d", ns.Len())
+	}
+}
+
+func TestPackStorageMmap(t *testing.T) {
+	defer func(v int64) { MaxPackSize = v }(MaxPackSize)
+	MaxPackSize = 256 * 1024
+
+	dir := t.TempDir()
+	s, err := NewPackStorageWithOptions(dir, 16*1024*1024, PackOptions{Mmap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data1, f1 := addRandomData(t, s, 1, 1024*1024)
+	data2, f2 := addRandomData(t, s, 2, 1024*1024)
+	key1, key2 := f1.Key(), f2.Key()
+	assertContent(t, s, key1, data1)
+	assertContent(t, s, key2, data2)
+	f1.Dispose()
+
+	// Repacking unmaps obsolete packs
+	s.FreeCache()
+	if err := s.Repack(); err != nil {
+		t.Fatal(err)
+	}
+	assertContent(t, s, key2, data2)
+	f2.Dispose()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Packs found on loading are mapped, too
+	if s, err = NewPackStorageWithOptions(dir, 16*1024*1024, PackOptions{Mmap: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assertContent(t, s, key2, data2)
+}
+
+func TestCloseDuringReads(t *testing.T) {
+	defer func(v int64) { MaxPackSize = v }(MaxPackSize)
+	MaxPackSize = 256 * 1024
+
+	s, err := NewPackStorageWithOptions(t.TempDir(), 16*1024*1024, PackOptions{Mmap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, f := addRandomData(t, s, 1, 2*1024*1024)
+	defer f.Dispose()
+
+	// Reads in progress while closing may fail, but must not access unmapped memory
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				r := f.Open()
+				_, _ = io.Copy(io.Discard, r)
+				r.Close()
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+}
+
+func benchmarkRandomReads(b *testing.B, opts PackOptions) {
+	defer func(v int64) { MaxPackSize = v }(MaxPackSize)
+	MaxPackSize = 1024 * 1024
+
+	s, err := NewPackStorageWithOptions(b.TempDir(), 64*1024*1024, opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	_, f := addRandomData(b, s, 1, 16*1024*1024)
+	defer f.Dispose()
+	var chunks []File
+	iter := f.Chunks()
+	for iter.Next() {
+		chunks = append(chunks, iter.File())
+	}
+	iter.Dispose()
+
+	r := rand.New(rand.NewSource(0))
+	buf := make([]byte, 1024*1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chunk := chunks[r.Intn(len(chunks))]
+		rd := chunk.Open()
+		if _, err := io.ReadFull(rd, buf[:chunk.Size()]); err != nil {
+			b.Fatal(err)
+		}
+		rd.Close()
+	}
+	b.StopTimer()
+	for _, chunk := range chunks {
+		chunk.Dispose()
+	}
+}
+
+func BenchmarkRandomReadsPlain(b *testing.B) {
+	benchmarkRandomReads(b, PackOptions{})
+}
+
+func BenchmarkRandomReadsMmap(b *testing.B) {
+	benchmarkRandomReads(b, PackOptions{Mmap: true})
+}
+
+func TestMaterialize(t *testing.T) {
+	s, err := NewPackStorage(t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	dir := t.TempDir()
+	for _, size := range []int{0, 1000, 3 * 1024 * 1024} {
+		data, f := addRandomData(t, s, int64(size), size)
+		for _, reflink := range []bool{false, true} {
+			path := filepath.Join(dir, fmt.Sprintf("file-%d-%v", size, reflink))
+			if err := Materialize(f, path, MaterializeOptions{Mode: 0640, Reflink: reflink}); err != nil {
+				t.Fatalf("Error materializing %d bytes: %v", size, err)
+			}
+			if content, err := os.ReadFile(path); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(content, data) {
+				t.Errorf("Content of %v differs", path)
+			}
+			if fi, err := os.Stat(path); err != nil {
+				t.Fatal(err)
+			} else if fi.Mode().Perm() != 0640 {
+				t.Errorf("Expected mode 0640, got %v", fi.Mode())
+			}
+		}
+		f.Dispose()
+	}
+	// No temporary files are left behind
+	if entries, _ := os.ReadDir(dir); len(entries) != 6 {
+		t.Errorf("Expected 6 files, got %v", entries)
+	}
+}
+
+func TestHashWorkers(t *testing.T) {
+	s, err := NewPackStorage(t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	data, f := addRandomData(t, s, 1, 2*1024*1024)
+	defer f.Dispose()
+	used := s.GetUsageInfo().Used
+
+	// Ingesting the same data again with parallel hashing must produce the same chunks
+	temp := s.CreateWithOptions("Parallel", CreateOptions{HashWorkers: 4})
+	defer temp.Dispose()
+	for b := data; len(b) > 0; b = b[len(b)/3+1:] {
+		if _, err := temp.Write(b[:len(b)/3+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := temp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	g := temp.File()
+	defer g.Dispose()
+	if g.Key() != f.Key() || g.NumChunks() != f.NumChunks() {
+		t.Errorf("Got %v with %d chunks, expected %v with %d chunks", g.Key(), g.NumChunks(), f.Key(), f.NumChunks())
+	}
+	if u := s.GetUsageInfo().Used; u != used {
+		t.Errorf("Expected no additional bytes to be used, got %d instead of %d", u, used)
+	}
+	assertContent(t, s, f.Key(), data)
+}
+
+func TestSnapshot(t *testing.T) {
+	s, err := NewPackStorage(t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	temp := s.Create("Growing")
+	defer temp.Dispose()
+	pos := 0
+	for _, end := range []int{100, 300000, 300001, len(data)} {
+		if _, err := temp.Write(data[pos:end]); err != nil {
+			t.Fatal(err)
+		}
+		pos = end
+		snapshot, err := temp.(Snapshotter).Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertContent(t, s, snapshot.Key(), data[:end])
+		snapshot.Dispose()
+	}
+	if err := temp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f := temp.File()
+	defer f.Dispose()
+	assertContent(t, s, f.Key(), data)
+}
+
+func TestFragmentation(t *testing.T) {
+	defer func(v int64) { MaxPackSize = v }(MaxPackSize)
+	MaxPackSize = 256 * 1024
+
+	dir := t.TempDir()
+	s, err := NewPackStorage(dir, 16*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Checks that the report is consistent with the pack files on disk
+	check := func(msg string) Fragmentation {
+		frag := s.Fragmentation()
+		if len(frag.Packs) != s.NumPacks() {
+			t.Fatalf("%v: expected %d packs, got %d", msg, s.NumPacks(), len(frag.Packs))
+		}
+		var live, dead int64
+		for _, p := range frag.Packs {
+			live += p.Live
+			dead += p.Dead
+			if p.Dead+p.Live > 0 && p.Fraction != float64(p.Dead)/float64(p.Dead+p.Live) {
+				t.Errorf("%v: pack %v has wrong fraction %v", msg, p.Name, p.Fraction)
+			}
+		}
+		if live != frag.Total.Live || dead != frag.Total.Dead {
+			t.Errorf("%v: total %+v doesn't match packs (live: %d, dead: %d)", msg, frag.Total, live, dead)
+		}
+		if size := packsSize(t, dir); size != live+dead+int64(len(packMagic)*len(frag.Packs)) {
+			t.Errorf("%v: %d bytes on disk, reported %d live and %d dead", msg, size, live, dead)
+		}
+		return frag
+	}
+
+	_, f1 := addRandomData(t, s, 1, 1024*1024)
+	_, f2 := addRandomData(t, s, 2, 1024*1024)
+	f1.Dispose()
+	before := check("Before deleting")
+	if before.Total.Dead != 0 || before.Total.Fraction != 0 {
+		t.Errorf("Expected no dead space, got %+v", before.Total)
+	}
+
+	// Delete the first file while holding the second one. Each deleted object leaves its record
+	// as dead space and adds a deletion record, which is dead as well.
+	sub := s.Subscribe(1024)
+	defer sub.Close()
+	s.FreeCache()
+	deleted := int64(0)
+	for len(sub.C) > 0 {
+		if e := <-sub.C; e.Type == EventEvicted {
+			deleted++
+		}
+	}
+	const deletionRecordSize = 1 + 32 + 3
+	after := check("After deleting")
+	if expected := before.Total.Live - after.Total.Live + deleted*deletionRecordSize; after.Total.Dead != expected {
+		t.Errorf("Expected %d dead bytes, got %d", expected, after.Total.Dead)
+	}
+	if after.Total.Live < f2.Size() || after.Total.Fraction < 0.4 || after.Total.Fraction > 0.6 {
+		t.Errorf("Unexpected fragmentation after deleting half of the data: %+v", after.Total)
+	}
+
+	// Repacking removes all dead space
+	if err := s.Repack(); err != nil {
+		t.Fatal(err)
+	}
+	repacked := check("After repacking")
+	if repacked.Total.Dead != 0 || repacked.Total.Live != after.Total.Live {
+		t.Errorf("Expected %d live and no dead bytes after repacking, got %+v", after.Total.Live, repacked.Total)
+	}
+	f2.Dispose()
+}
+
+func TestWriteTar(t *testing.T) {
+	s, err := NewPackStorage(t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	data1, f1 := addRandomData(t, s, 1, 1000)
+	defer f1.Dispose()
+	data2, f2 := addRandomData(t, s, 2, 3*1024*1024)
+	defer f2.Dispose()
+
+	// Content is copied from the pack files' extents
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := WriteTar(tw, []ArchiveEntry{{Name: "a", File: f1}, {Name: "b", File: f2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	for _, expected := range [][]byte{data1, data2} {
+		if _, err := tr.Next(); err != nil {
+			t.Fatal(err)
+		}
+		if content, err := io.ReadAll(tr); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(content, expected) {
+			t.Errorf("Content of %d bytes differs", len(expected))
+		}
+	}
+
+	// Compressed records aren't extents, so their content is read through the file
+	compressed, err := NewPackStorageWithOptions(t.TempDir(), 16*1024*1024, PackOptions{Codec: Flate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compressed.Close()
+	text := bytes.Repeat([]byte("Compressible content. "), 20000)
+	temp := compressed.Create("compressible")
+	defer temp.Dispose()
+	if _, err := temp.Write(text); err != nil {
+		t.Fatal(err)
+	}
+	if err := temp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f3 := temp.File()
+	defer f3.Dispose()
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	if err := WriteTar(tw, []ArchiveEntry{{Name: "c", File: f3}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr = tar.NewReader(&buf)
+	if _, err := tr.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := io.ReadAll(tr); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(content, text) {
+		t.Errorf("Content of compressed file differs")
+	}
+}
+
+func TestRepair(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPackStorage(dir, 16*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, f := addRandomData(t, s, 1, 1000)
+	key := f.Key()
+	f.Dispose()
+	s.Close()
+
+	// Flip a bit within the stored data
+	path := packPath(dir, 1)
+	pack, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack[len(pack)-100] ^= 1
+	if err := os.WriteFile(path, pack, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err = NewPackStorage(dir, 16*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)-100] ^= 1
+	assertContent(t, s, key, corrupt)
+	if err := s.(Repairer).Repair(&key, corrupt); err != ErrKeyMismatch {
+		t.Errorf("Expected ErrKeyMismatch when repairing with wrong data, got %v", err)
+	}
+	if err := s.(Repairer).Repair(&key, data); err != nil {
+		t.Fatal(err)
+	}
+	assertContent(t, s, key, data)
+	s.Close()
+
+	// The repaired content survives reopening
+	if s, err = NewPackStorage(dir, 16*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assertContent(t, s, key, data)
+	if frag := s.Fragmentation(); frag.Total.Dead == 0 {
+		t.Errorf("Expected the corrupt record to be dead space: %v", frag)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 1024*1024; i++ {
+		fmt.Fprintf(&buf, "Line %d of compressible test data\n", i)
+	}
+	text := buf.Bytes()
+	store := func(s FileStorage, data []byte) SKey {
+		temp := s.Create("Compression test")
+		defer temp.Dispose()
+		if _, err := temp.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := temp.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f := temp.File()
+		defer f.Dispose()
+		return f.Key()
+	}
+
+	plainDir, compressedDir := t.TempDir(), t.TempDir()
+	plain, err := NewPackStorage(plainDir, 16*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	s, err := NewPackStorageWithOptions(compressedDir, 16*1024*1024, PackOptions{Codec: Flate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := store(s, text)
+	if plainKey := store(plain, text); plainKey != key {
+		t.Fatalf("Compression changed the key from %v to %v", plainKey, key)
+	}
+	if p, c := packsSize(t, plainDir), packsSize(t, compressedDir); c > p/2 {
+		t.Errorf("Expected compressed packs to be much smaller: %d bytes vs. %d uncompressed", c, p)
+	}
+	if p, c := plain.GetUsageInfo().Used, s.GetUsageInfo().Used; c > p/2 {
+		t.Errorf("Expected compressed usage to be much smaller: %d bytes vs. %d uncompressed", c, p)
+	}
+	assertContent(t, s, key, text)
+
+	// Incompressible chunks are stored as they are
+	random, f := addRandomData(t, s, 1, 256*1024)
+	randomKey := f.Key()
+	iter := f.Chunks()
+	for iter.Next() {
+		k := iter.Key()
+		if entry := s.(*packStorage).entries[k]; entry.codec != 0 || entry.storedSize != entry.dataSize {
+			t.Errorf("Random chunk %v stored compressed", k)
+		}
+	}
+	iter.Dispose()
+	f.Dispose()
+
+	// Compressed data is readable after reopening, even without configuring the codec
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewPackStorage(compressedDir, 16*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assertContent(t, s, key, text)
+	assertContent(t, s, randomKey, random)
+	f, err = s.Get(&key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Dispose()
+	path := filepath.Join(t.TempDir(), "materialized")
+	if err := Materialize(f, path, MaterializeOptions{Reflink: true}); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(path); err != nil || !bytes.Equal(content, text) {
+		t.Errorf("Materialized content differs: %v", err)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPackStorage(dir, 16*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, expected := addRandomData(t, s, 1, 1024*1024)
+	expectedKey := expected.Key()
+	expected.Dispose()
+
+	temp := s.Create("Paused")
+	if _, err := temp.Write(data[:400000]); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := temp.(Pauser).Pause()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := cp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	temp.Dispose()
+
+	// Unreferenced chunks are kept when reopening the storage, as long as there's space
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = NewPackStorage(dir, 16*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var restored Checkpoint
+	if err := restored.UnmarshalBinary(encoded); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := s.(Resumer).Resume(&restored, "Resumed", CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Dispose()
+	if _, err := resumed.Write(data[400000:]); err != nil {
+		t.Fatal(err)
+	}
+	key, err := Finalize(resumed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertContent(t, s, key, data)
+	if key != expectedKey {
+		t.Errorf("Expected %v, got %v", expectedKey, key)
+	}
+}
+
+func TestEnumerateKeysSorted(t *testing.T) {
+	s, err := NewPackStorage(t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for seed := int64(1); seed <= 3; seed++ {
+		_, f := addRandomData(t, s, seed, 200000)
+		f.Dispose()
+	}
+	var keys []SKey
+	s.(KeyEnumerator).EnumerateKeys(func(key SKey) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) < 6 {
+		t.Fatalf("Expected more keys, got %d", len(keys))
+	}
+	for i := 1; i < len(keys); i++ {
+		if bytes.Compare(keys[i-1][:], keys[i][:]) >= 0 {
+			t.Fatalf("Keys #%d and #%d not in ascending order", i-1, i)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Returned by Checkpoint.UnmarshalBinary if the data isn't an encoded checkpoint.
+var ErrInvalidCheckpoint = errors.New("Invalid checkpoint")
+
+// Returned by Pause if the temporary's state can't be captured, e.g. because it places chunk
+// boundaries at the positions given by CreateOptions.BoundaryHints.
+var ErrCannotPause = errors.New("Temporary can't be paused")
+
+// Interface Pauser is implemented by temporaries whose ingest can be paused deliberately, e.g. to
+// yield resources during a backup window, and resumed later using the storage's Resumer.
+type Pauser interface {
+	// Stores the complete chunks written so far and returns a checkpoint capturing the state of
+	// the temporary, which includes the data of the incomplete last chunk. The temporary's working
+	// memory is released and it can only be disposed afterwards. As long as it isn't disposed,
+	// the chunks are retained, so that resuming from the checkpoint is guaranteed to succeed.
+	Pause() (*Checkpoint, error)
+}
+
+// Interface Resumer is implemented by storages whose temporaries implement Pauser.
+type Resumer interface {
+	// Returns a temporary continuing the ingest paused at `checkpoint`. Writing the remaining data
+	// to it yields the same file as an uninterrupted ingest, given the same CreateOptions. Returns
+	// ErrNotFound if chunks of the checkpoint have been evicted in the meantime.
+	Resume(checkpoint *Checkpoint, info string, opts CreateOptions) (Temporary, error)
+}
+
+// Type Checkpoint captures the state of a paused temporary (see Pauser). It can be encoded using
+// MarshalBinary for resuming the ingest in another process.
+type Checkpoint struct {
+	Chunks []SKey // Keys of the complete chunks written so far, in order
+	Tail   []byte // Data written since the last chunk boundary
+	Hash   []byte // Encoded state of the hash over the data written so far
+	Sniff  []byte // Beginning of the data, if content type detection was requested
+	Inline bool   // Whether Tail has been buffered for being stored inline and hasn't been hashed yet
+}
+
+// Version of the encoding of checkpoints
+const checkpointVersion = 1
+
+// Implements encoding.BinaryMarshaler.
+func (c *Checkpoint) MarshalBinary() ([]byte, error) {
+	var flags byte
+	if c.Inline {
+		flags = 1
+	}
+	b := []byte{checkpointVersion, flags}
+	b = binary.AppendUvarint(b, uint64(len(c.Chunks)))
+	for i := range c.Chunks {
+		b = append(b, c.Chunks[i][:]...)
+	}
+	for _, field := range [][]byte{c.Tail, c.Hash, c.Sniff} {
+		b = binary.AppendUvarint(b, uint64(len(field)))
+		b = append(b, field...)
+	}
+	return b, nil
+}
+
+// Implements encoding.BinaryUnmarshaler.
+func (c *Checkpoint) UnmarshalBinary(b []byte) error {
+	if len(b) < 2 || b[0] != checkpointVersion || b[1] > 1 {
+		return ErrInvalidCheckpoint
+	}
+	inline := b[1] == 1
+	b = b[2:]
+	n, l := binary.Uvarint(b)
+	if l <= 0 || n > uint64(len(b)-l)/uint64(len(SKey{})) {
+		return ErrInvalidCheckpoint
+	}
+	b = b[l:]
+	chunks := make([]SKey, n)
+	for i := range chunks {
+		b = b[copy(chunks[i][:], b):]
+	}
+	var fields [3][]byte
+	for i := range fields {
+		n, l := binary.Uvarint(b)
+		if l <= 0 || n > uint64(len(b)-l) {
+			return ErrInvalidCheckpoint
+		}
+		fields[i] = append([]byte(nil), b[l:l+int(n)]...)
+		b = b[l+int(n):]
+	}
+	if len(b) > 0 {
+		return ErrInvalidCheckpoint
+	}
+	*c = Checkpoint{Chunks: chunks, Tail: fields[0], Hash: fields[1], Sniff: fields[2], Inline: inline}
+	return nil
+}
@@ -0,0 +1,105 @@
+package cafs_test
+
+import (
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"math/rand"
+	"testing"
+)
+
+func TestPauseResume(t *testing.T) {
+	s := ram.NewRamStorage(8 * 1024 * 1024)
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+	copy(data, "<html>")
+	store := func(opts CreateOptions, pauseAt int) File {
+		temp := s.CreateWithOptions("Pause test", opts)
+		defer temp.Dispose()
+		if _, err := temp.Write(data[:pauseAt]); err != nil {
+			t.Fatal(err)
+		}
+		if pauseAt < len(data) {
+			cp, err := temp.(Pauser).Pause()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := temp.Write(data[pauseAt:]); err != ErrInvalidState {
+				t.Errorf("Expected ErrInvalidState writing to a paused temporary, got %v", err)
+			}
+			encoded, err := cp.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var restored Checkpoint
+			if err := restored.UnmarshalBinary(encoded); err != nil {
+				t.Fatal(err)
+			}
+			resumed, err := s.(Resumer).Resume(&restored, "Resumed", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resumed.Dispose()
+			temp.Dispose()
+			temp = resumed
+			if _, err := temp.Write(data[pauseAt:]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := temp.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return temp.File()
+	}
+	chunks := func(f File) (keys []SKey) {
+		iter := f.Chunks()
+		defer iter.Dispose()
+		for iter.Next() {
+			keys = append(keys, iter.Key())
+		}
+		return
+	}
+
+	for _, opts := range []CreateOptions{
+		{},
+		{HashWorkers: 4},
+		{SniffContentType: true},
+		{InlineThreshold: 2000},
+		{InlineThreshold: 2 * 1024 * 1024},
+	} {
+		expected := store(opts, len(data))
+		for _, pauseAt := range []int{0, 100, 1000, 333333, len(data) - 1} {
+			f := store(opts, pauseAt)
+			if f.Key() != expected.Key() || f.ContentType() != expected.ContentType() {
+				t.Errorf("%+v, paused at %d: expected %v (%v), got %v (%v)", opts, pauseAt, expected.Key(), expected.ContentType(), f.Key(), f.ContentType())
+			} else if a, b := chunks(f), chunks(expected); len(a) != len(b) {
+				t.Errorf("%+v, paused at %d: expected %d chunks, got %d", opts, pauseAt, len(b), len(a))
+			}
+			f.Dispose()
+		}
+		expected.Dispose()
+	}
+
+	// Resuming fails once the chunks have been evicted
+	temp := s.Create("Evicted")
+	_, _ = temp.Write(data)
+	cp, err := temp.(Pauser).Pause()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cp.Chunks) == 0 {
+		t.Fatal("Expected chunks to be stored when pausing")
+	}
+	temp.Dispose()
+	s.FreeCache()
+	if _, err := s.(Resumer).Resume(cp, "Evicted", CreateOptions{}); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	hinted := s.CreateWithOptions("Hinted", CreateOptions{BoundaryHints: []int64{10}})
+	defer hinted.Dispose()
+	if _, err := hinted.(Pauser).Pause(); err != ErrCannotPause {
+		t.Errorf("Expected ErrCannotPause, got %v", err)
+	}
+	if ui := s.GetUsageInfo(); ui.Locked != 0 {
+		t.Errorf("Expected nothing to be locked, got %v", ui)
+	}
+}
@@ -0,0 +1,47 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"errors"
+	"github.com/indyjo/cafs/chunking"
+)
+
+// Returned when writing into a temporary created with a chunking profile unknown to the storage.
+var ErrUnknownProfile = errors.New("Unknown chunking profile")
+
+// Type ChunkingProfiles maps names to chunker configurations, so that content of different kinds
+// can be chunked differently by naming a profile when ingesting it (see CreateOptions.Profile).
+// Storages accept profiles as an option.
+type ChunkingProfiles map[string]chunking.Config
+
+// Returns the chunker to use for a temporary created with `opts`, taking the profile and the
+// boundary hints into account. Meant to be used by storage implementations. Returns
+// ErrUnknownProfile if the profile isn't defined.
+func (p ChunkingProfiles) NewChunker(opts CreateOptions) (chunking.Chunker, error) {
+	var config chunking.Config
+	if opts.Profile != "" {
+		var ok bool
+		if config, ok = p[opts.Profile]; !ok {
+			return nil, ErrUnknownProfile
+		}
+	}
+	if len(opts.BoundaryHints) > 0 {
+		return chunking.NewHintedWithConfig(config, opts.BoundaryHints), nil
+	}
+	return chunking.NewWithConfig(config), nil
+}
@@ -0,0 +1,55 @@
+package cafs_test
+
+import (
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"math/rand"
+	"testing"
+)
+
+func TestChunkingProfiles(t *testing.T) {
+	profiles := ChunkingProfiles{
+		"small": {AvgChunk: 1024},
+		"large": {MinChunk: 4096, AvgChunk: 32768},
+	}
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(0)).Read(data)
+
+	// Uses a separate storage per profile because existing entries would be reused
+	ingest := func(profile string) File {
+		s := ram.NewRamStorageWithOptions(64*1024*1024, ram.RamOptions{Profiles: profiles})
+		temp := s.CreateWithOptions("profile "+profile, CreateOptions{Profile: profile})
+		defer temp.Dispose()
+		if _, err := temp.Write(data); err != nil {
+			t.Fatalf("Profile %v: %v", profile, err)
+		}
+		if err := temp.Close(); err != nil {
+			t.Fatalf("Profile %v: %v", profile, err)
+		}
+		return temp.File()
+	}
+	small := ingest("small")
+	defer small.Dispose()
+	large := ingest("large")
+	defer large.Dispose()
+	dflt := ingest("")
+	defer dflt.Dispose()
+
+	if small.Key() != large.Key() || small.Key() != dflt.Key() {
+		t.Errorf("Expected same key regardless of profile, got %v, %v and %v", small.Key(), large.Key(), dflt.Key())
+	}
+	if small.NumChunks() <= dflt.NumChunks() || large.NumChunks() >= dflt.NumChunks() {
+		t.Errorf("Expected chunk counts to differ by profile, got %d (small), %d (default) and %d (large)",
+			small.NumChunks(), dflt.NumChunks(), large.NumChunks())
+	}
+
+	s := ram.NewRamStorageWithOptions(64*1024*1024, ram.RamOptions{Profiles: profiles})
+	temp := s.CreateWithOptions("unknown", CreateOptions{Profile: "unknown"})
+	defer temp.Dispose()
+	if _, err := temp.Write(data); err != ErrUnknownProfile {
+		t.Errorf("Expected ErrUnknownProfile on write, got %v", err)
+	}
+	if err := temp.Close(); err != ErrUnknownProfile {
+		t.Errorf("Expected ErrUnknownProfile on close, got %v", err)
+	}
+}
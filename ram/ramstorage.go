@@ -21,12 +21,13 @@ package ram
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding"
 	"fmt"
 	. "github.com/indyjo/cafs"
-	"github.com/indyjo/cafs/chunking"
 	"hash"
 	"io"
 	"log"
+	"runtime"
 	"sync"
 )
 
@@ -35,7 +36,13 @@ type ramStorage struct {
 	entries             map[SKey]*ramEntry
 	bytesUsed, bytesMax int64
 	bytesLocked         int64
-	youngest, oldest    SKey
+	bytesHeadroom       int64          // Kept free on ingest by evicting early, if possible
+	policy              EvictionPolicy // Knows about all entries that aren't locked
+	events              EventBroker
+	access              *AccessCounter // Counts retrievals of files and chunks, if enabled
+	profiles            ChunkingProfiles
+	keySize             int  // Number of leading bytes of the SHA-256 hash kept in keys
+	paranoid            bool // Whether recycled entries are compared to the content being stored
 }
 
 type ramFile struct {
@@ -52,14 +59,15 @@ type chunkRef struct {
 }
 
 type ramEntry struct {
-	// Keys to the next older and next younger entry
-	younger, older SKey
-	info           string
+	info string
+	// MIME type detected on ingest, if requested
+	contentType string
 	// Holds data if entry is of simple kind
 	data []byte
 	// Holds a list of chunk positions if entry is of chunk list type
 	chunks []chunkRef
 	refs   int
+	pins   int // Number of references held by Pin
 }
 
 type ramDataReader struct {
@@ -76,23 +84,97 @@ type ramChunkReader struct {
 	dataReader io.ReadCloser
 }
 
-type ramTemporary struct {
-	storage   *ramStorage
-	info      string           // Info text given by user identifying the current file
-	buffer    bytes.Buffer     // Stores bytes since beginning of current chunk
-	fileHash  hash.Hash        // hash since the beginning of the file
-	chunkHash hash.Hash        // hash since the beginning of the current chunk
-	valid     bool             // If false, something has gone wrong
-	open      bool             // Set to false on Close()
-	chunker   chunking.Chunker // Determines chunk boundaries
-	chunks    []chunkRef       // Grows every time a chunk boundary is encountered
-}
-
 func NewRamStorage(maxBytes int64) BoundedStorage {
+	return NewRamStorageWithOptions(maxBytes, RamOptions{})
+}
+
+// Type RamOptions contains optional settings for a RAM storage.
+// The zero value selects the default behavior.
+type RamOptions struct {
+	// Decides which entries to evict when space is needed. Defaults to NewLRUPolicy().
+	Policy EvictionPolicy
+	// If set, retrievals of files and chunks, whether by Get or while reading a file, are counted
+	// per key and reported by HotChunks (see cafs.AccessReporter).
+	TrackAccess bool
+	// Fraction of the capacity, between 0 and 1, that storing an object tries to keep free by
+	// evicting entries earlier than necessary. This leaves slack for in-progress operations during
+	// bursty ingest. Objects are still stored if the headroom can't be kept free, as long as they fit.
+	Headroom float64
+	// Named chunker configurations which can be selected through CreateOptions.Profile.
+	Profiles ChunkingProfiles
+	// Number of leading bytes of the SHA-256 hash kept in keys, the remaining bytes being zero.
+	// Values outside of MinKeySize and 32 select full-length keys. Truncated keys save space where
+	// keys are stored compactly, at the cost of collisions becoming likely: for n distinct chunks
+	// and files, the probability of any two sharing a key of k bytes is about n²/2^(8k+1). With
+	// 8 bytes and a million objects, that's 3·10⁻⁸, with 4 bytes and 10,000 objects already 1%.
+	// Therefore, Paranoid is always enabled for truncated keys.
+	//
+	// Content can only be exchanged with storages using keys of the same length, and cafs.Verify
+	// reports the chunks of such a storage as damaged.
+	KeySize int
+	// If set, content stored under a key that is already in use is compared to the stored content
+	// byte by byte instead of being deduplicated blindly. Storing fails with ErrKeyCollision if the
+	// contents differ.
+	Paranoid bool
+}
+
+// The minimum number of bytes of truncated keys (see RamOptions.KeySize).
+const MinKeySize = 4
+
+// Like NewRamStorage, but allows for specifying options.
+func NewRamStorageWithOptions(maxBytes int64, opts RamOptions) BoundedStorage {
+	if opts.Policy == nil {
+		opts.Policy = NewLRUPolicy()
+	}
+	if opts.KeySize < MinKeySize || opts.KeySize > len(SKey{}) {
+		opts.KeySize = len(SKey{})
+	}
 	return &ramStorage{
-		entries:  make(map[SKey]*ramEntry),
-		bytesMax: maxBytes,
+		entries:       make(map[SKey]*ramEntry),
+		bytesMax:      maxBytes,
+		bytesHeadroom: int64(float64(maxBytes) * min(max(opts.Headroom, 0), 1)),
+		policy:        opts.Policy,
+		access:        NewAccessCounter(opts.TrackAccess),
+		profiles:      opts.Profiles,
+		keySize:       opts.KeySize,
+		paranoid:      opts.Paranoid || opts.KeySize < len(SKey{}),
+	}
+}
+
+// Type truncatedHash zeroes all but the first `size` bytes of the hashes computed by Hash.
+type truncatedHash struct {
+	hash.Hash
+	size int
+}
+
+func (h truncatedHash) MarshalBinary() ([]byte, error) {
+	return h.Hash.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+func (h truncatedHash) UnmarshalBinary(b []byte) error {
+	return h.Hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+}
+
+func (h truncatedHash) Sum(b []byte) []byte {
+	n := len(b)
+	b = h.Hash.Sum(b)
+	clear(b[n+h.size:])
+	return b
+}
+
+// Returns a new hash computing keys of this storage.
+func (s *ramStorage) newHash() hash.Hash {
+	if s.keySize == len(SKey{}) {
+		return sha256.New()
 	}
+	return truncatedHash{sha256.New(), s.keySize}
+}
+
+// Returns the key of `data` in this storage.
+func (s *ramStorage) hashKey(data []byte) SKey {
+	key := SKey(sha256.Sum256(data))
+	clear(key[s.keySize:])
+	return key
 }
 
 func (s *ramStorage) GetUsageInfo() UsageInfo {
@@ -105,40 +187,112 @@ func (s *ramStorage) FreeCache() int64 {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	oldBytesUsed := s.bytesUsed
-	s.reserveBytes("FreeCache", s.bytesMax)
+	s.reserveBytes("FreeCache", s.bytesMax, 0)
+	s.events.Publish(Event{Type: EventCacheFreed, Size: oldBytesUsed - s.bytesUsed})
 	return oldBytesUsed - s.bytesUsed
 }
 
+func (s *ramStorage) Subscribe(bufferSize int) *Subscription {
+	return s.events.Subscribe(bufferSize)
+}
+
 func (s *ramStorage) Get(key *SKey) (File, error) {
+	file, err := s.get(key)
+	if err == nil {
+		s.access.Record(*key)
+	}
+	return file, err
+}
+
+// Like Get, but doesn't count as an access.
+func (s *ramStorage) get(key *SKey) (File, error) {
+	// Eviction happens under the same mutex and only considers entries without references, so
+	// an entry found here can't be evicted before the reference is taken.
 	s.mutex.Lock()
 	entry, ok := s.entries[*key]
 	if ok {
-		if entry.refs == 0 {
-			s.removeFromChain(key, entry)
-			s.bytesLocked += entry.storageSize()
-		}
-		entry.refs++
+		s.lock(key, entry)
 	}
 	s.mutex.Unlock()
 	if ok {
-		return &ramFile{s, *key, entry, false}, nil
+		f := &ramFile{s, *key, entry, false}
+		if GetLeakMode() != LeakIgnore {
+			runtime.SetFinalizer(f, (*ramFile).finalize)
+		}
+		return f, nil
 	} else {
 		return nil, ErrNotFound
 	}
-	return nil, nil // never reached
 }
 
-func (s *ramStorage) Create(info string) Temporary {
-	return &ramTemporary{
-		storage:   s,
-		info:      info,
-		fileHash:  sha256.New(),
-		chunkHash: sha256.New(),
-		valid:     true,
-		open:      true,
-		chunker:   chunking.New(),
-		chunks:    make([]chunkRef, 0, 16),
+func (s *ramStorage) HotChunks(n int) []AccessStat {
+	return s.access.Top(n)
+}
+
+func (s *ramStorage) StatByKey(key *SKey) (FileStat, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[*key]
+	if !ok {
+		return FileStat{}, ErrNotFound
+	}
+	// Chunks are kept alive by the entries referencing them, so a stored file is always complete.
+	stat := FileStat{Size: int64(len(entry.data)), NumChunks: 1, Resident: true}
+	if len(entry.chunks) > 0 {
+		stat.Size = entry.chunks[len(entry.chunks)-1].nextPos
+		stat.NumChunks = int64(len(entry.chunks))
 	}
+	return stat, nil
+}
+
+func (s *ramStorage) Pin(file File) error {
+	f, ok := file.(*ramFile)
+	if !ok || f.storage != s {
+		return ErrForeignFile
+	}
+	f.checkValid()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f.entry.pins++
+	s.lock(&f.key, f.entry)
+	return nil
+}
+
+func (s *ramStorage) Unpin(file File) error {
+	f, ok := file.(*ramFile)
+	if !ok || f.storage != s {
+		return ErrForeignFile
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if f.entry.pins == 0 {
+		return ErrNotPinned
+	}
+	f.entry.pins--
+	s.release(&f.key, f.entry)
+	return nil
+}
+
+func (s *ramStorage) EnumerateKeys(f func(key SKey) bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := make([]SKey, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	for _, key := range SortKeys(keys) {
+		if !f(key) {
+			return
+		}
+	}
+}
+
+func (s *ramStorage) Create(info string) Temporary {
+	return s.CreateWithOptions(info, CreateOptions{})
+}
+
+func (s *ramStorage) CreateWithOptions(info string, opts CreateOptions) Temporary {
+	return NewChunkingTemporary(ramChunkStore{s}, s.newHash, s.profiles, info, opts)
 }
 
 func (s *ramStorage) DumpStatistics(log Printer) {
@@ -157,11 +311,10 @@ func (s *ramStorage) DumpStatistics(log Printer) {
 	}
 
 	log.Printf("<html><head><title>CAFS Statistics</title></head><body><pre>")
-	log.Printf("Bytes used: %d, locked: %d, oldest: %x, youngest: %x", s.bytesUsed, s.bytesLocked, s.oldest[:4], s.youngest[:4])
+	log.Printf("Bytes used: %d, locked: %d", s.bytesUsed, s.bytesLocked)
 	for key, entry := range s.entries {
-		log.Printf("<a name=\"%v\">  [%v] refs=%d size=%v [%v] %v (older) %v (younger)</a>",
-			key, link(key, 4, false), entry.refs, entry.storageSize(), entry.info,
-			link(entry.older, 4, true), link(entry.younger, 4, true))
+		log.Printf("<a name=\"%v\">  [%v] refs=%d pins=%d size=%v [%v]</a>",
+			key, link(key, 4, false), entry.refs, entry.pins, entry.storageSize(), entry.info)
 
 		prevPos := int64(0)
 		for i, chunk := range entry.chunks {
@@ -173,34 +326,35 @@ func (s *ramStorage) DumpStatistics(log Printer) {
 	log.Printf("</pre></body></html>")
 }
 
-func (s *ramStorage) reserveBytes(info string, numBytes int64) error {
+// Makes sure that numBytes are free, evicting entries as needed. Beyond that, tries to keep
+// headroom bytes free.
+func (s *ramStorage) reserveBytes(info string, numBytes, headroom int64) error {
 	if numBytes > s.bytesMax {
 		return ErrNotEnoughSpace
 	}
+	headroom = min(headroom, s.bytesMax-numBytes)
 	bytesFree := s.bytesMax - s.bytesUsed
 	if bytesFree < numBytes && LoggingEnabled {
 		log.Printf("[%v] Need to free %v (currently unlocked %v) more bytes of CAFS space to store object of size %v",
 			info, numBytes-bytesFree, s.bytesUsed-s.bytesLocked, numBytes)
 	}
-	for bytesFree < numBytes {
-		oldestKey := s.oldest
-		oldestEntry := s.entries[oldestKey]
-		if oldestEntry == nil {
+	for bytesFree < numBytes+headroom {
+		victimKey, ok := s.policy.Evict()
+		if !ok && bytesFree >= numBytes {
+			break
+		} else if !ok {
 			return ErrNotEnoughSpace
 		}
-		s.removeFromChain(&s.oldest, oldestEntry)
-		delete(s.entries, oldestKey)
-
-		oldLocked := s.bytesLocked
-		// Dereference all referenced chunks
-		for _, chunk := range oldestEntry.chunks {
-			s.release(&chunk.key, s.entries[chunk.key])
+		victimEntry := s.entries[victimKey]
+		if victimEntry == nil || victimEntry.refs > 0 {
+			panic(fmt.Sprintf("Eviction policy selected invalid entry %v", victimKey))
 		}
-		oldestSize := oldestEntry.storageSize()
-		s.bytesUsed -= oldestSize
-		bytesFree += oldestSize
+		oldLocked := s.bytesLocked
+		s.deleteEntry(&victimKey, victimEntry)
+		victimSize := victimEntry.storageSize()
+		bytesFree += victimSize
 		if LoggingEnabled {
-			log.Printf("[%v]   Deleted object of size %v bytes: [%v] %v", info, oldestSize, oldestEntry.info, oldestKey)
+			log.Printf("[%v]   Deleted object of size %v bytes: [%v] %v", info, victimSize, victimEntry.info, victimKey)
 			if oldLocked != s.bytesLocked {
 				log.Printf("       -> unlocked %d bytes", oldLocked-s.bytesLocked)
 			}
@@ -209,9 +363,31 @@ func (s *ramStorage) reserveBytes(info string, numBytes int64) error {
 	return nil
 }
 
+// Removes an unreferenced entry which is no longer known to the eviction policy.
+func (s *ramStorage) deleteEntry(key *SKey, entry *ramEntry) {
+	delete(s.entries, *key)
+	s.access.Forget(*key)
+	// Dereference all referenced chunks
+	for _, chunk := range entry.chunks {
+		s.release(&chunk.key, s.entries[chunk.key])
+	}
+	s.bytesUsed -= entry.storageSize()
+	s.events.Publish(Event{Type: EventEvicted, Key: *key, Size: entry.storageSize(), Info: entry.info})
+}
+
+// Returns the size of the content stored as either data of the given size, or chunks.
+func contentSize(dataSize int64, chunks []chunkRef) int64 {
+	if len(chunks) > 0 {
+		return chunks[len(chunks)-1].nextPos
+	}
+	return dataSize
+}
+
 // Puts an entry into the store. If an entry already exists, it must be identical to the old one.
 // The newly-created or recycled entry has been lock'ed once and must be release'd properly.
-func (s *ramStorage) storeEntry(key *SKey, data []byte, chunks []chunkRef, info string) error {
+// A non-empty contentType is recorded with the entry.
+// Returns true if an existing entry was recycled.
+func (s *ramStorage) storeEntry(key *SKey, data []byte, chunks []chunkRef, info, contentType string) (bool, error) {
 	if len(data) > 0 && len(chunks) > 0 {
 		panic("Illegal entry")
 	}
@@ -220,8 +396,17 @@ func (s *ramStorage) storeEntry(key *SKey, data []byte, chunks []chunkRef, info
 
 	// Detect if we're re-writing the same data (or even handle a hash collision)
 	var newEntry *ramEntry
+	var recycled bool
 	if oldEntry := s.entries[*key]; oldEntry != nil {
-		if len(oldEntry.data) != len(data) || len(oldEntry.chunks) != len(chunks) {
+		// The same content may be stored with different chunks, e.g. if stored inline (see
+		// CreateOptions.InlineThreshold). The existing entry is kept in that case.
+		if s.paranoid && !s.sameContent(oldEntry, data, chunks) {
+			if LoggingEnabled {
+				log.Printf("[%v] Key collision: %v [%v]", info, key, oldEntry.info)
+			}
+			return false, ErrKeyCollision
+		}
+		if contentSize(int64(len(oldEntry.data)), oldEntry.chunks) != contentSize(int64(len(data)), chunks) {
 			panic(fmt.Sprintf("[%v] Key collision: %v [%v]", info, key, oldEntry.info))
 		}
 		if LoggingEnabled {
@@ -238,55 +423,88 @@ func (s *ramStorage) storeEntry(key *SKey, data []byte, chunks []chunkRef, info
 		}
 
 		// re-use old entry
+		if contentType != "" {
+			oldEntry.contentType = contentType
+		}
 		newEntry = oldEntry
+		recycled = true
 	} else {
 		newEntry = &ramEntry{
-			info:   info,
-			data:   data,
-			chunks: chunks,
-			refs:   1,
+			info:        info,
+			contentType: contentType,
+			data:        data,
+			chunks:      chunks,
+			refs:        1,
 		}
 		// Reserve the necessary space for storing the object
-		if err := s.reserveBytes(info, newEntry.storageSize()); err != nil {
-			return err
+		if err := s.reserveBytes(info, newEntry.storageSize(), s.bytesHeadroom); err != nil {
+			return false, err
 		}
 
 		s.entries[*key] = newEntry
 		s.bytesUsed += newEntry.storageSize()
 		s.bytesLocked += newEntry.storageSize()
+		s.events.Publish(Event{Type: EventStored, Key: *key, Size: newEntry.storageSize(), Info: info})
 		if LoggingEnabled {
 			log.Printf("[%v] Stored key: %v (data: %d bytes, chunks: %d)", info, key, len(data), len(chunks))
 		}
 	}
 
-	return nil
+	return recycled, nil
+}
+
+// Returns whether `entry` holds the content given by `data` or, if chunked, `chunks`.
+// Must happen while mutex is held.
+func (s *ramStorage) sameContent(entry *ramEntry, data []byte, chunks []chunkRef) bool {
+	if contentSize(int64(len(entry.data)), entry.chunks) != contentSize(int64(len(data)), chunks) {
+		return false
+	}
+	if len(entry.chunks) > 0 && len(entry.chunks) == len(chunks) {
+		// Chunks have been compared when they were stored
+		same := true
+		for i := range chunks {
+			same = same && entry.chunks[i] == chunks[i]
+		}
+		if same {
+			return true
+		}
+	}
+	return bytes.Equal(s.content(entry.data, entry.chunks), s.content(data, chunks))
 }
 
-func (s *ramStorage) removeFromChain(key *SKey, entry *ramEntry) {
-	if youngerEntry := s.entries[entry.younger]; youngerEntry != nil {
-		youngerEntry.older = entry.older
-	} else if s.youngest == *key {
-		s.youngest = entry.older
+// Returns the content given by `data` or, if chunked, `chunks`. Must happen while mutex is held.
+func (s *ramStorage) content(data []byte, chunks []chunkRef) []byte {
+	if len(chunks) == 0 {
+		return data
 	}
-	if olderEntry := s.entries[entry.older]; olderEntry != nil {
-		olderEntry.younger = entry.younger
-	} else if s.oldest == *key {
-		s.oldest = entry.younger
+	result := make([]byte, 0, contentSize(0, chunks))
+	for _, chunk := range chunks {
+		result = append(result, s.entries[chunk.key].data...)
 	}
-	// clear outgoing links
-	entry.younger, entry.older = SKey{}, SKey{}
+	return result
 }
 
-func (s *ramStorage) insertIntoChain(key *SKey, entry *ramEntry) {
-	entry.older = s.youngest
-	if youngestEntry := s.entries[s.youngest]; youngestEntry != nil {
-		// chain former youngest entry to new one
-		youngestEntry.younger = *key
-	} else {
-		// empty map, new entry will also be oldest
-		s.oldest = *key
+// Replaces the data of the chunk or unchunked file stored as `key` after checking that `data`
+// hashes to `key`. Returns ErrNotFound if there is no such entry or if it is chunked, as its
+// content is repaired by repairing its chunks. Readers of the old data keep it.
+func (s *ramStorage) Repair(key *SKey, data []byte) error {
+	if s.hashKey(data) != *key {
+		return ErrKeyMismatch
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := s.entries[*key]
+	if entry == nil || len(entry.chunks) > 0 {
+		return ErrNotFound
+	} else if len(entry.data) != len(data) {
+		return ErrKeyMismatch
+	}
+	// Readers of the old data keep it
+	entry.data = append([]byte{}, data...)
+	if LoggingEnabled {
+		log.Printf("[%v] Repaired key: %v (data: %d bytes)", entry.info, key, len(data))
 	}
-	s.youngest = *key
+	return nil
 }
 
 // Mutex lock-protected version of lock()
@@ -298,7 +516,7 @@ func (s *ramStorage) lockL(key *SKey, entry *ramEntry) {
 
 func (s *ramStorage) lock(key *SKey, entry *ramEntry) {
 	if entry.refs == 0 {
-		s.removeFromChain(key, entry)
+		s.policy.Remove(*key)
 		s.bytesLocked += entry.storageSize()
 	}
 	entry.refs++
@@ -319,7 +537,7 @@ func (s *ramStorage) release(key *SKey, entry *ramEntry) {
 	entry.refs--
 	if entry.refs == 0 {
 		s.bytesLocked -= entry.storageSize()
-		s.insertIntoChain(key, entry)
+		s.policy.Add(*key, entry.storageSize())
 	}
 }
 
@@ -346,18 +564,36 @@ func (f *ramFile) Open() io.ReadCloser {
 			closed:     false,
 		}
 	} else {
-		return &ramDataReader{f.entry.data, 0}
+		return &ramDataReader{f.data(), 0}
 	}
 }
 
+// Returns the data of an entry of simple kind, which may be replaced by Repair.
+func (f *ramFile) data() []byte {
+	f.storage.mutex.Lock()
+	defer f.storage.mutex.Unlock()
+	return f.entry.data
+}
+
+func (f *ramFile) OpenTransformed(transform TransformFunc) io.ReadCloser {
+	return OpenTransformed(f, transform)
+}
+
 func (f *ramFile) Size() int64 {
-	if f.entry.data != nil {
-		return int64(len(f.entry.data))
+	if len(f.entry.chunks) == 0 {
+		return int64(len(f.data()))
 	} else {
 		return f.entry.chunks[len(f.entry.chunks)-1].nextPos
 	}
 }
 
+// Called by the garbage collector if leak detection is enabled (see cafs.SetLeakMode).
+func (f *ramFile) finalize() {
+	if !f.disposed && ReportLeak(f.key, f.entry.info) {
+		f.Dispose()
+	}
+}
+
 func (f *ramFile) Dispose() {
 	if !f.disposed {
 		f.disposed = true
@@ -373,7 +609,7 @@ func (f *ramFile) checkValid() {
 
 func (f *ramFile) Duplicate() File {
 	f.checkValid()
-	file, err := f.storage.Get(&f.key)
+	file, err := f.storage.get(&f.key)
 	if err != nil {
 		panic("Couldn't duplicate file")
 	}
@@ -405,6 +641,12 @@ func (f *ramFile) Chunks() FileIterator {
 	}
 }
 
+func (f *ramFile) ContentType() string {
+	f.storage.mutex.Lock()
+	defer f.storage.mutex.Unlock()
+	return f.entry.contentType
+}
+
 func (f *ramFile) NumChunks() int64 {
 	if len(f.entry.chunks) > 0 {
 		return int64(len(f.entry.chunks))
@@ -546,158 +788,60 @@ func (r *ramChunkReader) Close() (err error) {
 	return
 }
 
-// Writes the current buffer into a new chunk and resets the buffer.
-// Assumes that chunkHash has already been updated.
-func (t *ramTemporary) flushBufferIntoChunk() error {
-	if t.buffer.Len() == 0 {
-		return nil
-	}
-
-	// Copy the chunk's data
-	chunkInfo := fmt.Sprintf("%v #%d", t.info, len(t.chunks))
-	chunkData := make([]byte, t.buffer.Len())
-	copy(chunkData, t.buffer.Bytes())
-
-	// Get the chunk hash
-	var key SKey
-	t.chunkHash.Sum(key[:0])
-	t.chunkHash.Reset()
-
-	if err := t.storage.storeEntry(&key, chunkData, nil, chunkInfo); err != nil {
-		return err
-	}
-
-	chunk := chunkRef{
-		key:     key,
-		nextPos: int64(t.buffer.Len()),
+// Implements Resumer.
+func (s *ramStorage) Resume(cp *Checkpoint, info string, opts CreateOptions) (Temporary, error) {
+	t := NewChunkingTemporary(ramChunkStore{s}, s.newHash, s.profiles, info, opts)
+	if err := t.Restore(cp); err != nil {
+		t.Dispose()
+		return nil, err
 	}
-	if len(t.chunks) > 0 {
-		chunk.nextPos += t.chunks[len(t.chunks)-1].nextPos
-	}
-	t.chunks = append(t.chunks, chunk)
-
-	t.buffer.Reset()
-	return nil
+	return t, nil
 }
 
-func (t *ramTemporary) Write(b []byte) (int, error) {
-	if !t.valid || !t.open {
-		return 0, ErrInvalidState
-	}
-	t.valid = false // only temporary -> set to true on successful end of function
-
-	nBytes := len(b)
-
-	for len(b) > 0 {
-		nBoundary := t.chunker.Scan(b)
-		if _, err := t.buffer.Write(b[:nBoundary]); err != nil {
-			return 0, err
-		}
-		t.chunkHash.Write(b[:nBoundary])
-		t.fileHash.Write(b[:nBoundary])
-		if nBoundary < len(b) {
-			// a chunk boundary was detected
-			if err := t.flushBufferIntoChunk(); err != nil {
-				return 0, err
-			}
-			b = b[nBoundary:]
-		} else {
-			b = nil
-		}
-	}
-
-	t.valid = true
-	return nBytes, nil
+// Type ramChunkStore lets a ChunkingTemporary store into a RAM storage.
+type ramChunkStore struct {
+	*ramStorage
 }
 
-func (t *ramTemporary) Close() error {
-	if !t.valid || !t.open {
-		return ErrInvalidState
-	}
-	t.open = false
-	t.valid = false // only temporary -> set to true on successful end of function
-	var key SKey
-	t.fileHash.Sum(key[:0])
-
-	if len(t.chunks) == 0 {
-		// File is single-chunk
-		data := make([]byte, t.buffer.Len())
-		copy(data, t.buffer.Bytes())
-		if err := t.storage.storeEntry(&key, data, nil, t.info); err != nil {
-			return err
-		}
-	} else {
-		// Flush buffer contents into one last chunk
-		if err := t.flushBufferIntoChunk(); err != nil {
-			return err
-		}
-		finalChunks := make([]chunkRef, len(t.chunks))
-		copy(finalChunks, t.chunks)
-		if err := t.storage.storeEntry(&key, nil, finalChunks, t.info); err != nil {
-			return err
-		}
-	}
-	t.valid = true
-	return nil
+func (s ramChunkStore) StoreData(key *SKey, data []byte, info, contentType string) (bool, error) {
+	return s.storeEntry(key, data, nil, info, contentType)
 }
 
-func (t *ramTemporary) File() File {
-	if !t.valid {
-		panic(ErrInvalidState)
-	}
-	if t.open {
-		panic(ErrStillOpen)
+func (s ramChunkStore) StoreChunks(key *SKey, chunks []ChunkRef, info, contentType string) error {
+	refs := make([]chunkRef, len(chunks))
+	for i, chunk := range chunks {
+		refs[i] = chunkRef{key: chunk.Key, nextPos: chunk.NextPos}
 	}
-
-	var key SKey
-	t.fileHash.Sum(key[:0])
-
-	file, err := t.storage.Get(&key)
-	if err != nil {
-		// Shouldn't happen
-		panic(err)
-	}
-	return file
+	_, err := s.storeEntry(key, nil, refs, info, contentType)
+	return err
 }
 
-func (t *ramTemporary) Dispose() {
-	if t.chunks == nil {
-		// temporary was already disposed, we allow this
-		return
+func (s ramChunkStore) LockChunk(key *SKey) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := s.entries[*key]
+	if entry == nil || len(entry.chunks) > 0 {
+		return 0, ErrNotFound
 	}
+	s.lock(key, entry)
+	return int64(len(entry.data)), nil
+}
 
-	t.releaseFromStorage()
+func (s ramChunkStore) Release(key *SKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.release(key, s.entries[*key])
+}
 
-	t.valid = false
-	wasOpen := t.open
-	t.open = false
-	t.buffer = bytes.Buffer{}
-	t.chunker = nil
-	t.chunks = nil
-	if LoggingEnabled {
-		if wasOpen {
-			log.Printf("[%v] Temporary canceled", t.info)
-		} else {
-			log.Printf("[%v] Temporary disposed", t.info)
-		}
+func (s ramChunkStore) Remove(key *SKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if entry := s.entries[*key]; entry != nil && entry.refs == 0 {
+		s.policy.Forget(*key)
+		s.deleteEntry(key, entry)
 	}
 }
 
-// Calls release() on all chunks locked by this temporary.
-func (t *ramTemporary) releaseFromStorage() {
-	t.storage.mutex.Lock()
-	defer t.storage.mutex.Unlock()
-
-	// dereference single-chunk entry if successfully closed
-	if !t.open && t.valid {
-		var key SKey
-		t.fileHash.Sum(key[:0])
-		t.storage.release(&key, t.storage.entries[key])
-	} else {
-		// dereference all locked chunks otherwise
-		// (they have been locked once just by storing them)
-		for _, chunk := range t.chunks {
-			t.storage.release(&chunk.key, t.storage.entries[chunk.key])
-		}
-	}
+func (s ramChunkStore) File(key *SKey) (File, error) {
+	return s.get(key)
 }
@@ -1,10 +1,14 @@
 package ram
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	. "github.com/indyjo/cafs"
 	"io"
 	"math/rand"
+	"runtime"
+	"sync"
 	"testing"
 )
 
@@ -197,6 +201,18 @@ func addData(t *testing.T, s FileStorage, size int) File {
 	return temp.File()
 }
 
+func addBytes(t *testing.T, s FileStorage, data []byte) File {
+	temp := s.Create(fmt.Sprintf("%v bytes", len(data)))
+	defer temp.Dispose()
+	if _, err := temp.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := temp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return temp.File()
+}
+
 func addRandomData(t *testing.T, s FileStorage, size int) File {
 	temp := s.Create(fmt.Sprintf("%v random bytes", size))
 	defer temp.Dispose()
@@ -212,3 +228,937 @@ func addRandomData(t *testing.T, s FileStorage, size int) File {
 	}
 	return temp.File()
 }
+
+func TestContentType(t *testing.T) {
+	s := NewRamStorage(1000000)
+	png := append([]byte("\x89PNG\x0d\x0a\x1a\x0a"), make([]byte, 200000)...)
+	text := bytes.Repeat([]byte("Lorem ipsum dolor sit amet. "), 10)
+	for _, test := range []struct {
+		data        []byte
+		sniff       bool
+		contentType string
+	}{
+		{png, true, "image/png"},
+		{text, true, "text/plain; charset=utf-8"},
+		{text[1:], false, ""},
+		// Content type is recorded with the content, so de-duplicated content retains it
+		{text, false, "text/plain; charset=utf-8"},
+	} {
+		temp := s.CreateWithOptions("Sniffing", CreateOptions{SniffContentType: test.sniff})
+		// Write in small portions to check that sniffing works across calls to Write
+		for i := 0; i < len(test.data); i += 7 {
+			end := i + 7
+			if end > len(test.data) {
+				end = len(test.data)
+			}
+			if _, err := temp.Write(test.data[i:end]); err != nil {
+				t.Fatalf("Error on Write: %v", err)
+			}
+		}
+		if err := temp.Close(); err != nil {
+			t.Fatalf("Error on Close: %v", err)
+		}
+		f := temp.File()
+		temp.Dispose()
+		if ct := f.ContentType(); ct != test.contentType {
+			t.Errorf("Expected content type %#v, got %#v", test.contentType, ct)
+		}
+		f.Dispose()
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	s := NewRamStorage(1000)
+	sub := s.Subscribe(10)
+	defer sub.Close()
+	slowSub := s.Subscribe(1)
+
+	f := addData(t, s, 128)
+	key := f.Key()
+	f.Dispose()
+	freed := s.FreeCache()
+
+	expected := []Event{
+		{Type: EventStored, Key: key, Size: 128 + entrySize, Info: "Adding 128 bytes object"},
+		{Type: EventEvicted, Key: key, Size: 128 + entrySize, Info: "Adding 128 bytes object"},
+		{Type: EventCacheFreed, Size: freed},
+	}
+	for i, e := range expected {
+		select {
+		case actual := <-sub.C:
+			if actual != e {
+				t.Errorf("Event #%d: expected %v, got %v", i, e, actual)
+			}
+		default:
+			t.Fatalf("Event #%d: expected %v, got nothing", i, e)
+		}
+	}
+
+	if slowSub.Dropped() != int64(len(expected)-1) {
+		t.Errorf("Expected %d dropped events, got %d", len(expected)-1, slowSub.Dropped())
+	}
+	slowSub.Close()
+	slowSub.Close()
+	if e := <-slowSub.C; e.Type != EventStored {
+		t.Errorf("Expected buffered event to be delivered, got %v", e)
+	}
+	if _, ok := <-slowSub.C; ok {
+		t.Error("Expected channel to be closed")
+	}
+}
+
+type xorReader struct {
+	r      io.Reader
+	key    byte
+	closed bool
+}
+
+func (x *xorReader) Close() error {
+	x.closed = true
+	return nil
+}
+
+func (x *xorReader) Read(b []byte) (int, error) {
+	n, err := x.r.Read(b)
+	for i := 0; i < n; i++ {
+		b[i] ^= x.key
+	}
+	return n, err
+}
+
+func TestOpenTransformed(t *testing.T) {
+	s := NewRamStorage(1000000)
+	f := addRandomData(t, s, 500000)
+	defer f.Dispose()
+
+	r := f.Open()
+	reference, _ := io.ReadAll(r)
+	r.Close()
+	for i := range reference {
+		reference[i] ^= 0x5a
+	}
+
+	var x *xorReader
+	r = f.OpenTransformed(func(r io.Reader) io.Reader {
+		x = &xorReader{r: r, key: 0x5a}
+		return x
+	})
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	if !bytes.Equal(data, reference) {
+		t.Fatal("Transformed data differs from reference")
+	}
+	if !x.closed {
+		t.Error("Expected transformed reader to be closed")
+	}
+}
+
+func TestDedupGuard(t *testing.T) {
+	s := NewRamStorage(32 * 1024 * 1024)
+	data := make([]byte, 4*1024*1024)
+	for i := range data {
+		data[i] = byte(rand.Int())
+	}
+	guard := &DedupGuard{MinRatio: 0.8, WarmupChunks: 64}
+
+	ingest := func(data []byte, guard *DedupGuard) error {
+		temp := s.CreateWithOptions("guarded", CreateOptions{DedupGuard: guard})
+		defer temp.Dispose()
+		if _, err := temp.Write(data); err != nil {
+			return err
+		}
+		return temp.Close()
+	}
+
+	// Seed the storage without a guard
+	if err := ingest(data, nil); err != nil {
+		t.Fatalf("Error seeding storage: %v", err)
+	}
+
+	// Mostly overlapping content: a modified prefix followed by the original data
+	overlapping := append(append([]byte(nil), data[:16384]...), data...)
+	for i := 0; i < 16384; i++ {
+		overlapping[i] ^= 0x55
+	}
+	if err := ingest(overlapping, guard); err != nil {
+		t.Fatalf("Guard tripped on overlapping content: %v", err)
+	}
+
+	// Non-overlapping content
+	other := make([]byte, len(data))
+	for i := range other {
+		other[i] = byte(rand.Int())
+	}
+	if err := ingest(other, guard); err != ErrDedupTooLow {
+		t.Fatalf("Expected guard to trip on non-overlapping content, got: %v", err)
+	}
+
+	// Warn-only guards don't abort
+	for i := range other {
+		other[i] = byte(rand.Int())
+	}
+	if err := ingest(other, &DedupGuard{MinRatio: 0.8, WarmupChunks: 64, WarnOnly: true}); err != nil {
+		t.Fatalf("Warn-only guard aborted ingest: %v", err)
+	}
+
+	s.FreeCache()
+	if s.GetUsageInfo().Locked != 0 {
+		t.Errorf("Locked bytes remaining: %v", s.GetUsageInfo())
+	}
+}
+
+func TestStatByKey(t *testing.T) {
+	s := NewRamStorage(8 * 1024 * 1024)
+	for _, size := range []int{0, 100, 1000000} {
+		f := addRandomData(t, s, size)
+		key := f.Key()
+		expected := FileStat{Size: f.Size(), NumChunks: f.NumChunks(), Resident: true}
+		f.Dispose()
+		usage := s.GetUsageInfo()
+		if stat, err := s.StatByKey(&key); err != nil {
+			t.Errorf("Error statting file of size %v: %v", size, err)
+		} else if stat != expected {
+			t.Errorf("Expected %v, got %v", expected, stat)
+		} else if stat.Size != int64(size) {
+			t.Errorf("Expected size %v, got %v", size, stat.Size)
+		}
+		if s.GetUsageInfo() != usage {
+			t.Errorf("StatByKey changed usage: %v -> %v", usage, s.GetUsageInfo())
+		}
+	}
+	if _, err := s.StatByKey(&SKey{}); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestEnumerateKeys(t *testing.T) {
+	s := NewRamStorage(8 * 1024 * 1024)
+	f := addRandomData(t, s, 100000)
+	defer f.Dispose()
+	expected := map[SKey]bool{f.Key(): true}
+	chunks := f.Chunks()
+	for chunks.Next() {
+		expected[chunks.Key()] = true
+	}
+	chunks.Dispose()
+
+	found := make(map[SKey]bool)
+	s.(KeyEnumerator).EnumerateKeys(func(key SKey) bool {
+		found[key] = true
+		return true
+	})
+	if len(found) != len(expected) {
+		t.Errorf("Expected %d keys, found %d", len(expected), len(found))
+	}
+	for key := range expected {
+		if !found[key] {
+			t.Errorf("Key %v not enumerated", key)
+		}
+	}
+
+	n := 0
+	s.(KeyEnumerator).EnumerateKeys(func(key SKey) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("Expected enumeration to stop after first key, got %d calls", n)
+	}
+}
+
+func TestBoundaryHints(t *testing.T) {
+	// Create a tar-like stream of records, and a second one with the records in reverse order
+	r := rand.New(rand.NewSource(0))
+	var records [][]byte
+	for i := 0; i < 200; i++ {
+		record := make([]byte, 512+r.Intn(4096))
+		r.Read(record)
+		records = append(records, record)
+	}
+	stream := func(reverse bool) (data []byte, hints []int64) {
+		for i := range records {
+			if reverse {
+				i = len(records) - 1 - i
+			}
+			hints = append(hints, int64(len(data)))
+			data = append(data, records[i]...)
+		}
+		return
+	}
+	data1, hints1 := stream(false)
+	data2, hints2 := stream(true)
+
+	// Returns the number of bytes the second stream occupies in addition to the first one
+	extraBytes := func(hinted bool) int64 {
+		s := NewRamStorage(64 * 1024 * 1024)
+		ingest := func(data []byte, hints []int64) {
+			if !hinted {
+				hints = nil
+			}
+			temp := s.CreateWithOptions("stream", CreateOptions{BoundaryHints: hints})
+			defer temp.Dispose()
+			if _, err := temp.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := temp.Close(); err != nil {
+				t.Fatal(err)
+			}
+			f := temp.File()
+			defer f.Dispose()
+			rd := f.Open()
+			defer rd.Close()
+			if content, err := io.ReadAll(rd); err != nil || !bytes.Equal(content, data) {
+				t.Fatalf("Content mismatch (err: %v)", err)
+			}
+		}
+		ingest(data1, hints1)
+		used := s.GetUsageInfo().Used
+		ingest(data2, hints2)
+		return s.GetUsageInfo().Used - used
+	}
+
+	unhinted, hinted := extraBytes(false), extraBytes(true)
+	t.Logf("Extra bytes for re-ordered stream: %d unhinted, %d hinted (stream size: %d)", unhinted, hinted, len(data2))
+	if hinted*4 > unhinted {
+		t.Errorf("Expected hints to improve dedup significantly: %d unhinted vs. %d hinted", unhinted, hinted)
+	}
+}
+
+func TestPin(t *testing.T) {
+	s := NewRamStorage(3 * 1024 * 1024)
+	f := addRandomData(t, s, 1024*1024)
+	key := f.Key()
+	if err := s.Pin(f); err != nil {
+		t.Fatalf("Error pinning: %v", err)
+	}
+	f.Dispose()
+
+	// Overfill the storage. The pinned file must survive.
+	for i := 0; i < 4; i++ {
+		addRandomData(t, s, 1024*1024).Dispose()
+	}
+	s.FreeCache()
+	if f, err := s.Get(&key); err != nil {
+		t.Fatalf("Expected pinned file to survive, got %v", err)
+	} else {
+		defer f.Dispose()
+		if ui := s.GetUsageInfo(); ui.Locked < 1024*1024 {
+			t.Errorf("Expected pinned bytes to count as locked: %v", ui)
+		}
+		if err := s.Unpin(f); err != nil {
+			t.Errorf("Error unpinning: %v", err)
+		}
+		if err := s.Unpin(f); err != ErrNotPinned {
+			t.Errorf("Expected ErrNotPinned, got %v", err)
+		}
+		other := NewRamStorage(1024)
+		if err := other.Pin(f); err != ErrForeignFile {
+			t.Errorf("Expected ErrForeignFile, got %v", err)
+		}
+	}
+}
+
+// Ingests `data` in randomly sized writes and returns the keys of the resulting file and its chunks.
+func ingestWithWorkers(t *testing.T, s FileStorage, data []byte, workers int) (SKey, []SKey) {
+	temp := s.CreateWithOptions("ingest", CreateOptions{HashWorkers: workers})
+	defer temp.Dispose()
+	r := rand.New(rand.NewSource(1))
+	for b := data; len(b) > 0; {
+		n := 1 + r.Intn(65536)
+		if n > len(b) {
+			n = len(b)
+		}
+		if _, err := temp.Write(b[:n]); err != nil {
+			t.Fatal(err)
+		}
+		b = b[n:]
+	}
+	if err := temp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f := temp.File()
+	defer f.Dispose()
+	var chunks []SKey
+	iter := f.Chunks()
+	defer iter.Dispose()
+	for iter.Next() {
+		chunks = append(chunks, iter.Key())
+	}
+	return f.Key(), chunks
+}
+
+func TestHashWorkers(t *testing.T) {
+	for _, size := range []int{0, 100, 4 * 1024 * 1024} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+		serial := NewRamStorage(16 * 1024 * 1024)
+		key, chunks := ingestWithWorkers(t, serial, data, 1)
+		for _, workers := range []int{2, 3, 8} {
+			parallel := NewRamStorage(16 * 1024 * 1024)
+			pkey, pchunks := ingestWithWorkers(t, parallel, data, workers)
+			if pkey != key {
+				t.Errorf("Size %d, %d workers: got key %v, expected %v", size, workers, pkey, key)
+			}
+			if fmt.Sprint(pchunks) != fmt.Sprint(chunks) {
+				t.Errorf("Size %d, %d workers: chunks differ (%d vs. %d chunks)", size, workers, len(pchunks), len(chunks))
+			}
+			if pu, u := parallel.GetUsageInfo(), serial.GetUsageInfo(); pu != u {
+				t.Errorf("Size %d, %d workers: usage %v, expected %v", size, workers, pu, u)
+			}
+			if f, err := parallel.Get(&key); err != nil {
+				t.Errorf("Size %d, %d workers: %v", size, workers, err)
+			} else {
+				rd := f.Open()
+				if content, err := io.ReadAll(rd); err != nil || !bytes.Equal(content, data) {
+					t.Errorf("Size %d, %d workers: content mismatch (err: %v)", size, workers, err)
+				}
+				rd.Close()
+				f.Dispose()
+			}
+		}
+	}
+}
+
+func TestInlineThreshold(t *testing.T) {
+	s := NewRamStorage(16 * 1024 * 1024)
+	plain := NewRamStorage(16 * 1024 * 1024)
+	opts := CreateOptions{InlineThreshold: 64 * 1024}
+	ingest := func(s FileStorage, data []byte, opts CreateOptions) File {
+		temp := s.CreateWithOptions("ingest", opts)
+		defer temp.Dispose()
+		for b := data; len(b) > 0; b = b[len(b)/2+1:] {
+			if _, err := temp.Write(b[:len(b)/2+1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := temp.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return temp.File()
+	}
+
+	small := make([]byte, 48*1024)
+	rand.New(rand.NewSource(1)).Read(small)
+	chunked := ingest(plain, small, CreateOptions{})
+	defer chunked.Dispose()
+	if chunked.NumChunks() < 2 {
+		t.Fatalf("Expected small file to be chunked by default, got %d chunks", chunked.NumChunks())
+	}
+	inlined := ingest(s, small, opts)
+	defer inlined.Dispose()
+	if inlined.Key() != chunked.Key() || inlined.NumChunks() != 1 || inlined.IsChunked() {
+		t.Errorf("Expected small file to be stored inline, got %v with %d chunks", inlined.Key(), inlined.NumChunks())
+	}
+
+	// Inlined files are de-duplicated
+	used := s.GetUsageInfo().Used
+	again := ingest(s, small, opts)
+	defer again.Dispose()
+	if again.Key() != inlined.Key() || s.GetUsageInfo().Used != used {
+		t.Errorf("Expected inlined file to be de-duplicated")
+	}
+
+	// Content already stored with several chunks is reused
+	reused := ingest(plain, small, opts)
+	if reused.NumChunks() != chunked.NumChunks() {
+		t.Errorf("Expected existing entry to be reused, got %d chunks", reused.NumChunks())
+	}
+	reused.Dispose()
+
+	// Files above the threshold are chunked as usual
+	large := make([]byte, 256*1024)
+	rand.New(rand.NewSource(2)).Read(large)
+	expected := ingest(plain, large, CreateOptions{})
+	defer expected.Dispose()
+	f := ingest(s, large, opts)
+	defer f.Dispose()
+	if f.Key() != expected.Key() || f.NumChunks() != expected.NumChunks() || f.NumChunks() < 2 {
+		t.Errorf("Expected large file to be chunked as usual, got %d instead of %d chunks", f.NumChunks(), expected.NumChunks())
+	}
+	rd := f.Open()
+	defer rd.Close()
+	if content, err := io.ReadAll(rd); err != nil || !bytes.Equal(content, large) {
+		t.Errorf("Content mismatch (err: %v)", err)
+	}
+}
+
+// Runs a scan-heavy trace: a small set of hot files is accessed repeatedly, interleaved with
+// scans of cold files that are accessed only once. Returns the hit rate of the hot files.
+func hotHitRate(t *testing.T, policy EvictionPolicy) float64 {
+	s := NewRamStorageWithOptions(40*(entrySize+1000), RamOptions{Policy: policy})
+	content := func(i int) []byte {
+		data := make([]byte, 1000)
+		rand.New(rand.NewSource(int64(i))).Read(data)
+		return data
+	}
+	store := func(data []byte) SKey {
+		temp := s.CreateWithOptions("trace", CreateOptions{InlineThreshold: 4096})
+		defer temp.Dispose()
+		if _, err := temp.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := temp.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f := temp.File()
+		defer f.Dispose()
+		return f.Key()
+	}
+	const numHot = 20
+	var hotKeys []SKey
+	for i := 0; i < numHot; i++ {
+		hotKeys = append(hotKeys, store(content(i)))
+	}
+	hits, accesses := 0, 0
+	for round := 0; round < 50; round++ {
+		for i, key := range hotKeys {
+			accesses++
+			if f, err := s.Get(&key); err == nil {
+				hits++
+				f.Dispose()
+			} else {
+				store(content(i))
+			}
+		}
+		for i := 0; i < 30; i++ {
+			store(content(1000 + 30*round + i))
+		}
+	}
+	return float64(hits) / float64(accesses)
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	lru := hotHitRate(t, nil)
+	lfu := hotHitRate(t, NewLFUPolicy())
+	arc := hotHitRate(t, NewARCPolicy(40))
+	t.Logf("Hit rates of hot files: LRU %.2f, LFU %.2f, ARC %.2f", lru, lfu, arc)
+	if lfu <= lru+0.2 {
+		t.Errorf("Expected LFU to be significantly better than LRU: %.2f vs. %.2f", lfu, lru)
+	}
+	if arc <= lru+0.2 {
+		t.Errorf("Expected ARC to be significantly better than LRU: %.2f vs. %.2f", arc, lru)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s := NewRamStorage(64 * 1024 * 1024)
+	r := rand.New(rand.NewSource(0))
+	for _, opts := range []CreateOptions{{}, {HashWorkers: 4}, {InlineThreshold: 100000}} {
+		temp := s.CreateWithOptions("log", opts)
+		var written []byte
+		var snapshots []File
+		for phase := 0; phase < 8; phase++ {
+			data := make([]byte, r.Intn(200000))
+			r.Read(data)
+			if _, err := temp.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			written = append(written, data...)
+			snapshot, err := temp.(Snapshotter).Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			snapshots = append(snapshots, snapshot)
+			rd := snapshot.Open()
+			content, err := io.ReadAll(rd)
+			rd.Close()
+			if err != nil || !bytes.Equal(content, written) {
+				t.Fatalf("Snapshot #%d doesn't match the content written so far (err: %v)", phase, err)
+			}
+		}
+		if err := temp.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f := temp.File()
+		if last := snapshots[len(snapshots)-1]; f.Key() != last.Key() {
+			t.Errorf("Final file %v differs from last snapshot %v", f.Key(), last.Key())
+		}
+		if _, err := temp.(Snapshotter).Snapshot(); err != ErrInvalidState {
+			t.Errorf("Expected ErrInvalidState after Close, got %v", err)
+		}
+
+		// Snapshots share their chunks, so the storage holds little more than the data written
+		if used := s.GetUsageInfo().Used; used > 2*int64(len(written)) {
+			t.Errorf("Snapshots of %d bytes use %d bytes", len(written), used)
+		}
+		temp.Dispose()
+		f.Dispose()
+		for _, snapshot := range snapshots {
+			snapshot.Dispose()
+		}
+		s.FreeCache()
+		if ui := s.GetUsageInfo(); ui.Locked != 0 || ui.Used != 0 {
+			t.Errorf("Expected everything to be freed after disposing the snapshots: %v", ui)
+		}
+	}
+}
+
+func TestHotChunks(t *testing.T) {
+	s := NewRamStorageWithOptions(1024*1024, RamOptions{TrackAccess: true})
+	files := []File{addRandomData(t, s, 1000), addRandomData(t, s, 1000), addRandomData(t, s, 1000)}
+	for i, accesses := range []int{3, 5, 1} {
+		key := files[i].Key()
+		for j := 0; j < accesses; j++ {
+			f, err := s.Get(&key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Dispose()
+		}
+	}
+
+	hot := s.(AccessReporter).HotChunks(2)
+	if len(hot) != 2 || hot[0].Key != files[1].Key() || hot[0].Count != 5 || hot[1].Key != files[0].Key() || hot[1].Count != 3 {
+		t.Errorf("Unexpected hot chunks: %v", hot)
+	}
+
+	// Evicted content is no longer reported
+	for _, f := range files {
+		f.Dispose()
+	}
+	s.FreeCache()
+	if hot := s.(AccessReporter).HotChunks(2); len(hot) != 0 {
+		t.Errorf("Expected no hot chunks after freeing the cache, got %v", hot)
+	}
+
+	if hot := NewRamStorage(1024).(AccessReporter).HotChunks(2); hot != nil {
+		t.Errorf("Expected no accounting by default, got %v", hot)
+	}
+}
+
+func TestHeadroom(t *testing.T) {
+	const capacity = 256 * 1024
+	countEvictions := func(sub *Subscription) (n int) {
+		for {
+			select {
+			case e := <-sub.C:
+				if e.Type == EventEvicted {
+					n++
+				}
+			default:
+				return
+			}
+		}
+	}
+
+	// Concurrent ingest while files are being served
+	run := func(headroom float64) int {
+		s := NewRamStorageWithOptions(capacity, RamOptions{Headroom: headroom})
+		sub := s.Subscribe(100000)
+		defer sub.Close()
+		var served []File
+		for i := 0; i < 4; i++ {
+			served = append(served, addRandomData(t, s, 8*1024))
+		}
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for _, f := range served {
+			wg.Add(1)
+			go func(f File) {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					r := f.Open()
+					if _, err := io.Copy(io.Discard, r); err != nil {
+						t.Error(err)
+					}
+					r.Close()
+				}
+			}(f)
+		}
+		var ingest sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			ingest.Add(1)
+			go func() {
+				defer ingest.Done()
+				for j := 0; j < 32; j++ {
+					addRandomData(t, s, 4*1024).Dispose()
+				}
+			}()
+		}
+		ingest.Wait()
+		close(stop)
+		wg.Wait()
+
+		if used := s.GetUsageInfo().Used; used > capacity-int64(headroom*capacity) {
+			t.Errorf("Headroom %v: %d of %d bytes used", headroom, used, capacity)
+		}
+		for _, f := range served {
+			f.Dispose()
+		}
+		if sub.Dropped() != 0 {
+			t.Fatalf("Dropped %d events", sub.Dropped())
+		}
+		return countEvictions(sub)
+	}
+	without, with := run(0), run(0.1)
+	t.Logf("Evictions during concurrent ingest: %d without headroom, %d with 10%% headroom", without, with)
+	// The number of evictions depends on scheduling, but headroom is kept free in either case
+	if without == 0 || with == 0 {
+		t.Errorf("Expected concurrent ingest to evict entries")
+	}
+
+	// Ingesting what fits into the storage, but not into its headroom, evicts only if requested
+	for _, headroom := range []float64{0, 0.5} {
+		s := NewRamStorageWithOptions(capacity, RamOptions{Headroom: headroom})
+		sub := s.Subscribe(1000)
+		for i := 0; i < 24; i++ {
+			addRandomData(t, s, 8*1024).Dispose()
+		}
+		if n := countEvictions(sub); (n > 0) != (headroom > 0) {
+			t.Errorf("Headroom %v: %d evictions", headroom, n)
+		}
+		sub.Close()
+	}
+
+	// Locked data may use the headroom
+	s := NewRamStorageWithOptions(capacity, RamOptions{Headroom: 0.5})
+	var locked []File
+	for i := 0; i < 24; i++ {
+		locked = append(locked, addRandomData(t, s, 8*1024))
+	}
+	if ui := s.GetUsageInfo(); ui.Locked <= capacity/2 {
+		t.Errorf("Expected locked data to exceed the headroom: %v", ui)
+	}
+	for _, f := range locked {
+		f.Dispose()
+	}
+}
+
+func TestGetDuringEviction(t *testing.T) {
+	s := NewRamStorage(64 * 1024)
+	var keys []SKey
+	var contents [][]byte
+	for i := 0; i < 64; i++ {
+		data := make([]byte, 2000)
+		rand.Read(data)
+		keys = append(keys, sha256.Sum256(data))
+		contents = append(contents, data)
+	}
+	// Make sure some of the files are present before the readers start
+	for _, data := range contents {
+		addBytes(t, s, data).Dispose()
+	}
+
+	// Keep storing the files and evicting them again while the readers are running
+	done := make(chan struct{})
+	var evictor sync.WaitGroup
+	evictor.Add(1)
+	go func() {
+		defer evictor.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if i%16 == 15 {
+				s.FreeCache()
+				continue
+			}
+			temp := s.Create("stress")
+			_, _ = temp.Write(contents[i%len(contents)])
+			if temp.Close() == nil {
+				temp.File().Dispose()
+			}
+			temp.Dispose()
+		}
+	}()
+
+	var readers sync.WaitGroup
+	var found int64
+	var foundMutex sync.Mutex
+	errs := make(chan error, 8)
+	for r := 0; r < 8; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			for i := 0; i < 500; i++ {
+				key := keys[(r*7+i)%len(keys)]
+				f, err := s.Get(&key)
+				if err == ErrNotFound {
+					continue
+				}
+				foundMutex.Lock()
+				found++
+				foundMutex.Unlock()
+				runtime.Gosched()
+				rd := f.Open()
+				data, err := io.ReadAll(rd)
+				rd.Close()
+				if err == nil && SKey(sha256.Sum256(data)) != key {
+					err = fmt.Errorf("Content of %v doesn't match key", key)
+				}
+				if _, statErr := s.StatByKey(&key); err == nil && statErr != nil {
+					err = fmt.Errorf("Evicted %v while referenced: %v", key, statErr)
+				}
+				f.Dispose()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(r)
+	}
+	readers.Wait()
+	close(done)
+	evictor.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if found == 0 {
+		t.Errorf("Readers never found a file")
+	}
+
+	s.FreeCache()
+	if ui := s.GetUsageInfo(); ui.Used != 0 {
+		t.Errorf("Expected all references to be released: %v", ui)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	s := NewRamStorage(1024 * 1024)
+	// Random data may contain a chunk boundary, so storing it unchunked takes an inline threshold
+	data := make([]byte, 1000)
+	rand.Read(data)
+	temp := s.CreateWithOptions("Repair test", CreateOptions{InlineThreshold: int64(len(data))})
+	_, _ = temp.Write(data)
+	if err := temp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f := temp.File()
+	temp.Dispose()
+	defer f.Dispose()
+	key := f.Key()
+
+	s.(*ramStorage).entries[key].data[500] ^= 1
+	corruptReader := f.Open()
+	if err := s.(Repairer).Repair(&key, data[:999]); err != ErrKeyMismatch {
+		t.Errorf("Expected ErrKeyMismatch when repairing with wrong data, got %v", err)
+	}
+	if err := s.(Repairer).Repair(&key, data); err != nil {
+		t.Fatal(err)
+	}
+	r := f.Open()
+	repaired, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(repaired, data) {
+		t.Errorf("Content not repaired")
+	}
+
+	// Readers opened before keep reading the old data
+	corrupt, _ := io.ReadAll(corruptReader)
+	corruptReader.Close()
+	if bytes.Equal(corrupt, data) || len(corrupt) != len(data) {
+		t.Errorf("Expected reader opened before repair to return the corrupt data")
+	}
+	unknown := SKey(sha256.Sum256([]byte("not stored")))
+	if err := s.(Repairer).Repair(&unknown, []byte("not stored")); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for unknown key, got %v", err)
+	}
+}
+
+func TestTruncatedKeys(t *testing.T) {
+	if s := NewRamStorageWithOptions(1<<20, RamOptions{KeySize: 2}).(*ramStorage); s.keySize != 32 || s.paranoid {
+		t.Errorf("Invalid key size: expected full-length keys, got %d bytes (paranoid: %v)", s.keySize, s.paranoid)
+	}
+	s := NewRamStorageWithOptions(1<<20, RamOptions{KeySize: 8}).(*ramStorage)
+	if s.keySize != 8 || !s.paranoid {
+		t.Fatalf("Expected paranoid storage with 8-byte keys, got %d bytes (paranoid: %v)", s.keySize, s.paranoid)
+	}
+
+	data := make([]byte, 200000)
+	rand.Read(data)
+	for _, opts := range []CreateOptions{{}, {HashWorkers: 4}} {
+		temp := s.CreateWithOptions("truncated", opts)
+		if _, err := temp.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := temp.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f := temp.File()
+		temp.Dispose()
+		if !f.IsChunked() {
+			t.Fatal("Expected a chunked file")
+		}
+		keys := []SKey{f.Key()}
+		iter := f.Chunks()
+		for iter.Next() {
+			keys = append(keys, iter.Key())
+		}
+		iter.Dispose()
+		for _, key := range keys {
+			if [24]byte(key[8:]) != [24]byte{} {
+				t.Errorf("Key %v not truncated", key)
+			}
+		}
+		key := f.Key()
+		g, err := s.Get(&key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Dispose()
+		r := g.Open()
+		content, err := io.ReadAll(r)
+		r.Close()
+		g.Dispose()
+		if err != nil || !bytes.Equal(content, data) {
+			t.Errorf("Content didn't round-trip: %v", err)
+		}
+	}
+
+	// Different content stored under the key of existing content is detected
+	f := addBytes(t, s, []byte("original"))
+	defer f.Dispose()
+	key := f.Key()
+	if _, err := s.storeEntry(&key, []byte("colliding"), nil, "collision", ""); err != ErrKeyCollision {
+		t.Errorf("Expected ErrKeyCollision, got %v", err)
+	}
+	if _, err := s.storeEntry(&key, []byte("original"), nil, "duplicate", ""); err != nil {
+		t.Errorf("Storing identical content failed: %v", err)
+	}
+	s.releaseL(&key, s.entries[key])
+}
+
+func TestEnumerateKeysSorted(t *testing.T) {
+	var contents [][]byte
+	for i := 0; i < 5; i++ {
+		data := make([]byte, 50000*i)
+		rand.Read(data)
+		contents = append(contents, data)
+	}
+	enumerate := func(order []int) []SKey {
+		s := NewRamStorage(8 * 1024 * 1024)
+		for _, i := range order {
+			addBytes(t, s, contents[i]).Dispose()
+		}
+		var keys []SKey
+		s.(KeyEnumerator).EnumerateKeys(func(key SKey) bool {
+			keys = append(keys, key)
+			return true
+		})
+		return keys
+	}
+	a, b := enumerate([]int{0, 1, 2, 3, 4}), enumerate([]int{4, 2, 0, 3, 1})
+	if len(a) < 10 || len(a) != len(b) {
+		t.Fatalf("Expected the same number of keys, got %d and %d", len(a), len(b))
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("Key #%d differs: %v vs. %v", i, a[i], b[i])
+		} else if i > 0 && bytes.Compare(a[i-1][:], a[i][:]) >= 0 {
+			t.Fatalf("Keys #%d and #%d not in ascending order", i-1, i)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"bytes"
+	"io"
+)
+
+// Type fetchedChunk holds the data of a chunk that has been read ahead.
+type fetchedChunk struct {
+	data []byte
+	err  error
+}
+
+// Type readAheadReader reads the chunks of a file sequentially while fetching up
+// to a fixed number of subsequent chunks concurrently.
+type readAheadReader struct {
+	pending chan chan fetchedChunk // Chunks being fetched, in file order
+	done    chan struct{}          // Closed on Close()
+	current []byte                 // Remaining data of the current chunk
+	err     error                  // Sticky error
+	closed  bool
+}
+
+// Function OpenWithReadAhead opens `file` for reading like File.Open(), but pre-fetches
+// up to `depth` chunks concurrently while the caller consumes the current one. This keeps
+// sequential reads smooth on storage backends with high latency.
+// With depth <= 0, no read-ahead is done and the result of file.Open() is returned.
+func OpenWithReadAhead(file File, depth int) io.ReadCloser {
+	if depth <= 0 {
+		return file.Open()
+	}
+	r := &readAheadReader{
+		pending: make(chan chan fetchedChunk, depth),
+		done:    make(chan struct{}),
+	}
+	go r.fetchChunks(file.Chunks())
+	return r
+}
+
+// Iterates over the chunks of a file and starts a fetching goroutine for each of them.
+// Blocks while `depth` chunks are pending.
+func (r *readAheadReader) fetchChunks(iter FileIterator) {
+	defer iter.Dispose()
+	defer close(r.pending)
+	for iter.Next() {
+		chunk := iter.File()
+		result := make(chan fetchedChunk, 1)
+		select {
+		case r.pending <- result:
+			go fetchChunk(chunk, result)
+		case <-r.done:
+			chunk.Dispose()
+			return
+		}
+	}
+}
+
+// Reads a chunk into memory and disposes it.
+func fetchChunk(chunk File, result chan<- fetchedChunk) {
+	defer chunk.Dispose()
+	var buf bytes.Buffer
+	buf.Grow(int(chunk.Size()))
+	reader := chunk.Open()
+	_, err := buf.ReadFrom(reader)
+	if e := reader.Close(); err == nil {
+		err = e
+	}
+	result <- fetchedChunk{buf.Bytes(), err}
+}
+
+func (r *readAheadReader) Read(b []byte) (n int, err error) {
+	if r.closed {
+		return 0, ErrInvalidState
+	}
+	for len(r.current) == 0 && r.err == nil {
+		if result, ok := <-r.pending; !ok {
+			r.err = io.EOF
+		} else {
+			fetched := <-result
+			r.current, r.err = fetched.data, fetched.err
+		}
+	}
+	if len(r.current) == 0 {
+		return 0, r.err
+	}
+	n = copy(b, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// Stops fetching and waits until all pending chunks have been released.
+func (r *readAheadReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	for result := range r.pending {
+		<-result
+	}
+	r.current = nil
+	return nil
+}
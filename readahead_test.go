@@ -0,0 +1,142 @@
+package cafs_test
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// Type slowFile simulates a storage backend with high latency when opening a file.
+type slowFile struct {
+	File
+	delay time.Duration
+}
+
+func (f slowFile) Open() io.ReadCloser {
+	time.Sleep(f.delay)
+	return f.File.Open()
+}
+
+func (f slowFile) Chunks() FileIterator {
+	return slowIterator{f.File.Chunks(), f.delay}
+}
+
+type slowIterator struct {
+	FileIterator
+	delay time.Duration
+}
+
+func (i slowIterator) File() File {
+	return slowFile{i.FileIterator.File(), i.delay}
+}
+
+func createRandomFile(t testing.TB, s FileStorage, size int) File {
+	temp := s.Create("Random data")
+	defer temp.Dispose()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(0)).Read(data)
+	if _, err := temp.Write(data); err != nil {
+		t.Fatalf("Error on Write: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		t.Fatalf("Error on Close: %v", err)
+	}
+	return temp.File()
+}
+
+// Stores `data` as a file.
+func addBytes(t testing.TB, s FileStorage, data []byte) File {
+	temp := s.Create(fmt.Sprintf("%v bytes", len(data)))
+	defer temp.Dispose()
+	if _, err := temp.Write(data); err != nil {
+		t.Fatalf("Error on Write: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		t.Fatalf("Error on Close: %v", err)
+	}
+	return temp.File()
+}
+
+// Like createRandomFile, but the content differs with every call.
+func addRandomData(t testing.TB, s FileStorage, size int) File {
+	data := make([]byte, size)
+	rand.Read(data)
+	return addBytes(t, s, data)
+}
+
+func TestReadAhead(t *testing.T) {
+	s := ram.NewRamStorage(4 * 1024 * 1024)
+	f := createRandomFile(t, s, 1024*1024)
+	fr := f.Open()
+	reference, _ := io.ReadAll(fr)
+	fr.Close()
+	for _, depth := range []int{0, 1, 2, 8, 1000} {
+		r := OpenWithReadAhead(slowFile{f, time.Millisecond}, depth)
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Error reading with depth %v: %v", depth, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("Error closing with depth %v: %v", depth, err)
+		}
+		if !bytes.Equal(data, reference) {
+			t.Fatalf("Data read with depth %v differs", depth)
+		}
+	}
+
+	// Close early. All pre-fetched chunks must be released.
+	r := OpenWithReadAhead(f, 4)
+	if _, err := io.ReadFull(r, make([]byte, 100)); err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	r.Close()
+	if _, err := r.Read(make([]byte, 1)); err != ErrInvalidState {
+		t.Errorf("Expected ErrInvalidState after Close, got %v", err)
+	}
+	f.Dispose()
+	s.FreeCache()
+	if locked := s.GetUsageInfo().Locked; locked != 0 {
+		t.Errorf("Expected no bytes to be locked, got %v", locked)
+	}
+}
+
+func benchmarkReadAhead(b *testing.B, depth int) {
+	s := ram.NewRamStorage(4 * 1024 * 1024)
+	f := createRandomFile(b, s, 1024*1024)
+	defer f.Dispose()
+	slow := slowFile{f, time.Millisecond}
+	b.SetBytes(f.Size())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if depth == 0 {
+			// Simulate fetching chunks on demand, as done by File.Open()
+			iter := slow.Chunks()
+			for iter.Next() {
+				chunk := iter.File()
+				r := chunk.Open()
+				if _, err := io.Copy(io.Discard, r); err != nil {
+					b.Fatalf("Error reading: %v", err)
+				}
+				r.Close()
+				chunk.Dispose()
+			}
+			iter.Dispose()
+			continue
+		}
+		r := OpenWithReadAhead(slow, depth)
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			b.Fatalf("Error reading: %v", err)
+		}
+		r.Close()
+	}
+}
+
+func BenchmarkReadAhead0(b *testing.B)  { benchmarkReadAhead(b, 0) }
+func BenchmarkReadAhead1(b *testing.B)  { benchmarkReadAhead(b, 1) }
+func BenchmarkReadAhead4(b *testing.B)  { benchmarkReadAhead(b, 4) }
+func BenchmarkReadAhead16(b *testing.B) { benchmarkReadAhead(b, 16) }
@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Request code of the FICLONERANGE ioctl, see ioctl_ficlonerange(2)
+const ficloneRange = 0x4020940d
+
+type fileCloneRange struct {
+	srcFd      int64
+	srcOffset  uint64
+	srcLength  uint64
+	destOffset uint64
+}
+
+// Clones `length` bytes at `offset` of `src` into `dst` at `dstOffset` using copy-on-write.
+func cloneRange(dst, src *os.File, offset, length, dstOffset int64) error {
+	arg := fileCloneRange{
+		srcFd:      int64(src.Fd()),
+		srcOffset:  uint64(offset),
+		srcLength:  uint64(length),
+		destOffset: uint64(dstOffset),
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficloneRange, uintptr(unsafe.Pointer(&arg)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"io"
+	"sync"
+)
+
+// Number of writes queued per receiver before a slow receiver holds back the others.
+const broadcastQueueLen = 64
+
+// Function BroadcastChunkHashes writes the announcement of `file` (see WriteChunkHashesWithOptions)
+// to all of `writers` concurrently, iterating the file's chunks and shuffling them only once. Each
+// writer receives identical bytes from its own goroutine, so that receivers proceed independently
+// as long as none of them falls behind by more than a few writes.
+// Returns one error per writer. A writer that fails (with ErrPeerClosed if the receiver closed the
+// connection prematurely) is dropped while the others continue. An error of the announcement
+// itself, e.g. when iterating the chunks, is reported for all writers that didn't fail before.
+func BroadcastChunkHashes(file cafs.File, perm shuffle.Permutation, writers []io.Writer, opts AnnounceOptions) []error {
+	b := &broadcaster{outs: make([]*broadcastOut, len(writers))}
+	var wg sync.WaitGroup
+	for i, w := range writers {
+		out := &broadcastOut{
+			w:      w,
+			queue:  make(chan []byte, broadcastQueueLen),
+			failed: make(chan struct{}),
+		}
+		b.outs[i] = out
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out.run()
+		}()
+	}
+
+	err := WriteChunkHashesWithOptions(file, perm, b, opts)
+	for _, out := range b.outs {
+		close(out.queue)
+	}
+	wg.Wait()
+
+	errs := make([]error, len(writers))
+	for i, out := range b.outs {
+		if out.err != nil {
+			errs[i] = checkPeerClosed(out.err)
+		} else {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// Type broadcaster is an io.Writer that queues a copy of each write for every receiver.
+type broadcaster struct {
+	outs []*broadcastOut
+}
+
+// Type broadcastOut writes the queued data to a single receiver.
+type broadcastOut struct {
+	w      io.Writer
+	queue  chan []byte
+	failed chan struct{} // closed when err has been set
+	err    error
+}
+
+func (o *broadcastOut) run() {
+	for data := range o.queue {
+		if o.err != nil {
+			continue // keep draining so that the broadcaster doesn't block
+		}
+		if _, err := o.w.Write(data); err != nil {
+			o.err = err
+			close(o.failed)
+		}
+	}
+}
+
+// Fails only if all receivers have failed, returning the error of the first one.
+func (b *broadcaster) Write(p []byte) (int, error) {
+	// The caller may reuse p, and receivers write at their own pace
+	data := append([]byte(nil), p...)
+	alive := 0
+	for _, out := range b.outs {
+		select {
+		case out.queue <- data:
+			alive++
+		case <-out.failed:
+		}
+	}
+	if alive == 0 && len(b.outs) > 0 {
+		return 0, b.outs[0].err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,74 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"context"
+	"sync"
+)
+
+// Type MemoryBudget limits the number of bytes of chunk data held open at the same time by all
+// transmissions sharing it, which protects a server with many concurrent receivers from running
+// out of memory (see ServeOptions.MemoryBudget). A chunk larger than the whole budget is admitted
+// while no other chunk is open.
+type MemoryBudget struct {
+	mutex sync.Mutex
+	limit int64
+	inUse int64
+	freed chan struct{} // Closed and replaced whenever bytes are released
+}
+
+// Returns a budget of `limit` bytes.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit, freed: make(chan struct{})}
+}
+
+// Returns the number of bytes currently acquired.
+func (b *MemoryBudget) InUse() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.inUse
+}
+
+// Blocks until `n` bytes fit into the budget, then acquires them. Returns the context's error if
+// it is done first.
+func (b *MemoryBudget) acquire(ctx context.Context, n int64) error {
+	for {
+		b.mutex.Lock()
+		if b.inUse == 0 || b.inUse+n <= b.limit {
+			b.inUse += n
+			b.mutex.Unlock()
+			return nil
+		}
+		freed := b.freed
+		b.mutex.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Releases `n` bytes previously acquired.
+func (b *MemoryBudget) release(n int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.inUse -= n
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
@@ -0,0 +1,69 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"io"
+)
+
+// Type Comparison reports how a local file differs from a file announced by a remote peer.
+type Comparison struct {
+	// Whether the announced file consists of exactly the chunks of the local file, in the same order.
+	Identical bool
+	// Chunks announced, but not contained in the local file, with their offsets in the announced file.
+	Missing []ChunkInfo
+	// Chunks of the local file not announced, with their offsets in the local file.
+	Extra []ChunkInfo
+}
+
+// Function CompareAnnouncement checks whether `file` has the same content as the file announced by
+// `announcement`, which must have been written by WriteChunkHashes using `perm`, by comparing chunk
+// hashes only. Nothing is stored and no wishlist is sent, so the remote peer needn't be asked for
+// any chunk data. Chunks are matched by key, so that content shifted by an insertion or deletion
+// is only reported once. Salted announcements never match, as their keys can't be compared.
+func CompareAnnouncement(file cafs.File, perm shuffle.Permutation, announcement io.Reader) (Comparison, error) {
+	var result Comparison
+	remote, err := DecodeAnnouncement(perm, announcement)
+	if err != nil {
+		return result, err
+	}
+	local := ListChunks(file)
+
+	result.Identical = len(remote) == len(local)
+	localKeys := make(map[cafs.SKey]bool, len(local))
+	for i, c := range local {
+		localKeys[c.Key] = true
+		if result.Identical && (remote[i].Key != c.Key || remote[i].Size != c.Size) {
+			result.Identical = false
+		}
+	}
+	remoteKeys := make(map[cafs.SKey]bool, len(remote))
+	for _, c := range remote {
+		remoteKeys[c.Key] = true
+		if !localKeys[c.Key] {
+			result.Missing = append(result.Missing, c)
+		}
+	}
+	for _, c := range local {
+		if !remoteKeys[c.Key] {
+			result.Extra = append(result.Extra, c)
+		}
+	}
+	return result, nil
+}
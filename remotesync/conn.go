@@ -0,0 +1,76 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"net"
+	"time"
+)
+
+// Type ConnTimeouts contains the timeouts applied by WithTimeouts.
+// The zero value selects the default behavior, which is not to time out.
+type ConnTimeouts struct {
+	// The maximum time a single read may block without receiving any data, or 0 for no limit.
+	Read time.Duration
+	// The maximum time a write may block without any data being sent, or 0 for no limit.
+	Write time.Duration
+}
+
+// Maximum number of bytes passed to the underlying connection per write, so that the write
+// deadline is renewed as long as data is being sent.
+const timeoutWriteSize = 32 * 1024
+
+// Function WithTimeouts returns a connection that sets a deadline on `conn` before every read
+// and write, which is renewed as long as data is flowing. Transmissions over the returned
+// connection fail with an error matching os.ErrDeadlineExceeded if the peer stalls, e.g.
+// because the connection is half-open, instead of blocking forever.
+func WithTimeouts(conn net.Conn, timeouts ConnTimeouts) net.Conn {
+	return &timeoutConn{conn, timeouts}
+}
+
+type timeoutConn struct {
+	net.Conn
+	timeouts ConnTimeouts
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if c.timeouts.Read > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeouts.Read)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if c.timeouts.Write <= 0 {
+		return c.Conn.Write(b)
+	}
+	var written int
+	for len(b) > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeouts.Write)); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(b[:min(len(b), timeoutWriteSize)])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
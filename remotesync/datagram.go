@@ -0,0 +1,495 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/chunking/adler32"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Interface DatagramConn sends and receives datagrams, which may be lost, duplicated or reordered
+// on the way. A connected *net.UDPConn implements it. Read must fail with an error wrapping
+// os.ErrDeadlineExceeded when the read deadline has passed.
+type DatagramConn interface {
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+	SetReadDeadline(t time.Time) error
+}
+
+// Returned by Builder.ReceiveDatagrams if the wishlist hasn't been written completely.
+var ErrWishListIncomplete = errors.New("Wishlist incomplete")
+
+// Packet types of the datagram data phase
+const (
+	packetData   = 'D'
+	packetParity = 'P'
+	packetEnd    = 'E'
+)
+
+// Every packet starts with the type (1 byte), the number of the chunk among the requested chunks
+// (4 bytes), the chunk's length (4 bytes), the index of the data shard or parity group (4 bytes),
+// the shard size (2 bytes) and the number of data shards per parity group (1 byte).
+const packetHeaderSize = 16
+
+// Number of times the end packet is sent, as it might get lost
+const endRepeats = 3
+
+// Type DatagramOptions contains optional settings for sending and receiving chunk data as
+// datagrams. The zero value selects the default behavior.
+type DatagramOptions struct {
+	// The number of chunk data bytes per packet. Defaults to 1200, which keeps packets within
+	// the MTU of most links. At most 65535. The receiver drops packets of other sizes.
+	PacketSize int
+	// The number of data packets protected by a parity packet, which allows recovering any single
+	// packet of the group if lost. Smaller groups recover more losses at the cost of more
+	// overhead. Defaults to 8. At most 255. The receiver drops packets of other group sizes.
+	GroupSize int
+	// The pause after each packet sent, for limiting the sending rate. Defaults to no pause.
+	Interval time.Duration
+	// How long the receiver waits for the next packet before it considers the data phase
+	// to be over. Defaults to 1 second.
+	IdleTimeout time.Duration
+	// The maximum number of chunks the receiver collects packets for at a time. When exceeded,
+	// the incomplete chunk with the lowest number is given up on. Defaults to 16.
+	MaxPartial int
+}
+
+func (o *DatagramOptions) setDefaults() {
+	if o.PacketSize <= 0 {
+		o.PacketSize = 1200
+	} else if o.PacketSize > 65535 {
+		o.PacketSize = 65535
+	}
+	if o.GroupSize <= 0 {
+		o.GroupSize = 8
+	} else if o.GroupSize > 255 {
+		o.GroupSize = 255
+	}
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = time.Second
+	}
+	if o.MaxPartial <= 0 {
+		o.MaxPartial = 16
+	}
+}
+
+// Type packet is a decoded datagram.
+type packet struct {
+	typ     byte
+	seq     int
+	length  int
+	index   int
+	size    int
+	group   int
+	payload []byte
+}
+
+func (p *packet) encode(buf []byte) []byte {
+	buf = append(buf[:0], p.typ)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(p.seq))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(p.length))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(p.index))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(p.size))
+	buf = append(buf, byte(p.group))
+	return append(buf, p.payload...)
+}
+
+func decodePacket(b []byte) (packet, bool) {
+	if len(b) < packetHeaderSize {
+		return packet{}, false
+	}
+	p := packet{
+		typ:     b[0],
+		seq:     int(binary.BigEndian.Uint32(b[1:])),
+		length:  int(binary.BigEndian.Uint32(b[5:])),
+		index:   int(binary.BigEndian.Uint32(b[9:])),
+		size:    int(binary.BigEndian.Uint16(b[13:])),
+		group:   int(b[15]),
+		payload: b[packetHeaderSize:],
+	}
+	if p.typ == packetEnd {
+		return p, true
+	}
+	if (p.typ != packetData && p.typ != packetParity) || p.length > adler32.MAX_CHUNK || p.size == 0 || p.group == 0 {
+		return packet{}, false
+	}
+	return p, true
+}
+
+// Returns the number of data shards a chunk of `length` bytes is split into.
+func numShards(length, size int) int {
+	return max(1, (length+size-1)/size)
+}
+
+// Type DatagramSender sends the chunks requested by a wishlist as datagrams protected by forward
+// error correction, then serves the chunks the receiver failed to recover over a reliable stream.
+// This avoids stalls on lossy links with a high latency. The receiver uses Builder.ReceiveDatagrams.
+type DatagramSender struct {
+	storage cafs.FileStorage
+	keys    []cafs.SKey // The requested chunks, in the order they are transmitted
+}
+
+// Returns a sender for the chunks of `file` requested by the wishlist read from `r`, which is
+// read completely. The wishlist format and AllowChunk are taken from `opts`.
+func NewDatagramSender(storage cafs.FileStorage, file cafs.File, r io.ByteReader, perm shuffle.Permutation, opts ServeOptions) (*DatagramSender, error) {
+	if opts.AllowChunk != nil {
+		if err := checkChunksAllowed(file, opts.AllowChunk); err != nil {
+			return nil, err
+		}
+	}
+	transfer, _ := opts.Registry.register(opts.Context, opts.Name, Sending)
+	defer transfer.done()
+	s := &DatagramSender{storage: storage}
+	err := forEachChunk(storage, file, r, perm, wishListFormatOf(opts.RunLengthWishList, opts.IndexWishList), opts.Padding, transfer, func(chunk cafs.File, requested bool) error {
+		if requested {
+			s.keys = append(s.keys, chunk.Key())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Sends all requested chunks to `conn`, followed by an end marker. Each chunk is split into
+// packets of DatagramOptions.PacketSize bytes, with a parity packet after every group of
+// DatagramOptions.GroupSize packets.
+func (s *DatagramSender) Send(conn DatagramConn, opts DatagramOptions) error {
+	opts.setDefaults()
+	buf := make([]byte, 0, packetHeaderSize+opts.PacketSize)
+	parity := make([]byte, opts.PacketSize)
+	send := func(p *packet) error {
+		buf = p.encode(buf)
+		if _, err := conn.Write(buf); err != nil {
+			return err
+		}
+		if opts.Interval > 0 {
+			time.Sleep(opts.Interval)
+		}
+		return nil
+	}
+
+	for seq, key := range s.keys {
+		err := withChunk(s.storage, key, func(chunk cafs.File) error {
+			r := chunk.Open()
+			data, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			p := packet{seq: seq, length: len(data), size: opts.PacketSize, group: opts.GroupSize}
+			n := numShards(len(data), opts.PacketSize)
+			for i := 0; i < n; i++ {
+				shard := data[min(i*opts.PacketSize, len(data)):min((i+1)*opts.PacketSize, len(data))]
+				if i%opts.GroupSize == 0 {
+					clear(parity)
+				}
+				xorInto(parity, shard)
+				p.typ, p.index, p.payload = packetData, i, shard
+				if err := send(&p); err != nil {
+					return err
+				}
+				if i%opts.GroupSize == opts.GroupSize-1 || i == n-1 {
+					p.typ, p.index, p.payload = packetParity, i/opts.GroupSize, parity
+					if err := send(&p); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	end := packet{typ: packetEnd, seq: len(s.keys)}
+	for i := 0; i < endRepeats; i++ {
+		if err := send(&end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads the list of missing chunks written by Builder.WriteMissingList from `r` and writes the
+// data of these chunks to `w`, in the format read by Builder.ReconstructFileFromRequestedChunks.
+func (s *DatagramSender) ServeMissingChunks(r io.ByteReader, w io.Writer) error {
+	bits := newWishListReader(r, formatIndex)
+	for _, key := range s.keys {
+		missing, err := bits.ReadBit()
+		if err != nil {
+			return fmt.Errorf("Missing list too short: %v", err)
+		} else if !missing {
+			continue
+		}
+		err = withChunk(s.storage, key, func(chunk cafs.File) error {
+			if err := writeVarint(w, chunk.Size()); err != nil {
+				return err
+			}
+			r := chunk.Open()
+			defer r.Close()
+			_, err := io.Copy(w, r)
+			return err
+		})
+		if err != nil {
+			return checkPeerClosed(err)
+		}
+	}
+	return bits.expectEnd()
+}
+
+func xorInto(dst, src []byte) {
+	for i, b := range src {
+		dst[i] ^= b
+	}
+}
+
+// Type partialChunk collects the packets of a chunk until its data is complete.
+type partialChunk struct {
+	length, size, group int
+	shards              [][]byte // Data shards by index, nil while missing
+	parity              [][]byte // Parity by group, nil while missing
+	missing             int      // Number of data shards missing
+}
+
+func newPartialChunk(p *packet) *partialChunk {
+	n := numShards(p.length, p.size)
+	return &partialChunk{
+		length:  p.length,
+		size:    p.size,
+		group:   p.group,
+		shards:  make([][]byte, n),
+		parity:  make([][]byte, (n+p.group-1)/p.group),
+		missing: n,
+	}
+}
+
+func (c *partialChunk) shardSize(i int) int {
+	return min(c.size, c.length-i*c.size)
+}
+
+// Adds the packet's payload. Returns the chunk's data once it is complete.
+func (c *partialChunk) add(p *packet) []byte {
+	if p.length != c.length || p.size != c.size || p.group != c.group {
+		return nil
+	}
+	var group int
+	if p.typ == packetData {
+		if p.index >= len(c.shards) || c.shards[p.index] != nil || len(p.payload) != c.shardSize(p.index) {
+			return nil
+		}
+		c.shards[p.index] = bytes.Clone(p.payload)
+		c.missing--
+		group = p.index / c.group
+	} else {
+		if p.index >= len(c.parity) || c.parity[p.index] != nil || len(p.payload) != c.size {
+			return nil
+		}
+		c.parity[p.index] = bytes.Clone(p.payload)
+		group = p.index
+	}
+	c.recover(group)
+	if c.missing > 0 {
+		return nil
+	}
+	return bytes.Join(c.shards, nil)
+}
+
+// Reconstructs the data shard missing from `group` if it's the only one and the parity is known.
+func (c *partialChunk) recover(group int) {
+	if c.parity[group] == nil {
+		return
+	}
+	start, end := group*c.group, min((group+1)*c.group, len(c.shards))
+	lost := -1
+	for i := start; i < end; i++ {
+		if c.shards[i] == nil {
+			if lost >= 0 {
+				return
+			}
+			lost = i
+		}
+	}
+	if lost < 0 {
+		return
+	}
+	shard := bytes.Clone(c.parity[group])
+	for i := start; i < end; i++ {
+		if i != lost {
+			xorInto(shard, c.shards[i])
+		}
+	}
+	c.shards[lost] = shard[:c.shardSize(lost)]
+	c.missing--
+}
+
+// Receives chunk data sent by DatagramSender.Send from `conn`, until the end marker is received,
+// all requested chunks have been received, or no packet arrives for DatagramOptions.IdleTimeout.
+// Must be called after WriteWishList has completed, so the Builder's window must be large enough
+// to hold the whole file (see NewBuilder). Chunks that can't be recovered from the
+// packets received are then requested using WriteMissingList, and all chunks are assembled by
+// ReconstructFileFromRequestedChunks, which must be given the stream written by
+// DatagramSender.ServeMissingChunks. The PacketSize and GroupSize given in `opts` must match
+// those of the sender. Returns the number of chunks received.
+func (b *Builder) ReceiveDatagrams(conn DatagramConn, opts DatagramOptions) (int, error) {
+	opts.setDefaults()
+	b.mutex.Lock()
+	if !b.chunksClosed || b.announcing {
+		b.mutex.Unlock()
+		return 0, ErrWishListIncomplete
+	}
+	order := b.requestedOrder
+	if b.datagrams == nil {
+		b.datagrams = make([]bool, len(order))
+	}
+	b.mutex.Unlock()
+
+	b.transfer.setPhase("data", "receiving datagrams")
+	defer b.transfer.setPhase("data", "datagrams received")
+	partials := make(map[int]*partialChunk)
+	buf := make([]byte, packetHeaderSize+65536)
+	received := 0
+	for b.countDatagrams() < len(order) {
+		if err := b.ctx.Err(); err != nil {
+			return received, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(opts.IdleTimeout)); err != nil {
+			return received, err
+		}
+		n, err := conn.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		} else if err != nil {
+			return received, err
+		}
+		p, ok := decodePacket(buf[:n])
+		if !ok {
+			continue
+		} else if p.typ == packetEnd {
+			break
+		} else if p.seq >= len(order) || p.size != opts.PacketSize || p.group != opts.GroupSize || b.hasDatagram(p.seq) {
+			continue
+		}
+		partial := partials[p.seq]
+		if partial == nil {
+			if len(partials) >= opts.MaxPartial {
+				// Chunks are sent in order, so the oldest one has likely lost too many packets
+				oldest := p.seq
+				for seq := range partials {
+					oldest = min(oldest, seq)
+				}
+				if oldest == p.seq {
+					continue
+				}
+				delete(partials, oldest)
+			}
+			partial = newPartialChunk(&p)
+			partials[p.seq] = partial
+		}
+		data := partial.add(&p)
+		if data == nil {
+			continue
+		}
+		delete(partials, p.seq)
+		if ok, err := b.storeDatagramChunk(p.seq, order[p.seq], data); err != nil {
+			return received, err
+		} else if ok {
+			received++
+		}
+	}
+	return received, nil
+}
+
+func (b *Builder) countDatagrams() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.prefetched)
+}
+
+func (b *Builder) hasDatagram(seq int) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.datagrams[seq]
+}
+
+// Stores the data of requested chunk number `seq`, if it hashes to the expected key, and keeps
+// it until ReconstructFileFromRequestedChunks needs it. Returns false if the data was dropped.
+// The data is verified before it is stored, as the packets might have been spoofed.
+func (b *Builder) storeDatagramChunk(seq int, expected cafs.SKey, data []byte) (bool, error) {
+	if saltKey(b.opts.Salt, sha256.Sum256(data)) != expected {
+		return false, nil
+	}
+	chunkFile, err := copyChunk(b.storage, bytes.NewReader(data), int64(len(data)), fmt.Sprintf("%v datagram #%d", b.info, seq))
+	if err != nil {
+		return false, err
+	}
+	if b.announcedKey(chunkFile.Key()) != expected {
+		chunkFile.Dispose()
+		return false, nil
+	}
+	if LoggingEnabled {
+		log.Printf("Receiver: received chunk #%d (size:%v, %v) as datagrams", seq, chunkFile.Size(), expected)
+	}
+	b.mutex.Lock()
+	if b.disposed || b.recon != nil {
+		b.mutex.Unlock()
+		chunkFile.Dispose()
+		return false, ErrDisposed
+	}
+	b.datagrams[seq] = true
+	if b.prefetched == nil {
+		b.prefetched = make(map[cafs.SKey]cafs.File)
+	}
+	b.prefetched[expected] = chunkFile
+	b.stats.ChunksReceived++
+	b.stats.BytesReceived += chunkFile.Size()
+	b.mutex.Unlock()
+	b.transfer.addBytes(chunkFile.Size())
+	if b.opts.OnNewChunk != nil {
+		b.opts.OnNewChunk(chunkFile)
+	}
+	return true, nil
+}
+
+// Writes the list of requested chunks not received by ReceiveDatagrams to `w`, to be read by
+// DatagramSender.ServeMissingChunks. If ReceiveDatagrams hasn't been called, all requested chunks
+// are listed.
+func (b *Builder) WriteMissingList(w FlushWriter) error {
+	b.mutex.Lock()
+	n := len(b.requestedOrder)
+	received := b.datagrams
+	b.mutex.Unlock()
+	bits := newWishListWriter(w, formatIndex)
+	for seq := 0; seq < n; seq++ {
+		if err := bits.WriteBit(received == nil || !b.hasDatagram(seq)); err != nil {
+			return checkPeerClosed(err)
+		}
+	}
+	return checkPeerClosed(bits.Flush())
+}
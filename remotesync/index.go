@@ -0,0 +1,110 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The indexed wishlist format (see BuilderOptions.IndexWishList) consists of a sequence of
+// uvarint tokens. The lowest bit of a token tells whether it denotes a requested chunk, the
+// remaining bits the number of chunks not requested before it:
+//   - 1: gap<<1 | 1 for a requested chunk following `gap` chunks that aren't requested
+//   - 0: gap<<1 as the last token, for the `gap` chunks at the end that aren't requested
+//
+// The size of the wishlist thereby depends on the number of requested chunks only.
+
+var errInvalidIndexList = errors.New("Invalid indexed wishlist")
+
+type indexWriter struct {
+	w   FlushWriter
+	gap uint64 // Number of chunks not requested since the last requested one
+	buf []byte
+}
+
+func (w *indexWriter) WriteBit(b bool) error {
+	if !b {
+		w.gap++
+		return nil
+	}
+	return w.emit(w.gap<<1 | 1)
+}
+
+func (w *indexWriter) emit(token uint64) error {
+	w.buf = appendUvarint(w.buf[:0], token)
+	w.gap = 0
+	if _, err := w.w.Write(w.buf); err != nil {
+		return err
+	}
+	w.w.Flush()
+	return nil
+}
+
+// Requested chunks are written immediately, so there is nothing the sender waits for.
+func (w *indexWriter) sync() error {
+	return nil
+}
+
+func (w *indexWriter) Flush() error {
+	return w.emit(w.gap << 1)
+}
+
+type indexReader struct {
+	r         io.ByteReader
+	gap       uint64 // Number of chunks remaining before the end of the current token
+	requested bool   // Whether the current token ends with a requested chunk
+	pending   bool   // Whether a token has been read and not yet been consumed completely
+}
+
+func (r *indexReader) ReadBit() (bool, error) {
+	if !r.pending {
+		token, err := binary.ReadUvarint(r.r)
+		if err == io.ErrUnexpectedEOF {
+			return false, errInvalidIndexList
+		} else if err != nil {
+			return false, err
+		}
+		r.gap, r.requested, r.pending = token>>1, token&1 != 0, true
+	}
+	if r.gap > 0 {
+		r.gap--
+		return false, nil
+	}
+	if !r.requested {
+		// All chunks covered by the last token have been read
+		return false, io.EOF
+	}
+	r.pending = false
+	return true, nil
+}
+
+func (r *indexReader) expectEnd() error {
+	if !r.pending {
+		// The last token hasn't been read yet
+		if token, err := binary.ReadUvarint(r.r); err != nil || token != 0 {
+			return errors.New("Wishlist too long")
+		}
+	} else if r.requested || r.gap > 0 {
+		return errors.New("Wishlist too long")
+	}
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return errors.New("Wishlist too long")
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"fmt"
+	"github.com/indyjo/cafs"
+)
+
+// Type MergePolicy determines what MergeStores does with a name that is bound in both namespaces,
+// but to different files.
+type MergePolicy int
+
+const (
+	// The destination keeps its file and the source's file is not merged.
+	MergeSkip MergePolicy = iota
+	// The name is rebound to the source's file, dropping the destination's file and attributes.
+	MergeOverwrite
+	// The source's file is bound to the first free name of the sequence `name.1`, `name.2`, ...
+	MergeRename
+)
+
+// Type MergeConflict describes a name that was bound to different files in both namespaces.
+type MergeConflict struct {
+	Name     string    // The conflicting name
+	Existing cafs.SKey // Key of the file the name was bound to in the destination
+	Incoming cafs.SKey // Key of the file the name is bound to in the source
+	BoundAs  string    // Name the source's file was bound to in the destination, or "" if skipped
+}
+
+// Type MergeStats reports what MergeStores has done.
+type MergeStats struct {
+	Names     int             // Number of names processed
+	Merged    int             // Number of names bound in the destination, including renamed ones
+	Unchanged int             // Number of names already bound to the same file in the destination
+	Copied    int             // Number of files copied because they were missing from the destination
+	Bytes     int64           // Number of bytes written into the destination's storage
+	Conflicts []MergeConflict // Names bound to different files, in lexical order
+}
+
+// Function MergeStores binds every name of namespace `src` in namespace `dst`, copying the files
+// bound to them, along with their chunks, into the destination's storage unless it already holds
+// them. Attributes are copied with the names. A name bound to the same file in both namespaces is
+// left unchanged, while a name bound to different files is a conflict resolved by `policy`. Names
+// are processed in lexical order; names removed from `src` while merging are skipped.
+//
+// Unlike Replicate, which copies everything held by a storage, only named files are merged.
+func MergeStores(src, dst *cafs.Namespace, policy MergePolicy) (MergeStats, error) {
+	var stats MergeStats
+	for _, name := range src.Names() {
+		if err := mergeName(src, dst, name, policy, &stats); err != nil {
+			return stats, fmt.Errorf("Merging %v: %w", name, err)
+		}
+	}
+	return stats, nil
+}
+
+func mergeName(src, dst *cafs.Namespace, name string, policy MergePolicy, stats *MergeStats) error {
+	file, err := src.Get(name)
+	if err == cafs.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	key := file.Key()
+	file.Dispose()
+	stats.Names++
+
+	target := name
+	if existing, err := dst.Get(name); err == nil {
+		existingKey := existing.Key()
+		existing.Dispose()
+		if existingKey == key {
+			stats.Unchanged++
+			return nil
+		}
+		conflict := MergeConflict{Name: name, Existing: existingKey, Incoming: key}
+		switch policy {
+		case MergeSkip:
+			stats.Conflicts = append(stats.Conflicts, conflict)
+			return nil
+		case MergeRename:
+			target = freeName(dst, name)
+		}
+		conflict.BoundAs = target
+		stats.Conflicts = append(stats.Conflicts, conflict)
+	} else if err != cafs.ErrNotFound {
+		return err
+	}
+
+	copied, n, err := replicateKey(src.Storage(), dst.Storage(), key)
+	if err != nil {
+		return err
+	}
+	if copied {
+		stats.Copied++
+		stats.Bytes += n
+	}
+	merged, err := dst.Storage().Get(&key)
+	if err != nil {
+		return err
+	}
+	defer merged.Dispose()
+
+	// Rebind explicitly so that the destination's own NamePolicy doesn't interfere
+	dst.Remove(target)
+	if err := dst.SetName(target, merged); err != nil {
+		return err
+	}
+	attrs, err := src.ListAttrs(name)
+	if err == cafs.ErrNotFound {
+		attrs = nil
+	} else if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		value, err := src.GetAttr(name, attr)
+		if err == cafs.ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := dst.SetAttr(target, attr, value); err != nil {
+			return err
+		}
+	}
+	stats.Merged++
+	return nil
+}
+
+// Returns the first name of the sequence `name.1`, `name.2`, ... that isn't bound in `ns`.
+func freeName(ns *cafs.Namespace, name string) string {
+	for i := 1; ; i++ {
+		versioned := fmt.Sprintf("%v.%d", name, i)
+		if _, err := ns.ListAttrs(versioned); err == cafs.ErrNotFound {
+			return versioned
+		}
+	}
+}
@@ -0,0 +1,376 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Returned by ReconstructFromSources when chunks are missing but no usable source is left.
+var ErrNoSource = errors.New("No source left to fetch chunks from")
+
+// Interface ChunkSource is implemented by peers from which chunks can be fetched by key.
+// As chunks are content-addressed, any source holding a chunk is as good as any other.
+type ChunkSource interface {
+	// Writes the chunks identified by `keys` to `w`, in the order given. Each chunk is encoded as
+	// its length (varint) followed by its data, like in the stream written by WriteChunkData.
+	// Should return as soon as possible when `ctx` is done. A call that doesn't is abandoned, so
+	// the next call to the same source may begin before it has returned.
+	FetchChunks(ctx context.Context, keys []cafs.SKey, w io.Writer) error
+}
+
+// Type storageSource is a ChunkSource serving chunks from a FileStorage.
+type storageSource struct {
+	storage cafs.FileStorage
+}
+
+// Returns a ChunkSource serving chunks from the given storage.
+func NewStorageSource(storage cafs.FileStorage) ChunkSource {
+	return storageSource{storage}
+}
+
+func (s storageSource) FetchChunks(ctx context.Context, keys []cafs.SKey, w io.Writer) error {
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk, err := s.storage.Get(&key)
+		if err != nil {
+			return err
+		}
+		err = writeVarint(w, chunk.Size())
+		if err == nil {
+			r := chunk.Open()
+			_, err = io.Copy(w, r)
+			r.Close()
+		}
+		chunk.Dispose()
+		if err != nil {
+			return checkPeerClosed(err)
+		}
+	}
+	return nil
+}
+
+// Type MultiSourceOptions contains optional settings for ReconstructFromSources.
+// The zero value selects the default behavior.
+type MultiSourceOptions struct {
+	// The maximum number of chunks requested from a source at once. The fastest source is
+	// assigned batches of this size, slower sources proportionally smaller ones. Defaults to 16.
+	BatchSize int
+
+	// If set, a source taking longer than this to deliver a batch is interrupted, and the chunks
+	// not yet delivered are reassigned. This counts as a failure of the source.
+	BatchTimeout time.Duration
+
+	// The number of consecutive failures after which a source is given up. Defaults to 3.
+	MaxFailures int
+
+	// If set, ReconstructFromSources is aborted with the context's error when the context is done.
+	Context context.Context
+
+	// If set, called once for every chunk fetched, with the index of the source that delivered it.
+	// The chunk is only valid during the call. May be called concurrently.
+	OnNewChunk func(source int, chunk cafs.File)
+}
+
+// Type multiSource holds the state shared between the workers of ReconstructFromSources.
+type multiSource struct {
+	storage cafs.FileStorage
+	info    string
+	opts    MultiSourceOptions
+	ctx     context.Context
+
+	mutex    sync.Mutex // Guards subsequent variables
+	cond     *sync.Cond // Signalled whenever one of the subsequent variables changes
+	lengths  map[cafs.SKey]int
+	queue    []cafs.SKey             // Chunks not yet assigned to a source
+	assigned int                     // Chunks assigned to a source, but not yet received
+	chunks   map[cafs.SKey]cafs.File // Chunks available locally
+	rates    []float64               // Estimated throughput per source in bytes/s, 0 if unknown
+	active   int                     // Number of sources still in use
+}
+
+// Function ReconstructFromSources reconstructs a file from an announcement as written by
+// WriteChunkHashes, fetching the chunks missing from `storage` from several sources in parallel.
+// Every source is repeatedly assigned a batch of missing chunks as soon as it has delivered
+// the previous one, so that faster sources serve more chunks. Batch sizes are weighted by
+// each source's measured throughput. When a source fails or times out, the chunks it didn't
+// deliver are reassigned to the other sources. Chunks are verified against the announcement.
+// Returns ErrNoSource if all sources have been given up before all chunks were fetched.
+func ReconstructFromSources(storage cafs.FileStorage, perm shuffle.Permutation, announcement io.Reader, sources []ChunkSource, info string, opts MultiSourceOptions) (cafs.File, error) {
+	if err := perm.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 16
+	}
+	if opts.MaxFailures <= 0 {
+		opts.MaxFailures = 3
+	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m := &multiSource{
+		storage: storage,
+		info:    info,
+		opts:    opts,
+		ctx:     ctx,
+		lengths: make(map[cafs.SKey]int),
+		chunks:  make(map[cafs.SKey]cafs.File),
+		rates:   make([]float64, len(sources)),
+		active:  len(sources),
+	}
+	m.cond = sync.NewCond(&m.mutex)
+	defer func() {
+		for _, chunk := range m.chunks {
+			chunk.Dispose()
+		}
+	}()
+
+	order, err := m.readAnnouncement(perm, announcement)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(m.queue) > 0 {
+		// Wake up waiting workers when the context is done
+		stop := context.AfterFunc(ctx, func() {
+			m.mutex.Lock()
+			m.cond.Broadcast()
+			m.mutex.Unlock()
+		})
+		defer stop()
+
+		var wg sync.WaitGroup
+		for i, source := range sources {
+			wg.Add(1)
+			go func(i int, source ChunkSource) {
+				defer wg.Done()
+				m.work(i, source)
+			}(i, source)
+		}
+		wg.Wait()
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		} else if len(m.queue) > 0 {
+			return nil, ErrNoSource
+		}
+	}
+
+	temp := storage.Create(info)
+	defer temp.Dispose()
+	for _, key := range order {
+		if err := appendChunk(temp, m.chunks[key]); err != nil {
+			return nil, err
+		}
+	}
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	return temp.File(), nil
+}
+
+// Reads the announcement and returns the keys of all chunks in their original order. Chunks
+// found in the storage are kept, all others are queued for fetching.
+func (m *multiSource) readAnnouncement(perm shuffle.Permutation, announcement io.Reader) ([]cafs.SKey, error) {
+	r := bufio.NewReader(announcement)
+	var order []cafs.SKey
+	unshuffler := shuffle.NewInverseStreamShuffler(perm, placeholder, func(v interface{}) error {
+		order = append(order, v.(cafs.SKey))
+		return nil
+	})
+	for idx := 0; ; idx++ {
+		var key cafs.SKey
+		if _, err := io.ReadFull(r, key[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Error reading hash of chunk #%d: %v", idx, err)
+		}
+		length, err := readChunkLength(r)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading length of chunk #%d: %v", idx, err)
+		}
+		if key == emptyKey {
+			_ = unshuffler.Put(placeholder)
+			continue
+		}
+		_ = unshuffler.Put(key)
+		if _, ok := m.lengths[key]; ok {
+			continue
+		}
+		m.lengths[key] = int(length)
+		if chunk, err := m.storage.Get(&key); err == nil {
+			m.chunks[key] = chunk
+		} else {
+			m.queue = append(m.queue, key)
+		}
+	}
+	_ = unshuffler.End()
+	return order, nil
+}
+
+// Function work fetches batches of chunks from source `i` until no chunks are left to fetch
+// or the source has failed too often.
+func (m *multiSource) work(i int, source ChunkSource) {
+	failures := 0
+	defer func() {
+		m.mutex.Lock()
+		m.active--
+		m.cond.Broadcast()
+		m.mutex.Unlock()
+	}()
+	for failures < m.opts.MaxFailures {
+		batch := m.nextBatch(i)
+		if batch == nil {
+			return
+		}
+		start := time.Now()
+		received, bytes, err := m.fetch(i, source, batch)
+		m.mutex.Lock()
+		// Chunks not delivered are put back at the front of the queue
+		m.queue = append(batch[received:len(batch):len(batch)], m.queue...)
+		m.assigned -= len(batch)
+		if bytes > 0 {
+			rate := float64(bytes) / time.Since(start).Seconds()
+			if m.rates[i] == 0 {
+				m.rates[i] = rate
+			} else {
+				m.rates[i] = 0.5*m.rates[i] + 0.5*rate
+			}
+		}
+		m.cond.Broadcast()
+		m.mutex.Unlock()
+		if err != nil {
+			failures++
+			if LoggingEnabled {
+				log.Printf("Source #%d failed after delivering %d of %d chunks: %v", i, received, len(batch), err)
+			}
+		} else {
+			failures = 0
+		}
+	}
+}
+
+// Function nextBatch waits until chunks can be assigned to source `i` and returns them.
+// Returns nil if nothing is left to do.
+func (m *multiSource) nextBatch(i int) []cafs.SKey {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for len(m.queue) == 0 {
+		// Chunks assigned to other sources may come back if those fail
+		if m.assigned == 0 || m.ctx.Err() != nil {
+			return nil
+		}
+		m.cond.Wait()
+	}
+	if m.ctx.Err() != nil {
+		return nil
+	}
+	n := m.opts.BatchSize
+	if maxRate := m.maxRate(); m.rates[i] > 0 && maxRate > 0 {
+		n = int(float64(n)*m.rates[i]/maxRate + 0.5)
+	}
+	if n < 1 {
+		n = 1
+	} else if n > len(m.queue) {
+		n = len(m.queue)
+	}
+	batch := make([]cafs.SKey, n)
+	copy(batch, m.queue)
+	m.queue = m.queue[n:]
+	m.assigned += n
+	return batch
+}
+
+func (m *multiSource) maxRate() float64 {
+	var max float64
+	for _, rate := range m.rates {
+		if rate > max {
+			max = rate
+		}
+	}
+	return max
+}
+
+// Function fetch requests `batch` from `source` and stores the chunks delivered. Returns the
+// number of chunks and bytes received, and the error that ended the transmission, if any.
+func (m *multiSource) fetch(i int, source ChunkSource, batch []cafs.SKey) (int, int64, error) {
+	ctx, cancel := m.ctx, context.CancelFunc(func() {})
+	if m.opts.BatchTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, m.opts.BatchTimeout)
+	}
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(source.FetchChunks(ctx, batch, pw))
+	}()
+	// Reading is interrupted when the context is done, even if the source doesn't notice
+	stop := context.AfterFunc(ctx, func() {
+		pr.CloseWithError(ctx.Err())
+	})
+	defer func() {
+		stop()
+		pr.Close()
+		if ctx.Err() == nil {
+			// The source fails writing to the closed pipe. Once the context is done, a source
+			// ignoring it might block elsewhere indefinitely.
+			<-done
+		}
+	}()
+
+	r := bufio.NewReader(pr)
+	var bytes int64
+	for n, key := range batch {
+		chunk, err := readChunk(m.storage, r, fmt.Sprintf("%v #%v", m.info, key))
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, bytes, err
+		}
+		if chunk.Key() != key || chunk.Size() != int64(m.lengths[key]) {
+			chunk.Dispose()
+			return n, bytes, ErrUnexpectedChunk
+		}
+		bytes += chunk.Size()
+		if m.opts.OnNewChunk != nil {
+			m.opts.OnNewChunk(i, chunk)
+		}
+		m.mutex.Lock()
+		m.chunks[key] = chunk
+		m.mutex.Unlock()
+	}
+	return len(batch), bytes, nil
+}
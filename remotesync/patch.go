@@ -0,0 +1,173 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"io"
+)
+
+// Every patch written by ExportPatch starts with this byte sequence.
+const patchMagic = "CAFSPATCH1"
+
+// Returned by ApplyPatch if the patch is malformed.
+var ErrInvalidPatch = errors.New("Invalid patch")
+
+// Returned by ApplyPatch if the patch was created against a different base file.
+var ErrBaseMismatch = errors.New("Patch doesn't apply to base file")
+
+// Function ExportPatch writes a patch to `w` from which `target` can be reconstructed given `base`.
+// The patch consists of the keys of both files, followed by the list of the target's chunks.
+// The data of every chunk not contained in `base` is included the first time it occurs, so the
+// size of the patch is close to the number of bytes that differ.
+//
+// The encoding is: magic, base key, target key, then for each chunk (key, length as varint,
+// flag byte) optionally followed by the data if the flag is 1. The list ends with the zero key.
+func ExportPatch(base, target cafs.File, w io.Writer) error {
+	var known cafs.KeySet
+	for _, c := range ListChunks(base) {
+		known.Add(c.Key)
+	}
+
+	bw := bufio.NewWriter(w)
+	baseKey, targetKey := base.Key(), target.Key()
+	bw.WriteString(patchMagic)
+	bw.Write(baseKey[:])
+	bw.Write(targetKey[:])
+
+	iter := target.Chunks()
+	defer iter.Dispose()
+	for iter.Next() {
+		key := iter.Key()
+		bw.Write(key[:])
+		if err := writeVarint(bw, iter.Size()); err != nil {
+			return err
+		}
+		if known.Contains(key) {
+			if err := bw.WriteByte(0); err != nil {
+				return err
+			}
+			continue
+		}
+		known.Add(key)
+		if err := bw.WriteByte(1); err != nil {
+			return err
+		}
+		if err := copyChunkData(bw, iter.File()); err != nil {
+			return err
+		}
+	}
+	bw.Write(zeroKey[:])
+	return bw.Flush()
+}
+
+func copyChunkData(w io.Writer, chunk cafs.File) error {
+	defer chunk.Dispose()
+	r := chunk.Open()
+	defer r.Close()
+	_, err := io.Copy(w, r)
+	return err
+}
+
+// Function ApplyPatch reads a patch written by ExportPatch from `r` and reconstructs the target
+// file in `storage`, taking the chunks not included in the patch from `base`. Returns
+// ErrBaseMismatch if the patch was created against another base file, and ErrInvalidPatch if the
+// patch is malformed or the reconstructed file doesn't match the target key.
+func ApplyPatch(base cafs.File, r io.Reader, storage cafs.FileStorage) (cafs.File, error) {
+	br := bufio.NewReader(r)
+	var header [len(patchMagic) + 2*len(cafs.SKey{})]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	} else if string(header[:len(patchMagic)]) != patchMagic {
+		return nil, ErrInvalidPatch
+	}
+	var baseKey, targetKey cafs.SKey
+	copy(baseKey[:], header[len(patchMagic):])
+	copy(targetKey[:], header[len(patchMagic)+len(baseKey):])
+	if baseKey != base.Key() {
+		return nil, ErrBaseMismatch
+	}
+
+	// Chunks available for reconstruction, from the base file or from the patch
+	chunks := make(map[cafs.SKey]cafs.File)
+	defer func() {
+		for _, chunk := range chunks {
+			chunk.Dispose()
+		}
+	}()
+	iter := base.Chunks()
+	for iter.Next() {
+		if _, ok := chunks[iter.Key()]; !ok {
+			chunks[iter.Key()] = iter.File()
+		}
+	}
+	iter.Dispose()
+
+	temp := storage.Create(fmt.Sprintf("Patched %v", targetKey))
+	defer temp.Dispose()
+	for idx := 0; ; idx++ {
+		var key cafs.SKey
+		if _, err := io.ReadFull(br, key[:]); err != nil {
+			return nil, fmt.Errorf("%w: reading key of chunk #%d: %v", ErrInvalidPatch, idx, err)
+		} else if key == zeroKey {
+			break
+		}
+		length, err := readChunkLength(br)
+		if err != nil {
+			return nil, fmt.Errorf("%w: reading length of chunk #%d: %v", ErrInvalidPatch, idx, err)
+		}
+		flag, err := br.ReadByte()
+		if err != nil || flag > 1 {
+			return nil, fmt.Errorf("%w: reading flag of chunk #%d: %v", ErrInvalidPatch, idx, err)
+		}
+		chunk := chunks[key]
+		if flag == 1 && chunk == nil {
+			if chunk, err = copyChunk(storage, br, length, fmt.Sprintf("Patch chunk #%d", idx)); err != nil {
+				return nil, fmt.Errorf("%w: reading data of chunk #%d: %v", ErrInvalidPatch, idx, err)
+			}
+			chunks[key] = chunk
+			if chunk.Key() != key {
+				return nil, fmt.Errorf("%w: data of chunk #%d doesn't match its key", ErrInvalidPatch, idx)
+			}
+		} else if flag == 1 {
+			// Already known; skip the data
+			if _, err := br.Discard(int(length)); err != nil {
+				return nil, fmt.Errorf("%w: reading data of chunk #%d: %v", ErrInvalidPatch, idx, err)
+			}
+		} else if chunk == nil {
+			return nil, fmt.Errorf("%w: chunk #%d is neither in base nor in patch", ErrInvalidPatch, idx)
+		}
+		if chunk.Size() != length {
+			return nil, fmt.Errorf("%w: chunk #%d has unexpected length", ErrInvalidPatch, idx)
+		}
+		if err := appendChunk(temp, chunk); err != nil {
+			return nil, err
+		}
+	}
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	file := temp.File()
+	if file.Key() != targetKey {
+		file.Dispose()
+		return nil, fmt.Errorf("%w: reconstructed file doesn't match target key", ErrInvalidPatch)
+	}
+	return file, nil
+}
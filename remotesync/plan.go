@@ -0,0 +1,188 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"io"
+	"sort"
+)
+
+// Function DecodeAnnouncement reads an announcement written by WriteChunkHashes using `perm` and
+// returns the announced chunks in their original order, with their offsets within the file.
+// An announcement ending with a digest (see AnnounceOptions.Digest) is accepted; the digest
+// itself is ignored. Salted announcements yield salted keys.
+func DecodeAnnouncement(perm shuffle.Permutation, announcement io.Reader) ([]ChunkInfo, error) {
+	if err := perm.Validate(); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(announcement)
+	var result []ChunkInfo
+	var offset int64
+	unshuffler := shuffle.NewInverseStreamShuffler(perm, placeholder, func(v interface{}) error {
+		c := v.(ChunkInfo)
+		c.Offset = offset
+		offset += c.Size
+		result = append(result, c)
+		return nil
+	})
+	for idx := 0; ; idx++ {
+		var key cafs.SKey
+		if _, err := io.ReadFull(r, key[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Error reading hash of chunk #%d: %v", idx, err)
+		}
+		if key == zeroKey {
+			var digest cafs.SKey
+			if _, err := io.ReadFull(r, digest[:]); err != nil {
+				return nil, fmt.Errorf("Error reading digest: %v", err)
+			} else if _, err := r.ReadByte(); err != io.EOF {
+				return nil, errors.New("Data after digest")
+			}
+			break
+		}
+		length, err := readChunkLength(r)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading length of chunk #%d: %v", idx, err)
+		}
+		if key == emptyKey {
+			_ = unshuffler.Put(placeholder)
+		} else {
+			_ = unshuffler.Put(ChunkInfo{Key: key, Size: length})
+		}
+	}
+	_ = unshuffler.End()
+	return result, nil
+}
+
+// Type FetchPlan assigns the chunks missing from a storage to the sources holding them.
+type FetchPlan struct {
+	// The keys to fetch from each source, in the order the chunks appear in the wanted files.
+	Assignments [][]cafs.SKey
+	// The number of bytes to fetch from each source.
+	Bytes []int64
+	// Keys of chunks missing from the storage that no source holds, in the order they appear.
+	Unavailable []cafs.SKey
+}
+
+// Function PlanFetch decides which source to fetch each chunk of `wanted` from that is missing in
+// `storage`, given the chunk lists `available` announced by the sources, e.g. as decoded by
+// DecodeAnnouncement. Each missing chunk is assigned to exactly one source holding it. Chunks held
+// by fewer sources are assigned first, each to the holder with the fewest bytes assigned so far,
+// which spreads the load evenly. No data is transferred; the plan can be executed by passing each
+// source's assignment to ChunkSource.FetchChunks.
+func PlanFetch(storage cafs.FileStorage, wanted []ChunkInfo, available [][]ChunkInfo) *FetchPlan {
+	holders := make(map[cafs.SKey][]int)
+	for i, chunks := range available {
+		for _, c := range chunks {
+			if h := holders[c.Key]; len(h) == 0 || h[len(h)-1] != i {
+				holders[c.Key] = append(h, i)
+			}
+		}
+	}
+
+	// Collect missing chunks, remembering their first position within the wanted files
+	type missing struct {
+		ChunkInfo
+		pos int
+	}
+	var todo []missing
+	seen := cafs.NewKeySet(len(wanted))
+	for pos, c := range wanted {
+		if !seen.Add(c.Key) {
+			continue
+		}
+		if _, err := storage.StatByKey(&c.Key); err == nil {
+			continue
+		}
+		todo = append(todo, missing{c, pos})
+	}
+
+	plan := &FetchPlan{
+		Assignments: make([][]cafs.SKey, len(available)),
+		Bytes:       make([]int64, len(available)),
+	}
+	sort.SliceStable(todo, func(i, j int) bool {
+		return len(holders[todo[i].Key]) < len(holders[todo[j].Key])
+	})
+	assigned := make([][]missing, len(available))
+	for _, m := range todo {
+		h := holders[m.Key]
+		if len(h) == 0 {
+			plan.Unavailable = append(plan.Unavailable, m.Key)
+			continue
+		}
+		best := h[0]
+		for _, i := range h[1:] {
+			if plan.Bytes[i] < plan.Bytes[best] {
+				best = i
+			}
+		}
+		assigned[best] = append(assigned[best], m)
+		plan.Bytes[best] += m.Size
+	}
+	for i, chunks := range assigned {
+		sort.Slice(chunks, func(a, b int) bool { return chunks[a].pos < chunks[b].pos })
+		for _, m := range chunks {
+			plan.Assignments[i] = append(plan.Assignments[i], m.Key)
+		}
+	}
+	return plan
+}
+
+// Type ExchangePlan tells two peers A and B which chunks to send each other, so that both end up
+// holding all chunks of both files.
+type ExchangePlan struct {
+	// For each chunk of B's file, whether B sends it to A.
+	ToA []bool
+	// For each chunk of A's file, whether A sends it to B.
+	ToB []bool
+	// The number of bytes sent in either direction.
+	BytesToA, BytesToB int64
+}
+
+// Function PlanExchange computes which chunks two peers need to exchange, given the chunk lists
+// `a` and `b` they announced, e.g. as decoded by DecodeAnnouncement. Every chunk held by only one
+// of the peers is sent exactly once, by the peer holding it, at its first position in that peer's
+// file. Chunks held by both peers aren't sent at all.
+func PlanExchange(a, b []ChunkInfo) *ExchangePlan {
+	plan := &ExchangePlan{ToA: make([]bool, len(b)), ToB: make([]bool, len(a))}
+	plan.BytesToB = planDirection(a, b, plan.ToB)
+	plan.BytesToA = planDirection(b, a, plan.ToA)
+	return plan
+}
+
+// Marks the first occurrence of each chunk of `from` missing in `to` and returns their size.
+func planDirection(from, to []ChunkInfo, send []bool) int64 {
+	present := cafs.NewKeySet(len(to) + len(from))
+	for _, c := range to {
+		present.Add(c.Key)
+	}
+	var bytes int64
+	for i, c := range from {
+		if present.Add(c.Key) {
+			send[i] = true
+			bytes += c.Size
+		}
+	}
+	return bytes
+}
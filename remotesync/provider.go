@@ -0,0 +1,106 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"fmt"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/chunking/adler32"
+	"io"
+)
+
+// Interface ChunkProvider is implemented by anything chunks can be obtained from by key, e.g. a
+// local cache, a CDN or a group of peers. Unlike a ChunkSource, it is asked for one chunk at a time.
+type ChunkProvider interface {
+	// Returns a reader over the data of the chunk identified by `key`, which is closed by the
+	// caller. Returns cafs.ErrNotFound if the chunk isn't available.
+	GetChunk(key cafs.SKey) (io.ReadCloser, error)
+}
+
+// Type storageProvider is a ChunkProvider serving chunks from a FileStorage.
+type storageProvider struct {
+	storage cafs.FileStorage
+}
+
+// Returns a ChunkProvider serving chunks from the given storage.
+func NewStorageProvider(storage cafs.FileStorage) ChunkProvider {
+	return storageProvider{storage}
+}
+
+func (p storageProvider) GetChunk(key cafs.SKey) (io.ReadCloser, error) {
+	chunk, err := p.storage.Get(&key)
+	if err != nil {
+		return nil, err
+	}
+	return fileReader{chunk.Open(), chunk}, nil
+}
+
+// Like ReconstructFileFromRequestedChunks, but obtains each requested chunk from `provider` instead
+// of reading a stream of chunk data. Must be called after WriteWishList. Chunks received by
+// ReceiveDatagrams aren't requested again, and neither are chunks received before a failed
+// reconstruction, which this function resumes. Chunks are verified like those read from a stream.
+//
+// Chunks are requested by the keys they were announced with, so salted announcements (see
+// BuilderOptions.Salt) require a provider aware of the salt.
+func (b *Builder) ReconstructFromProvider(provider ChunkProvider) (cafs.File, error) {
+	b.mutex.Lock()
+	keys := make([]cafs.SKey, 0, len(b.requestedOrder))
+	for seq, key := range b.requestedOrder {
+		if b.datagrams == nil || !b.datagrams[seq] {
+			keys = append(keys, key)
+		}
+	}
+	b.mutex.Unlock()
+	keys = keys[min(b.ReceivedChunks(), len(keys)):]
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(writeProvidedChunks(provider, keys, pw))
+	}()
+	defer func() {
+		pr.Close()
+		<-done
+	}()
+	return b.ReconstructFileFromRequestedChunks(pr)
+}
+
+// Writes the chunks identified by `keys`, as obtained from `provider`, to `w` in the format
+// written by WriteChunkData.
+func writeProvidedChunks(provider ChunkProvider, keys []cafs.SKey, w io.Writer) error {
+	for _, key := range keys {
+		r, err := provider.GetChunk(key)
+		if err != nil {
+			return fmt.Errorf("Getting chunk %v: %w", key, err)
+		}
+		data, err := io.ReadAll(io.LimitReader(r, adler32.MAX_CHUNK+1))
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("Reading chunk %v: %w", key, err)
+		} else if len(data) > adler32.MAX_CHUNK {
+			return ErrUnexpectedChunk
+		}
+		if err := writeVarint(w, int64(len(data))); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"errors"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"io"
+)
+
+// Every pull request starts with this byte sequence.
+const pullMagic = "CAFSPULL1"
+
+// Returned by ServePull if the connection doesn't start with a valid request.
+var ErrInvalidPull = errors.New("Invalid pull request")
+
+// Names of the phases of a pull, as reported in PullEvent.
+const (
+	PhaseRequesting    = "requesting"
+	PhaseNegotiating   = "negotiating"
+	PhaseReceivingData = "receiving data"
+	PhaseConfirming    = "confirming"
+)
+
+// Type PullEventType tells what a PullEvent reports.
+type PullEventType int
+
+const (
+	// A new phase of the transfer has begun.
+	PullPhase PullEventType = iota
+	// A chunk missing from the storage has been received.
+	PullProgress
+	// The transfer has ended. This is the last event.
+	PullCompleted
+)
+
+func (t PullEventType) String() string {
+	switch t {
+	case PullPhase:
+		return "phase"
+	case PullProgress:
+		return "progress"
+	case PullCompleted:
+		return "completed"
+	}
+	return "unknown"
+}
+
+// Type PullEvent reports the progress of a transfer driven by RunPull.
+type PullEvent struct {
+	Type  PullEventType
+	Phase string // The current phase (see the Phase constants)
+	// Size of the file, once the announcement has been received
+	BytesTotal int64
+	// Bytes and number of the chunks received from the sender so far
+	BytesReceived  int64
+	ChunksReceived int
+	// Set on PullCompleted if the transfer failed
+	Err error
+}
+
+// Type Pull is a transfer started by RunPull.
+type Pull struct {
+	// Delivers the events of the transfer, ending with a PullCompleted event, after which it is
+	// closed. Must be drained, as the transfer blocks until its events have been received.
+	Events <-chan PullEvent
+	done   chan struct{}
+	file   cafs.File
+	err    error
+	stats  TransferStats
+}
+
+// Waits for the transfer to end and returns the received file, which must be disposed, or the
+// error that made it fail.
+func (p *Pull) Wait() (cafs.File, error) {
+	<-p.done
+	return p.file, p.err
+}
+
+// Waits for the transfer to end and returns its final statistics (see Builder.Stats), e.g. for
+// reporting how effective deduplication was (see TransferStats.DedupRatio). The statistics are
+// zero if the transfer failed before the announcement was received.
+func (p *Pull) Stats() TransferStats {
+	<-p.done
+	return p.stats
+}
+
+// Function RunPull requests the file stored under `key` from the peer at the other end of `conn`,
+// which must be running ServePull, and stores it in `storage`. The transfer runs in the background,
+// reporting its progress through the returned Pull's events, which allows tools to render it.
+// The options are applied as with ReceivePush. The transfer fails with cafs.ErrNotFound if the
+// peer doesn't have the file.
+func RunPull(storage cafs.FileStorage, conn io.ReadWriter, key cafs.SKey, info string, opts BuilderOptions) *Pull {
+	events := make(chan PullEvent, 16)
+	p := &Pull{Events: events, done: make(chan struct{})}
+	go func() {
+		var last PullEvent
+		emit := func(typ PullEventType) {
+			last.Type = typ
+			events <- last
+		}
+
+		onNewChunk := opts.OnNewChunk
+		opts.OnNewChunk = func(chunk cafs.File) {
+			if onNewChunk != nil {
+				onNewChunk(chunk)
+			}
+			last.BytesReceived += chunk.Size()
+			last.ChunksReceived++
+			emit(PullProgress)
+		}
+
+		last.Phase = PhaseRequesting
+		emit(PullPhase)
+		p.err = requestPull(conn, key)
+		if p.err == nil {
+			var b *Builder
+			p.file, p.err = receivePush(storage, conn, info, opts, func(name string, builder *Builder) {
+				last.Phase = name
+				if builder != nil {
+					b = builder
+					last.BytesTotal = builder.Stats().Bytes
+				}
+				emit(PullPhase)
+			})
+			if b != nil {
+				p.stats = b.Stats()
+			}
+		}
+		last.Err = p.err
+		emit(PullCompleted)
+		close(events)
+		close(p.done)
+	}()
+	return p
+}
+
+// Like RunPull, but if `storage` already holds the complete file stored under `key` (see
+// LocalFile), the pull ends immediately with that file, without using `conn`, and its statistics
+// are zero. In that case, the caller should close the connection, which makes the peer's ServePull
+// fail while reading the request.
+func PullIfMissing(storage cafs.FileStorage, conn io.ReadWriter, key cafs.SKey, info string, opts BuilderOptions) *Pull {
+	file, err := LocalFile(storage, key)
+	if err == cafs.ErrNotFound {
+		return RunPull(storage, conn, key, info, opts)
+	}
+	events := make(chan PullEvent, 1)
+	p := &Pull{Events: events, done: make(chan struct{}), file: file, err: err}
+	event := PullEvent{Type: PullCompleted, Err: err}
+	if file != nil {
+		event.BytesTotal = file.Size()
+	}
+	events <- event
+	close(events)
+	close(p.done)
+	return p
+}
+
+// Function LocalFile returns the file stored under `key` in `storage` if all of its chunks are
+// present, so that pulling it would transfer no data. The file must be disposed. Returns
+// cafs.ErrNotFound if the file or any of its chunks is missing.
+func LocalFile(storage cafs.FileStorage, key cafs.SKey) (cafs.File, error) {
+	file, err := storage.Get(&key)
+	if err != nil {
+		return nil, err
+	}
+	chunks := file.Chunks()
+	defer chunks.Dispose()
+	for chunks.Next() {
+		chunkKey := chunks.Key()
+		if _, err := storage.StatByKey(&chunkKey); err != nil {
+			file.Dispose()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// Writes the request for `key` and reads the response. Returns cafs.ErrNotFound if the peer
+// doesn't have the file.
+func requestPull(conn io.ReadWriter, key cafs.SKey) error {
+	if _, err := conn.Write(append([]byte(pullMagic), key[:]...)); err != nil {
+		return checkPeerClosed(err)
+	}
+	var status [1]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return checkPeerClosed(err)
+	} else if status[0] == 0 {
+		return cafs.ErrNotFound
+	}
+	return nil
+}
+
+// Function ServePull answers a request written by RunPull at the other end of `conn`, pushing the
+// requested file from `storage` using `perm` (see PushWithOptions). Returns ErrInvalidPull if
+// the connection doesn't start with a valid request, and cafs.ErrNotFound if the file isn't
+// stored, which is also reported to the peer.
+func ServePull(storage cafs.FileStorage, conn io.ReadWriter, perm shuffle.Permutation, opts PushOptions) error {
+	return servePull(storage, conn, perm, opts, nil)
+}
+
+// Implements ServePull. If `server` is not nil, a slot of its pool is occupied from after reading
+// the request until the push has ended.
+func servePull(storage cafs.FileStorage, conn io.ReadWriter, perm shuffle.Permutation, opts PushOptions, server *Server) error {
+	header := make([]byte, len(pullMagic)+len(cafs.SKey{}))
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return checkPeerClosed(err)
+	} else if string(header[:len(pullMagic)]) != pullMagic {
+		return ErrInvalidPull
+	}
+	var key cafs.SKey
+	copy(key[:], header[len(pullMagic):])
+	if server != nil {
+		server.acquire(nil)
+		defer server.release()
+	}
+
+	file, err := storage.Get(&key)
+	if err != nil {
+		conn.Write([]byte{0})
+		return err
+	}
+	defer file.Dispose()
+	if _, err := conn.Write([]byte{1}); err != nil {
+		return checkPeerClosed(err)
+	}
+	return PushWithOptions(storage, file, perm, conn, opts)
+}
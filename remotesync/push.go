@@ -0,0 +1,350 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"io"
+)
+
+// Every push starts with this byte sequence.
+const pushMagic = "CAFSPUSH1"
+
+// Upper bound for the length of a pushed permutation
+const maxPushPermutation = 1 << 16
+
+// Upper bound for the number of chunks of a pushed file, unless BuilderOptions.MaxChunks is given.
+// The receiver keeps all of them in the Builder's window, which is allocated in advance.
+const defaultMaxPushChunks = 1 << 16
+
+// Returned by Push if the receiver reported that it couldn't reconstruct the file.
+var ErrPushRejected = errors.New("Push rejected by receiver")
+
+// Returned by ReceivePush if the connection doesn't start with a valid push header.
+var ErrInvalidPush = errors.New("Invalid push header")
+
+// Type PushOptions contains optional settings for PushWithOptions.
+// The zero value selects the default behavior.
+type PushOptions struct {
+	// The maximum size of the frames the announcement and the chunk data are sent in. Small frames
+	// allow the receiver to start processing the announcement sooner, large frames reduce the
+	// overhead. Defaults to 16 KiB.
+	MaxFrameSize int
+}
+
+// Function Push transmits `file` to the peer at the other end of `conn`, which must be running
+// ReceivePush. This allows the holder of the content to open the connection, e.g. if the receiver
+// can't accept connections. The phases are the same as when the receiver drives the transfer, but
+// follow each other: the file is announced along with the permutation, then the wishlist is
+// received, then the requested chunks are sent. Finally, the receiver confirms the file's key.
+// Returns ErrPushRejected if the receiver failed. If announcing the file fails, `conn` is closed
+// if it implements io.Closer. Otherwise, a goroutine keeps reading from it until it fails.
+func Push(storage cafs.FileStorage, file cafs.File, perm shuffle.Permutation, conn io.ReadWriter) error {
+	return PushWithOptions(storage, file, perm, conn, PushOptions{})
+}
+
+// Like Push, but allows for specifying options.
+func PushWithOptions(storage cafs.FileStorage, file cafs.File, perm shuffle.Permutation, conn io.ReadWriter, opts PushOptions) error {
+	if err := perm.Validate(); err != nil {
+		return err
+	}
+	if opts.MaxFrameSize <= 0 {
+		opts.MaxFrameSize = 16 * 1024
+	}
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+
+	// Header: magic, key, number of chunks and permutation
+	bw.WriteString(pushMagic)
+	key := file.Key()
+	bw.Write(key[:])
+	writeUvarint(bw, uint64(file.NumChunks()))
+	writeUvarint(bw, uint64(len(perm)))
+	for _, v := range perm {
+		writeUvarint(bw, uint64(v))
+	}
+
+	// The wishlist is read while announcing, as the receiver writes it while reading
+	type wishlistResult struct {
+		rle      bool
+		index    bool
+		anyOrder bool
+		data     []byte
+		err      error
+	}
+	wishlistDone := make(chan wishlistResult, 1)
+	go func() {
+		var res wishlistResult
+		var flags byte
+		if flags, res.err = br.ReadByte(); res.err == nil {
+			res.rle = flags&1 != 0
+			res.index = flags&2 != 0
+			res.anyOrder = flags&4 != 0
+			res.data, res.err = io.ReadAll(&frameReader{r: br})
+		}
+		wishlistDone <- res
+	}()
+
+	// Stops the wishlist reader if announcing fails
+	abort := func(err error) error {
+		if c, ok := conn.(io.Closer); ok {
+			c.Close()
+			<-wishlistDone
+		}
+		return err
+	}
+
+	// Coalesce the many small writes into frames
+	fw := &frameWriter{w: bw, max: opts.MaxFrameSize}
+	aw := bufio.NewWriterSize(fw, opts.MaxFrameSize)
+	if err := WriteChunkHashes(file, perm, aw); err != nil {
+		return abort(err)
+	}
+	if err := aw.Flush(); err != nil {
+		return abort(checkPeerClosed(err))
+	}
+	if err := fw.Close(); err != nil {
+		return abort(checkPeerClosed(err))
+	}
+	if err := bw.Flush(); err != nil {
+		return abort(checkPeerClosed(err))
+	}
+
+	wishlist := <-wishlistDone
+	if wishlist.err != nil {
+		return checkPeerClosed(wishlist.err)
+	}
+
+	fw = &frameWriter{w: bw, max: opts.MaxFrameSize}
+	dw := bufio.NewWriterSize(fw, opts.MaxFrameSize)
+	if err := WriteChunkDataWithOptions(storage, file, bufio.NewReader(bytes.NewReader(wishlist.data)), perm, dw, nil,
+		ServeOptions{RunLengthWishList: wishlist.rle, IndexWishList: wishlist.index, LocalityOrder: wishlist.anyOrder}); err != nil {
+		return err
+	}
+	if err := dw.Flush(); err != nil {
+		return checkPeerClosed(err)
+	}
+	if err := fw.Close(); err != nil {
+		return checkPeerClosed(err)
+	}
+	if err := bw.Flush(); err != nil {
+		return checkPeerClosed(err)
+	}
+
+	var confirmed cafs.SKey
+	if _, err := io.ReadFull(br, confirmed[:]); err != nil {
+		return checkPeerClosed(err)
+	}
+	if confirmed != key {
+		return ErrPushRejected
+	}
+	return nil
+}
+
+// Function ReceivePush receives a file pushed by the peer at the other end of `conn` using Push,
+// and stores it in `storage`. The options are applied as with NewBuilderWithOptions, except that
+// the number of chunks is limited to the number announced in the header, which is limited to
+// 65536 unless MaxChunks is given. As the wishlist phase
+// completes before the data phase begins, the Builder's window covers the whole file. The
+// Context option should be used for limiting the duration of the transfer. With AnyChunkOrder,
+// the sender is asked to send the chunks in the order of its storage (see ServeOptions.LocalityOrder).
+func ReceivePush(storage cafs.FileStorage, conn io.ReadWriter, info string, opts BuilderOptions) (cafs.File, error) {
+	return receivePush(storage, conn, info, opts, func(string, *Builder) {})
+}
+
+// Like ReceivePush, but calls `phase` whenever a new phase of the transfer begins.
+func receivePush(storage cafs.FileStorage, conn io.ReadWriter, info string, opts BuilderOptions, phase func(name string, builder *Builder)) (cafs.File, error) {
+	phase(PhaseNegotiating, nil)
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+
+	magic := make([]byte, len(pushMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, checkPeerClosed(err)
+	} else if string(magic) != pushMagic {
+		return nil, ErrInvalidPush
+	}
+	var key cafs.SKey
+	if _, err := io.ReadFull(br, key[:]); err != nil {
+		return nil, checkPeerClosed(err)
+	}
+	numChunks, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, checkPeerClosed(err)
+	}
+	if numChunks == 0 {
+		return nil, fmt.Errorf("%w: file of %d chunks", ErrInvalidPush, numChunks)
+	}
+	permLen, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, checkPeerClosed(err)
+	} else if permLen == 0 || permLen > maxPushPermutation {
+		return nil, fmt.Errorf("%w: permutation of length %d", ErrInvalidPush, permLen)
+	}
+	perm := make(shuffle.Permutation, permLen)
+	for i := range perm {
+		v, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, checkPeerClosed(err)
+		} else if v >= permLen {
+			return nil, shuffle.ErrInvalidPermutation
+		}
+		perm[i] = int(v)
+	}
+	if opts.MaxChunks <= 0 {
+		opts.MaxChunks = defaultMaxPushChunks
+	}
+	if numChunks > uint64(opts.MaxChunks) {
+		return nil, fmt.Errorf("%w: more than %d chunks", ErrAnnouncementRejected, opts.MaxChunks)
+	}
+	// Otherwise, announcing more chunks than fit into the window would block the announcement
+	opts.MaxChunks = int(numChunks)
+
+	builder := NewBuilderWithOptions(storage, perm, int(numChunks)+len(perm), info, opts)
+	defer builder.Dispose()
+
+	var flags byte
+	if opts.RunLengthWishList {
+		flags |= 1
+	}
+	if opts.IndexWishList {
+		flags |= 2
+	}
+	if opts.AnyChunkOrder {
+		flags |= 4
+	}
+	bw.WriteByte(flags)
+	fw := &frameWriter{w: bw}
+	if err := builder.WriteWishList(&frameReader{r: br}, flushingFrameWriter{fw, bw}); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, checkPeerClosed(err)
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, checkPeerClosed(err)
+	}
+
+	phase(PhaseReceivingData, builder)
+	file, err := builder.ReconstructFileFromRequestedChunks(&frameReader{r: br})
+	if err == nil && file.Key() != key {
+		file.Dispose()
+		file, err = nil, ErrContentMismatch
+	}
+
+	// Confirm the key of the received file, or report failure with the zero key
+	phase(PhaseConfirming, builder)
+	var confirmed cafs.SKey
+	if err == nil {
+		confirmed = key
+	}
+	bw.Write(confirmed[:])
+	if e := bw.Flush(); err == nil && e != nil {
+		file.Dispose()
+		file, err = nil, checkPeerClosed(e)
+	}
+	return file, err
+}
+
+func writeUvarint(w io.Writer, value uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	_, err := w.Write(buf[:binary.PutUvarint(buf[:], value)])
+	return err
+}
+
+// Type frameWriter delimits a stream within a connection by writing each block of data as a frame
+// prefixed with its length. Blocks larger than max (if > 0) are split. Close writes an empty
+// frame, which marks the end of the stream.
+type frameWriter struct {
+	w   io.Writer
+	max int
+}
+
+func (w *frameWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		frame := b
+		if w.max > 0 && len(frame) > w.max {
+			frame = frame[:w.max]
+		}
+		if err := writeUvarint(w.w, uint64(len(frame))); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(frame)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[len(frame):]
+	}
+	return written, nil
+}
+
+func (w *frameWriter) Close() error {
+	return writeUvarint(w.w, 0)
+}
+
+// Type flushingFrameWriter implements FlushWriter for writing the wishlist in frames.
+type flushingFrameWriter struct {
+	*frameWriter
+	bw *bufio.Writer
+}
+
+func (w flushingFrameWriter) Flush() {
+	_ = w.bw.Flush()
+}
+
+// Type frameReader reads a stream written by frameWriter, returning io.EOF at its end without
+// reading beyond it.
+type frameReader struct {
+	r         *bufio.Reader
+	remaining uint64
+	done      bool
+}
+
+func (r *frameReader) Read(b []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	if r.remaining == 0 {
+		l, err := binary.ReadUvarint(r.r)
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		} else if l == 0 {
+			r.done = true
+			return 0, io.EOF
+		}
+		r.remaining = l
+	}
+	if uint64(len(b)) > r.remaining {
+		b = b[:r.remaining]
+	}
+	n, err := r.r.Read(b)
+	r.remaining -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
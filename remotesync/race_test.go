@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package remotesync
+
+// The race detector slows down the tests considerably, so large test cases are skipped.
+const raceEnabled = true
@@ -0,0 +1,89 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"fmt"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/chunking/adler32"
+	"io"
+	"log"
+)
+
+// Type ChunkInfo describes a chunk of a file by its key, its position within the file
+// and its length.
+type ChunkInfo struct {
+	Key    cafs.SKey
+	Offset int64
+	Size   int64
+}
+
+// Function ListChunks returns the list of chunks making up `file`, in order.
+func ListChunks(file cafs.File) []ChunkInfo {
+	result := make([]ChunkInfo, 0, file.NumChunks())
+	iter := file.Chunks()
+	defer iter.Dispose()
+	var offset int64
+	for iter.Next() {
+		result = append(result, ChunkInfo{Key: iter.Key(), Offset: offset, Size: iter.Size()})
+		offset += iter.Size()
+	}
+	return result
+}
+
+// Function ReconstructFromReaderAt reconstructs a file consisting of `chunks` in `storage`,
+// reading only those chunks not already present in `storage` from the random-access source `src`.
+// This is a shortcut to the wishlist/data exchange for sources that are locally accessible.
+// Returns ErrUnexpectedChunk if data read from `src` doesn't match the chunk's key.
+func ReconstructFromReaderAt(storage cafs.FileStorage, chunks []ChunkInfo, src io.ReaderAt, info string) (cafs.File, error) {
+	if LoggingEnabled {
+		log.Printf("Receiver: Begin ReconstructFromReaderAt")
+		defer log.Printf("Receiver: End ReconstructFromReaderAt")
+	}
+
+	temp := storage.Create(info)
+	defer temp.Dispose()
+
+	for idx, c := range chunks {
+		if c.Size < 0 || c.Size > adler32.MAX_CHUNK {
+			return nil, fmt.Errorf("Invalid chunk length: %v", c.Size)
+		}
+		chunk, err := storage.Get(&c.Key)
+		if err == cafs.ErrNotFound {
+			chunk, err = copyChunk(storage, io.NewSectionReader(src, c.Offset, c.Size), c.Size, fmt.Sprintf("%v #%d", info, idx))
+			if err != nil {
+				return nil, err
+			}
+			if chunk.Key() != c.Key {
+				chunk.Dispose()
+				return nil, ErrUnexpectedChunk
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		err = appendChunk(temp, chunk)
+		chunk.Dispose()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	return temp.File(), nil
+}
@@ -18,18 +18,56 @@ package remotesync
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/overlay"
 	"github.com/indyjo/cafs/remotesync/shuffle"
 	"io"
 	"log"
+	"os"
 	"sync"
+	"time"
 )
 
 var ErrDisposed = errors.New("Disposed")
+
+// Returned by ReconstructFileFromRequestedChunks if a requested chunk arrives out of order, or if
+// the length prefix of the next chunk doesn't match the length announced for it. In the latter
+// case, the chunk data stream is out of sync and the chunk is rejected before its data is read.
 var ErrUnexpectedChunk = errors.New("Unexpected chunk")
 
+// Returned by ReconstructFileFromRequestedChunks if the sender sent a chunk that wasn't requested,
+// e.g. because the file changed after it had been announced. This is a violation of the protocol,
+// as opposed to ErrUnexpectedChunk, which signals that a requested chunk arrived out of order or
+// with the wrong length.
+var ErrUnrequestedChunk = errors.New("Received chunk that wasn't requested")
+
+// Returned by ReconstructFileFromRequestedChunks if called again after it couldn't be resumed.
+var ErrNotResumable = errors.New("Reconstruction can't be resumed")
+
+// Returned by ReconstructFileFromRequestedChunks if BuilderOptions.MaxReorderBytes would be
+// exceeded and no SpillDir was given.
+var ErrReorderLimit = errors.New("Reorder buffer limit exceeded")
+
+// Returned by ReconstructFileFromRequestedChunks if BuilderOptions.ExpectDigest is set and the
+// reconstructed file doesn't match the digest announced by the sender. Also returned by
+// WriteWishList if the announcement doesn't end with a digest.
+var ErrDigestMismatch = errors.New("Whole-file digest mismatch")
+
+// Returned by WriteWishList when an announcement violates the limits given in BuilderOptions.
+var ErrAnnouncementRejected = errors.New("Announcement rejected")
+
+// Returned by WriteWishList and WriteChunkDataWithOptions if a transfer involves a chunk rejected by
+// the AllowChunk predicate given in the options.
+var ErrChunkDenied = errors.New("Chunk denied")
+
+// Returned by transmission functions when the other side closed the connection prematurely.
+// This usually signals a normal termination by the peer rather than an actual failure.
+var ErrPeerClosed = errors.New("Connection closed by peer")
+
 // Interface FlushWriter acts like an io.Writer with an additional Flush method.
 type FlushWriter interface {
 	io.Writer
@@ -47,15 +85,34 @@ type chunk struct {
 
 // Type Builder contains state needed for the duration of a file transmission.
 type Builder struct {
-	done    chan struct{}
-	storage cafs.FileStorage
-	chunks  chan chunk
-	info    string
-	perm    shuffle.Permutation
+	done     chan struct{}
+	storage  cafs.FileStorage
+	chunks   chan chunk
+	info     string
+	perm     shuffle.Permutation
+	opts     BuilderOptions
+	salted   *saltedIndex // Maps salted keys to local keys, if a salt was given
+	ctx      context.Context
+	transfer *transfer
+	overlay  overlay.OverlayStorage // Set if the Builder is ephemeral (see BuilderOptions.EphemeralBytes)
+	rootErr  error                  // Set by WriteWishList before closing chunks if the root hash or digest didn't match
 
 	mutex    sync.Mutex // Guards subsequent variables
 	disposed bool       // Set in Dispose
 	started  bool       // Set in WriteWishList. Signals that chunks channel will be used.
+
+	announcing   bool          // Set while WriteWishList is running
+	ann          *announcement // State of WriteWishList
+	chunksClosed bool          // Set when the chunks channel has been closed
+
+	reconstructing bool            // Set while ReconstructFileFromRequestedChunks is running
+	recon          *reconstruction // State of ReconstructFileFromRequestedChunks
+	stats          TransferStats   // Chunks and bytes announced and received so far
+	requested      cafs.KeySet     // Keys of the chunks requested from the sender
+	requestedOrder []cafs.SKey     // The same keys, in the order they are transmitted
+
+	datagrams  []bool                  // Which requested chunks ReceiveDatagrams received
+	prefetched map[cafs.SKey]cafs.File // Chunks received by ReceiveDatagrams, until reconstruction begins
 }
 
 // Returns a new receiver for reconstructing a file. Must eventually be disposed.
@@ -63,15 +120,117 @@ type Builder struct {
 // and output a "wishlist" of chunks that are missing in the local storage
 // for complete reconstruction of the file.
 func NewBuilder(storage cafs.FileStorage, perm shuffle.Permutation, windowSize int, info string) *Builder {
+	return NewBuilderWithOptions(storage, perm, windowSize, info, BuilderOptions{})
+}
+
+// Type BuilderOptions contains optional settings for a Builder.
+// The zero value selects the default behavior.
+type BuilderOptions struct {
+	// If any of the following limits (or AllowChunk) is set, WriteWishList reads the complete
+	// announcement before requesting any chunk, and rejects it with ErrAnnouncementRejected if a
+	// limit is violated. This protects receivers from senders trying to exhaust their resources.
+	MinChunkSize int64 // Minimum length of a chunk (except the last one), or 0 for no limit
+	MaxChunkSize int64 // Maximum length of a chunk, or 0 for no limit
+	MaxChunks    int   // Maximum number of chunks in the announcement, or 0 for no limit
+	// Called for each chunk key announced. If it returns false, the announcement is rejected with
+	// ErrChunkDenied, e.g. for enforcing a deny list. With a Salt, the salted keys are passed.
+	AllowChunk func(key cafs.SKey) bool
+
+	// If set, the announcement is expected to contain chunk hashes salted with this value
+	// (see AnnounceOptions). The storage must implement cafs.KeyEnumerator.
+	Salt []byte
+
+	// If set, WriteWishList and ReconstructFileFromRequestedChunks are aborted with the
+	// context's error when the context is done.
+	Context context.Context
+
+	// If set, the Builder is registered under its info string until it is disposed,
+	// allowing it to be listed and cancelled.
+	Registry *Registry
+
+	// If set, called by ReconstructFileFromRequestedChunks once for every chunk received from
+	// the sender, i.e. chunks that were missing from the storage. The chunk is only valid during
+	// the call and must be duplicated if needed afterwards (see cafs.File.Duplicate).
+	OnNewChunk func(chunk cafs.File)
+
+	// If set, the root hash of the announced chunk list (see RootHash) is computed while the
+	// announcement streams in, and must match. Otherwise, WriteWishList returns ErrRootMismatch
+	// after the announcement has been read, and so does ReconstructFileFromRequestedChunks
+	// instead of returning the file.
+	ExpectedRoot *cafs.SKey
+
+	// If set, the wishlist is written in the run-length encoded format. The sender must expect
+	// the same format (see ServeOptions.RunLengthWishList).
+	RunLengthWishList bool
+
+	// If set, the wishlist lists the positions of the requested chunks as deltas instead of
+	// containing a bit per chunk, which is much more compact if only few chunks of a large file
+	// are requested. The sender must expect the same format (see ServeOptions.IndexWishList).
+	// Takes precedence over RunLengthWishList.
+	IndexWishList bool
+
+	// If greater than 0, limits the total size of the chunks ReconstructFileFromRequestedChunks
+	// holds while waiting for their position in the file to be reached. Depending on the
+	// permutation, this may otherwise be a large fraction of the file. Chunks that would exceed
+	// the limit are spilled into a temporary file created in SpillDir. If SpillDir is empty, the
+	// reconstruction fails with ErrReorderLimit instead.
+	MaxReorderBytes int64
+	SpillDir        string
+
+	// If set, the announcement is expected to end with the digest of the file's content (see
+	// AnnounceOptions.Digest). This guards against the file being assembled wrongly from correct
+	// chunks: ReconstructFileFromRequestedChunks returns ErrDigestMismatch instead of a file whose
+	// key differs from the digest.
+	ExpectDigest bool
+
+	// If set, ReconstructFileFromRequestedChunks accepts the requested chunks in any order, as
+	// sent with ServeOptions.LocalityOrder. Chunks received ahead of their position are matched by
+	// their key and held in the storage until their position is reached.
+	AnyChunkOrder bool
+
+	// If greater than 0, the Builder doesn't write to its storage. Instead, received chunks and
+	// the reconstructed file are kept in an in-memory storage of this capacity, layered over the
+	// storage (see package overlay), which must be able to hold the whole file. Chunks already
+	// present in the storage are still used. The in-memory storage is discarded when the Builder
+	// is disposed, while the reconstructed file remains valid until disposed itself. See
+	// ReconstructToReader.
+	EphemeralBytes int64
+
+	// If greater than 0, ReconstructFileFromRequestedChunks reads chunk data from the stream on a
+	// separate goroutine, so that reading overlaps with committing chunks to the storage. Up to
+	// this many chunks are queued for being committed. When the queue is full, reading pauses,
+	// which bounds the memory used if the storage is slower than the network. Otherwise, each
+	// chunk is committed before the next one is read. As chunks are read ahead, their lengths are
+	// compared with the announcement only after their data has been read. Even if the stream is out
+	// of sync, no more than CommitQueue+2 chunks of up to the maximum chunk size are buffered. After a failed reconstruction, the goroutine may complete a read from the stream
+	// already in progress.
+	CommitQueue int
+}
+
+func (o *BuilderOptions) hasLimits() bool {
+	return o.MinChunkSize > 0 || o.MaxChunkSize > 0 || o.MaxChunks > 0 || o.AllowChunk != nil
+}
+
+// Like NewBuilder, but allows for specifying options.
+func NewBuilderWithOptions(storage cafs.FileStorage, perm shuffle.Permutation, windowSize int, info string, opts BuilderOptions) *Builder {
 	p := make(shuffle.Permutation, len(perm))
 	copy(p, perm)
-	return &Builder{
-		done:    make(chan struct{}),
-		storage: storage,
-		chunks:  make(chan chunk, windowSize),
-		info:    info,
-		perm:    p,
+	transfer, ctx := opts.Registry.register(opts.Context, info, Receiving)
+	b := &Builder{
+		done:     make(chan struct{}),
+		storage:  storage,
+		chunks:   make(chan chunk, windowSize),
+		info:     info,
+		perm:     p,
+		opts:     opts,
+		ctx:      ctx,
+		transfer: transfer,
+	}
+	if opts.EphemeralBytes > 0 {
+		b.overlay = overlay.NewOverlayStorage(storage, opts.EphemeralBytes)
+		b.storage = b.overlay
 	}
+	return b
 }
 
 // Disposes the receiver. Must be called exactly once per receiver. May cause the goroutines running
@@ -83,9 +242,21 @@ func (b *Builder) Dispose() {
 	}
 	b.disposed = true
 	started := b.started
+	if started && !b.announcing {
+		// An interrupted announcement won't be resumed
+		b.closeChunks()
+	}
+	if b.recon != nil && !b.reconstructing {
+		b.disposeReconstruction(b.recon)
+	}
+	for _, chunk := range b.prefetched {
+		chunk.Dispose()
+	}
+	b.prefetched = nil
 	b.mutex.Unlock()
 
 	close(b.done)
+	b.transfer.done()
 
 	if started {
 		for chunk := range b.chunks {
@@ -94,151 +265,604 @@ func (b *Builder) Dispose() {
 			}
 		}
 	}
+	if b.overlay != nil {
+		b.overlay.Dispose()
+	}
 }
 
 // Reads a byte sequence encoded with WriteChunkHashes and
 // outputs a bit stream with '1' for each missing chunk, and
 // '0' for each chunk that is already available or already requested.
+// Returns ErrPeerClosed if the sender stopped reading the wishlist or closed the announcement
+// prematurely, and shuffle.ErrInvalidPermutation if the Builder's permutation is not a valid bijection.
+// If limits are set in the BuilderOptions, an announcement violating them is rejected with
+// ErrAnnouncementRejected before any chunk is requested. Likewise, an announcement containing a
+// chunk denied by BuilderOptions.AllowChunk is rejected with ErrChunkDenied.
+//
+// If reading the announcement or writing the wishlist fails, the state is kept and the function
+// may be called again with new streams. The new announcement stream must continue with the
+// first entry not yet read (see AnnouncedEntries and AnnounceOptions.SkipEntries), while the new
+// wishlist is written from the beginning. Note that an announcement interrupted exactly between
+// two entries can't be told apart from a complete one. After any other error, or after success,
+// ErrNotResumable is returned.
 func (b *Builder) WriteWishList(_r io.Reader, w FlushWriter) error {
 	if LoggingEnabled {
 		log.Printf("Receiver: Begin WriteWishList")
 		defer log.Printf("Receiver: End WriteWishList")
 	}
 
-	if err := b.start(); err != nil {
+	ann, err := b.beginAnnouncement()
+	if err != nil {
 		return err
 	}
+	// We need ReadByte
+	resumable, err := b.writeWishList(ann, bufio.NewReader(_r), w)
+	b.endAnnouncement(ann, err == nil || !resumable)
+	b.transfer.setPhase("wishlist", endPhase(err))
+	return checkTruncated(err)
+}
+
+// Returns the number of announcement entries (including placeholders) read so far by
+// WriteWishList. When resuming, the sender must skip this number of entries.
+func (b *Builder) AnnouncedEntries() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.ann == nil {
+		return 0
+	}
+	return b.ann.read
+}
 
-	defer close(b.chunks)
+// Type announcement holds the state of WriteWishList, which is kept across interruptions of
+// the announcement stream.
+type announcement struct {
+	read      int                    // Number of entries read from announcement streams
+	announced []chunk                // All entries read, if limits are checked
+	backlog   []chunk                // Entries read but not yet processed
+	idx       int                    // Number of entries processed
+	lastPos   int64                  // Sum of the lengths of the entries processed
+	requested cafs.KeySet            // Keys requested or found in the storage
+	root      *RootHasher            // Computes the root hash, if expected
+	inverse   shuffle.StreamShuffler // Restores the original order for root
+	wishes    []byte                 // Wishlist bits written so far, eight per byte
+	digest    *cafs.SKey             // The digest announced by the sender, if expected
+	finished  bool                   // Set when the announcement succeeded or failed irrecoverably
+}
 
-	// We need ReadByte
-	r := bufio.NewReader(_r)
+func (a *announcement) addWish(bit bool) {
+	if a.idx%8 == 0 {
+		a.wishes = append(a.wishes, 0)
+	}
+	if bit {
+		a.wishes[len(a.wishes)-1] |= 1 << (a.idx % 8)
+	}
+}
 
-	requested := make(map[cafs.SKey]bool)
-	idx := 0
-	var lastPos int64
+func (a *announcement) wish(i int) bool {
+	return a.wishes[i/8]&(1<<(i%8)) != 0
+}
+
+func (b *Builder) beginAnnouncement() (*announcement, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.disposed {
+		return nil, ErrDisposed
+	}
+	if b.announcing {
+		panic("WriteWishList called concurrently")
+	}
+	if b.ann == nil {
+		b.ann = &announcement{}
+		if b.opts.ExpectedRoot != nil {
+			root := new(RootHasher)
+			b.ann.root = root
+			b.ann.inverse = shuffle.NewInverseStreamShuffler(b.perm, placeholder, func(v interface{}) error {
+				c := v.(chunk)
+				root.Add(c.key, int64(c.length))
+				return nil
+			})
+		}
+		// This has consequences for the Dispose method
+		b.started = true
+	} else if b.ann.finished {
+		return nil, ErrNotResumable
+	}
+	b.announcing = true
+	return b.ann, nil
+}
+
+// Closes the chunks channel once the announcement is finished, or if the Builder has been disposed.
+func (b *Builder) endAnnouncement(ann *announcement, finished bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.announcing = false
+	if finished {
+		ann.finished = true
+	}
+	if finished || b.disposed {
+		b.closeChunks()
+	}
+}
+
+// Must be called with the mutex held.
+func (b *Builder) closeChunks() {
+	if !b.chunksClosed {
+		b.chunksClosed = true
+		close(b.chunks)
+	}
+}
+
+// Function writeWishList implements WriteWishList. Returns whether an error is caused by the
+// streams, so that the announcement can be resumed.
+func (b *Builder) writeWishList(ann *announcement, r *bufio.Reader, w FlushWriter) (bool, error) {
+	resumable := false
+
+	if err := b.perm.Validate(); err != nil {
+		return false, err
+	}
+
+	if len(b.opts.Salt) > 0 && b.salted == nil {
+		if idx, err := newSaltedIndex(b.storage, b.opts.Salt); err != nil {
+			return false, err
+		} else {
+			b.salted = idx
+		}
+	}
 
 	// Utility closure for creating informative error messages
 	statusError := func(msg string, err error) error {
-		return fmt.Errorf("Error %v after successfully reading %v chunks hashes up to byte position %v: %v",
-			msg, idx, lastPos, err)
+		return fmt.Errorf("Error %v after successfully reading %v chunks hashes up to byte position %v: %w",
+			msg, ann.idx, ann.lastPos, err)
+	}
+
+	// Reads a chunk hash and its length. Only complete entries count as read. If a digest is
+	// expected, it is read when encountering the zero key and must end the announcement.
+	next := func() (key cafs.SKey, length int64, err error) {
+		if _, err = io.ReadFull(r, key[:]); err == io.EOF {
+			if b.opts.ExpectDigest && ann.digest == nil {
+				b.rootErr = ErrDigestMismatch
+				err = ErrDigestMismatch
+			}
+			return
+		} else if err != nil {
+			resumable = true
+			err = statusError("reading chunk hash", err)
+			return
+		} else if key == zeroKey && b.opts.ExpectDigest {
+			var digest cafs.SKey
+			if _, err = io.ReadFull(r, digest[:]); err != nil {
+				resumable = true
+				err = statusError("reading digest", err)
+				return
+			} else if _, err = r.ReadByte(); err == nil {
+				err = statusError("reading end of announcement", errors.New("Data after digest"))
+				return
+			} else if err != io.EOF {
+				resumable = true
+				err = statusError("reading end of announcement", err)
+				return
+			}
+			b.mutex.Lock()
+			ann.digest = &digest
+			b.mutex.Unlock()
+			return
+		}
+		if length, err = readChunkLength(r); err != nil {
+			resumable = true
+			err = statusError("reading length of chunk", err)
+			return
+		}
+		b.mutex.Lock()
+		ann.read++
+		b.mutex.Unlock()
+		return
+	}
+
+	if b.opts.hasLimits() {
+		// Check the complete announcement before requesting anything. Entries read before an
+		// interruption are checked again.
+		saved := ann.announced
+		announced, err := b.readAnnouncement(func() (key cafs.SKey, length int64, err error) {
+			if len(saved) > 0 {
+				key, length = saved[0].key, int64(saved[0].length)
+				saved = saved[1:]
+				return
+			}
+			if key, length, err = next(); err == nil {
+				ann.announced = append(ann.announced, chunk{key: key, length: int(length)})
+			}
+			return
+		})
+		if err != nil {
+			return resumable, err
+		}
+		ann.backlog = announced[ann.idx:]
 	}
 
-	bitWriter := newBitWriter(w)
+	bitWriter := newWishListWriter(w, wishListFormatOf(b.opts.RunLengthWishList, b.opts.IndexWishList))
+	// The wishlist is written from the beginning
+	for i := 0; i < ann.idx; i++ {
+		if err := bitWriter.WriteBit(ann.wish(i)); err != nil {
+			return true, checkPeerClosed(err)
+		}
+	}
 
 	for {
-		// Read a chunk hash and its length
-		var key cafs.SKey
-		if _, err := io.ReadFull(r, key[:]); err == io.EOF {
+		var c chunk
+		b.transfer.setPhase("wishlist", "reading announcement")
+		if len(ann.backlog) > 0 {
+			c, ann.backlog = ann.backlog[0], ann.backlog[1:]
+		} else if key, length, err := next(); err == io.EOF {
 			break
 		} else if err != nil {
-			return statusError("reading chunk hash", err)
-		}
-		var length int64
-		if l, err := readChunkLength(r); err != nil {
-			return statusError("reading length of chunk", err)
+			return resumable, err
 		} else {
-			length = l
+			c = chunk{key: key, length: int(length)}
 		}
 
-		lastPos += length
-		chunk := chunk{
-			key:    key,
-			length: int(length),
+		// Write chunk info into channel. This might block if channel buffer is full.
+		// In that case, pending wishlist bits are written first, as the other end might
+		// wait for them.
+		if len(b.chunks) == cap(b.chunks) {
+			b.transfer.setPhase("wishlist", "writing wishlist")
+			if err := bitWriter.sync(); err != nil {
+				ann.backlog = append([]chunk{c}, ann.backlog...)
+				return true, checkPeerClosed(err)
+			}
 		}
 
-		if key == emptyKey || requested[key] {
+		if c.key == emptyKey || ann.requested.Contains(c.key) {
 			// This key was already requested. Also, the empty key is never requested.
-			chunk.requested = false
-		} else if file, err := b.storage.Get(&key); err != nil {
+			c.requested = false
+		} else if file, err := b.getChunk(c.key); err != nil {
 			// File was not found in storage -> request and remember
-			chunk.requested = true
-			requested[key] = true
+			c.requested = true
+			ann.requested.Add(c.key)
+			b.mutex.Lock()
+			b.requested.Add(c.key)
+			b.requestedOrder = append(b.requestedOrder, c.key)
+			b.mutex.Unlock()
 		} else {
 			// File was already in storage -> prevent it from being collected until it is needed
-			chunk.file = file
-			chunk.requested = false
-			requested[key] = true
+			c.file = file
+			c.requested = false
+			ann.requested.Add(c.key)
 		}
 
-		// Write chunk info into channel. This might block if channel buffer is full.
 		// Only wait until disposed.
+		b.transfer.setPhase("wishlist", "waiting for window")
 		select {
-		case b.chunks <- chunk:
+		case b.chunks <- c:
 			// Responsibility for disposing chunk.file is passed to the channel
 		case <-b.done:
-			if chunk.file != nil {
-				chunk.file.Dispose()
+			if c.file != nil {
+				c.file.Dispose()
 			}
-			return ErrDisposed
+			return false, ErrDisposed
+		case <-b.ctx.Done():
+			if c.file != nil {
+				c.file.Dispose()
+			}
+			return false, b.ctx.Err()
 		}
 
-		if err := bitWriter.WriteBit(chunk.requested); err != nil {
-			return err
+		// The root hash is computed over the chunk list in original order
+		if ann.inverse != nil && c.key == emptyKey {
+			_ = ann.inverse.Put(placeholder)
+		} else if ann.inverse != nil {
+			_ = ann.inverse.Put(chunk{key: c.key, length: c.length})
 		}
+		if c.key != emptyKey {
+			b.mutex.Lock()
+			b.stats.Chunks++
+			b.stats.Bytes += int64(c.length)
+			b.mutex.Unlock()
+		}
+		ann.lastPos += int64(c.length)
+		ann.addWish(c.requested)
+		ann.idx++
 
-		idx++
+		b.transfer.setPhase("wishlist", "writing wishlist")
+		if err := bitWriter.WriteBit(c.requested); err != nil {
+			return true, checkPeerClosed(err)
+		}
+	}
+	if err := bitWriter.Flush(); err != nil {
+		return true, checkPeerClosed(err)
+	}
+	if ann.inverse != nil {
+		_ = ann.inverse.End()
+		if ann.root.Sum() != *b.opts.ExpectedRoot {
+			b.rootErr = ErrRootMismatch
+			return false, ErrRootMismatch
+		}
 	}
-	return bitWriter.Flush()
+	return false, nil
 }
 
-// Function start is called by WriteWishList to mark the Builder as started.
-// This has consequences for the Dispose method.
-func (b *Builder) start() error {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-	if b.disposed {
-		return ErrDisposed
+// Function readAnnouncement reads all chunk hashes and lengths using `next` and checks them
+// against the limits given in the BuilderOptions.
+func (b *Builder) readAnnouncement(next func() (cafs.SKey, int64, error)) ([]chunk, error) {
+	var announced []chunk
+	// The last chunk of a file may be arbitrarily short, but we don't know which one it is in the
+	// permuted order. So we allow for exactly one short chunk.
+	numChunks, numShort := 0, 0
+	for {
+		key, length, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		announced = append(announced, chunk{key: key, length: int(length)})
+		if key == emptyKey {
+			// Placeholders don't count
+			continue
+		}
+		numChunks++
+		if b.opts.AllowChunk != nil && !b.opts.AllowChunk(key) {
+			return nil, fmt.Errorf("%w: %v", ErrChunkDenied, key)
+		}
+		if b.opts.MaxChunks > 0 && numChunks > b.opts.MaxChunks {
+			return nil, fmt.Errorf("%w: more than %d chunks", ErrAnnouncementRejected, b.opts.MaxChunks)
+		}
+		if b.opts.MaxChunkSize > 0 && length > b.opts.MaxChunkSize {
+			return nil, fmt.Errorf("%w: chunk of length %d exceeds maximum of %d",
+				ErrAnnouncementRejected, length, b.opts.MaxChunkSize)
+		}
+		if length < b.opts.MinChunkSize {
+			numShort++
+			if numShort > 1 {
+				return nil, fmt.Errorf("%w: chunk of length %d is below minimum of %d",
+					ErrAnnouncementRejected, length, b.opts.MinChunkSize)
+			}
+		}
 	}
-	if b.started {
-		panic("WriteWishList called twice")
+	return announced, nil
+}
+
+// Retrieves the chunk announced as `key` from the local storage, taking salting into account.
+func (b *Builder) getChunk(key cafs.SKey) (cafs.File, error) {
+	if b.salted != nil {
+		if k, ok := b.salted.lookup(key); ok {
+			key = k
+		} else {
+			return nil, cafs.ErrNotFound
+		}
 	}
-	b.started = true
-	return nil
+	return b.storage.Get(&key)
+}
+
+// Returns the key under which a chunk with local key `key` is announced. If salting is used,
+// the chunk is also made known to getChunk.
+func (b *Builder) announcedKey(key cafs.SKey) cafs.SKey {
+	if b.salted != nil {
+		return b.salted.add(key)
+	}
+	return key
+}
+
+// Returns whether the chunk announced as `key` has been requested from the sender.
+func (b *Builder) wasRequested(key cafs.SKey) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.requested.Contains(key)
 }
 
 var placeholder interface{} = struct{}{}
 
+// Type reconstruction holds the state of ReconstructFileFromRequestedChunks, which is kept
+// across interruptions of the chunk data stream.
+type reconstruction struct {
+	temp       cafs.Temporary
+	unshuffler shuffle.StreamShuffler
+	idx        int    // Number of chunk infos processed
+	pending    *chunk // Chunk info whose data was being read when the stream broke
+	received   int    // Number of requested chunks received
+	finished   bool   // Set when the reconstruction succeeded or failed irrecoverably
+
+	maxBuffered int64    // Limit for buffered, or 0 for no limit
+	buffered    int64    // Total size of the chunks held by the unshuffler
+	spillDir    string   // Where to create spill, or "" if exceeding maxBuffered is an error
+	spill       *os.File // Holds the data of chunks that would have exceeded maxBuffered
+	spillSize   int64    // Number of bytes written to spill
+
+	early map[cafs.SKey]cafs.File // Chunks received ahead of their position (see AnyChunkOrder)
+}
+
+// Type spilledChunk takes the place of a chunk in the unshuffler after its data has been
+// written to the reconstruction's spill file.
+type spilledChunk struct {
+	offset, size int64
+}
+
 // Reads a sequence of length-prefixed data chunks and tries to reconstruct a file from that
-// information.
+// information. Returns shuffle.ErrInvalidPermutation if the Builder's permutation is not a valid bijection.
+// If the chunk data ends prematurely, the error matches both ErrPeerClosed and io.ErrUnexpectedEOF.
+//
+// If reading the chunk data fails, the state of the reconstruction is kept and the function may be
+// called again with a new stream, which must continue with the first requested chunk not yet
+// received (see ReceivedChunks and ServeOptions.SkipRequested). Chunks received completely are
+// not requested again. After any other error, or after success, ErrNotResumable is returned.
+//
+// When the reconstruction fails with an error it can't be resumed from, or is cancelled, all
+// references to chunks introduced so far are released before returning, so that the storage is
+// free to reclaim them. After a resumable error, they are kept until the reconstruction is resumed
+// successfully or the Builder is disposed.
 func (b *Builder) ReconstructFileFromRequestedChunks(_r io.Reader) (cafs.File, error) {
 	if LoggingEnabled {
 		log.Printf("Receiver: Begin ReconstructFileFromRequestedChunks")
 		defer log.Printf("Receiver: End ReconstructFileFromRequestedChunks")
 	}
 
-	temp := b.storage.Create(b.info)
-	defer temp.Dispose()
+	if err := b.perm.Validate(); err != nil {
+		return nil, err
+	}
 
-	r := bufio.NewReader(_r)
+	rec, err := b.beginReconstruction()
+	if err != nil {
+		return nil, err
+	}
+	file, resumable, err := b.reconstruct(rec, bufio.NewReader(_r))
+	b.endReconstruction(rec, err == nil || !resumable)
+	b.transfer.setPhase("data", endPhase(err))
+	return file, checkTruncated(err)
+}
 
-	errDone := errors.New("Done")
+// Like ReconstructFileFromRequestedChunks, but returns a reader over the reconstructed file, which
+// is disposed when the reader is closed. Combined with BuilderOptions.EphemeralBytes, this allows
+// for processing a file's content without adding it to the storage.
+func (b *Builder) ReconstructToReader(r io.Reader) (io.ReadCloser, error) {
+	file, err := b.ReconstructFileFromRequestedChunks(r)
+	if err != nil {
+		return nil, err
+	}
+	return fileReader{file.Open(), file}, nil
+}
 
-	unshuffler := shuffle.NewInverseStreamShuffler(b.perm, placeholder, func(v interface{}) error {
-		chunk := v.(cafs.File)
-		// Write a chunk of the work file
-		err := appendChunk(temp, chunk)
-		chunk.Dispose()
-		return err
-	})
+// Type fileReader reads a file's content and disposes the file when closed.
+type fileReader struct {
+	io.ReadCloser
+	file cafs.File
+}
+
+func (r fileReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.file.Dispose()
+	return err
+}
+
+// Returns the number of requested chunks received so far by ReconstructFileFromRequestedChunks.
+// When resuming, the sender must skip this number of requested chunks.
+func (b *Builder) ReceivedChunks() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.recon == nil {
+		return 0
+	}
+	return b.recon.received
+}
+
+func (b *Builder) beginReconstruction() (*reconstruction, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.disposed {
+		return nil, ErrDisposed
+	}
+	if b.reconstructing {
+		panic("ReconstructFileFromRequestedChunks called concurrently")
+	}
+	if b.recon == nil {
+		rec := &reconstruction{
+			temp:        b.storage.Create(b.info),
+			maxBuffered: b.opts.MaxReorderBytes,
+			spillDir:    b.opts.SpillDir,
+		}
+		rec.unshuffler = shuffle.NewInverseStreamShuffler(b.perm, placeholder, rec.consume)
+		rec.early, b.prefetched = b.prefetched, nil
+		b.recon = rec
+	} else if b.recon.finished {
+		return nil, ErrNotResumable
+	}
+	b.reconstructing = true
+	return b.recon, nil
+}
+
+func (b *Builder) endReconstruction(rec *reconstruction, finished bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.reconstructing = false
+	if finished || b.disposed {
+		b.disposeReconstruction(rec)
+	}
+}
+
+// Releases the reconstruction's resources and records the duration of the transfer.
+// Must be called with the mutex held.
+func (b *Builder) disposeReconstruction(rec *reconstruction) {
+	if !rec.finished {
+		b.stats.Duration = time.Since(b.transfer.info.Started)
+	}
+	rec.dispose()
+}
 
+// Releases all resources held by the reconstruction.
+func (rec *reconstruction) dispose() {
+	if rec.finished {
+		return
+	}
+	rec.finished = true
 	// Make sure all chunks in the unshuffler are disposed in the end
-	defer unshuffler.WithFunc(func(v interface{}) error {
-		v.(cafs.File).Dispose()
+	rec.unshuffler.WithFunc(func(v interface{}) error {
+		if chunk, ok := v.(cafs.File); ok {
+			chunk.Dispose()
+		}
 		return nil
 	}).End()
+	rec.temp.Dispose()
+	if rec.spill != nil {
+		rec.spill.Close()
+		os.Remove(rec.spill.Name())
+	}
+	if rec.pending != nil && rec.pending.file != nil {
+		rec.pending.file.Dispose()
+	}
+	for _, chunk := range rec.early {
+		chunk.Dispose()
+	}
+	rec.early = nil
+}
+
+// Function reconstruct implements ReconstructFileFromRequestedChunks. Returns whether an error is
+// caused by the chunk data stream, so that the reconstruction can be resumed.
+func (b *Builder) reconstruct(rec *reconstruction, r *bufio.Reader) (cafs.File, bool, error) {
+	errDone := errors.New("Done")
+	resumable := false
+
+	// Reads the next chunk from the stream and commits it to the storage. Unless `expected` is
+	// negative, a chunk whose length prefix differs from it is rejected with ErrUnexpectedChunk,
+	// as the stream is out of sync with the announcement. This happens before its data is read,
+	// except with a CommitQueue, which reads ahead.
+	read := func(expected int64) (cafs.File, error) {
+		length, err := readChunkLength(r)
+		if err != nil {
+			return nil, err
+		} else if expected >= 0 && length != expected {
+			return nil, ErrUnexpectedChunk
+		}
+		return copyChunk(b.storage, r, length, fmt.Sprintf("%v #%d", b.info, rec.idx))
+	}
+	if b.opts.CommitQueue > 0 {
+		queue := newChunkQueue(r, b.opts.CommitQueue)
+		defer queue.close()
+		read = func(expected int64) (cafs.File, error) {
+			return queue.next(b, fmt.Sprintf("%v #%d", b.info, rec.idx), expected)
+		}
+	}
 
-	idx := 0
 	iteration := func() error {
 		var chunkInfo chunk
 
-		// Wait until either a chunk info can be read from the channel, or the builder
-		// has been disposed.
-		select {
-		case <-b.done:
-			return ErrDisposed
-		case chunkInfo = <-b.chunks:
-			// successfully read, continue...
+		if err := b.ctx.Err(); err != nil {
+			return err
+		}
+		b.transfer.setProgress(rec.idx, rec.unshuffler.Buffered())
+		if rec.pending != nil {
+			// Continue with the chunk that was being read when the last stream broke
+			chunkInfo = *rec.pending
+			rec.pending = nil
+		} else {
+			// Wait until either a chunk info can be read from the channel, or the builder
+			// has been disposed.
+			b.transfer.setPhase("data", "waiting for chunk info")
+			select {
+			case <-b.done:
+				return ErrDisposed
+			case <-b.ctx.Done():
+				return b.ctx.Err()
+			case chunkInfo = <-b.chunks:
+				// successfully read, continue...
+			}
 		}
 
 		// It is our responsibility to dispose the file.
@@ -247,61 +871,277 @@ func (b *Builder) ReconstructFileFromRequestedChunks(_r io.Reader) (cafs.File, e
 		}
 
 		if chunkInfo.key == emptyKey {
-			return unshuffler.Put(placeholder)
+			return rec.unshuffler.Put(placeholder)
+		} else if chunkInfo.key == zeroKey && b.rootErr != nil {
+			// The chunk info stream has ended, but didn't match the expected root hash
+			return b.rootErr
 		}
 
 		// Under the following circumstances, read chunk data from the stream.
 		//  - chunk data was requested
 		//  - the chunk info stream has ended (to check whether the chunk data stream also ends).
 		// If there was a real error, abort.
-		if chunkInfo.requested || chunkInfo.key == zeroKey {
-			chunkFile, err := readChunk(b.storage, r, fmt.Sprintf("%v #%d", b.info, idx))
+		if chunkInfo.requested && (b.opts.AnyChunkOrder || len(rec.early) > 0) {
+			chunkFile, streamErr, err := b.receiveUntil(rec, read, chunkInfo)
+			if err != nil {
+				if streamErr {
+					rec.pending = &chunkInfo
+					resumable = true
+				}
+				return err
+			}
+			defer chunkFile.Dispose()
+		} else if chunkInfo.key == zeroKey && len(rec.early) > 0 {
+			return ErrUnexpectedChunk
+		} else if chunkInfo.requested || chunkInfo.key == zeroKey {
+			b.transfer.setPhase("data", "reading chunk data")
+			expected := int64(-1)
+			if chunkInfo.requested {
+				expected = int64(chunkInfo.length)
+			}
+			chunkFile, err := read(expected)
 			if chunkFile != nil {
 				defer chunkFile.Dispose()
 			}
 			if err == io.EOF && chunkInfo.key == zeroKey {
 				return errDone
-			} else if err == io.EOF {
-				return io.ErrUnexpectedEOF
+			} else if err == ErrUnexpectedChunk {
+				return err
 			} else if err != nil {
+				// Requested chunks never hold a file, so the chunk info can be kept as is
+				rec.pending = &chunkInfo
+				resumable = true
+				if err == io.EOF {
+					return io.ErrUnexpectedEOF
+				}
 				return err
 			} else if chunkInfo.key == zeroKey {
 				return fmt.Errorf("Unsolicited chunk data")
-			} else if chunkFile.Key() != chunkInfo.key {
-				return ErrUnexpectedChunk
-			} else if chunkFile.Size() != int64(chunkInfo.length) {
+			} else if key := b.announcedKey(chunkFile.Key()); key != chunkInfo.key {
+				if !b.wasRequested(key) {
+					return ErrUnrequestedChunk
+				}
 				return ErrUnexpectedChunk
 			}
+			b.countReceived(rec, chunkFile)
 		}
 
 		// Retrieve the chunk from CAFS (we can expect to find it)
-		chunk, _ := b.storage.Get(&chunkInfo.key)
+		chunk, _ := b.getChunk(chunkInfo.key)
 		// ... and dispatch it to the unshuffler, where it will be buffered for a while.
 		// Disposing is done by the unshuffler's ConsumeFunc.
 		if LoggingEnabled {
 			log.Printf("Receiver: unshuffler.Put(size:%v, %v)", chunk.Size(), chunk.Key())
 		}
-		return unshuffler.Put(chunk)
+		b.transfer.setPhase("data", "writing file")
+		v, err := rec.hold(chunk)
+		if err != nil {
+			return err
+		}
+		return rec.unshuffler.Put(v)
 	}
 
 	for {
 		if err := iteration(); err == errDone {
 			break
 		} else if err != nil {
-			return nil, err
+			return nil, resumable, err
 		}
-		idx++
+		rec.idx++
 	}
 
-	if err := unshuffler.End(); err != nil {
-		return nil, err
+	if err := rec.unshuffler.End(); err != nil {
+		return nil, false, err
+	}
+
+	if err := rec.temp.Close(); err != nil {
+		return nil, false, err
+	}
+
+	file := rec.temp.File()
+	if b.opts.ExpectDigest {
+		b.mutex.Lock()
+		digest := b.ann.digest
+		b.mutex.Unlock()
+		if digest == nil || file.Key() != *digest {
+			file.Dispose()
+			return nil, false, ErrDigestMismatch
+		}
+	}
+	return file, false, nil
+}
+
+// Type chunkQueue reads chunk data from a stream ahead of it being committed to the storage
+// (see BuilderOptions.CommitQueue).
+type chunkQueue struct {
+	chunks chan queuedChunk
+	stop   chan struct{}
+}
+
+type queuedChunk struct {
+	data []byte
+	err  error
+}
+
+// Starts reading chunks from `r`, until an error occurs or `size` chunks are queued.
+func newChunkQueue(r *bufio.Reader, size int) *chunkQueue {
+	q := &chunkQueue{
+		chunks: make(chan queuedChunk, size),
+		stop:   make(chan struct{}),
+	}
+	go func() {
+		for {
+			var c queuedChunk
+			if length, err := readChunkLength(r); err != nil {
+				c.err = err
+			} else {
+				c.data = make([]byte, length)
+				if _, err := io.ReadFull(r, c.data); err != nil {
+					c.err = err
+				}
+			}
+			select {
+			case q.chunks <- c:
+			case <-q.stop:
+				return
+			}
+			if c.err != nil {
+				return
+			}
+		}
+	}()
+	return q
+}
+
+// Waits for the next chunk read from the stream and commits it to the builder's storage. Unless
+// `expected` is negative, a chunk of a different length is rejected with ErrUnexpectedChunk. Its
+// data has been read by then, as the lengths of the chunks to come aren't known when reading ahead.
+func (q *chunkQueue) next(b *Builder, info string, expected int64) (cafs.File, error) {
+	var c queuedChunk
+	select {
+	case c = <-q.chunks:
+	case <-b.done:
+		return nil, ErrDisposed
+	case <-b.ctx.Done():
+		return nil, b.ctx.Err()
+	}
+	if c.err != nil {
+		return nil, c.err
+	} else if expected >= 0 && int64(len(c.data)) != expected {
+		return nil, ErrUnexpectedChunk
 	}
+	b.transfer.setPhase("data", "committing chunk")
+	return copyChunk(b.storage, bytes.NewReader(c.data), int64(len(c.data)), info)
+}
 
-	if err := temp.Close(); err != nil {
+// Stops reading. A read from the stream already in progress is completed, but its data discarded.
+func (q *chunkQueue) close() {
+	close(q.stop)
+}
+
+// Accounts for a chunk received from the sender.
+func (b *Builder) countReceived(rec *reconstruction, chunkFile cafs.File) {
+	b.mutex.Lock()
+	rec.received++
+	b.stats.BytesReceived += chunkFile.Size()
+	b.mutex.Unlock()
+	b.transfer.addBytes(chunkFile.Size())
+	if b.opts.OnNewChunk != nil {
+		b.opts.OnNewChunk(chunkFile)
+	}
+}
+
+// Reads chunk data until the chunk announced as `expected` has been received, keeping the chunks
+// received ahead of their position (see BuilderOptions.AnyChunkOrder). The returned chunk must be
+// disposed. Returns whether an error is caused by the chunk data stream.
+func (b *Builder) receiveUntil(rec *reconstruction, read func(expected int64) (cafs.File, error), expected chunk) (cafs.File, bool, error) {
+	if chunkFile, ok := rec.early[expected.key]; ok {
+		delete(rec.early, expected.key)
+		if chunkFile.Size() != int64(expected.length) {
+			chunkFile.Dispose()
+			return nil, false, ErrUnexpectedChunk
+		}
+		return chunkFile, false, nil
+	}
+	for {
+		b.transfer.setPhase("data", "reading chunk data")
+		// The chunk arriving next is unknown, so its length can only be checked once it's hashed
+		chunkFile, err := read(-1)
+		if err == io.EOF {
+			return nil, true, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, true, err
+		}
+		key := b.announcedKey(chunkFile.Key())
+		if !b.wasRequested(key) {
+			chunkFile.Dispose()
+			return nil, false, ErrUnrequestedChunk
+		} else if _, ok := rec.early[key]; ok {
+			chunkFile.Dispose()
+			return nil, false, ErrUnexpectedChunk
+		}
+		b.countReceived(rec, chunkFile)
+		if key == expected.key {
+			if chunkFile.Size() != int64(expected.length) {
+				chunkFile.Dispose()
+				return nil, false, ErrUnexpectedChunk
+			}
+			return chunkFile, false, nil
+		}
+		if rec.early == nil {
+			rec.early = make(map[cafs.SKey]cafs.File)
+		}
+		rec.early[key] = chunkFile
+	}
+}
+
+// Returns the value to put into the unshuffler in place of `chunk`. If holding the chunk would
+// exceed the limit of buffered bytes, its data is moved to the spill file and the chunk is disposed.
+func (rec *reconstruction) hold(chunk cafs.File) (interface{}, error) {
+	size := chunk.Size()
+	if rec.maxBuffered <= 0 || rec.buffered+size <= rec.maxBuffered {
+		rec.buffered += size
+		return chunk, nil
+	}
+	defer chunk.Dispose()
+	if rec.spillDir == "" {
+		return nil, ErrReorderLimit
+	}
+	if rec.spill == nil {
+		f, err := os.CreateTemp(rec.spillDir, "cafs-reorder-*")
+		if err != nil {
+			return nil, err
+		}
+		rec.spill = f
+	}
+	if LoggingEnabled {
+		log.Printf("Receiver: spilling chunk(size:%v, %v)", size, chunk.Key())
+	}
+	r := chunk.Open()
+	defer r.Close()
+	n, err := io.Copy(rec.spill, r)
+	offset := rec.spillSize
+	rec.spillSize += n
+	if err != nil {
 		return nil, err
 	}
+	return spilledChunk{offset, n}, nil
+}
 
-	return temp.File(), nil
+// Function consume is the unshuffler's ConsumeFunc. It appends the data of chunks reaching
+// their position to the work file.
+func (rec *reconstruction) consume(v interface{}) error {
+	switch c := v.(type) {
+	case cafs.File:
+		rec.buffered -= c.Size()
+		err := appendChunk(rec.temp, c)
+		c.Dispose()
+		return err
+	case spilledChunk:
+		_, err := io.Copy(rec.temp, io.NewSectionReader(rec.spill, c.offset, c.size))
+		return err
+	}
+	panic("Unexpected value in unshuffler")
 }
 
 // Function appendChunk appends data of `chunk` to `temp`.
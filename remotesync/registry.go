@@ -0,0 +1,229 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type Direction tells whether a transfer sends or receives data.
+type Direction int
+
+const (
+	Sending Direction = iota
+	Receiving
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Sending:
+		return "sending"
+	case Receiving:
+		return "receiving"
+	}
+	return "unknown"
+}
+
+// Type TransferInfo describes a transfer registered with a Registry.
+type TransferInfo struct {
+	ID               uint64
+	Name             string
+	Direction        Direction
+	BytesTransferred int64
+	Started          time.Time
+}
+
+// Type TransferState is a diagnostic snapshot of a transfer registered with a Registry, meant for
+// finding out where a stuck transfer is waiting.
+type TransferState struct {
+	TransferInfo
+	// Number of announcement entries, including placeholders, processed by the data phase so far.
+	ChunkIndex int64
+	// Number of entries held by the shuffler of the data phase.
+	ShufflerBuffered int64
+	// What each goroutine working on the transfer is currently doing, keyed by its role
+	// ("wishlist" or "data").
+	Phases map[string]string
+}
+
+func (s TransferState) String() string {
+	roles := make([]string, 0, len(s.Phases))
+	for role := range s.Phases {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	phases := make([]string, len(roles))
+	for i, role := range roles {
+		phases[i] = fmt.Sprintf("%v: %v", role, s.Phases[role])
+	}
+	return fmt.Sprintf("#%d %v (%v) since %v: %d bytes, chunk %d, %d buffered [%v]",
+		s.ID, s.Name, s.Direction, s.Started.Format(time.RFC3339), s.BytesTransferred, s.ChunkIndex,
+		s.ShufflerBuffered, strings.Join(phases, ", "))
+}
+
+// Type Registry keeps track of in-flight transfers and allows for cancelling them and for dumping
+// their state when they appear to hang.
+// Transfers are registered by passing the registry in ServeOptions or BuilderOptions.
+// The zero value is an empty registry ready to use.
+type Registry struct {
+	mutex     sync.Mutex
+	nextID    uint64
+	transfers map[uint64]*transfer
+}
+
+// Type transfer represents a single registration with a Registry.
+type transfer struct {
+	registry         *Registry
+	info             TransferInfo
+	bytesTransferred int64 // Accessed atomically
+	chunkIndex       int64 // Accessed atomically
+	buffered         int64 // Accessed atomically
+	cancel           context.CancelFunc
+
+	mutex  sync.Mutex        // Guards phases
+	phases map[string]string // Current phase per role
+}
+
+// Registers a new transfer and returns it, together with a context derived from `ctx` that is
+// cancelled when the transfer is cancelled via the registry. A nil registry returns a nil transfer
+// and a plain cancelable context.
+func (r *Registry) register(ctx context.Context, name string, direction Direction) (*transfer, context.Context) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	t := &transfer{
+		registry: r,
+		info:     TransferInfo{Name: name, Direction: direction, Started: time.Now()},
+		cancel:   cancel,
+	}
+	if r == nil {
+		return t, ctx
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.transfers == nil {
+		r.transfers = make(map[uint64]*transfer)
+	}
+	r.nextID++
+	t.info.ID = r.nextID
+	r.transfers[t.info.ID] = t
+	return t, ctx
+}
+
+// Returns a snapshot of all transfers currently registered, ordered by ID.
+func (r *Registry) List() []TransferInfo {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	result := make([]TransferInfo, 0, len(r.transfers))
+	for _, t := range r.transfers {
+		info := t.info
+		info.BytesTransferred = atomic.LoadInt64(&t.bytesTransferred)
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// Returns a diagnostic snapshot of all transfers currently registered, ordered by ID.
+func (r *Registry) DumpState() []TransferState {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	result := make([]TransferState, 0, len(r.transfers))
+	for _, t := range r.transfers {
+		result = append(result, t.state())
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// Cancels the context of the transfer with the given ID. The transfer function then returns
+// with context.Canceled as soon as it notices. Returns false if no such transfer is registered.
+func (r *Registry) Cancel(id uint64) bool {
+	r.mutex.Lock()
+	t := r.transfers[id]
+	r.mutex.Unlock()
+	if t == nil {
+		return false
+	}
+	t.cancel()
+	return true
+}
+
+func (t *transfer) addBytes(n int64) {
+	atomic.AddInt64(&t.bytesTransferred, n)
+}
+
+// Records the progress of the data phase.
+func (t *transfer) setProgress(chunkIndex, buffered int) {
+	atomic.StoreInt64(&t.chunkIndex, int64(chunkIndex))
+	atomic.StoreInt64(&t.buffered, int64(buffered))
+}
+
+// Records what the goroutine with the given role is doing. Transfers without a registry
+// don't record anything.
+func (t *transfer) setPhase(role, phase string) {
+	if t.registry == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.phases == nil {
+		t.phases = make(map[string]string)
+	}
+	t.phases[role] = phase
+}
+
+// Returns the phase recorded when a goroutine stops working on a transfer.
+func endPhase(err error) string {
+	if err != nil {
+		return fmt.Sprintf("failed: %v", err)
+	}
+	return "finished"
+}
+
+func (t *transfer) state() TransferState {
+	s := TransferState{
+		TransferInfo:     t.info,
+		ChunkIndex:       atomic.LoadInt64(&t.chunkIndex),
+		ShufflerBuffered: atomic.LoadInt64(&t.buffered),
+		Phases:           make(map[string]string),
+	}
+	s.BytesTransferred = atomic.LoadInt64(&t.bytesTransferred)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for role, phase := range t.phases {
+		s.Phases[role] = phase
+	}
+	return s
+}
+
+// Deregisters the transfer and releases its context.
+func (t *transfer) done() {
+	t.cancel()
+	if r := t.registry; r != nil {
+		r.mutex.Lock()
+		delete(r.transfers, t.info.ID)
+		r.mutex.Unlock()
+	}
+}
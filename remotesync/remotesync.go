@@ -19,6 +19,12 @@
 // Step 1: Sender lists hashes of chunks of file to transmit (32 byte + ~2.5 bytes for length per chunk)
 // Step 2: Receiver lists missing chunks (one bit per chunk)
 // Step 3: Sender sends content of missing chunks
+//
+// All three steps are streamed: the receiver emits wishlist bits while reading the chunk hashes, and the
+// sender transmits chunk data while reading the wishlist. When run concurrently (e.g. over a full-duplex
+// connection), the steps overlap, so neither side needs to keep more than a window of chunks in memory,
+// regardless of the size of the file. The window is determined by the permutation's length and the
+// Builder's window size.
 package remotesync
 
 var LoggingEnabled = false
@@ -2,13 +2,28 @@ package remotesync
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/chunking/adler32"
+	"github.com/indyjo/cafs/pack"
 	. "github.com/indyjo/cafs/ram"
 	"github.com/indyjo/cafs/remotesync/shuffle"
 	"io"
 	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 type writerPrinter struct {
@@ -41,6 +56,9 @@ func TestRemoteSync(t *testing.T) {
 		// We can't test up to 512 because we don't know how much overhead data was produced
 		// by the chunking algorithm (yes, RAM storage counts that overhead!)
 		for _, nBlocks := range []int{0, 1, 2, 4, 8, 16, 32, 64, 128, 256, 400} {
+			if nBlocks > 32 && skipLarge() {
+				continue
+			}
 			sigma := 0.25
 			if nBlocks > 256 {
 				sigma = 0
@@ -58,6 +76,11 @@ func TestRemoteSync(t *testing.T) {
 	}
 }
 
+// Returns whether large test cases should be skipped, as with -short or the race detector.
+func skipLarge() bool {
+	return testing.Short() || raceEnabled
+}
+
 func check(t *testing.T, msg string, err error) {
 	if err != nil {
 		t.Fatalf("Error %v: %v", msg, err)
@@ -216,3 +239,3854 @@ func reportUsage(t *testing.T, name string, store cafs.BoundedStorage) {
 		t.FailNow()
 	}
 }
+
+func TestPeerClosed(t *testing.T) {
+	store := NewRamStorage(1024 * 1024)
+	temp := store.Create("Test file")
+	defer temp.Dispose()
+	check(t, "writing test data", createSimilarData(temp, io.Discard, 1, 0.25, 8192, 16))
+	check(t, "closing temp", temp.Close())
+	file := temp.File()
+	defer file.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	// The receiver hangs up before reading the chunk hashes
+	pipeReader, pipeWriter := io.Pipe()
+	pipeReader.Close()
+	if err := WriteChunkHashes(file, perm, pipeWriter); err != ErrPeerClosed {
+		t.Errorf("WriteChunkHashes: expected ErrPeerClosed, got %v", err)
+	}
+
+	// The receiver requests all chunks, then hangs up before reading the chunk data
+	var hashes, wishlist bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(file, perm, &hashes))
+	announcement := append([]byte(nil), hashes.Bytes()...)
+	builder := NewBuilder(NewRamStorage(1024*1024), perm, 1024, "Test file")
+	defer builder.Dispose()
+	check(t, "writing wishlist", builder.WriteWishList(&hashes, flushWriter{&wishlist}))
+	requested := append([]byte(nil), wishlist.Bytes()...)
+	pipeReader, pipeWriter = io.Pipe()
+	pipeReader.Close()
+	if err := WriteChunkData(store, file, bufio.NewReader(&wishlist), perm, pipeWriter, nil); err != ErrPeerClosed {
+		t.Errorf("WriteChunkData: expected ErrPeerClosed, got %v", err)
+	}
+
+	// The sender hangs up in the middle of the chunk hashes
+	receiver := NewBuilder(NewRamStorage(1024*1024), perm, 1024, "Test file")
+	defer receiver.Dispose()
+	wishlist.Reset()
+	if err := receiver.WriteWishList(bytes.NewReader(announcement[:len(cafs.SKey{})/2]), flushWriter{&wishlist}); !errors.Is(err, ErrPeerClosed) {
+		t.Errorf("WriteWishList: expected ErrPeerClosed, got %v", err)
+	}
+
+	// The sender hangs up in the middle of the chunk data
+	var data bytes.Buffer
+	check(t, "writing chunk data", WriteChunkData(store, file, bufio.NewReader(bytes.NewReader(requested)), perm, &data, nil))
+	receiver = NewBuilder(NewRamStorage(1024*1024), perm, 1024, "Test file")
+	defer receiver.Dispose()
+	check(t, "writing wishlist", receiver.WriteWishList(bytes.NewReader(announcement), flushWriter{io.Discard}))
+	if _, err := receiver.ReconstructFileFromRequestedChunks(bytes.NewReader(data.Bytes()[:data.Len()/2])); !errors.Is(err, ErrPeerClosed) {
+		t.Errorf("ReconstructFileFromRequestedChunks: expected ErrPeerClosed, got %v", err)
+	}
+}
+
+func TestInvalidPermutation(t *testing.T) {
+	store := NewRamStorage(1024 * 1024)
+	for _, perm := range []shuffle.Permutation{{}, {0, 0}, {1, 2}, {2, 0, -1}} {
+		builder := NewBuilder(store, perm, 8, "Test file")
+		var wishlist bytes.Buffer
+		if err := builder.WriteWishList(bytes.NewReader(nil), flushWriter{&wishlist}); err != shuffle.ErrInvalidPermutation {
+			t.Errorf("WriteWishList with permutation %v: expected ErrInvalidPermutation, got %v", perm, err)
+		}
+		if _, err := builder.ReconstructFileFromRequestedChunks(bytes.NewReader(nil)); err != shuffle.ErrInvalidPermutation {
+			t.Errorf("ReconstructFileFromRequestedChunks with permutation %v: expected ErrInvalidPermutation, got %v", perm, err)
+		}
+		builder.Dispose()
+	}
+}
+
+// Test that a single announcement can be replayed to several receivers.
+func TestAnnouncement(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	storeC := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "C", storeC)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.5, 0.25, 8192, 64))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(100))
+	announcement, err := NewAnnouncement(fileA, perm)
+	check(t, "creating announcement", err)
+
+	var direct bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &direct))
+	if !bytes.Equal(direct.Bytes(), announcement.data) {
+		t.Fatal("Announcement differs from output of WriteChunkHashes")
+	}
+
+	// Serve receiver B (with half of the data already present) and receiver C (without any data)
+	for _, receiver := range []cafs.BoundedStorage{storeB, storeC} {
+		func() {
+			builder := NewBuilder(receiver, perm, 8, "Recovered A")
+			defer builder.Dispose()
+
+			pipeReader1, pipeWriter1 := io.Pipe()
+			pipeReader2, pipeWriter2 := io.Pipe()
+			pipeReader3, pipeWriter3 := io.Pipe()
+			go func() {
+				_, err := announcement.WriteTo(pipeWriter1)
+				pipeWriter1.CloseWithError(err)
+			}()
+			go func() {
+				pipeWriter2.CloseWithError(builder.WriteWishList(pipeReader1, flushWriter{pipeWriter2}))
+			}()
+			go func() {
+				pipeWriter3.CloseWithError(WriteChunkData(storeA, fileA, bufio.NewReader(pipeReader2), perm, pipeWriter3, nil))
+			}()
+
+			fileB, err := builder.ReconstructFileFromRequestedChunks(pipeReader3)
+			check(t, "reconstructing", err)
+			defer fileB.Dispose()
+			assertEqual(t, fileA.Open(), fileB.Open())
+		}()
+	}
+}
+
+func TestAnnouncementLimits(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	check(t, "creating data", createSimilarData(tempA, io.Discard, 0, 0.25, 8192, 64))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(10))
+	announcement, err := NewAnnouncement(fileA, perm)
+	check(t, "creating announcement", err)
+
+	for _, opts := range []BuilderOptions{
+		{MaxChunkSize: 1024},
+		{MinChunkSize: adler32.MAX_CHUNK},
+		{MaxChunks: int(fileA.NumChunks()) - 1},
+	} {
+		builder := NewBuilderWithOptions(storeB, perm, 8, "Recovered A", opts)
+		var wishlist bytes.Buffer
+		if err := builder.WriteWishList(announcement.Reader(), flushWriter{&wishlist}); !errors.Is(err, ErrAnnouncementRejected) {
+			t.Errorf("Options %+v: expected ErrAnnouncementRejected, got %v", opts, err)
+		}
+		if wishlist.Len() != 0 {
+			t.Errorf("Options %+v: %d bytes of wishlist written despite rejection", opts, wishlist.Len())
+		}
+		builder.Dispose()
+	}
+
+	// Limits that are met by the announcement
+	opts := BuilderOptions{MinChunkSize: adler32.MIN_CHUNK, MaxChunkSize: adler32.MAX_CHUNK, MaxChunks: int(fileA.NumChunks())}
+	builder := NewBuilderWithOptions(storeB, perm, 8, "Recovered A", opts)
+	defer builder.Dispose()
+	pipeReader1, pipeWriter1 := io.Pipe()
+	pipeReader2, pipeWriter2 := io.Pipe()
+	go func() {
+		pipeWriter1.CloseWithError(builder.WriteWishList(announcement.Reader(), flushWriter{pipeWriter1}))
+	}()
+	go func() {
+		pipeWriter2.CloseWithError(WriteChunkData(storeA, fileA, bufio.NewReader(pipeReader1), perm, pipeWriter2, nil))
+	}()
+	fileB, err := builder.ReconstructFileFromRequestedChunks(pipeReader2)
+	check(t, "reconstructing", err)
+	defer fileB.Dispose()
+	assertEqual(t, fileA.Open(), fileB.Open())
+}
+
+func TestAllowChunk(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	check(t, "creating data", createSimilarData(tempA, io.Discard, 0, 0.25, 8192, 64))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	// Deny one chunk in the middle of the file
+	denied := cafs.NewKeySet(1)
+	iter := fileA.Chunks()
+	for i := 0; i < int(fileA.NumChunks())/2 && iter.Next(); i++ {
+	}
+	denied.Add(iter.Key())
+	iter.Dispose()
+	deny := func(key cafs.SKey) bool { return !denied.Contains(key) }
+
+	// The receiver refuses the announcement
+	announcement, err := NewAnnouncement(fileA, perm)
+	check(t, "creating announcement", err)
+	builder := NewBuilderWithOptions(storeB, perm, 8, "Recovered A", BuilderOptions{AllowChunk: deny})
+	var wishlist bytes.Buffer
+	if err := builder.WriteWishList(announcement.Reader(), flushWriter{&wishlist}); !errors.Is(err, ErrChunkDenied) {
+		t.Errorf("Expected ErrChunkDenied from receiver, got %v", err)
+	}
+	if wishlist.Len() != 0 {
+		t.Errorf("%d bytes of wishlist written despite denied chunk", wishlist.Len())
+	}
+	builder.Dispose()
+
+	// The sender refuses to serve the file
+	builder = NewBuilder(storeB, perm, int(fileA.NumChunks())+len(perm), "Recovered A")
+	defer builder.Dispose()
+	wishlist.Reset()
+	check(t, "writing wishlist", builder.WriteWishList(announcement.Reader(), flushWriter{&wishlist}))
+	var data bytes.Buffer
+	err = WriteChunkDataWithOptions(storeA, fileA, bufio.NewReader(&wishlist), perm, &data, nil, ServeOptions{AllowChunk: deny})
+	if !errors.Is(err, ErrChunkDenied) {
+		t.Errorf("Expected ErrChunkDenied from sender, got %v", err)
+	}
+	if data.Len() != 0 {
+		t.Errorf("%d bytes of chunk data written despite denied chunk", data.Len())
+	}
+
+	// Files without denied chunks are transferred
+	allowAll := func(cafs.SKey) bool { return true }
+	transmitSequentially(t, storeA, storeB, fileA, perm, AnnounceOptions{}, BuilderOptions{AllowChunk: allowAll})
+}
+
+func TestMemoryBudget(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	check(t, "creating data", createSimilarData(tempA, io.Discard, 0, 0.25, 8192, 64))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	// A receiver without any data requests all chunks
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	announcement, err := NewAnnouncement(fileA, perm)
+	check(t, "creating announcement", err)
+	builder := NewBuilder(storeB, perm, int(fileA.NumChunks())+len(perm), "Recovered A")
+	var wishlist bytes.Buffer
+	check(t, "writing wishlist", builder.WriteWishList(announcement.Reader(), flushWriter{&wishlist}))
+	builder.Dispose()
+
+	var largest int64
+	iter := fileA.Chunks()
+	for iter.Next() {
+		largest = max(largest, iter.Size())
+	}
+	iter.Dispose()
+
+	const limit = 32 * 1024
+	budget := NewMemoryBudget(limit)
+	storage := &openBytesStorage{FileStorage: storeA}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := WriteChunkDataWithOptions(storage, fileA, bufio.NewReader(bytes.NewReader(wishlist.Bytes())), perm,
+				yieldingWriter{}, nil, ServeOptions{MemoryBudget: budget})
+			if err != nil {
+				t.Errorf("Serving: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak := storage.peak.Load(); peak > max(limit, largest) || peak == 0 {
+		t.Errorf("Expected at most %d bytes of chunk data to be open at once, got %d", max(limit, largest), peak)
+	}
+	if budget.InUse() != 0 {
+		t.Errorf("Expected budget to be released, %d bytes still in use", budget.InUse())
+	}
+
+	// Waiting for the budget is aborted with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	check(t, "acquiring budget", budget.acquire(ctx, limit))
+	cancel()
+	if err := budget.acquire(ctx, 1); err != context.Canceled {
+		t.Errorf("Expected waiting to be cancelled, got %v", err)
+	}
+	budget.release(limit)
+}
+
+// Type openBytesStorage keeps track of the number of bytes of chunk data opened at once.
+type openBytesStorage struct {
+	cafs.FileStorage
+	open, peak atomic.Int64
+}
+
+type openBytesFile struct {
+	cafs.File
+	storage *openBytesStorage
+}
+
+type openBytesReader struct {
+	io.ReadCloser
+	storage *openBytesStorage
+	size    int64
+}
+
+func (s *openBytesStorage) Get(key *cafs.SKey) (cafs.File, error) {
+	f, err := s.FileStorage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return openBytesFile{f, s}, nil
+}
+
+func (f openBytesFile) Open() io.ReadCloser {
+	open := f.storage.open.Add(f.Size())
+	for peak := f.storage.peak.Load(); open > peak && !f.storage.peak.CompareAndSwap(peak, open); peak = f.storage.peak.Load() {
+	}
+	return openBytesReader{f.File.Open(), f.storage, f.Size()}
+}
+
+func (r openBytesReader) Close() error {
+	r.storage.open.Add(-r.size)
+	return r.ReadCloser.Close()
+}
+
+// Type yieldingWriter discards data, yielding to other goroutines on every write.
+type yieldingWriter struct{}
+
+func (yieldingWriter) Write(b []byte) (int, error) {
+	runtime.Gosched()
+	return len(b), nil
+}
+
+// Type observedWriter calls a function before the first write.
+type observedWriter struct {
+	w       io.Writer
+	onFirst func()
+}
+
+func (o *observedWriter) Write(b []byte) (int, error) {
+	if o.onFirst != nil {
+		o.onFirst()
+		o.onFirst = nil
+	}
+	return o.w.Write(b)
+}
+
+func (o *observedWriter) Flush() {}
+
+// Test that the announce, wishlist and data phases overlap when run concurrently, and that
+// the result matches running them one after the other.
+func TestPipelining(t *testing.T) {
+	storeA := NewRamStorage(16 * 1024 * 1024)
+	storeB := NewRamStorage(16 * 1024 * 1024)
+	storeC := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "C", storeC)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	check(t, "creating data", createSimilarData(tempA, io.Discard, 0, 0.25, 8192, 512))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(64))
+
+	// Pipelined: each phase consumes the previous phase's output while it is being produced
+	var hashesDone, wishlistDone, hashesDoneAtWishlist, wishlistDoneAtData int32
+	var pipelined bytes.Buffer
+	func() {
+		builder := NewBuilder(storeB, perm, 8, "Pipelined")
+		defer builder.Dispose()
+		pipeReader1, pipeWriter1 := io.Pipe()
+		pipeReader2, pipeWriter2 := io.Pipe()
+		pipeReader3, pipeWriter3 := io.Pipe()
+		go func() {
+			err := WriteChunkHashes(fileA, perm, pipeWriter1)
+			atomic.StoreInt32(&hashesDone, 1)
+			pipeWriter1.CloseWithError(err)
+		}()
+		go func() {
+			w := &observedWriter{io.MultiWriter(pipeWriter2, &pipelined), func() {
+				atomic.StoreInt32(&hashesDoneAtWishlist, atomic.LoadInt32(&hashesDone))
+			}}
+			err := builder.WriteWishList(pipeReader1, w)
+			atomic.StoreInt32(&wishlistDone, 1)
+			pipeWriter2.CloseWithError(err)
+		}()
+		go func() {
+			w := &observedWriter{pipeWriter3, func() {
+				atomic.StoreInt32(&wishlistDoneAtData, atomic.LoadInt32(&wishlistDone))
+			}}
+			pipeWriter3.CloseWithError(WriteChunkData(storeA, fileA, bufio.NewReader(pipeReader2), perm, w, nil))
+		}()
+		fileB, err := builder.ReconstructFileFromRequestedChunks(pipeReader3)
+		check(t, "reconstructing pipelined", err)
+		defer fileB.Dispose()
+		assertEqual(t, fileA.Open(), fileB.Open())
+	}()
+	if hashesDoneAtWishlist != 0 {
+		t.Errorf("Wishlist was only written after all hashes had been announced")
+	}
+	if wishlistDoneAtData != 0 {
+		t.Errorf("Data was only sent after the complete wishlist had been written")
+	}
+
+	// Sequential: each phase runs to completion before the next one starts
+	var hashes, sequential, data bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+	builder := NewBuilder(storeC, perm, int(fileA.NumChunks())+len(perm), "Sequential")
+	defer builder.Dispose()
+	check(t, "writing wishlist", builder.WriteWishList(&hashes, flushWriter{&sequential}))
+	check(t, "writing data", WriteChunkData(storeA, fileA, bufio.NewReader(bytes.NewReader(sequential.Bytes())), perm, &data, nil))
+	fileC, err := builder.ReconstructFileFromRequestedChunks(&data)
+	check(t, "reconstructing sequentially", err)
+	defer fileC.Dispose()
+	assertEqual(t, fileA.Open(), fileC.Open())
+
+	if !bytes.Equal(pipelined.Bytes(), sequential.Bytes()) {
+		t.Errorf("Wishlists differ between pipelined and sequential transmission")
+	}
+}
+
+// Runs a sequential transmission of `file` from `storeA` to `storeB` and returns the wishlist.
+func transmitSequentially(t *testing.T, storeA, storeB cafs.FileStorage, file cafs.File, perm shuffle.Permutation, announceOpts AnnounceOptions, builderOpts BuilderOptions) []byte {
+	var hashes, wishlist, data bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashesWithOptions(file, perm, &hashes, announceOpts))
+	builder := NewBuilderWithOptions(storeB, perm, int(file.NumChunks())+len(perm), "Received", builderOpts)
+	defer builder.Dispose()
+	check(t, "writing wishlist", builder.WriteWishList(&hashes, flushWriter{&wishlist}))
+	check(t, "writing data", WriteChunkDataWithOptions(storeA, file, bufio.NewReader(bytes.NewReader(wishlist.Bytes())), perm, &data, nil,
+		ServeOptions{RunLengthWishList: builderOpts.RunLengthWishList, IndexWishList: builderOpts.IndexWishList, LocalityOrder: builderOpts.AnyChunkOrder}))
+	received, err := builder.ReconstructFileFromRequestedChunks(&data)
+	check(t, "reconstructing", err)
+	defer received.Dispose()
+	assertEqual(t, file.Open(), received.Open())
+	return wishlist.Bytes()
+}
+
+func TestSaltedAnnouncement(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.5, 0.25, 8192, 64))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	// Announcements of different sessions don't reveal the chunk keys and can't be correlated
+	salt1, err := NewSalt()
+	check(t, "creating salt", err)
+	salt2, err := NewSalt()
+	check(t, "creating salt", err)
+	var plain, salted1, salted2 bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &plain))
+	check(t, "writing chunk hashes", WriteChunkHashesWithOptions(fileA, perm, &salted1, AnnounceOptions{Salt: salt1}))
+	check(t, "writing chunk hashes", WriteChunkHashesWithOptions(fileA, perm, &salted2, AnnounceOptions{Salt: salt2}))
+	if bytes.Equal(salted1.Bytes(), salted2.Bytes()) {
+		t.Error("Announcements of different sessions are identical")
+	}
+	chunks := fileA.Chunks()
+	for chunks.Next() {
+		key := chunks.Key()
+		if !bytes.Contains(plain.Bytes(), key[:]) {
+			t.Errorf("Chunk %v missing from plain announcement", key)
+		}
+		if bytes.Contains(salted1.Bytes(), key[:]) || bytes.Contains(salted2.Bytes(), key[:]) {
+			t.Errorf("Chunk %v revealed by salted announcement", key)
+		}
+	}
+	chunks.Dispose()
+
+	// Dedup works as well as without salt. storeB is restored after each transmission.
+	wishlist := func(announceOpts AnnounceOptions, builderOpts BuilderOptions) []byte {
+		defer storeB.FreeCache()
+		return transmitSequentially(t, storeA, storeB, fileA, perm, announceOpts, builderOpts)
+	}
+	expected := wishlist(AnnounceOptions{}, BuilderOptions{})
+	if w := wishlist(AnnounceOptions{Salt: salt1}, BuilderOptions{Salt: salt1}); !bytes.Equal(w, expected) {
+		t.Errorf("Salted wishlist %x differs from plain wishlist %x", w, expected)
+	}
+
+	// A receiver using the wrong salt can't verify the chunks it receives
+	builder := NewBuilderWithOptions(storeB, perm, int(fileA.NumChunks())+len(perm), "Received", BuilderOptions{Salt: salt2})
+	defer builder.Dispose()
+	var wrong, data bytes.Buffer
+	check(t, "writing wishlist", builder.WriteWishList(bytes.NewReader(salted1.Bytes()), flushWriter{&wrong}))
+	check(t, "writing data", WriteChunkData(storeA, fileA, bufio.NewReader(&wrong), perm, &data, nil))
+	if _, err := builder.ReconstructFileFromRequestedChunks(&data); err != ErrUnrequestedChunk {
+		t.Errorf("Expected ErrUnrequestedChunk when using the wrong salt, got %v", err)
+	}
+}
+
+func TestResumeChunkData(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	check(t, "creating data", createSimilarData(tempA, io.Discard, 0, 0.25, 8192, 64))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	var hashes bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+
+	for _, resume := range []bool{true, false} {
+		// Make sure everything is requested again
+		storeB.FreeCache()
+		func() {
+			builder := NewBuilder(storeB, perm, int(fileA.NumChunks())+len(perm), "Received")
+			defer builder.Dispose()
+			var wishlist, full bytes.Buffer
+			check(t, "writing wishlist", builder.WriteWishList(bytes.NewReader(hashes.Bytes()), flushWriter{&wishlist}))
+			check(t, "writing data", WriteChunkData(storeA, fileA, bufio.NewReader(bytes.NewReader(wishlist.Bytes())), perm, &full, nil))
+
+			// Break the data stream in the middle
+			cut := full.Len() / 2
+			if _, err := builder.ReconstructFileFromRequestedChunks(bytes.NewReader(full.Bytes()[:cut])); !errors.Is(err, io.ErrUnexpectedEOF) || !errors.Is(err, ErrPeerClosed) {
+				t.Fatalf("Expected ErrUnexpectedEOF and ErrPeerClosed, got %v", err)
+			}
+			received := builder.ReceivedChunks()
+			if received == 0 {
+				t.Fatalf("Expected some chunks to be received before the stream broke")
+			}
+			if !resume {
+				return
+			}
+
+			// Resume, skipping the chunks already received
+			var rest bytes.Buffer
+			check(t, "resuming data", WriteChunkDataWithOptions(storeA, fileA, bufio.NewReader(bytes.NewReader(wishlist.Bytes())),
+				perm, &rest, nil, ServeOptions{SkipRequested: received}))
+			if !bytes.HasSuffix(full.Bytes(), rest.Bytes()) || full.Len()-rest.Len() > cut {
+				t.Errorf("Resumed stream (%d bytes) is not the remainder of the %d bytes stream after %d bytes",
+					rest.Len(), full.Len(), cut)
+			}
+			if full.Len()-rest.Len() < cut-adler32.MAX_CHUNK-binary.MaxVarintLen64 {
+				t.Errorf("Chunks were resent: resumed stream has %d bytes, only %d bytes were lost", rest.Len(), full.Len()-cut)
+			}
+			fileB, err := builder.ReconstructFileFromRequestedChunks(&rest)
+			check(t, "resuming reconstruction", err)
+			defer fileB.Dispose()
+			assertEqual(t, fileA.Open(), fileB.Open())
+			if _, err := builder.ReconstructFileFromRequestedChunks(&rest); err != ErrNotResumable {
+				t.Errorf("Expected ErrNotResumable after success, got %v", err)
+			}
+		}()
+	}
+}
+
+// Type flakyStorage fails to retrieve each chunk `failures` times before succeeding.
+type flakyStorage struct {
+	cafs.FileStorage
+	failures int
+	attempts map[cafs.SKey]int
+}
+
+var errFlaky = errors.New("Transient error")
+
+func (s *flakyStorage) Get(key *cafs.SKey) (cafs.File, error) {
+	s.attempts[*key]++
+	if s.attempts[*key] <= s.failures {
+		return nil, errFlaky
+	}
+	return s.FileStorage.Get(key)
+}
+
+func TestRetryGet(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	check(t, "creating data", createSimilarData(tempA, io.Discard, 0, 0.25, 8192, 16))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	var hashes, wishlist bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	builder := NewBuilder(storeB, perm, int(fileA.NumChunks())+len(perm), "Received")
+	defer builder.Dispose()
+	check(t, "writing wishlist", builder.WriteWishList(&hashes, flushWriter{&wishlist}))
+
+	serve := func(failures int, opts ServeOptions) error {
+		flaky := &flakyStorage{storeA, failures, make(map[cafs.SKey]int)}
+		return WriteChunkDataWithOptions(flaky, fileA, bufio.NewReader(bytes.NewReader(wishlist.Bytes())), perm, io.Discard, nil, opts)
+	}
+	if err := serve(1, ServeOptions{}); err != errFlaky {
+		t.Errorf("Expected serve without retries to fail, got %v", err)
+	}
+	if err := serve(1, ServeOptions{GetRetries: 1, RetryBackoff: time.Millisecond}); err != nil {
+		t.Errorf("Expected serve with retries to succeed, got %v", err)
+	}
+	if err := serve(3, ServeOptions{GetRetries: 2, RetryBackoff: time.Millisecond}); err != errFlaky {
+		t.Errorf("Expected serve to fail after exhausting retries, got %v", err)
+	}
+
+	// Missing chunks are not retried
+	flaky := &flakyStorage{NewRamStorage(1024), 0, make(map[cafs.SKey]int)}
+	err := WriteChunkDataWithOptions(flaky, fileA, bufio.NewReader(bytes.NewReader(wishlist.Bytes())), perm, io.Discard, nil,
+		ServeOptions{GetRetries: 5, RetryBackoff: time.Hour})
+	if err != cafs.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+// Type slowWriter delays every write.
+type slowWriter struct {
+	w io.Writer
+}
+
+func (s slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return s.w.Write(b)
+}
+
+// Waits until the registry lists exactly one transfer and returns it.
+func awaitTransfer(t *testing.T, registry *Registry) TransferInfo {
+	for i := 0; i < 1000; i++ {
+		if transfers := registry.List(); len(transfers) == 1 {
+			return transfers[0]
+		} else if len(transfers) > 1 {
+			t.Fatalf("Expected one transfer, got %v", transfers)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Transfer didn't show up in registry")
+	return TransferInfo{}
+}
+
+func TestRegistry(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	check(t, "creating data", createSimilarData(tempA, io.Discard, 0, 0.25, 8192, 256))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	var hashes, wishlist bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+	var registry Registry
+
+	// Receiving: WriteWishList blocks because nobody reconstructs the file
+	builder := NewBuilderWithOptions(storeB, perm, 1, "Receiver", BuilderOptions{Registry: &registry})
+	result := make(chan error)
+	go func() {
+		result <- builder.WriteWishList(bytes.NewReader(hashes.Bytes()), flushWriter{&wishlist})
+	}()
+	info := awaitTransfer(t, &registry)
+	if info.Name != "Receiver" || info.Direction != Receiving || info.Started.IsZero() {
+		t.Errorf("Unexpected transfer info: %+v", info)
+	}
+	if !registry.Cancel(info.ID) {
+		t.Errorf("Cancelling transfer %v failed", info.ID)
+	}
+	if err := <-result; err != context.Canceled {
+		t.Errorf("Expected WriteWishList to be cancelled, got %v", err)
+	}
+	builder.Dispose()
+	if transfers := registry.List(); len(transfers) != 0 {
+		t.Errorf("Expected disposed builder to be deregistered, got %v", transfers)
+	}
+
+	// Sending: the receiver consumes data slowly
+	builder = NewBuilder(storeB, perm, int(fileA.NumChunks())+len(perm), "Receiver")
+	defer builder.Dispose()
+	wishlist.Reset()
+	check(t, "writing wishlist", builder.WriteWishList(bytes.NewReader(hashes.Bytes()), flushWriter{&wishlist}))
+	go func() {
+		result <- WriteChunkDataWithOptions(storeA, fileA, bufio.NewReader(&wishlist), perm, slowWriter{io.Discard}, nil,
+			ServeOptions{Registry: &registry, Name: "Sender"})
+	}()
+	info = awaitTransfer(t, &registry)
+	if info.Name != "Sender" || info.Direction != Sending {
+		t.Errorf("Unexpected transfer info: %+v", info)
+	}
+	if registry.Cancel(info.ID + 1) {
+		t.Errorf("Cancelled non-existing transfer")
+	}
+	registry.Cancel(info.ID)
+	if err := <-result; err != context.Canceled {
+		t.Errorf("Expected WriteChunkData to be cancelled, got %v", err)
+	}
+	if transfers := registry.List(); len(transfers) != 0 {
+		t.Errorf("Expected finished transfer to be deregistered, got %v", transfers)
+	}
+}
+
+// Type gateWriter passes `limit` bytes to the underlying writer, then closes `blocked` and blocks
+// until `release` is closed.
+type gateWriter struct {
+	w       io.Writer
+	limit   int64
+	blocked chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (g *gateWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	} else if g.limit <= 0 {
+		g.once.Do(func() { close(g.blocked) })
+		<-g.release
+		return g.w.Write(b)
+	}
+	n := int64(len(b))
+	if n > g.limit {
+		n = g.limit
+	}
+	written, err := g.w.Write(b[:n])
+	g.limit -= int64(written)
+	if err != nil {
+		return written, err
+	}
+	rest, err := g.Write(b[n:])
+	return written + rest, err
+}
+
+func TestDumpState(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	check(t, "creating data", createSimilarData(tempA, io.Discard, 0, 0.25, 8192, 256))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	var hashes, wishlist bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+	var registry Registry
+	builder := NewBuilderWithOptions(storeB, perm, int(fileA.NumChunks())+len(perm), "Receiver", BuilderOptions{Registry: &registry})
+	defer builder.Dispose()
+	check(t, "writing wishlist", builder.WriteWishList(bytes.NewReader(hashes.Bytes()), flushWriter{&wishlist}))
+
+	// The sender gets stuck halfway through the chunk data
+	pr, pw := io.Pipe()
+	gate := &gateWriter{w: pw, limit: fileA.Size() / 2, blocked: make(chan struct{}), release: make(chan struct{})}
+	sent := make(chan error, 1)
+	go func() {
+		err := WriteChunkDataWithOptions(storeA, fileA, bufio.NewReader(&wishlist), perm, gate, nil,
+			ServeOptions{Registry: &registry, Name: "Sender"})
+		pw.CloseWithError(err)
+		sent <- err
+	}()
+	received := make(chan cafs.File, 1)
+	go func() {
+		f, err := builder.ReconstructFileFromRequestedChunks(pr)
+		check(t, "reconstructing", err)
+		received <- f
+	}()
+
+	// Wait for the receiver to consume everything that passed the gate
+	<-gate.blocked
+	var states []TransferState
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		last := states
+		states = registry.DumpState()
+		if len(states) == 2 && len(last) == 2 && states[0].BytesTransferred == last[0].BytesTransferred &&
+			states[0].Phases["data"] == "reading chunk data" {
+			break
+		}
+	}
+	if len(states) != 2 {
+		t.Fatalf("Expected two transfers, got %v", states)
+	}
+	recv, send := states[0], states[1]
+	t.Logf("Receiver: %v", recv)
+	t.Logf("Sender: %v", send)
+	if recv.Name != "Receiver" || recv.Phases["wishlist"] != "finished" || recv.Phases["data"] != "reading chunk data" {
+		t.Errorf("Unexpected receiver state: %v", recv)
+	}
+	if send.Name != "Sender" || send.Phases["data"] != "writing chunk data" {
+		t.Errorf("Unexpected sender state: %v", send)
+	}
+	entries := fileA.NumChunks() + int64(len(perm)) - 1
+	for _, s := range states {
+		if s.ChunkIndex <= 0 || s.ChunkIndex >= entries {
+			t.Errorf("Implausible chunk index %d of %d entries: %v", s.ChunkIndex, entries, s)
+		}
+		if s.ShufflerBuffered < 0 || s.ShufflerBuffered > int64(len(perm)) {
+			t.Errorf("Implausible number of buffered entries: %v", s)
+		}
+		if s.BytesTransferred <= 0 || s.BytesTransferred > fileA.Size()/2 {
+			t.Errorf("Implausible number of bytes transferred: %v", s)
+		}
+	}
+
+	close(gate.release)
+	check(t, "sending", <-sent)
+	fileB := <-received
+	defer fileB.Dispose()
+	assertEqual(t, fileA.Open(), fileB.Open())
+	if states := registry.DumpState(); len(states) != 1 || states[0].Phases["data"] != "finished" {
+		t.Errorf("Expected only the finished receiver to be registered, got %v", states)
+	}
+}
+
+func TestOnNewChunk(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.5, 0.25, 8192, 64))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	// Determine which chunks are missing from storeB
+	missing := make(map[cafs.SKey]bool)
+	chunks := fileA.Chunks()
+	for chunks.Next() {
+		key := chunks.Key()
+		if _, err := storeB.StatByKey(&key); err == cafs.ErrNotFound {
+			missing[key] = true
+		}
+	}
+	chunks.Dispose()
+	if len(missing) == 0 || int64(len(missing)) == fileA.NumChunks() {
+		t.Fatalf("Expected some, but not all chunks to be missing: %d of %d", len(missing), fileA.NumChunks())
+	}
+
+	learned := make(map[cafs.SKey]int)
+	var learnedData []cafs.File
+	opts := BuilderOptions{OnNewChunk: func(chunk cafs.File) {
+		learned[chunk.Key()]++
+		learnedData = append(learnedData, chunk.Duplicate())
+	}}
+	transmitSequentially(t, storeA, storeB, fileA, perm, AnnounceOptions{}, opts)
+
+	for key, n := range learned {
+		if !missing[key] {
+			t.Errorf("Hook called for chunk %v which was present before", key)
+		} else if n != 1 {
+			t.Errorf("Hook called %d times for chunk %v", n, key)
+		}
+	}
+	if len(learned) != len(missing) {
+		t.Errorf("Hook called for %d chunks, expected %d", len(learned), len(missing))
+	}
+	for _, chunk := range learnedData {
+		key := chunk.Key()
+		original, err := storeA.Get(&key)
+		check(t, "getting original chunk", err)
+		assertEqual(t, original.Open(), chunk.Open())
+		original.Dispose()
+		chunk.Dispose()
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.5, 0.25, 8192, 64))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	var hashes, wishlist bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+	builder := NewBuilder(storeB, perm, int(fileA.NumChunks())+len(perm), "Received")
+	defer builder.Dispose()
+	check(t, "writing wishlist", builder.WriteWishList(&hashes, flushWriter{&wishlist}))
+
+	serve := func(w io.Writer) (toTransfer, transferred int64) {
+		cb := func(bytesToTransfer, bytesTransferred int64) {
+			toTransfer, transferred = bytesToTransfer, bytesTransferred
+		}
+		check(t, "serving", WriteChunkData(storeA, fileA, bufio.NewReader(bytes.NewReader(wishlist.Bytes())), perm, w, cb))
+		return
+	}
+	var data bytes.Buffer
+	dryToTransfer, dryTransferred := serve(nil)
+	realToTransfer, realTransferred := serve(&data)
+	if dryToTransfer != realToTransfer || dryTransferred != realTransferred {
+		t.Errorf("Dry run reported %d of %d bytes, real serve %d of %d bytes",
+			dryTransferred, dryToTransfer, realTransferred, realToTransfer)
+	}
+	if dryTransferred == 0 || dryTransferred == fileA.Size() || dryTransferred > int64(data.Len()) {
+		t.Errorf("Implausible number of bytes: %d (file size %d, stream size %d)", dryTransferred, fileA.Size(), data.Len())
+	}
+}
+
+type countingReaderAt struct {
+	r         io.ReaderAt
+	bytesRead int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.bytesRead += int64(n)
+	return n, err
+}
+
+func TestReconstructFromReaderAt(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	var dataA bytes.Buffer
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(&dataA, tempB, 0.5, 0.25, 8192, 64))
+	check(t, "closing tempB", tempB.Close())
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	_, err := tempA.Write(dataA.Bytes())
+	check(t, "writing tempA", err)
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+
+	chunks := ListChunks(fileA)
+	if int64(len(chunks)) != fileA.NumChunks() {
+		t.Fatalf("Expected %v chunks, got %v", fileA.NumChunks(), len(chunks))
+	}
+
+	// Calculate the number of bytes that need to be read from the source
+	var expected int64
+	seen := make(map[cafs.SKey]bool)
+	for _, c := range chunks {
+		if f, err := storeB.Get(&c.Key); err == nil {
+			f.Dispose()
+		} else if !seen[c.Key] {
+			expected += c.Size
+		}
+		seen[c.Key] = true
+	}
+
+	src := &countingReaderAt{r: bytes.NewReader(dataA.Bytes())}
+	fileB, err := ReconstructFromReaderAt(storeB, chunks, src, "Recovered A")
+	check(t, "reconstructing", err)
+	defer fileB.Dispose()
+
+	assertEqual(t, fileA.Open(), fileB.Open())
+	if src.bytesRead != expected {
+		t.Errorf("Expected to read %v bytes from source, but read %v", expected, src.bytesRead)
+	}
+	if expected == 0 || expected == fileA.Size() {
+		t.Errorf("Test data expected to overlap partially, but %v of %v bytes were missing", expected, fileA.Size())
+	}
+}
+
+func TestRunLengthEncoding(t *testing.T) {
+	for _, runLength := range []int{1, 3, 15, 16, 17, 63, 64, 65, 1000} {
+		var bits []bool
+		for len(bits) < 5000 {
+			bit := rand.Intn(2) == 1
+			for n := rand.Intn(2 * runLength); n >= 0; n-- {
+				bits = append(bits, bit)
+			}
+		}
+		var buf bytes.Buffer
+		w := newWishListWriter(flushWriter{&buf}, formatRunLength)
+		for _, bit := range bits {
+			check(t, "writing bit", w.WriteBit(bit))
+		}
+		check(t, "flushing", w.Flush())
+		t.Logf("Run length %d: %d bits encoded into %d bytes", runLength, len(bits), buf.Len())
+		if raw := (len(bits) + 7) / 8; runLength >= 64 && buf.Len() > raw/2 {
+			t.Errorf("Expected long runs to be encoded compactly")
+		} else if buf.Len() > raw+raw/10 {
+			t.Errorf("Expected short runs to be encoded as literals")
+		}
+
+		r := newWishListReader(bufio.NewReader(&buf), formatRunLength)
+		for i, expected := range bits {
+			if bit, err := r.ReadBit(); err != nil {
+				t.Fatalf("Run length %d: error reading bit %d: %v", runLength, i, err)
+			} else if bit != expected {
+				t.Fatalf("Run length %d: bit %d mismatch", runLength, i)
+			}
+		}
+		check(t, "expecting end", r.expectEnd())
+	}
+
+	// Truncated and malformed streams are rejected
+	for _, data := range [][]byte{{0x00}, {0x03<<0 | 1<<2}, {rleLiteral | 9<<2, 0xff}} {
+		r := newWishListReader(bufio.NewReader(bytes.NewReader(data)), formatRunLength)
+		var err error
+		for i := 0; i < 10 && err == nil; i++ {
+			_, err = r.ReadBit()
+		}
+		if err != errInvalidRLE {
+			t.Errorf("Expected errInvalidRLE for %x, got %v", data, err)
+		}
+	}
+}
+
+// Type countingFlushWriter counts the flushes of the underlying writer and fails writing
+// once err is set.
+type countingFlushWriter struct {
+	bytes.Buffer
+	flushes int
+	err     error
+}
+
+func (w *countingFlushWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.Buffer.Write(b)
+}
+
+func (w *countingFlushWriter) Flush() {
+	w.flushes++
+}
+
+// Test that the run-length encoder flushes only when syncing or flushing, and that it returns
+// write errors.
+func TestRunLengthFlush(t *testing.T) {
+	var cw countingFlushWriter
+	w := newWishListWriter(&cw, formatRunLength)
+	for i := 0; i < 4*rleMaxPending; i++ {
+		check(t, "writing bit", w.WriteBit(true))
+	}
+	if cw.Len() == 0 || cw.flushes != 0 {
+		t.Errorf("Expected tokens to be written but not flushed, got %d bytes and %d flushes", cw.Len(), cw.flushes)
+	}
+	check(t, "syncing", w.sync())
+	if cw.flushes != 1 {
+		t.Errorf("Expected sync to flush once, got %d flushes", cw.flushes)
+	}
+	check(t, "syncing", w.sync())
+	if cw.flushes != 1 {
+		t.Errorf("Expected sync without pending tokens not to flush, got %d flushes", cw.flushes)
+	}
+
+	cw.err = errors.New("write failed")
+	for i := 0; i < rleMinRun; i++ {
+		check(t, "writing bit", w.WriteBit(i%2 == 0))
+	}
+	if err := w.Flush(); err != cw.err {
+		t.Errorf("Expected write error from Flush, got %v", err)
+	}
+}
+
+func TestIndexWishList(t *testing.T) {
+	// The encoding round-trips
+	var bits []bool
+	for i := 0; i < 5000; i++ {
+		bits = append(bits, rand.Intn(100) == 0)
+	}
+	for _, tail := range []bool{false, true} {
+		bits := append(bits, tail)
+		var buf bytes.Buffer
+		w := newWishListWriter(flushWriter{&buf}, formatIndex)
+		for _, bit := range bits {
+			check(t, "writing bit", w.WriteBit(bit))
+		}
+		check(t, "flushing", w.Flush())
+		r := newWishListReader(bufio.NewReader(bytes.NewReader(buf.Bytes())), formatIndex)
+		for i, expected := range bits {
+			if bit, err := r.ReadBit(); err != nil {
+				t.Fatalf("Error reading bit %d: %v", i, err)
+			} else if bit != expected {
+				t.Fatalf("Bit %d mismatch", i)
+			}
+		}
+		check(t, "expecting end", r.expectEnd())
+
+		// Reading past the end fails
+		r = newWishListReader(bufio.NewReader(bytes.NewReader(buf.Bytes())), formatIndex)
+		var err error
+		for i := 0; i <= len(bits) && err == nil; i++ {
+			_, err = r.ReadBit()
+		}
+		if err == nil {
+			t.Errorf("Expected error reading past the end")
+		}
+	}
+	r := newWishListReader(bufio.NewReader(bytes.NewReader([]byte{0x80})), formatIndex)
+	if _, err := r.ReadBit(); err != errInvalidIndexList {
+		t.Errorf("Expected errInvalidIndexList for truncated token, got %v", err)
+	}
+
+	// The receiver needs only a few chunks of a large file
+	original := randomBytes(8 * 1024 * 1024)
+	modified := append([]byte{}, original...)
+	for i := 0; i < 8; i++ {
+		modified[rand.Intn(len(modified))] ^= 1
+	}
+
+	storeA := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	_, _ = tempA.Write(modified)
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(4))
+
+	transmit := func(opts BuilderOptions) int {
+		storeB := NewRamStorage(16 * 1024 * 1024)
+		defer reportUsage(t, "B", storeB)
+		tempB := storeB.Create("Data B")
+		defer tempB.Dispose()
+		_, _ = tempB.Write(original)
+		check(t, "closing tempB", tempB.Close())
+		return len(transmitSequentially(t, storeA, storeB, fileA, perm, AnnounceOptions{}, opts))
+	}
+	raw, rle, index := transmit(BuilderOptions{}), transmit(BuilderOptions{RunLengthWishList: true}), transmit(BuilderOptions{IndexWishList: true})
+	t.Logf("Wishlist for %d chunks: %d bytes raw, %d bytes run-length encoded, %d bytes indexed", fileA.NumChunks(), raw, rle, index)
+	if index*4 > raw || index > rle {
+		t.Errorf("Expected indexed wishlist to be the smallest")
+	}
+}
+
+func TestRunLengthWishList(t *testing.T) {
+	// The receiver already has the first part of an appended file
+	original := randomBytes(4 * 1024 * 1024)
+	appended := append(append([]byte{}, original...), randomBytes(1024*1024)...)
+
+	storeA := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	_, _ = tempA.Write(appended)
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(4))
+
+	transmit := func(rle bool) int {
+		storeB := NewRamStorage(16 * 1024 * 1024)
+		defer reportUsage(t, "B", storeB)
+		tempB := storeB.Create("Data B")
+		defer tempB.Dispose()
+		_, _ = tempB.Write(original)
+		check(t, "closing tempB", tempB.Close())
+		return len(transmitSequentially(t, storeA, storeB, fileA, perm, AnnounceOptions{}, BuilderOptions{RunLengthWishList: rle}))
+	}
+	raw, rle := transmit(false), transmit(true)
+	t.Logf("Wishlist for %d chunks: %d bytes raw, %d bytes run-length encoded", fileA.NumChunks(), raw, rle)
+	if rle*4 > raw {
+		t.Errorf("Expected run-length encoded wishlist to be much smaller")
+	}
+
+	// Pending requests must be written before the receiver blocks, or the transfer would stall
+	storeB := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	builder := NewBuilderWithOptions(storeB, perm, 4, "Received", BuilderOptions{RunLengthWishList: true})
+	defer builder.Dispose()
+	hashesR, hashesW := io.Pipe()
+	wishlistR, wishlistW := io.Pipe()
+	dataR, dataW := io.Pipe()
+	go func() {
+		hashesW.CloseWithError(WriteChunkHashes(fileA, perm, hashesW))
+	}()
+	go func() {
+		wishlistW.CloseWithError(builder.WriteWishList(hashesR, flushWriter{wishlistW}))
+	}()
+	go func() {
+		dataW.CloseWithError(WriteChunkDataWithOptions(storeA, fileA, bufio.NewReader(wishlistR), perm, dataW, nil,
+			ServeOptions{RunLengthWishList: true}))
+	}()
+	received, err := builder.ReconstructFileFromRequestedChunks(dataR)
+	check(t, "reconstructing", err)
+	defer received.Dispose()
+	assertEqual(t, fileA.Open(), received.Open())
+}
+
+func TestRootHash(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.5, 0.25, 8192, 64))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	// Batch computation over the complete chunk list
+	var batch cafs.SKey
+	for _, c := range ListChunks(fileA) {
+		buf := append(append([]byte{}, batch[:]...), c.Key[:]...)
+		batch = sha256.Sum256(binary.AppendUvarint(buf, uint64(c.Size)))
+	}
+	if root := RootHash(fileA, nil); root != batch {
+		t.Fatalf("Incremental root %v doesn't match batch computation %v", root, batch)
+	}
+
+	// The receiver computes the root from the permuted announcement while it streams in
+	root := RootHash(fileA, nil)
+	transmitSequentially(t, storeA, storeB, fileA, perm, AnnounceOptions{}, BuilderOptions{ExpectedRoot: &root})
+	storeB.FreeCache()
+
+	salt, err := NewSalt()
+	check(t, "creating salt", err)
+	saltedRoot := RootHash(fileA, salt)
+	if saltedRoot == root {
+		t.Errorf("Expected salted root to differ")
+	}
+	transmitSequentially(t, storeA, storeB, fileA, perm, AnnounceOptions{Salt: salt},
+		BuilderOptions{Salt: salt, ExpectedRoot: &saltedRoot})
+	storeB.FreeCache()
+
+	// A mismatching announcement is rejected, and no file is reconstructed
+	var hashes, wishlist, data bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+	builder := NewBuilderWithOptions(storeB, perm, int(fileA.NumChunks())+len(perm), "Received",
+		BuilderOptions{ExpectedRoot: &saltedRoot})
+	defer builder.Dispose()
+	if err := builder.WriteWishList(&hashes, flushWriter{&wishlist}); err != ErrRootMismatch {
+		t.Fatalf("Expected ErrRootMismatch from WriteWishList, got %v", err)
+	}
+	check(t, "writing data", WriteChunkData(storeA, fileA, bufio.NewReader(&wishlist), perm, &data, nil))
+	if f, err := builder.ReconstructFileFromRequestedChunks(&data); err != ErrRootMismatch {
+		if f != nil {
+			f.Dispose()
+		}
+		t.Fatalf("Expected ErrRootMismatch from ReconstructFileFromRequestedChunks, got %v", err)
+	}
+}
+
+// Type stalledFile is a file whose chunk iteration blocks after `n` chunks until `release` is
+// closed. Channel `disposed` is closed when the iterator is disposed.
+type stalledFile struct {
+	cafs.File
+	n                 int
+	release, disposed chan struct{}
+}
+
+type stalledIterator struct {
+	cafs.FileIterator
+	n                 int
+	release, disposed chan struct{}
+}
+
+func (f stalledFile) Chunks() cafs.FileIterator {
+	return &stalledIterator{f.File.Chunks(), f.n, f.release, f.disposed}
+}
+
+func (i *stalledIterator) Dispose() {
+	i.FileIterator.Dispose()
+	close(i.disposed)
+}
+
+func (i *stalledIterator) Next() bool {
+	if i.n == 0 {
+		<-i.release
+	}
+	i.n--
+	return i.FileIterator.Next()
+}
+
+func TestAnnounceTimeout(t *testing.T) {
+	store := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "A", store)
+	temp := store.Create("Data")
+	defer temp.Dispose()
+	check(t, "creating data", createSimilarData(temp, io.Discard, 0.5, 0.25, 8192, 64))
+	check(t, "closing temp", temp.Close())
+	file := temp.File()
+	defer file.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	release, disposed := make(chan struct{}), make(chan struct{})
+	stalled := stalledFile{file, 5, release, disposed}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := WriteChunkHashesWithOptions(stalled, perm, io.Discard, AnnounceOptions{Context: ctx})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline to be exceeded, got %v", err)
+	} else if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Aborting took %v", d)
+	}
+	// The abandoned iterator is disposed once it returns
+	close(release)
+	<-disposed
+
+	// Without stalling, the announcement matches the one written without a context
+	var plain, withContext bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(file, perm, &plain))
+	check(t, "writing chunk hashes", WriteChunkHashesWithOptions(file, perm, &withContext,
+		AnnounceOptions{Context: context.Background()}))
+	if !bytes.Equal(plain.Bytes(), withContext.Bytes()) {
+		t.Errorf("Announcements differ")
+	}
+}
+
+// Type corruptStorage returns altered content for one key.
+type corruptStorage struct {
+	cafs.FileStorage
+	bad cafs.SKey
+}
+
+type corruptFile struct {
+	cafs.File
+}
+
+func (s corruptStorage) Get(key *cafs.SKey) (cafs.File, error) {
+	f, err := s.FileStorage.Get(key)
+	if err == nil && *key == s.bad {
+		return corruptFile{f}, nil
+	}
+	return f, err
+}
+
+func (f corruptFile) Open() io.ReadCloser {
+	return f.OpenTransformed(func(r io.Reader) io.Reader {
+		data, _ := io.ReadAll(r)
+		data[len(data)/2] ^= 1
+		return bytes.NewReader(data)
+	})
+}
+
+// Type corruptedStorage returns altered content for some keys until they are repaired.
+type corruptedStorage struct {
+	cafs.FileStorage
+	mutex sync.Mutex
+	bad   map[cafs.SKey]bool
+}
+
+func (s *corruptedStorage) Get(key *cafs.SKey) (cafs.File, error) {
+	f, err := s.FileStorage.Get(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err == nil && s.bad[*key] {
+		return corruptFile{f}, nil
+	}
+	return f, err
+}
+
+func (s *corruptedStorage) Repair(key *cafs.SKey, data []byte) error {
+	if err := s.FileStorage.(cafs.Repairer).Repair(key, data); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.bad, *key)
+	return nil
+}
+
+// Type creationCounter counts the temporaries created in a storage.
+type creationCounter struct {
+	cafs.FileStorage
+	created *int
+}
+
+func (c creationCounter) CreateWithOptions(info string, opts cafs.CreateOptions) cafs.Temporary {
+	*c.created++
+	return c.FileStorage.CreateWithOptions(info, opts)
+}
+
+func TestReplicate(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	var files []cafs.File
+	for _, size := range []int{1024 * 1024, 100, 0} {
+		temp := storeA.Create(fmt.Sprintf("%d bytes", size))
+		_, _ = temp.Write(randomBytes(size))
+		check(t, "closing temp", temp.Close())
+		files = append(files, temp.File())
+		defer files[len(files)-1].Dispose()
+		temp.Dispose()
+	}
+	total := 0
+	storeA.(cafs.KeyEnumerator).EnumerateKeys(func(cafs.SKey) bool {
+		total++
+		return true
+	})
+
+	// Interrupt the replication after some keys
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var checkpoint cafs.SKey
+	processed, created1 := 0, 0
+	stats1, err := Replicate(storeA, creationCounter{storeB, &created1}, ReplicateOptions{
+		Context: ctx,
+		Checkpoint: func(key cafs.SKey) {
+			if processed > 0 && bytes.Compare(key[:], checkpoint[:]) <= 0 {
+				t.Errorf("Checkpoint %v not in ascending order", key)
+			}
+			checkpoint = key
+			if processed++; processed == total/2 {
+				cancel()
+			}
+		},
+	})
+	if err != context.Canceled {
+		t.Fatalf("Expected replication to be cancelled, got %v", err)
+	}
+	if stats1.Keys != total/2 || stats1.Copied != created1 || stats1.Copied == 0 {
+		t.Errorf("Unexpected stats of interrupted replication: %+v (%d created)", stats1, created1)
+	}
+
+	// The resumed replication doesn't copy anything twice
+	created2 := 0
+	stats2, err := Replicate(storeA, creationCounter{storeB, &created2}, ReplicateOptions{ResumeAfter: &checkpoint})
+	check(t, "resuming replication", err)
+	if stats2.Keys != total-stats1.Keys || stats2.Copied != created2 {
+		t.Errorf("Unexpected stats of resumed replication: %+v (%d created)", stats2, created2)
+	}
+	mismatches, err := VerifyReplica(storeA, storeB, VerifyOptions{})
+	check(t, "verifying", err)
+	if len(mismatches) != 0 {
+		t.Errorf("Expected complete replica, got %v", mismatches)
+	}
+
+	// Running again copies nothing
+	stats3, err := Replicate(storeA, storeB, ReplicateOptions{})
+	check(t, "replicating again", err)
+	if stats3.Keys != total || stats3.Copied != 0 {
+		t.Errorf("Expected nothing to be copied again, got %+v", stats3)
+	}
+}
+
+func TestVerifyReplica(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	data := randomBytes(1024 * 1024)
+	var files []cafs.File
+	for _, s := range []cafs.FileStorage{storeA, storeB} {
+		temp := s.Create("Data")
+		_, _ = temp.Write(data)
+		check(t, "closing temp", temp.Close())
+		files = append(files, temp.File())
+		temp.Dispose()
+	}
+	defer files[0].Dispose()
+	defer files[1].Dispose()
+
+	var progress, total int32
+	mismatches, err := VerifyReplica(storeA, storeB, VerifyOptions{Progress: func(verified, n int) {
+		atomic.StoreInt32(&total, int32(n))
+		atomic.AddInt32(&progress, 1)
+	}})
+	check(t, "verifying", err)
+	if len(mismatches) != 0 {
+		t.Errorf("Expected no mismatches, got %v", mismatches)
+	}
+	if n := int(files[0].NumChunks()) + 1; int(progress) != n || int(total) != n {
+		t.Errorf("Expected progress to be reported for %d keys, got %d of %d", n, progress, total)
+	}
+
+	// A backend storing wrong bytes under the right key is detected
+	bad := ListChunks(files[0])[3].Key
+	mismatches, err = VerifyReplica(storeA, corruptStorage{storeB, bad}, VerifyOptions{Workers: 2})
+	check(t, "verifying", err)
+	if len(mismatches) != 1 || mismatches[0].Key != bad || mismatches[0].Err != ErrContentMismatch {
+		t.Errorf("Expected mismatch of chunk %v, got %v", bad, mismatches)
+	}
+
+	// Mismatching chunks are repaired in the same pass
+	if _, err := VerifyReplica(storeA, corruptStorage{storeB, bad}, VerifyOptions{Repair: true}); err != ErrCannotRepair {
+		t.Errorf("Expected ErrCannotRepair, got %v", err)
+	}
+	chunks := ListChunks(files[0])
+	corrupted := &corruptedStorage{FileStorage: storeB, bad: map[cafs.SKey]bool{chunks[1].Key: true, chunks[5].Key: true}}
+	mismatches, err = VerifyReplica(storeA, corrupted, VerifyOptions{Repair: true})
+	check(t, "verifying with repair", err)
+	if len(mismatches) != 2 || !mismatches[0].Repaired || !mismatches[1].Repaired || mismatches[0].Err != ErrContentMismatch {
+		t.Errorf("Expected two repaired mismatches, got %v", mismatches)
+	}
+	if len(corrupted.bad) != 0 {
+		t.Errorf("Expected all chunks to be repaired: %v", corrupted.bad)
+	}
+	mismatches, err = VerifyReplica(storeA, corrupted, VerifyOptions{})
+	check(t, "verifying after repair", err)
+	if len(mismatches) != 0 {
+		t.Errorf("Expected no mismatches after repair, got %v", mismatches)
+	}
+	key := files[0].Key()
+	healed, err := corrupted.Get(&key)
+	check(t, "getting repaired file", err)
+	assertEqual(t, files[0].Open(), healed.Open())
+	healed.Dispose()
+
+	// Missing files are reported
+	temp := storeA.Create("Extra")
+	_, _ = temp.Write([]byte("only in A"))
+	check(t, "closing temp", temp.Close())
+	extra := temp.File()
+	temp.Dispose()
+	defer extra.Dispose()
+	mismatches, err = VerifyReplica(storeA, storeB, VerifyOptions{})
+	check(t, "verifying", err)
+	if len(mismatches) != 1 || mismatches[0].Key != extra.Key() || mismatches[0].Err != cafs.ErrNotFound {
+		t.Errorf("Expected missing file %v, got %v", extra.Key(), mismatches)
+	}
+}
+
+func TestAbortedReconstructionCleanup(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	check(t, "creating data", createSimilarData(tempA, io.Discard, 0, 0.25, 8192, 128))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	for _, cancelAfter := range []int{1, 20, 100} {
+		ctx, cancel := context.WithCancel(context.Background())
+		received := 0
+		builder := NewBuilderWithOptions(storeB, perm, 8, "Receiver", BuilderOptions{
+			Context: ctx,
+			OnNewChunk: func(chunk cafs.File) {
+				if received++; received == cancelAfter {
+					cancel()
+				}
+			},
+		})
+		hashesR, hashesW := io.Pipe()
+		wishlistR, wishlistW := io.Pipe()
+		dataR, dataW := io.Pipe()
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			hashesW.CloseWithError(WriteChunkHashes(fileA, perm, hashesW))
+		}()
+		go func() {
+			defer wg.Done()
+			err := builder.WriteWishList(hashesR, flushWriter{wishlistW})
+			wishlistW.CloseWithError(err)
+			hashesR.CloseWithError(err)
+		}()
+		go func() {
+			defer wg.Done()
+			err := WriteChunkData(storeA, fileA, bufio.NewReader(wishlistR), perm, dataW, nil)
+			dataW.CloseWithError(err)
+			wishlistR.CloseWithError(err)
+		}()
+		f, err := builder.ReconstructFileFromRequestedChunks(dataR)
+		if err != context.Canceled {
+			t.Errorf("Expected reconstruction to be cancelled after %d chunks, got %v", cancelAfter, err)
+		}
+		if f != nil {
+			f.Dispose()
+		}
+		// The references are released by the failure itself rather than by disposing the Builder
+		if ui := storeB.GetUsageInfo(); ui.Locked != 0 {
+			t.Errorf("After cancelling at chunk %d, before disposing the builder: %v", cancelAfter, ui)
+		}
+		dataR.CloseWithError(err)
+		builder.Dispose()
+		wg.Wait()
+		cancel()
+
+		// The chunks received so far are no longer referenced and can be reclaimed
+		if ui := storeB.GetUsageInfo(); ui.Locked != 0 || ui.Used == 0 {
+			t.Errorf("After cancelling at chunk %d: %v", cancelAfter, ui)
+		}
+		storeB.FreeCache()
+		if ui := storeB.GetUsageInfo(); ui.Used != 0 {
+			t.Errorf("Expected orphaned chunks to be reclaimed: %v", ui)
+		}
+	}
+}
+
+// Type testSource wraps a ChunkSource, delaying every chunk, failing after a number of chunks,
+// stalling until the context is done, or blocking until a channel is closed.
+type testSource struct {
+	source    ChunkSource
+	delay     time.Duration
+	failAfter int // Fail after this many chunks if > 0
+	stall     bool
+	block     chan struct{} // Ignores the context if set
+}
+
+func (s testSource) FetchChunks(ctx context.Context, keys []cafs.SKey, w io.Writer) error {
+	if s.block != nil {
+		<-s.block
+		return errors.New("Source unblocked")
+	}
+	if s.stall {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	for i := range keys {
+		if s.failAfter > 0 && i == s.failAfter {
+			return errors.New("Source failure")
+		}
+		time.Sleep(s.delay)
+		if err := s.source.FetchChunks(ctx, keys[i:i+1], w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestReconstructFromSources(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating data", createSimilarData(tempA, tempB, 0.3, 0.25, 4096, 400))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	fileB := tempB.File()
+	defer fileB.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	var announcement bytes.Buffer
+	check(t, "announcing", WriteChunkHashes(fileA, perm, &announcement))
+
+	local := NewStorageSource(storeA)
+	fast := testSource{source: local}
+	slow := testSource{source: local, delay: 2 * time.Millisecond}
+	failing := testSource{source: local, failAfter: 2}
+	stalling := testSource{source: local, stall: true}
+	blocking := testSource{source: local, block: make(chan struct{})}
+	defer close(blocking.block)
+
+	reconstruct := func(sources []ChunkSource, counts []int64) (cafs.File, error) {
+		return ReconstructFromSources(storeB, perm, bytes.NewReader(announcement.Bytes()), sources, "Data A'",
+			MultiSourceOptions{
+				BatchSize:    8,
+				BatchTimeout: 100 * time.Millisecond,
+				OnNewChunk: func(source int, chunk cafs.File) {
+					atomic.AddInt64(&counts[source], 1)
+				},
+			})
+	}
+
+	counts := make([]int64, 5)
+	f, err := reconstruct([]ChunkSource{fast, slow, failing, stalling, blocking}, counts)
+	check(t, "reconstructing from sources", err)
+	defer f.Dispose()
+	if f.Key() != fileA.Key() || f.Size() != fileA.Size() {
+		t.Fatalf("Reconstructed %v (%d bytes), expected %v (%d bytes)", f.Key(), f.Size(), fileA.Key(), fileA.Size())
+	}
+	assertEqual(t, fileA.Open(), f.Open())
+	t.Logf("Chunks per source: %v", counts)
+	if counts[1] >= counts[0] {
+		t.Errorf("Expected slow source to deliver fewer chunks than fast source: %v", counts)
+	}
+	if counts[2] > 2*3 {
+		t.Errorf("Expected failing source to deliver at most 2 chunks per attempt: %v", counts)
+	}
+	if counts[3] != 0 || counts[4] != 0 {
+		t.Errorf("Expected stalling and blocking sources to deliver nothing: %v", counts)
+	}
+	f.Dispose()
+	storeB.FreeCache()
+
+	// Without a working source, reconstruction must fail
+	_, err = reconstruct([]ChunkSource{failing, stalling, blocking}, make([]int64, 3))
+	if err != ErrNoSource {
+		t.Errorf("Expected ErrNoSource, got: %v", err)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+	tempBase := storeA.Create("Base")
+	defer tempBase.Dispose()
+	tempTarget := storeA.Create("Target")
+	defer tempTarget.Dispose()
+	check(t, "creating data", createSimilarData(tempBase, tempTarget, 0.9, 0.25, 8192, 200))
+	check(t, "closing base", tempBase.Close())
+	check(t, "closing target", tempTarget.Close())
+	base := tempBase.File()
+	defer base.Dispose()
+	target := tempTarget.File()
+	defer target.Dispose()
+
+	var patch bytes.Buffer
+	check(t, "exporting patch", ExportPatch(base, target, &patch))
+	// The patch should contain little more than the data of the chunks not in base
+	var known cafs.KeySet
+	for _, c := range ListChunks(base) {
+		known.Add(c.Key)
+	}
+	var newBytes int64
+	targetChunks := ListChunks(target)
+	for _, c := range targetChunks {
+		if !known.Contains(c.Key) {
+			known.Add(c.Key)
+			newBytes += c.Size
+		}
+	}
+	t.Logf("Patch has %d bytes for %d new bytes in a file of %d bytes", patch.Len(), newBytes, target.Size())
+	if newBytes >= target.Size() || int64(patch.Len()) > newBytes+int64(64+len(targetChunks)*(32+3+1)) {
+		t.Errorf("Patch of %d bytes is too large for %d new bytes", patch.Len(), newBytes)
+	}
+
+	// Apply the patch to a copy of the base file, in a different storage
+	tempBaseB := storeB.Create("Base")
+	defer tempBaseB.Dispose()
+	check(t, "copying base", copyChunkData(tempBaseB, base.Duplicate()))
+	check(t, "closing base copy", tempBaseB.Close())
+	baseB := tempBaseB.File()
+	defer baseB.Dispose()
+	result, err := ApplyPatch(baseB, bytes.NewReader(patch.Bytes()), storeB)
+	check(t, "applying patch", err)
+	defer result.Dispose()
+	if result.Key() != target.Key() {
+		t.Errorf("Patched file has key %v, expected %v", result.Key(), target.Key())
+	}
+	assertEqual(t, target.Open(), result.Open())
+
+	// The patch applies only to its base
+	if _, err := ApplyPatch(target, bytes.NewReader(patch.Bytes()), storeB); err != ErrBaseMismatch {
+		t.Errorf("Expected ErrBaseMismatch, got %v", err)
+	}
+	if _, err := ApplyPatch(baseB, bytes.NewReader(patch.Bytes()[:patch.Len()/2]), storeB); !errors.Is(err, ErrInvalidPatch) {
+		t.Errorf("Expected ErrInvalidPatch for truncated patch, got %v", err)
+	}
+}
+
+func TestTransferStats(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.5, 0.25, 8192, 64))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	var hashes, wishlist, data bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+	builder := NewBuilderWithOptions(storeB, perm, int(fileA.NumChunks())+len(perm), "Received", BuilderOptions{RunLengthWishList: true})
+	defer builder.Dispose()
+	check(t, "writing wishlist", builder.WriteWishList(&hashes, flushWriter{&wishlist}))
+	check(t, "writing data", WriteChunkDataWithOptions(storeA, fileA, bufio.NewReader(&wishlist), perm, &data, nil,
+		ServeOptions{RunLengthWishList: true}))
+	received, err := builder.ReconstructFileFromRequestedChunks(&data)
+	check(t, "reconstructing", err)
+	defer received.Dispose()
+
+	stats := builder.Stats()
+	if stats.Chunks != int(fileA.NumChunks()) || stats.Bytes != fileA.Size() {
+		t.Errorf("Unexpected number of chunks or bytes announced: %+v", stats)
+	}
+	if stats.ChunksReceived == 0 || stats.ChunksReceived >= stats.Chunks || stats.BytesReceived >= stats.Bytes {
+		t.Errorf("Unexpected number of chunks or bytes received: %+v", stats)
+	}
+	if r := stats.DedupRatio(); r <= 0 || r >= 1 {
+		t.Errorf("Unexpected dedup ratio %v", r)
+	}
+	if stats.Duration <= 0 || stats.Duration != builder.Stats().Duration {
+		t.Errorf("Expected final duration, got %v", stats.Duration)
+	}
+
+	encoded, err := json.Marshal(stats)
+	check(t, "marshaling stats", err)
+	var decoded map[string]interface{}
+	check(t, "unmarshaling stats", json.Unmarshal(encoded, &decoded))
+	expected := map[string]interface{}{
+		"chunks":          float64(stats.Chunks),
+		"chunks_received": float64(stats.ChunksReceived),
+		"bytes":           float64(stats.Bytes),
+		"bytes_received":  float64(stats.BytesReceived),
+		"dedup_ratio":     stats.DedupRatio(),
+		"codec":           "rle",
+	}
+	for name, value := range expected {
+		if decoded[name] != value {
+			t.Errorf("Expected %v to be %v in %s", name, value, encoded)
+		}
+	}
+	if d, ok := decoded["duration_seconds"].(float64); !ok || d != stats.Duration.Seconds() {
+		t.Errorf("Unexpected duration in %s", encoded)
+	}
+	if len(decoded) != len(expected)+1 {
+		t.Errorf("Unexpected fields in %s", encoded)
+	}
+}
+
+func TestWarmer(t *testing.T) {
+	storeA := NewRamStorage(16 * 1024 * 1024)
+	storeB := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	// Y derives from X, and Z extends Y
+	tempX := storeA.Create("X")
+	defer tempX.Dispose()
+	tempY := storeA.Create("Y")
+	defer tempY.Dispose()
+	tempZ := storeA.Create("Z")
+	defer tempZ.Dispose()
+	check(t, "creating data", createSimilarData(tempX, io.MultiWriter(tempY, tempZ), 0.5, 0.25, 8192, 100))
+	_, err := tempZ.Write(randomBytes(100000))
+	check(t, "creating data", err)
+	var files []cafs.File
+	for _, temp := range []cafs.Temporary{tempX, tempY, tempZ} {
+		check(t, "closing temporary", temp.Close())
+		f := temp.File()
+		defer f.Dispose()
+		files = append(files, f)
+	}
+
+	// The receiver already has X
+	tempB := storeB.Create("X")
+	defer tempB.Dispose()
+	check(t, "copying X", copyChunkData(tempB, files[0].Duplicate()))
+	check(t, "closing X", tempB.Close())
+	fileB := tempB.File()
+	defer fileB.Dispose()
+
+	roots := []cafs.SKey{files[0].Key(), files[1].Key(), files[2].Key(), emptyKey}
+
+	// Determine the chunks and bytes missing in storeB, each counted once
+	var inX, known cafs.KeySet
+	for _, c := range ListChunks(files[0]) {
+		inX.Add(c.Key)
+		known.Add(c.Key)
+	}
+	missingChunks, missingBytes, perRootBytes := 0, int64(0), int64(0)
+	for _, f := range files[1:] {
+		var seen cafs.KeySet
+		for _, c := range ListChunks(f) {
+			if !inX.Contains(c.Key) && !seen.Contains(c.Key) {
+				perRootBytes += c.Size
+			}
+			seen.Add(c.Key)
+		}
+		for _, c := range ListChunks(f) {
+			if !known.Contains(c.Key) {
+				known.Add(c.Key)
+				missingChunks++
+				missingBytes += c.Size
+			}
+		}
+	}
+
+	warmer := NewWarmer(storeB, "Warming")
+	defer warmer.Dispose()
+	hashesR, hashesW := io.Pipe()
+	wishlistR, wishlistW := io.Pipe()
+	dataR, dataW := io.Pipe()
+	counter := &countingWriter{w: dataW}
+	go func() {
+		hashesW.CloseWithError(WriteRootsChunkHashes(storeA, roots, hashesW))
+	}()
+	go func() {
+		err := warmer.WriteWishList(hashesR, flushWriter{wishlistW})
+		wishlistW.CloseWithError(err)
+		hashesR.CloseWithError(err)
+	}()
+	go func() {
+		err := WriteRootsChunkData(storeA, roots, bufio.NewReader(wishlistR), counter)
+		dataW.CloseWithError(err)
+		wishlistR.CloseWithError(err)
+	}()
+	warmed, err := warmer.ReceiveChunks(dataR)
+	check(t, "receiving chunks", err)
+	dataR.Close()
+	if len(warmed) != len(roots) || warmed[3] != nil {
+		t.Fatalf("Expected %d files, the last one missing, got %v", len(roots), warmed)
+	}
+	for i, f := range warmed[:3] {
+		defer f.Dispose()
+		if f.Key() != roots[i] {
+			t.Errorf("File #%d has key %v, expected %v", i, f.Key(), roots[i])
+		}
+		assertEqual(t, files[i].Open(), f.Open())
+	}
+
+	// Shared chunks are transferred once
+	t.Logf("Transferred %d chunks in %d bytes, %d bytes missing, %d bytes if transferred per root",
+		warmer.RequestedChunks(), counter.n, missingBytes, perRootBytes)
+	if warmer.RequestedChunks() != missingChunks {
+		t.Errorf("Requested %d chunks, expected %d", warmer.RequestedChunks(), missingChunks)
+	}
+	if counter.n < missingBytes || counter.n > missingBytes+int64(3*missingChunks) || counter.n >= perRootBytes {
+		t.Errorf("Transferred %d bytes for %d missing bytes", counter.n, missingBytes)
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestUnrequestedChunk(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	check(t, "creating data", createSimilarData(tempA, io.Discard, 0, 0.25, 8192, 32))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	// Returns the error of a transmission in which the chunk data is modified by `tamper`
+	transmit := func(tamper func(records [][]byte) [][]byte) error {
+		var hashes, wishlist, data bytes.Buffer
+		check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+		builder := NewBuilder(storeB, perm, int(fileA.NumChunks())+len(perm), "Received")
+		defer builder.Dispose()
+		check(t, "writing wishlist", builder.WriteWishList(&hashes, flushWriter{&wishlist}))
+		check(t, "writing data", WriteChunkData(storeA, fileA, bufio.NewReader(&wishlist), perm, &data, nil))
+
+		// Split the chunk data into records of length and data
+		var records [][]byte
+		for b := data.Bytes(); len(b) > 0; {
+			length, n := binary.Varint(b)
+			records = append(records, b[:n+int(length)])
+			b = b[n+int(length):]
+		}
+		var tampered bytes.Buffer
+		for _, record := range tamper(records) {
+			tampered.Write(record)
+		}
+		f, err := builder.ReconstructFileFromRequestedChunks(&tampered)
+		if f != nil {
+			f.Dispose()
+		}
+		return err
+	}
+
+	if err := transmit(func(records [][]byte) [][]byte { return records }); err != nil {
+		t.Fatalf("Untampered transmission failed: %v", err)
+	}
+	storeB.FreeCache()
+
+	// A chunk with content the receiver didn't ask for, e.g. because the file changed
+	err := transmit(func(records [][]byte) [][]byte {
+		changed := append([]byte(nil), records[0]...)
+		changed[len(changed)-1]++
+		records[0] = changed
+		return records
+	})
+	if err != ErrUnrequestedChunk {
+		t.Errorf("Expected ErrUnrequestedChunk, got %v", err)
+	}
+	storeB.FreeCache()
+
+	// Requested chunks in the wrong order
+	err = transmit(func(records [][]byte) [][]byte {
+		records[0], records[1] = records[1], records[0]
+		return records
+	})
+	if err != ErrUnexpectedChunk {
+		t.Errorf("Expected ErrUnexpectedChunk, got %v", err)
+	}
+	storeB.FreeCache()
+
+	// A length prefix one byte short of the announced length is rejected before reading the data,
+	// which would otherwise yield a chunk that wasn't requested
+	err = transmit(func(records [][]byte) [][]byte {
+		length, n := binary.Varint(records[0])
+		prefix := binary.AppendVarint(nil, length-1)
+		records[0] = append(prefix, records[0][n:]...)
+		return records
+	})
+	if err != ErrUnexpectedChunk {
+		t.Errorf("Expected ErrUnexpectedChunk for wrong length prefix, got %v", err)
+	}
+	storeB.FreeCache()
+}
+
+func TestReorderLimit(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	check(t, "creating data", createSimilarData(tempA, io.Discard, 0, 0.25, 8192, 128))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+
+	// Reversing blocks of 64 chunks makes the receiver hold all but one of them at once
+	perm := make(shuffle.Permutation, 64)
+	for i := range perm {
+		perm[i] = len(perm) - 1 - i
+	}
+	const limit = 32 * 1024
+
+	// Without a spill directory, exceeding the limit is an error
+	var hashes, wishlist, data bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+	builder := NewBuilderWithOptions(storeB, perm, int(fileA.NumChunks())+len(perm), "Received",
+		BuilderOptions{MaxReorderBytes: limit})
+	check(t, "writing wishlist", builder.WriteWishList(&hashes, flushWriter{&wishlist}))
+	check(t, "writing data", WriteChunkData(storeA, fileA, bufio.NewReader(&wishlist), perm, &data, nil))
+	if f, err := builder.ReconstructFileFromRequestedChunks(&data); err != ErrReorderLimit {
+		t.Errorf("Expected ErrReorderLimit, got %v", err)
+		if f != nil {
+			f.Dispose()
+		}
+	}
+	builder.Dispose()
+	storeB.FreeCache()
+
+	// With a spill directory, the file is reconstructed and the spill file is removed afterwards
+	dir := t.TempDir()
+	spilled := false
+	transmitSequentially(t, storeA, storeB, fileA, perm, AnnounceOptions{}, BuilderOptions{
+		MaxReorderBytes: limit,
+		SpillDir:        dir,
+		OnNewChunk: func(cafs.File) {
+			if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+				spilled = true
+			}
+		},
+	})
+	if !spilled {
+		t.Error("Expected chunks to be spilled")
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("Expected spill directory to be empty, got %v entries (%v)", len(entries), err)
+	}
+}
+
+func TestResumeAnnouncement(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.5, 0.25, 8192, 64))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+	errBroken := errors.New("Connection broken")
+
+	var hashes bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+
+	for _, opts := range []BuilderOptions{{}, {MaxChunks: 1000}, {RunLengthWishList: true}, {IndexWishList: true}} {
+		// The wishlist of an uninterrupted announcement
+		var expected bytes.Buffer
+		reference := NewBuilderWithOptions(storeB, perm, int(fileA.NumChunks())+len(perm), "Reference", opts)
+		check(t, "writing wishlist", reference.WriteWishList(bytes.NewReader(hashes.Bytes()), flushWriter{&expected}))
+		reference.Dispose()
+
+		builder := NewBuilderWithOptions(storeB, perm, int(fileA.NumChunks())+len(perm), "Received", opts)
+
+		// Interrupt the announcement in the middle
+		var wishlist bytes.Buffer
+		broken := io.MultiReader(bytes.NewReader(hashes.Bytes()[:hashes.Len()/2]), iotest.ErrReader(errBroken))
+		if err := builder.WriteWishList(broken, flushWriter{&wishlist}); err == nil {
+			t.Fatal("Expected error from interrupted announcement")
+		}
+		entries := builder.AnnouncedEntries()
+		if entries == 0 || entries >= int(fileA.NumChunks()) {
+			t.Errorf("Unexpected number of entries read: %d", entries)
+		}
+
+		// Resume with the rest of the announcement. The wishlist is written from the beginning.
+		var rest bytes.Buffer
+		check(t, "writing rest of chunk hashes", WriteChunkHashesWithOptions(fileA, perm, &rest, AnnounceOptions{SkipEntries: entries}))
+		if !bytes.HasSuffix(hashes.Bytes(), rest.Bytes()) || rest.Len() >= hashes.Len() {
+			t.Fatalf("Expected a suffix of the announcement, got %d of %d bytes", rest.Len(), hashes.Len())
+		}
+		wishlist.Reset()
+		check(t, "resuming wishlist", builder.WriteWishList(&rest, flushWriter{&wishlist}))
+		if !bytes.Equal(wishlist.Bytes(), expected.Bytes()) {
+			t.Errorf("Resumed wishlist differs from the uninterrupted one")
+		}
+		if err := builder.WriteWishList(bytes.NewReader(nil), flushWriter{io.Discard}); err != ErrNotResumable {
+			t.Errorf("Expected ErrNotResumable, got %v", err)
+		}
+
+		var data bytes.Buffer
+		check(t, "writing data", WriteChunkDataWithOptions(storeA, fileA, bufio.NewReader(&wishlist), perm, &data, nil,
+			ServeOptions{RunLengthWishList: opts.RunLengthWishList, IndexWishList: opts.IndexWishList}))
+		received, err := builder.ReconstructFileFromRequestedChunks(&data)
+		check(t, "reconstructing", err)
+		assertEqual(t, fileA.Open(), received.Open())
+		received.Dispose()
+		builder.Dispose()
+		storeB.FreeCache()
+	}
+
+	// A Builder whose announcement is never resumed can still be disposed
+	builder := NewBuilder(storeB, perm, 4, "Abandoned")
+	broken := io.MultiReader(bytes.NewReader(hashes.Bytes()[:100]), iotest.ErrReader(errBroken))
+	if err := builder.WriteWishList(broken, flushWriter{io.Discard}); err == nil {
+		t.Error("Expected error from interrupted announcement")
+	}
+	builder.Dispose()
+}
+
+func TestConnTimeouts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Can't listen on loopback: %v", err)
+	}
+	defer l.Close()
+
+	// The peer accepts connections, but stalls until told to stop
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-stop
+				conn.Close()
+			}()
+		}
+	}()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return WithTimeouts(conn, ConnTimeouts{Read: 100 * time.Millisecond, Write: 100 * time.Millisecond})
+	}
+
+	// A receiver waiting for an announcement times out
+	conn := dial()
+	builder := NewBuilder(NewRamStorage(1024*1024), shuffle.Permutation{0}, 16, "Stalled")
+	var buf bytes.Buffer
+	if err := builder.WriteWishList(conn, flushWriter{&buf}); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected read deadline to be exceeded, got %v", err)
+	}
+	builder.Dispose()
+	conn.Close()
+
+	// A sender whose data isn't read times out once the socket buffers are full
+	conn = dial()
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, 256*1024*1024)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected write deadline to be exceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Write took %v to time out", d)
+	}
+	conn.Close()
+}
+
+func TestConnTimeoutsProgress(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	conn := WithTimeouts(a, ConnTimeouts{Read: 200 * time.Millisecond})
+
+	// Data trickling in slower than the total timeout, but faster than the per-read timeout
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := b.Write([]byte{byte(i)}); err != nil {
+				return
+			}
+		}
+		b.Close()
+	}()
+	if data, err := io.ReadAll(conn); err != nil || len(data) != 5 {
+		t.Errorf("Expected 5 bytes without timeout, got %d (%v)", len(data), err)
+	}
+}
+
+func TestRunPull(t *testing.T) {
+	storeA := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	storeB := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.7, 0.3, 8192, 256))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+
+	pull := func(key cafs.SKey) ([]PullEvent, cafs.File, error, error) {
+		connA, connB := net.Pipe()
+		served := make(chan error, 1)
+		go func() {
+			defer connA.Close()
+			served <- ServePull(storeA, connA, shuffle.Permutation(rand.Perm(7)), PushOptions{})
+		}()
+		defer connB.Close()
+		p := RunPull(storeB, connB, key, "Pulled", BuilderOptions{})
+		var events []PullEvent
+		for event := range p.Events {
+			events = append(events, event)
+		}
+		file, err := p.Wait()
+		return events, file, err, <-served
+	}
+
+	events, file, err, serveErr := pull(fileA.Key())
+	check(t, "pulling", err)
+	check(t, "serving", serveErr)
+	defer file.Dispose()
+	assertEqual(t, fileA.Open(), file.Open())
+
+	// Phases follow each other, with progress reported while receiving data
+	var phases []string
+	var progress, bytesReceived int64
+	for i, event := range events {
+		switch event.Type {
+		case PullPhase:
+			phases = append(phases, event.Phase)
+		case PullProgress:
+			if event.Phase != PhaseReceivingData || event.BytesReceived <= progress || event.BytesTotal != fileA.Size() {
+				t.Errorf("Event %d: unexpected progress %+v", i, event)
+			}
+			progress = event.BytesReceived
+		case PullCompleted:
+			if i != len(events)-1 || event.Err != nil {
+				t.Errorf("Event %d: unexpected completion %+v", i, event)
+			}
+			bytesReceived = event.BytesReceived
+		}
+	}
+	expected := []string{PhaseRequesting, PhaseNegotiating, PhaseReceivingData, PhaseConfirming}
+	if fmt.Sprint(phases) != fmt.Sprint(expected) {
+		t.Errorf("Expected phases %v, got %v", expected, phases)
+	}
+	if bytesReceived == 0 || bytesReceived >= fileA.Size() {
+		t.Errorf("Expected part of the file to be received, got %d of %d bytes", bytesReceived, fileA.Size())
+	}
+
+	// Files the peer doesn't have can't be pulled
+	events, _, err, serveErr = pull(cafs.SKey{1, 2, 3})
+	if err != cafs.ErrNotFound || serveErr != cafs.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v (puller) and %v (server)", err, serveErr)
+	}
+	if last := events[len(events)-1]; last.Type != PullCompleted || last.Err != cafs.ErrNotFound {
+		t.Errorf("Unexpected last event %+v", last)
+	}
+}
+
+func TestPush(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Can't listen on loopback: %v", err)
+	}
+	defer l.Close()
+
+	storeA := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := bytes.Buffer{}
+	check(t, "creating similar data", createSimilarData(tempA, &tempB, 0.7, 0.3, 8192, 256))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+
+	for _, opts := range []BuilderOptions{{}, {RunLengthWishList: true}, {IndexWishList: true}, {MaxChunks: 1000}, {AnyChunkOrder: true}} {
+		storeB := NewRamStorage(16 * 1024 * 1024)
+		tempFileB := storeB.Create("Data B")
+		_, _ = tempFileB.Write(tempB.Bytes())
+		check(t, "closing tempFileB", tempFileB.Close())
+		fileB := tempFileB.File()
+		tempFileB.Dispose()
+
+		// The receiver accepts a connection, while the holder of the data initiates it
+		type result struct {
+			file cafs.File
+			err  error
+		}
+		received := make(chan result, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				received <- result{nil, err}
+				return
+			}
+			defer conn.Close()
+			file, err := ReceivePush(storeB, conn, "Pushed", opts)
+			received <- result{file, err}
+		}()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		check(t, "dialing", err)
+		check(t, "pushing", Push(storeA, fileA, shuffle.Permutation(rand.Perm(7)), conn))
+		conn.Close()
+
+		res := <-received
+		check(t, "receiving push", res.err)
+		assertEqual(t, fileA.Open(), res.file.Open())
+		res.file.Dispose()
+		fileB.Dispose()
+		reportUsage(t, "B", storeB)
+	}
+
+	// The sender learns about a receiver refusing the file
+	connA, connB := net.Pipe()
+	go func() {
+		defer connB.Close()
+		_, _ = ReceivePush(NewRamStorage(16*1024*1024), connB, "Refused", BuilderOptions{MaxChunks: 1})
+	}()
+	if err := Push(storeA, fileA, shuffle.Permutation{0}, connA); err == nil {
+		t.Errorf("Expected push of %d chunks to fail", fileA.NumChunks())
+	}
+	connA.Close()
+
+	// Garbage isn't accepted as a push
+	if _, err := ReceivePush(NewRamStorage(1024), struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader([]byte("CAFSPULL1")), io.Discard}, "Invalid", BuilderOptions{}); err != ErrInvalidPush {
+		t.Errorf("Expected ErrInvalidPush, got %v", err)
+	}
+
+	// Without MaxChunks, the number of chunks announced in the header is limited
+	header := append([]byte(pushMagic), make([]byte, 32)...)
+	header = binary.AppendUvarint(header, defaultMaxPushChunks+1)
+	header = binary.AppendUvarint(header, 1)
+	header = binary.AppendUvarint(header, 0)
+	if _, err := ReceivePush(NewRamStorage(1024), struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(header), io.Discard}, "Huge", BuilderOptions{}); !errors.Is(err, ErrAnnouncementRejected) {
+		t.Errorf("Expected ErrAnnouncementRejected, got %v", err)
+	}
+
+	// If announcing fails, the connection is closed, which stops reading the wishlist
+	broken := &brokenConn{closed: make(chan struct{})}
+	if err := Push(storeA, fileA, shuffle.Permutation{0}, broken); err == nil {
+		t.Errorf("Expected push over broken connection to fail")
+	}
+	select {
+	case <-broken.closed:
+	default:
+		t.Errorf("Expected broken connection to be closed")
+	}
+}
+
+// Type brokenConn fails all writes. Reads block until it is closed.
+type brokenConn struct {
+	closed chan struct{}
+}
+
+func (c *brokenConn) Read([]byte) (int, error) {
+	<-c.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (c *brokenConn) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func (c *brokenConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+// Type refCountingStorage counts the handles to retrieved files that haven't been disposed yet.
+type refCountingStorage struct {
+	cafs.FileStorage
+	refs int32
+}
+
+type refCountedFile struct {
+	cafs.File
+	storage  *refCountingStorage
+	disposed bool
+}
+
+func (s *refCountingStorage) Get(key *cafs.SKey) (cafs.File, error) {
+	f, err := s.FileStorage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&s.refs, 1)
+	return &refCountedFile{File: f, storage: s}, nil
+}
+
+func (f *refCountedFile) Dispose() {
+	if !f.disposed {
+		f.disposed = true
+		atomic.AddInt32(&f.storage.refs, -1)
+	}
+	f.File.Dispose()
+}
+
+// Type cancellingWriter cancels a context on the n-th write.
+type cancellingWriter struct {
+	cancel func()
+	n      int
+	writes int
+}
+
+func (w *cancellingWriter) Write(b []byte) (int, error) {
+	w.writes++
+	if w.writes == w.n {
+		w.cancel()
+	}
+	return len(b), nil
+}
+
+func TestAbortReleasesChunks(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+	temp := storeA.Create("Data A")
+	_, _ = temp.Write(randomBytes(512 * 1024))
+	check(t, "closing temp", temp.Close())
+	fileA := temp.File()
+	temp.Dispose()
+	defer fileA.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(5))
+	var hashes, wishlist bytes.Buffer
+	check(t, "writing hashes", WriteChunkHashes(fileA, perm, &hashes))
+	builder := NewBuilder(storeB, perm, int(fileA.NumChunks())+len(perm), "Data B")
+	defer builder.Dispose()
+	check(t, "writing wishlist", builder.WriteWishList(&hashes, flushWriter{&wishlist}))
+
+	// The context is cancelled after the length of the second chunk has been written, which
+	// aborts the transmission while that chunk is being held
+	counting := &refCountingStorage{FileStorage: storeA}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &cancellingWriter{cancel: cancel, n: 3}
+	err := WriteChunkDataWithOptions(counting, fileA, bufio.NewReader(&wishlist), perm, w, nil, ServeOptions{Context: ctx})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected transmission to be cancelled, got %v", err)
+	}
+	if w.writes != 3 {
+		t.Errorf("Expected transmission to abort within the second chunk, got %d writes", w.writes)
+	}
+	if refs := atomic.LoadInt32(&counting.refs); refs != 0 {
+		t.Errorf("Expected all chunks to be released after abort, %d still held", refs)
+	}
+}
+
+func TestWholeFileDigest(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	temp := storeA.Create("Data A")
+	_, _ = temp.Write(randomBytes(256 * 1024))
+	check(t, "closing temp", temp.Close())
+	fileA := temp.File()
+	temp.Dispose()
+	defer fileA.Dispose()
+
+	for _, builderOpts := range []BuilderOptions{{ExpectDigest: true}, {ExpectDigest: true, MaxChunks: 1000}} {
+		storeB := NewRamStorage(8 * 1024 * 1024)
+		transmitSequentially(t, storeA, storeB, fileA, shuffle.Permutation(rand.Perm(4)), AnnounceOptions{Digest: true}, builderOpts)
+		reportUsage(t, "B", storeB)
+	}
+
+	// Simulates a reordering bug: the receiver restores the original order using the wrong
+	// permutation. There are no placeholders, so every chunk is received as announced.
+	n := int(fileA.NumChunks())
+	identity, reversed := make(shuffle.Permutation, n), make(shuffle.Permutation, n)
+	for i := range identity {
+		identity[i], reversed[i] = i, n-1-i
+	}
+	transmit := func(announceOpts AnnounceOptions, builderOpts BuilderOptions) (cafs.File, error) {
+		storeB := NewRamStorage(8 * 1024 * 1024)
+		var hashes, wishlist, data bytes.Buffer
+		check(t, "writing chunk hashes", WriteChunkHashesWithOptions(fileA, identity, &hashes, announceOpts))
+		builder := NewBuilderWithOptions(storeB, reversed, 2*n, "Received", builderOpts)
+		defer builder.Dispose()
+		if err := builder.WriteWishList(&hashes, flushWriter{&wishlist}); err != nil {
+			return nil, err
+		}
+		check(t, "writing data", WriteChunkData(storeA, fileA, bufio.NewReader(&wishlist), identity, &data, nil))
+		return builder.ReconstructFileFromRequestedChunks(&data)
+	}
+	if f, err := transmit(AnnounceOptions{}, BuilderOptions{}); err != nil {
+		t.Errorf("Expected wrong file to be reconstructed without digest, got %v", err)
+	} else {
+		if f.Key() == fileA.Key() {
+			t.Errorf("Expected reordering to produce wrong bytes")
+		}
+		f.Dispose()
+	}
+	if _, err := transmit(AnnounceOptions{Digest: true}, BuilderOptions{ExpectDigest: true}); err != ErrDigestMismatch {
+		t.Errorf("Expected ErrDigestMismatch, got %v", err)
+	}
+
+	// A receiver expecting a digest rejects announcements without one
+	if _, err := transmit(AnnounceOptions{}, BuilderOptions{ExpectDigest: true}); err != ErrDigestMismatch {
+		t.Errorf("Expected ErrDigestMismatch for missing digest, got %v", err)
+	}
+}
+
+// Type countingConn counts the bytes read from and written to a connection.
+type countingConn struct {
+	net.Conn
+	read, written int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read += int64(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written += int64(n)
+	return n, err
+}
+
+func TestPushFrameSize(t *testing.T) {
+	// Large blocks are split into frames
+	var buf bytes.Buffer
+	fw := &frameWriter{w: &buf, max: 4096}
+	data := randomBytes(10000)
+	if n, err := fw.Write(data); n != len(data) || err != nil {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	check(t, "closing frame writer", fw.Close())
+	frames := 0
+	for r := bufio.NewReader(bytes.NewReader(buf.Bytes())); ; frames++ {
+		l, err := binary.ReadUvarint(r)
+		check(t, "reading frame length", err)
+		if l == 0 {
+			break
+		} else if l > 4096 {
+			t.Errorf("Frame of %d bytes exceeds limit", l)
+		}
+		_, _ = r.Discard(int(l))
+	}
+	if frames != 3 {
+		t.Errorf("Expected 3 frames, got %d", frames)
+	}
+	read, err := io.ReadAll(&frameReader{r: bufio.NewReader(&buf)})
+	check(t, "reading frames", err)
+	if !bytes.Equal(read, data) {
+		t.Errorf("Frames don't contain the data written")
+	}
+
+	storeA := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	_, _ = tempA.Write(randomBytes(1024 * 1024))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	tempA.Dispose()
+	defer fileA.Dispose()
+
+	push := func(frameSize int) int64 {
+		storeB := NewRamStorage(16 * 1024 * 1024)
+		defer reportUsage(t, "B", storeB)
+		connA, connB := net.Pipe()
+		counting := &countingConn{Conn: connA}
+		received := make(chan cafs.File, 1)
+		failed := make(chan error, 1)
+		go func() {
+			defer connB.Close()
+			if file, err := ReceivePush(storeB, connB, "Pushed", BuilderOptions{}); err != nil {
+				failed <- err
+			} else {
+				received <- file
+			}
+		}()
+		check(t, "pushing", PushWithOptions(storeA, fileA, shuffle.Permutation{2, 0, 1}, counting, PushOptions{MaxFrameSize: frameSize}))
+		connA.Close()
+		var file cafs.File
+		select {
+		case file = <-received:
+		case err := <-failed:
+			t.Fatalf("Receiving push: %v", err)
+		}
+		assertEqual(t, fileA.Open(), file.Open())
+		file.Dispose()
+		return counting.written
+	}
+	small, large := push(256), push(1024*1024)
+	t.Logf("Bytes sent: %d with small frames, %d with large frames", small, large)
+	if small <= large {
+		t.Errorf("Expected small frames to cause more overhead")
+	}
+}
+
+// Type syscallWriter simulates a writer with a fixed cost per call, like an unbuffered socket,
+// and counts the calls.
+type syscallWriter struct {
+	w     io.Writer
+	calls int
+}
+
+func (s *syscallWriter) Write(b []byte) (int, error) {
+	s.calls++
+	for start := time.Now(); time.Since(start) < 2*time.Microsecond; {
+	}
+	return s.w.Write(b)
+}
+
+func TestAnnounceBufferSize(t *testing.T) {
+	store := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "store", store)
+	temp := store.Create("Data")
+	defer temp.Dispose()
+	_, _ = temp.Write(randomBytes(1024 * 1024))
+	check(t, "closing temp", temp.Close())
+	file := temp.File()
+	defer file.Dispose()
+	perm := shuffle.Permutation(rand.Perm(10))
+
+	var plain, buffered bytes.Buffer
+	plainWriter, bufferedWriter := &syscallWriter{w: &plain}, &syscallWriter{w: &buffered}
+	check(t, "announcing", WriteChunkHashesWithOptions(file, perm, plainWriter, AnnounceOptions{Digest: true}))
+	check(t, "announcing buffered", WriteChunkHashesWithOptions(file, perm, bufferedWriter,
+		AnnounceOptions{Digest: true, BufferSize: 4096}))
+	if !bytes.Equal(plain.Bytes(), buffered.Bytes()) {
+		t.Errorf("Buffering changed the announcement")
+	}
+	if expected := (buffered.Len() + 4095) / 4096; bufferedWriter.calls != expected {
+		t.Errorf("Expected %d writes with buffering, got %d (%d without)", expected, bufferedWriter.calls, plainWriter.calls)
+	}
+}
+
+func BenchmarkAnnounceBufferSize(b *testing.B) {
+	store := NewRamStorage(8 * 1024 * 1024)
+	temp := store.Create("Data")
+	defer temp.Dispose()
+	_, _ = temp.Write(randomBytes(4 * 1024 * 1024))
+	if err := temp.Close(); err != nil {
+		b.Fatal(err)
+	}
+	file := temp.File()
+	defer file.Dispose()
+	perm := shuffle.Permutation(rand.Perm(64))
+
+	for _, size := range []int{0, 512, 4096, 32768} {
+		b.Run(fmt.Sprintf("buffer-%d", size), func(b *testing.B) {
+			w := &syscallWriter{w: io.Discard}
+			for i := 0; i < b.N; i++ {
+				if err := WriteChunkHashesWithOptions(file, perm, w, AnnounceOptions{BufferSize: size}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(w.calls)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestPlanFetch(t *testing.T) {
+	data := randomBytes(1024 * 1024)
+	local := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "local", local)
+	store := func(s cafs.FileStorage, data []byte) cafs.File {
+		temp := s.Create("Data")
+		defer temp.Dispose()
+		_, _ = temp.Write(data)
+		check(t, "closing temp", temp.Close())
+		return temp.File()
+	}
+	localFile := store(local, data[:len(data)/4])
+	defer localFile.Dispose()
+
+	// Fetch and decode the metadata of all sources
+	var sources []ChunkSource
+	var available [][]ChunkInfo
+	for i, content := range [][]byte{data, data, data[len(data)/2:]} {
+		s := NewRamStorage(8 * 1024 * 1024)
+		f := store(s, content)
+		defer f.Dispose()
+		perm := shuffle.Permutation(rand.Perm(5 + i))
+		var conn bytes.Buffer
+		check(t, "announcing", WriteChunkHashesWithOptions(f, perm, &conn, AnnounceOptions{Digest: true}))
+		announcement, err := ReadAnnouncement(&conn)
+		check(t, "reading announcement", err)
+		chunks, err := announcement.Chunks(perm)
+		check(t, "decoding announcement", err)
+		if expected := ListChunks(f); fmt.Sprint(chunks) != fmt.Sprint(expected) {
+			t.Fatalf("Source %d: decoded chunks differ from the file's chunks", i)
+		}
+		sources = append(sources, NewStorageSource(s))
+		available = append(available, chunks)
+	}
+
+	wanted := available[0]
+	plan := PlanFetch(local, wanted, available)
+	if len(plan.Unavailable) != 0 {
+		t.Errorf("Expected all chunks to be available, got %v", plan.Unavailable)
+	}
+	assigned := make(map[cafs.SKey]int)
+	for i, keys := range plan.Assignments {
+		holds := make(map[cafs.SKey]bool)
+		for _, c := range available[i] {
+			holds[c.Key] = true
+		}
+		for _, key := range keys {
+			if !holds[key] {
+				t.Errorf("Chunk %v assigned to source %d, which doesn't hold it", key, i)
+			}
+			assigned[key]++
+		}
+	}
+	var missingBytes int64
+	counted := make(map[cafs.SKey]bool)
+	for _, c := range wanted {
+		_, err := local.StatByKey(&c.Key)
+		if present := err == nil; present != (assigned[c.Key] == 0) || assigned[c.Key] > 1 {
+			t.Errorf("Chunk %v: present locally=%v, but assigned %d times", c.Key, present, assigned[c.Key])
+		} else if !present && !counted[c.Key] {
+			missingBytes += c.Size
+			counted[c.Key] = true
+		}
+	}
+	var total, lowest, highest int64 = 0, missingBytes, 0
+	for _, n := range plan.Bytes {
+		total += n
+		lowest, highest = min(lowest, n), max(highest, n)
+	}
+	t.Logf("Bytes per source: %v", plan.Bytes)
+	if total != missingBytes || highest-lowest > 2*adler32.MAX_CHUNK {
+		t.Errorf("Expected %d missing bytes to be spread evenly, got %v", missingBytes, plan.Bytes)
+	}
+
+	// Executing the plan makes all wanted chunks available locally
+	var fetched []cafs.File
+	for i, keys := range plan.Assignments {
+		var buf bytes.Buffer
+		check(t, "fetching", sources[i].FetchChunks(context.Background(), keys, &buf))
+		r := bufio.NewReader(&buf)
+		for range keys {
+			chunk, err := readChunk(local, r, "Fetched")
+			check(t, "reading chunk", err)
+			fetched = append(fetched, chunk)
+		}
+	}
+	for _, c := range wanted {
+		if _, err := local.StatByKey(&c.Key); err != nil {
+			t.Errorf("Chunk %v missing after executing plan: %v", c.Key, err)
+		}
+	}
+	for _, chunk := range fetched {
+		chunk.Dispose()
+	}
+}
+
+func TestPlanExchange(t *testing.T) {
+	// Both files share a middle part, and A's file contains a repeated part
+	common := randomBytes(512 * 1024)
+	onlyA, onlyB := randomBytes(256*1024), randomBytes(256*1024)
+	dataA := append(append(append([]byte{}, onlyA...), common...), onlyA...)
+	dataB := append(append([]byte{}, common...), onlyB...)
+	s := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "s", s)
+	chunksOf := func(data []byte) []ChunkInfo {
+		temp := s.Create("Data")
+		defer temp.Dispose()
+		_, _ = temp.Write(data)
+		check(t, "closing temp", temp.Close())
+		f := temp.File()
+		defer f.Dispose()
+		return ListChunks(f)
+	}
+	a, b := chunksOf(dataA), chunksOf(dataB)
+
+	plan := PlanExchange(a, b)
+	// After the exchange, each peer must hold the union, having received every chunk it was
+	// missing exactly once, from the peer holding it
+	verify := func(name string, own, other []ChunkInfo, send []bool, bytes int64) {
+		holds := make(map[cafs.SKey]bool)
+		for _, c := range own {
+			holds[c.Key] = true
+		}
+		received := make(map[cafs.SKey]int)
+		var sent int64
+		for i, c := range other {
+			if send[i] {
+				if holds[c.Key] {
+					t.Errorf("%v: chunk %v sent although already present", name, c.Key)
+				}
+				received[c.Key]++
+				sent += c.Size
+			}
+		}
+		for _, c := range other {
+			if !holds[c.Key] && received[c.Key] != 1 {
+				t.Errorf("%v: missing chunk %v received %d times", name, c.Key, received[c.Key])
+			}
+		}
+		if sent != bytes || sent == 0 {
+			t.Errorf("%v: expected %d bytes to be sent, plan says %d", name, sent, bytes)
+		}
+	}
+	verify("A", a, b, plan.ToA, plan.BytesToA)
+	verify("B", b, a, plan.ToB, plan.BytesToB)
+	if plan.BytesToB > int64(len(onlyA))+adler32.MAX_CHUNK || plan.BytesToA > int64(len(onlyB))+adler32.MAX_CHUNK {
+		t.Errorf("Expected only the distinct parts to be exchanged, got %d and %d bytes", plan.BytesToB, plan.BytesToA)
+	}
+}
+
+func TestLocalityOrder(t *testing.T) {
+	storeA, err := pack.NewPackStorage(t.TempDir(), 16*1024*1024)
+	check(t, "opening pack storage", err)
+	defer storeA.Close()
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := bytes.Buffer{}
+	nBlocks := 256
+	if skipLarge() {
+		nBlocks = 32
+	}
+	check(t, "creating similar data", createSimilarData(tempA, &tempB, 0.5, 0.5, 8192, nBlocks))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(64))
+
+	transmit := func(serveOpts ServeOptions, builderOpts BuilderOptions) ([]cafs.SKey, error) {
+		storeB := NewRamStorage(16 * 1024 * 1024)
+		defer reportUsage(t, "B", storeB)
+		tempFileB := storeB.Create("Data B")
+		_, _ = tempFileB.Write(tempB.Bytes())
+		check(t, "closing tempFileB", tempFileB.Close())
+		tempFileB.Dispose()
+
+		var hashes, wishlist, data bytes.Buffer
+		check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+		builder := NewBuilderWithOptions(storeB, perm, int(fileA.NumChunks())+len(perm), "Received", builderOpts)
+		defer builder.Dispose()
+		check(t, "writing wishlist", builder.WriteWishList(&hashes, flushWriter{&wishlist}))
+		check(t, "writing data", WriteChunkDataWithOptions(storeA, fileA, bufio.NewReader(bytes.NewReader(wishlist.Bytes())), perm, &data, nil, serveOpts))
+
+		// Record the order in which the chunks were sent
+		var keys []cafs.SKey
+		scratch := NewRamStorage(16 * 1024 * 1024)
+		r := bufio.NewReader(bytes.NewReader(data.Bytes()))
+		for {
+			chunk, err := readChunk(scratch, r, "Sent")
+			if err == io.EOF {
+				break
+			}
+			check(t, "reading chunk", err)
+			keys = append(keys, chunk.Key())
+			chunk.Dispose()
+		}
+
+		received, err := builder.ReconstructFileFromRequestedChunks(&data)
+		if err != nil {
+			return keys, err
+		}
+		defer received.Dispose()
+		assertEqual(t, fileA.Open(), received.Open())
+		return keys, nil
+	}
+
+	sorted := func(keys []cafs.SKey) bool {
+		localizer := storeA.(cafs.Localizer)
+		var last int64 = -1
+		for _, key := range keys {
+			locality, ok := localizer.Locality(&key)
+			if !ok {
+				t.Fatalf("Locality of %v unknown", key)
+			}
+			if locality < last {
+				return false
+			}
+			last = locality
+		}
+		return true
+	}
+
+	wishlistOrder, err := transmit(ServeOptions{}, BuilderOptions{})
+	check(t, "transmitting in wishlist order", err)
+	if len(wishlistOrder) < 10 || sorted(wishlistOrder) {
+		t.Fatalf("Expected %d chunks in wishlist order not to be sorted by locality", len(wishlistOrder))
+	}
+	localityOrder, err := transmit(ServeOptions{LocalityOrder: true}, BuilderOptions{AnyChunkOrder: true})
+	check(t, "transmitting in locality order", err)
+	if len(localityOrder) != len(wishlistOrder) || !sorted(localityOrder) {
+		t.Errorf("Expected %d chunks sorted by locality, got %d", len(wishlistOrder), len(localityOrder))
+	}
+	if _, err := transmit(ServeOptions{LocalityOrder: true}, BuilderOptions{}); err != ErrUnexpectedChunk {
+		t.Errorf("Expected ErrUnexpectedChunk from receiver expecting wishlist order, got %v", err)
+	}
+}
+
+func BenchmarkLocalityOrder(b *testing.B) {
+	store, err := pack.NewPackStorageWithOptions(b.TempDir(), 256*1024*1024, pack.PackOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+	temp := store.Create("Data")
+	defer temp.Dispose()
+	_, _ = temp.Write(randomBytes(64 * 1024 * 1024))
+	if err := temp.Close(); err != nil {
+		b.Fatal(err)
+	}
+	file := temp.File()
+	defer file.Dispose()
+	perm := shuffle.Permutation(rand.Perm(1024))
+
+	// A receiver with an empty storage requests every chunk
+	var hashes, wishlist bytes.Buffer
+	if err := WriteChunkHashes(file, perm, &hashes); err != nil {
+		b.Fatal(err)
+	}
+	builder := NewBuilder(NewRamStorage(1024*1024), perm, int(file.NumChunks())+len(perm), "Benchmark")
+	defer builder.Dispose()
+	if err := builder.WriteWishList(&hashes, flushWriter{&wishlist}); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, locality := range []bool{false, true} {
+		b.Run(fmt.Sprintf("locality-%v", locality), func(b *testing.B) {
+			b.SetBytes(file.Size())
+			for i := 0; i < b.N; i++ {
+				r := bufio.NewReader(bytes.NewReader(wishlist.Bytes()))
+				if err := WriteChunkDataWithOptions(store, file, r, perm, io.Discard, nil, ServeOptions{LocalityOrder: locality}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReconstructEphemeral(t *testing.T) {
+	storeA := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	storeB := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.5, 0.5, 8192, 256))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(32))
+
+	keysOf := func(s cafs.FileStorage) map[cafs.SKey]bool {
+		keys := make(map[cafs.SKey]bool)
+		s.(cafs.KeyEnumerator).EnumerateKeys(func(key cafs.SKey) bool {
+			keys[key] = true
+			return true
+		})
+		return keys
+	}
+	keysBefore, usageBefore := keysOf(storeB), storeB.GetUsageInfo()
+
+	var hashes, wishlist, data bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+	builder := NewBuilderWithOptions(storeB, perm, int(fileA.NumChunks())+len(perm), "Ephemeral", BuilderOptions{EphemeralBytes: 16 * 1024 * 1024})
+	check(t, "writing wishlist", builder.WriteWishList(&hashes, flushWriter{&wishlist}))
+	check(t, "writing data", WriteChunkData(storeA, fileA, bufio.NewReader(bytes.NewReader(wishlist.Bytes())), perm, &data, nil))
+	r, err := builder.ReconstructToReader(&data)
+	check(t, "reconstructing", err)
+	if stats := builder.Stats(); stats.BytesReceived >= fileA.Size() {
+		t.Errorf("Expected chunks of the storage to be used, received %d of %d bytes", stats.BytesReceived, fileA.Size())
+	}
+	builder.Dispose()
+
+	// The content remains readable after the builder has been disposed. Closing the reader
+	// disposes the file.
+	assertEqual(t, fileA.Open(), r)
+
+	keysAfter := keysOf(storeB)
+	if len(keysAfter) != len(keysBefore) {
+		t.Errorf("Storage holds %d keys after ephemeral reconstruction, expected %d", len(keysAfter), len(keysBefore))
+	}
+	for key := range keysAfter {
+		if !keysBefore[key] {
+			t.Errorf("Key %v added to storage", key)
+		}
+	}
+	if usage := storeB.GetUsageInfo(); usage.Used != usageBefore.Used {
+		t.Errorf("Storage usage changed from %v to %v", usageBefore, usage)
+	}
+	key := fileA.Key()
+	if _, err := storeB.Get(&key); err != cafs.ErrNotFound {
+		t.Errorf("Expected reconstructed file not to be in storage, got %v", err)
+	}
+}
+
+// Type lossyLink delivers datagrams written to one end at the other end, dropping those for which
+// `drop` returns true.
+type lossyLink struct {
+	in, out  chan []byte
+	drop     func(n int) bool
+	written  int
+	deadline time.Time
+}
+
+func newLossyLink(drop func(n int) bool) (*lossyLink, *lossyLink) {
+	a, b := make(chan []byte, 1<<16), make(chan []byte, 1<<16)
+	return &lossyLink{in: a, out: b, drop: drop}, &lossyLink{in: b, out: a, drop: drop}
+}
+
+func (l *lossyLink) Write(p []byte) (int, error) {
+	l.written++
+	if !l.drop(l.written) {
+		l.out <- bytes.Clone(p)
+	}
+	return len(p), nil
+}
+
+func (l *lossyLink) Read(p []byte) (int, error) {
+	select {
+	case b := <-l.in:
+		return copy(p, b), nil
+	case <-time.After(time.Until(l.deadline)):
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (l *lossyLink) SetReadDeadline(t time.Time) error {
+	l.deadline = t
+	return nil
+}
+
+func TestDatagrams(t *testing.T) {
+	storeA := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := bytes.Buffer{}
+	check(t, "creating similar data", createSimilarData(tempA, &tempB, 0.3, 0.3, 8192, 256))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(16))
+
+	lossy := rand.New(rand.NewSource(1))
+	for _, test := range []struct {
+		name    string
+		drop    func(n int) bool
+		missing func(missing, requested int) bool
+	}{
+		{"lossless", func(int) bool { return false }, func(m, r int) bool { return m == 0 }},
+		// Every group of 4 data packets and its parity packet loses at most one packet
+		{"recoverable", func(n int) bool { return n%5 == 2 }, func(m, r int) bool { return m == 0 }},
+		{"lossy", func(int) bool { return lossy.Intn(10) == 0 }, func(m, r int) bool { return m > 0 && m < r/2 }},
+		{"lost", func(int) bool { return true }, func(m, r int) bool { return m == r }},
+	} {
+		storeB := NewRamStorage(16 * 1024 * 1024)
+		tempFileB := storeB.Create("Data B")
+		_, _ = tempFileB.Write(tempB.Bytes())
+		check(t, "closing tempFileB", tempFileB.Close())
+		tempFileB.Dispose()
+
+		// Announcement and wishlist are transmitted reliably
+		var hashes, wishlist, missingList, data bytes.Buffer
+		check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+		builder := NewBuilder(storeB, perm, int(fileA.NumChunks())+len(perm), "Received")
+		check(t, "writing wishlist", builder.WriteWishList(&hashes, flushWriter{&wishlist}))
+		sender, err := NewDatagramSender(storeA, fileA, bufio.NewReader(&wishlist), perm, ServeOptions{})
+		check(t, "creating sender", err)
+
+		// The chunk data is sent as datagrams, with the chunks not recovered sent reliably
+		connA, connB := newLossyLink(test.drop)
+		opts := DatagramOptions{PacketSize: 1000, GroupSize: 4, IdleTimeout: 100 * time.Millisecond}
+		check(t, "sending datagrams", sender.Send(connA, opts))
+		received, err := builder.ReceiveDatagrams(connB, opts)
+		check(t, "receiving datagrams", err)
+		check(t, "writing missing list", builder.WriteMissingList(flushWriter{&missingList}))
+		check(t, "serving missing chunks", sender.ServeMissingChunks(bufio.NewReader(&missingList), &data))
+		requested := len(sender.keys)
+		if missing := requested - received; requested < 10 || !test.missing(missing, requested) {
+			t.Errorf("%v: unexpectedly %d of %d requested chunks missing", test.name, missing, requested)
+		}
+
+		file, err := builder.ReconstructFileFromRequestedChunks(&data)
+		check(t, "reconstructing", err)
+		assertEqual(t, fileA.Open(), file.Open())
+		if stats := builder.Stats(); stats.ChunksReceived != requested {
+			t.Errorf("%v: received %d of %d chunks requested", test.name, stats.ChunksReceived, requested)
+		}
+		file.Dispose()
+		builder.Dispose()
+		reportUsage(t, "B", storeB)
+	}
+}
+
+func TestSpoofedDatagrams(t *testing.T) {
+	storeA := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := bytes.Buffer{}
+	check(t, "creating similar data", createSimilarData(tempA, &tempB, 0.3, 0.3, 8192, 64))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(16))
+	salt, err := NewSalt()
+	check(t, "creating salt", err)
+
+	storeB := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	tempFileB := storeB.Create("Data B")
+	_, _ = tempFileB.Write(tempB.Bytes())
+	check(t, "closing tempFileB", tempFileB.Close())
+	tempFileB.Dispose()
+
+	var hashes, wishlist, missingList, data bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashesWithOptions(fileA, perm, &hashes, AnnounceOptions{Salt: salt}))
+	builder := NewBuilderWithOptions(storeB, perm, int(fileA.NumChunks())+len(perm), "Received", BuilderOptions{Salt: salt})
+	defer builder.Dispose()
+	check(t, "writing wishlist", builder.WriteWishList(&hashes, flushWriter{&wishlist}))
+	sender, err := NewDatagramSender(storeA, fileA, bufio.NewReader(&wishlist), perm, ServeOptions{})
+	check(t, "creating sender", err)
+	requested := len(sender.keys)
+
+	// Before the actual data, forged chunks and packets of chunks with tiny shards arrive
+	connA, connB := newLossyLink(func(int) bool { return false })
+	opts := DatagramOptions{PacketSize: 1000, GroupSize: 4, IdleTimeout: 100 * time.Millisecond, MaxPartial: 4}
+	forged := bytes.Repeat([]byte{0x55}, 1000)
+	var buf []byte
+	for seq := 0; seq < requested; seq++ {
+		for _, p := range []packet{
+			{typ: packetData, seq: seq, length: 1000, size: 1000, group: 4, payload: forged},
+			{typ: packetData, seq: seq, length: 1 << 20, size: 1, group: 1, payload: forged[:1]},
+			{typ: packetData, seq: seq + requested, length: 1 << 20, size: 1000, group: 4, payload: forged},
+		} {
+			buf = p.encode(buf)
+			_, _ = connA.Write(buf)
+		}
+	}
+	check(t, "sending datagrams", sender.Send(connA, opts))
+	received, err := builder.ReceiveDatagrams(connB, opts)
+	check(t, "receiving datagrams", err)
+	if received != requested {
+		t.Errorf("Received %d of %d requested chunks", received, requested)
+	}
+	key := cafs.SKey(sha256.Sum256(forged))
+	if _, err := storeB.Get(&key); err != cafs.ErrNotFound {
+		t.Errorf("Expected forged chunk not to be stored, got %v", err)
+	}
+
+	check(t, "writing missing list", builder.WriteMissingList(flushWriter{&missingList}))
+	check(t, "serving missing chunks", sender.ServeMissingChunks(bufio.NewReader(&missingList), &data))
+	file, err := builder.ReconstructFileFromRequestedChunks(&data)
+	check(t, "reconstructing", err)
+	defer file.Dispose()
+	assertEqual(t, fileA.Open(), file.Open())
+}
+
+func TestAnnouncementPadding(t *testing.T) {
+	storeA := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	perm := shuffle.Permutation(rand.Perm(10))
+	const padding = 100
+
+	// Counts the entries of an announcement and the decoys among them
+	countEntries := func(announcement []byte) (entries, decoys int) {
+		r := bufio.NewReader(bytes.NewReader(announcement))
+		for {
+			var key cafs.SKey
+			if _, err := io.ReadFull(r, key[:]); err == io.EOF {
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readChunkLength(r); err != nil {
+				t.Fatal(err)
+			}
+			entries++
+			if key == emptyKey {
+				decoys++
+			}
+		}
+	}
+
+	for _, size := range []int{37, 52} {
+		tempA := storeA.Create("Data A")
+		tempB := bytes.Buffer{}
+		check(t, "creating similar data", createSimilarData(tempA, &tempB, 0.5, 0.3, 8192, size))
+		check(t, "closing tempA", tempA.Close())
+		fileA := tempA.File()
+		tempA.Dispose()
+
+		var plain, padded bytes.Buffer
+		check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &plain))
+		check(t, "writing chunk hashes", WriteChunkHashesWithOptions(fileA, perm, &padded, AnnounceOptions{Padding: padding}))
+		if entries, _ := countEntries(plain.Bytes()); entries == padding {
+			t.Fatalf("Unpadded announcement of %d chunks already has %d entries", fileA.NumChunks(), entries)
+		}
+		if entries, decoys := countEntries(padded.Bytes()); entries != padding || decoys < padding-int(fileA.NumChunks()) {
+			t.Errorf("Expected %d chunks to be padded to %d entries, got %d with %d decoys", fileA.NumChunks(), padding, entries, decoys)
+		}
+
+		// The receiver ignores decoys, which need room in its window
+		storeB := NewRamStorage(16 * 1024 * 1024)
+		tempFileB := storeB.Create("Data B")
+		_, _ = tempFileB.Write(tempB.Bytes())
+		check(t, "closing tempFileB", tempFileB.Close())
+		tempFileB.Dispose()
+		var wishlist, data bytes.Buffer
+		builder := NewBuilder(storeB, perm, padding+len(perm), "Received")
+		check(t, "writing wishlist", builder.WriteWishList(&padded, flushWriter{&wishlist}))
+		check(t, "writing data", WriteChunkDataWithOptions(storeA, fileA, bufio.NewReader(&wishlist), perm, &data, nil, ServeOptions{Padding: padding}))
+		received, err := builder.ReconstructFileFromRequestedChunks(&data)
+		check(t, "reconstructing", err)
+		assertEqual(t, fileA.Open(), received.Open())
+		if stats := builder.Stats(); stats.Chunks != int(fileA.NumChunks()) {
+			t.Errorf("Expected %d chunks to be counted, got %d", fileA.NumChunks(), stats.Chunks)
+		}
+		received.Dispose()
+		builder.Dispose()
+		reportUsage(t, "B", storeB)
+		fileA.Dispose()
+	}
+}
+
+// Type slowCommitStorage commits chunks slowly and records the bytes committed.
+type slowCommitStorage struct {
+	cafs.FileStorage
+	delay     time.Duration
+	committed *atomic.Int64
+	onCommit  func()
+}
+
+func (s slowCommitStorage) Create(info string) cafs.Temporary {
+	return &slowCommitTemporary{Temporary: s.FileStorage.Create(info), storage: s}
+}
+
+type slowCommitTemporary struct {
+	cafs.Temporary
+	storage slowCommitStorage
+	written int64
+}
+
+func (t *slowCommitTemporary) Write(b []byte) (int, error) {
+	n, err := t.Temporary.Write(b)
+	t.written += int64(n)
+	return n, err
+}
+
+func (t *slowCommitTemporary) Close() error {
+	time.Sleep(t.storage.delay)
+	t.storage.committed.Add(t.written)
+	t.storage.onCommit()
+	return t.Temporary.Close()
+}
+
+// Type readCounter counts the bytes read from a reader.
+type readCounter struct {
+	r    io.Reader
+	read *atomic.Int64
+}
+
+func (c readCounter) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestCommitQueue(t *testing.T) {
+	storeA := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	_, _ = tempA.Write(randomBytes(4 * 1024 * 1024))
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(8))
+
+	const queue = 4
+	storeB := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	var read, committed, maxAhead atomic.Int64
+	slow := slowCommitStorage{storeB, time.Millisecond, &committed, func() {
+		if ahead := read.Load() - committed.Load(); ahead > maxAhead.Load() {
+			maxAhead.Store(ahead)
+		}
+	}}
+
+	var hashes, wishlist, data bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+	builder := NewBuilderWithOptions(slow, perm, int(fileA.NumChunks())+len(perm), "Received", BuilderOptions{CommitQueue: queue})
+	defer builder.Dispose()
+	check(t, "writing wishlist", builder.WriteWishList(&hashes, flushWriter{&wishlist}))
+	check(t, "writing data", WriteChunkData(storeA, fileA, bufio.NewReader(&wishlist), perm, &data, nil))
+	total := int64(data.Len())
+	received, err := builder.ReconstructFileFromRequestedChunks(readCounter{&data, &read})
+	check(t, "reconstructing", err)
+	defer received.Dispose()
+	assertEqual(t, fileA.Open(), received.Open())
+
+	// Reading the stream may lead committing by the queued chunks, the chunk being read and its
+	// buffer, but not much further
+	bound := int64(queue+2)*int64(adler32.MAX_CHUNK) + 4096
+	if maxAhead.Load() > bound || total < 2*bound {
+		t.Errorf("Reading led committing by %d bytes of %d, expected at most %d", maxAhead.Load(), total, bound)
+	}
+	if maxAhead.Load() < int64(queue)*int64(fileA.Size()/fileA.NumChunks())/2 {
+		t.Errorf("Reading led committing by only %d bytes, expected chunks to be queued", maxAhead.Load())
+	}
+}
+
+func TestMergeStores(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	store := func(s cafs.FileStorage, data []byte) cafs.File {
+		temp := s.Create("merge test")
+		defer temp.Dispose()
+		_, _ = temp.Write(data)
+		check(t, "closing temp", temp.Close())
+		return temp.File()
+	}
+	shared, ours, theirs, added := randomBytes(300*1024), randomBytes(200*1024), randomBytes(100), randomBytes(0)
+
+	for _, policy := range []MergePolicy{MergeSkip, MergeOverwrite, MergeRename} {
+		func() {
+			src := cafs.NewNamespace(storeA, cafs.NamespaceOptions{})
+			dst := cafs.NewNamespace(storeB, cafs.NamespaceOptions{Policy: cafs.NameFail})
+			defer src.Clear()
+			defer dst.Clear()
+			bind := func(ns *cafs.Namespace, name string, data []byte) {
+				f := store(ns.Storage(), data)
+				defer f.Dispose()
+				check(t, "binding "+name, ns.SetName(name, f))
+			}
+			bind(src, "shared", shared)
+			bind(dst, "shared", shared)
+			bind(src, "conflict", theirs)
+			check(t, "setting attribute", src.SetAttr("conflict", "origin", "src"))
+			bind(dst, "conflict", ours)
+			bind(dst, "conflict.1", ours)
+			bind(src, "added", added)
+
+			stats, err := MergeStores(src, dst, policy)
+			check(t, "merging", err)
+			if stats.Names != 3 || stats.Unchanged != 1 || len(stats.Conflicts) != 1 {
+				t.Fatalf("Policy %v: unexpected stats %+v", policy, stats)
+			}
+			conflict := stats.Conflicts[0]
+			if conflict.Name != "conflict" || conflict.Incoming == conflict.Existing {
+				t.Errorf("Policy %v: unexpected conflict %+v", policy, conflict)
+			}
+
+			expected := map[string][]byte{"shared": shared, "conflict": ours, "conflict.1": ours, "added": added}
+			merged, boundAs := 2, ""
+			switch policy {
+			case MergeSkip:
+				merged = 1
+			case MergeOverwrite:
+				expected["conflict"], boundAs = theirs, "conflict"
+			case MergeRename:
+				expected["conflict.2"], boundAs = theirs, "conflict.2"
+			}
+			if stats.Merged != merged || conflict.BoundAs != boundAs {
+				t.Errorf("Policy %v: expected %d merged names bound as %q, got %+v", policy, merged, boundAs, stats)
+			}
+			if names := dst.Names(); len(names) != len(expected) {
+				t.Errorf("Policy %v: unexpected names %v", policy, names)
+			}
+			for name, data := range expected {
+				f, err := dst.Get(name)
+				if err != nil {
+					t.Errorf("Policy %v: getting %v: %v", policy, name, err)
+					continue
+				}
+				r := f.Open()
+				content, err := io.ReadAll(r)
+				r.Close()
+				f.Dispose()
+				check(t, "reading "+name, err)
+				if !bytes.Equal(content, data) {
+					t.Errorf("Policy %v: %v has unexpected content", policy, name)
+				}
+			}
+			if boundAs != "" {
+				if origin, err := dst.GetAttr(boundAs, "origin"); err != nil || origin != "src" {
+					t.Errorf("Policy %v: attribute not merged: %q, %v", policy, origin, err)
+				}
+			}
+		}()
+	}
+}
+
+func TestCompareAnnouncement(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	store := func(s cafs.FileStorage, data []byte) cafs.File {
+		temp := s.Create("compare test")
+		defer temp.Dispose()
+		_, _ = temp.Write(data)
+		check(t, "closing temp", temp.Close())
+		return temp.File()
+	}
+	data := randomBytes(1024 * 1024)
+	changed := bytes.Clone(data)
+	const changedAt = 500 * 1024
+	copy(changed[changedAt:], "changed")
+
+	local := store(storeA, data)
+	defer local.Dispose()
+	matching := store(storeB, data)
+	defer matching.Dispose()
+	differing := store(storeB, changed)
+	defer differing.Dispose()
+	usedBefore := storeA.GetUsageInfo().Used
+
+	perm := shuffle.Permutation(rand.Perm(10))
+	for _, remote := range []cafs.File{matching, differing} {
+		ann, err := NewAnnouncement(remote, perm)
+		check(t, "announcing", err)
+		cmp, err := CompareAnnouncement(local, perm, ann.Reader())
+		check(t, "comparing", err)
+		if remote == matching {
+			if !cmp.Identical || len(cmp.Missing) != 0 || len(cmp.Extra) != 0 {
+				t.Errorf("Expected identical files, got %+v", cmp)
+			}
+			continue
+		}
+		if cmp.Identical || len(cmp.Missing) == 0 || len(cmp.Extra) == 0 {
+			t.Fatalf("Expected differing files, got %+v", cmp)
+		}
+		// Only the chunks around the change differ
+		covered := false
+		for _, c := range cmp.Missing {
+			covered = covered || c.Offset <= changedAt && c.Offset+c.Size > changedAt
+		}
+		if !covered || len(cmp.Missing) > 3 {
+			t.Errorf("Expected few missing chunks covering offset %d, got %+v", changedAt, cmp.Missing)
+		}
+	}
+	if used := storeA.GetUsageInfo().Used; used != usedBefore {
+		t.Errorf("Comparing changed local storage usage from %d to %d", usedBefore, used)
+	}
+}
+
+// Type mapProvider is a ChunkProvider serving chunks from a map, counting the requests.
+type mapProvider struct {
+	chunks   map[cafs.SKey][]byte
+	requests map[cafs.SKey]int
+}
+
+func (p mapProvider) GetChunk(key cafs.SKey) (io.ReadCloser, error) {
+	p.requests[key]++
+	data, ok := p.chunks[key]
+	if !ok {
+		return nil, cafs.ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestChunkProvider(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.5, 0.3, 8192, 64))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+
+	// The provider only knows the chunks, not the storage holding them
+	provider := mapProvider{make(map[cafs.SKey][]byte), make(map[cafs.SKey]int)}
+	for _, c := range ListChunks(fileA) {
+		chunk, err := storeA.Get(&c.Key)
+		check(t, "getting chunk", err)
+		r := chunk.Open()
+		data, err := io.ReadAll(r)
+		r.Close()
+		chunk.Dispose()
+		check(t, "reading chunk", err)
+		provider.chunks[c.Key] = data
+	}
+
+	perm := shuffle.Permutation(rand.Perm(10))
+	var hashes, wishlist bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+	builder := NewBuilder(storeB, perm, int(fileA.NumChunks())+len(perm), "Received")
+	defer builder.Dispose()
+	check(t, "writing wishlist", builder.WriteWishList(&hashes, flushWriter{&wishlist}))
+	requested := len(builder.requestedOrder)
+	if requested == 0 || int64(requested) == fileA.NumChunks() {
+		t.Fatalf("Expected some chunks to be requested, got %d of %d", requested, fileA.NumChunks())
+	}
+
+	// A chunk the provider doesn't have fails the reconstruction, which can be resumed
+	withheld := builder.requestedOrder[requested/2]
+	data := provider.chunks[withheld]
+	delete(provider.chunks, withheld)
+	if _, err := builder.ReconstructFromProvider(provider); !errors.Is(err, cafs.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	provider.chunks[withheld] = data
+	file, err := builder.ReconstructFromProvider(provider)
+	check(t, "reconstructing", err)
+	defer file.Dispose()
+	assertEqual(t, fileA.Open(), file.Open())
+
+	// Every requested chunk has been obtained once, except for the one withheld at first
+	for _, key := range builder.requestedOrder {
+		if n := provider.requests[key]; n != 1 && !(key == withheld && n == 2) {
+			t.Errorf("Chunk %v requested %d times", key, n)
+		}
+	}
+	if len(provider.requests) != requested {
+		t.Errorf("Expected %d chunks to be requested from the provider, got %d", requested, len(provider.requests))
+	}
+
+	// Chunks can be provided by a storage as well
+	storeC := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "C", storeC)
+	hashes.Reset()
+	check(t, "writing chunk hashes", WriteChunkHashes(fileA, perm, &hashes))
+	builderC := NewBuilder(storeC, perm, int(fileA.NumChunks())+len(perm), "Received")
+	defer builderC.Dispose()
+	check(t, "writing wishlist", builderC.WriteWishList(&hashes, flushWriter{&bytes.Buffer{}}))
+	fileC, err := builderC.ReconstructFromProvider(NewStorageProvider(storeA))
+	check(t, "reconstructing from storage", err)
+	defer fileC.Dispose()
+	assertEqual(t, fileA.Open(), fileC.Open())
+}
+
+func TestPullDedupRatio(t *testing.T) {
+	for _, test := range []struct {
+		p        float64
+		min, max float64
+	}{{0, 0, 0.05}, {0.5, 0.1, 0.5}, {0.9, 0.6, 0.9}, {1, 1, 1}} {
+		storeA := NewRamStorage(16 * 1024 * 1024)
+		storeB := NewRamStorage(16 * 1024 * 1024)
+		tempA := storeA.Create("Data A")
+		tempB := storeB.Create("Data B")
+		check(t, "creating similar data", createSimilarData(tempA, tempB, test.p, 0.3, 8192, 256))
+		check(t, "closing tempA", tempA.Close())
+		check(t, "closing tempB", tempB.Close())
+		fileA := tempA.File()
+		tempA.Dispose()
+
+		connA, connB := net.Pipe()
+		served := make(chan error, 1)
+		go func() {
+			defer connA.Close()
+			served <- ServePull(storeA, connA, shuffle.Permutation(rand.Perm(7)), PushOptions{})
+		}()
+		p := RunPull(storeB, connB, fileA.Key(), "Pulled", BuilderOptions{})
+		for range p.Events {
+		}
+		file, err := p.Wait()
+		check(t, "pulling", err)
+		check(t, "serving", <-served)
+		connB.Close()
+
+		stats := p.Stats()
+		if stats.Bytes != fileA.Size() {
+			t.Errorf("p=%v: expected %d bytes announced, got %d", test.p, fileA.Size(), stats.Bytes)
+		}
+		t.Logf("p=%v: dedup ratio %.3f", test.p, stats.DedupRatio())
+		if r := stats.DedupRatio(); r < test.min || r > test.max {
+			t.Errorf("p=%v: dedup ratio %v not in [%v, %v]", test.p, r, test.min, test.max)
+		}
+		file.Dispose()
+		fileA.Dispose()
+		tempB.Dispose()
+		reportUsage(t, "A", storeA)
+		reportUsage(t, "B", storeB)
+	}
+}
+
+func TestBroadcastChunkHashes(t *testing.T) {
+	store := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "A", store)
+	temp := store.Create("Data")
+	defer temp.Dispose()
+	_, err := temp.Write(randomBytes(1024 * 1024))
+	check(t, "writing data", err)
+	check(t, "closing temp", temp.Close())
+	file := temp.File()
+	defer file.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(10))
+	opts := AnnounceOptions{Salt: []byte("salt"), Digest: true}
+	var direct bytes.Buffer
+	check(t, "writing chunk hashes", WriteChunkHashesWithOptions(file, perm, &direct, opts))
+
+	// Besides buffers, there are pipes read at different paces and a receiver hanging up early
+	buffers := make([]bytes.Buffer, 3)
+	readers := make([]*io.PipeReader, 2)
+	received := make([][]byte, len(readers))
+	var writers []io.Writer
+	for i := range buffers {
+		writers = append(writers, &buffers[i])
+	}
+	var wg sync.WaitGroup
+	for i := range readers {
+		r, w := io.Pipe()
+		readers[i] = r
+		writers = append(writers, w)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := make([]byte, 100*(i+1))
+			for {
+				n, err := r.Read(buf)
+				received[i] = append(received[i], buf[:n]...)
+				if err != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	hangup, hangupWriter := io.Pipe()
+	hangup.Close()
+	writers = append(writers, hangupWriter)
+
+	errs := BroadcastChunkHashes(file, perm, writers, opts)
+	for _, w := range writers[len(buffers) : len(buffers)+len(readers)] {
+		w.(*io.PipeWriter).Close()
+	}
+	wg.Wait()
+
+	for i, err := range errs[:len(errs)-1] {
+		check(t, fmt.Sprintf("broadcasting to writer #%d", i), err)
+	}
+	if err := errs[len(errs)-1]; err != ErrPeerClosed {
+		t.Errorf("Expected ErrPeerClosed for the hung up receiver, got %v", err)
+	}
+	for i := range buffers {
+		if !bytes.Equal(buffers[i].Bytes(), direct.Bytes()) {
+			t.Errorf("Buffer #%d received %d bytes differing from the direct announcement of %d bytes", i, buffers[i].Len(), direct.Len())
+		}
+	}
+	for i := range received {
+		if !bytes.Equal(received[i], direct.Bytes()) {
+			t.Errorf("Pipe #%d received %d bytes differing from the direct announcement of %d bytes", i, len(received[i]), direct.Len())
+		}
+	}
+}
+
+// Type gatedWriter reports its first write and then blocks until its gate is closed.
+type gatedWriter struct {
+	id      int
+	started chan<- int
+	gate    chan struct{}
+	once    sync.Once
+}
+
+func (w *gatedWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() {
+		w.started <- w.id
+		<-w.gate
+	})
+	return len(b), nil
+}
+
+func TestServerPool(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	temp := storeA.Create("Data")
+	defer temp.Dispose()
+	_, err := temp.Write(randomBytes(256 * 1024))
+	check(t, "writing data", err)
+	check(t, "closing temp", temp.Close())
+	file := temp.File()
+	defer file.Dispose()
+
+	// Without shuffling, there are no placeholders, and all chunks are requested
+	perm := shuffle.Permutation{0}
+	wishlist := bytes.Repeat([]byte{0xff}, int(file.NumChunks()+7)/8)
+
+	const poolSize, numServes = 2, 5
+	server := NewServer(storeA, poolSize)
+	started := make(chan int, numServes)
+	done := make(chan error, numServes)
+	writers := make([]*gatedWriter, numServes)
+	for i := range writers {
+		writers[i] = &gatedWriter{id: i, started: started, gate: make(chan struct{})}
+		go func(w *gatedWriter) {
+			r := bufio.NewReader(bytes.NewReader(wishlist))
+			done <- server.WriteChunkData(file, r, perm, w, nil, ServeOptions{})
+		}(writers[i])
+	}
+
+	// Expect the given number of transmissions to start, and no more
+	expectStarts := func(n int) []int {
+		var ids []int
+		for len(ids) < n {
+			select {
+			case id := <-started:
+				ids = append(ids, id)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Only %d of %d transmissions started", len(ids), n)
+			}
+		}
+		select {
+		case id := <-started:
+			t.Fatalf("Transmission #%d started while %d were in progress", id, server.Active())
+		case <-time.After(50 * time.Millisecond):
+		}
+		if server.Active() != poolSize {
+			t.Errorf("Expected %d active transmissions, got %d", poolSize, server.Active())
+		}
+		return ids
+	}
+
+	running := expectStarts(poolSize)
+	for remaining := numServes - poolSize; remaining > 0; remaining-- {
+		close(writers[running[0]].gate)
+		check(t, "serving", <-done)
+		running = append(running[1:], expectStarts(1)...)
+	}
+	for _, id := range running {
+		close(writers[id].gate)
+		check(t, "serving", <-done)
+	}
+	if server.Active() != 0 {
+		t.Errorf("Expected no active transmissions, got %d", server.Active())
+	}
+}
+
+func TestPullIfMissing(t *testing.T) {
+	storeA := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	storeB := NewRamStorage(16 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	_, err := tempA.Write(randomBytes(512 * 1024))
+	check(t, "writing data", err)
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+
+	if _, err := LocalFile(storeB, fileA.Key()); err != cafs.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound before pulling, got %v", err)
+	}
+
+	pull := func() (cafs.File, TransferStats, *countingConn) {
+		connA, connB := net.Pipe()
+		served := make(chan struct{})
+		go func() {
+			defer close(served)
+			defer connA.Close()
+			ServePull(storeA, connA, shuffle.Permutation(rand.Perm(7)), PushOptions{})
+		}()
+		// Closing the connection ends ServePull if it didn't receive a request
+		defer func() { <-served }()
+		defer connB.Close()
+		conn := &countingConn{Conn: connB}
+		p := PullIfMissing(storeB, conn, fileA.Key(), "Pulled", BuilderOptions{})
+		for range p.Events {
+		}
+		file, err := p.Wait()
+		check(t, "pulling", err)
+		return file, p.Stats(), conn
+	}
+
+	first, stats, conn := pull()
+	defer first.Dispose()
+	if stats.BytesReceived != fileA.Size() || conn.read <= fileA.Size() {
+		t.Errorf("First pull received %d of %d bytes, read %d bytes", stats.BytesReceived, fileA.Size(), conn.read)
+	}
+
+	second, stats, conn := pull()
+	defer second.Dispose()
+	if second.Key() != fileA.Key() {
+		t.Errorf("Second pull returned %v, expected %v", second.Key(), fileA.Key())
+	}
+	if stats != (TransferStats{}) || conn.read != 0 || conn.written != 0 {
+		t.Errorf("Second pull transferred data: %+v, read %d bytes, wrote %d bytes", stats, conn.read, conn.written)
+	}
+}
@@ -0,0 +1,137 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"io"
+	"sort"
+)
+
+// Type ReplicateOptions contains optional settings for Replicate.
+// The zero value selects the default behavior.
+type ReplicateOptions struct {
+	// If set, keys up to and including this one are skipped, resuming a replication that was
+	// interrupted after reporting it as checkpoint.
+	ResumeAfter *cafs.SKey
+
+	// If set, called after each key has been processed. All keys up to and including the key
+	// passed are then present in the destination, so the key can be saved as a checkpoint
+	// and passed as ResumeAfter later on.
+	Checkpoint func(key cafs.SKey)
+
+	// If set, the replication is aborted with the context's error when the context is done.
+	Context context.Context
+}
+
+// Type ReplicateStats reports what Replicate has done.
+type ReplicateStats struct {
+	Keys   int   // Number of keys processed, excluding those skipped due to ResumeAfter
+	Copied int   // Number of keys copied because they were missing from the destination
+	Bytes  int64 // Number of bytes written into the destination
+}
+
+// Function Replicate copies every file and chunk held by storage `src`, which must implement
+// cafs.KeyEnumerator, into `dst`, unless `dst` already holds it. Keys are processed in ascending
+// byte order, which is stable across runs, so that an interrupted replication can be resumed from
+// a checkpoint (see ReplicateOptions). Keys evicted from `src` while replicating are skipped.
+//
+// Copies are not retained in `dst`: like any other unreferenced data, they may be evicted again
+// if `dst` runs out of space.
+func Replicate(src, dst cafs.FileStorage, opts ReplicateOptions) (ReplicateStats, error) {
+	var stats ReplicateStats
+	enumerator, ok := src.(cafs.KeyEnumerator)
+	if !ok {
+		return stats, ErrCannotEnumerate
+	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var keys []cafs.SKey
+	enumerator.EnumerateKeys(func(key cafs.SKey) bool {
+		if opts.ResumeAfter == nil || bytes.Compare(key[:], opts.ResumeAfter[:]) > 0 {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		copied, n, err := replicateKey(src, dst, key)
+		if err != nil {
+			return stats, fmt.Errorf("Replicating %v: %w", key, err)
+		}
+		stats.Keys++
+		if copied {
+			stats.Copied++
+			stats.Bytes += n
+		}
+		if opts.Checkpoint != nil {
+			opts.Checkpoint(key)
+		}
+	}
+	return stats, nil
+}
+
+// Copies the file or chunk stored as `key` from `src` to `dst` if `dst` doesn't hold it yet.
+// Returns whether it has been copied and the number of bytes copied.
+func replicateKey(src, dst cafs.FileStorage, key cafs.SKey) (bool, int64, error) {
+	if _, err := dst.StatByKey(&key); err == nil {
+		return false, 0, nil
+	} else if err != cafs.ErrNotFound {
+		return false, 0, err
+	}
+	file, err := src.Get(&key)
+	if err == cafs.ErrNotFound {
+		return false, 0, nil
+	} else if err != nil {
+		return false, 0, err
+	}
+	defer file.Dispose()
+
+	// Unchunked files and chunks must not be split into chunks by the destination
+	var createOpts cafs.CreateOptions
+	if !file.IsChunked() {
+		createOpts.InlineThreshold = max(file.Size(), 1)
+	}
+	temp := dst.CreateWithOptions(fmt.Sprintf("Replica of %v", key), createOpts)
+	defer temp.Dispose()
+	r := file.Open()
+	defer r.Close()
+	n, err := io.Copy(temp, r)
+	if err != nil {
+		return false, 0, err
+	}
+	if err := temp.Close(); err != nil {
+		return false, 0, err
+	}
+	copied := temp.File()
+	defer copied.Dispose()
+	if copied.Key() != key {
+		return false, 0, cafs.ErrKeyMismatch
+	}
+	return true, n, nil
+}
@@ -0,0 +1,269 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The run-length encoded wishlist format (see BuilderOptions.RunLengthWishList) consists of a
+// sequence of tokens, each starting with a uvarint header. The lowest two bits of the header
+// denote the token type, the remaining bits the number of wishlist bits n > 0 it covers:
+//   - rleZeros: n consecutive zero bits (chunks not requested)
+//   - rleOnes: n consecutive one bits (chunks requested)
+//   - rleLiteral: n bits, packed in ceil(n/8) following bytes as in the raw format
+//
+// Short runs are collected into literals, so that wishlists without any long runs don't grow
+// much compared to the raw format.
+const (
+	rleZeros   = 0
+	rleOnes    = 1
+	rleLiteral = 2
+)
+
+const (
+	// Runs shorter than this are encoded as literals
+	rleMinRun = 16
+	// Literals and runs of ones are emitted after at most this many bits, so that the sender
+	// can start transmitting requested chunks early once the receiver syncs. Runs of zeros
+	// are unbounded.
+	rleMaxPending = 256
+)
+
+var errInvalidRLE = errors.New("Invalid run-length encoded wishlist")
+
+// Type wishListWriter is implemented by the encoders of the wishlist formats.
+type wishListWriter interface {
+	WriteBit(b bool) error
+	Flush() error
+	// Called before the receiver blocks. Writes out pending requests, if any, so that the
+	// sender can make progress.
+	sync() error
+}
+
+// Type wishListReader is implemented by the decoders of the wishlist formats.
+type wishListReader interface {
+	ReadBit() (bool, error)
+	// Returns an error if the wishlist contains more bits than have been read.
+	expectEnd() error
+}
+
+// Type wishListFormat selects one of the wishlist formats.
+type wishListFormat int
+
+const (
+	formatBitmap wishListFormat = iota
+	formatRunLength
+	formatIndex
+)
+
+// Returns the format selected by the RunLengthWishList and IndexWishList options.
+func wishListFormatOf(rle, index bool) wishListFormat {
+	if index {
+		return formatIndex
+	} else if rle {
+		return formatRunLength
+	}
+	return formatBitmap
+}
+
+func newWishListWriter(w FlushWriter, format wishListFormat) wishListWriter {
+	switch format {
+	case formatRunLength:
+		return &rleWriter{w: w}
+	case formatIndex:
+		return &indexWriter{w: w}
+	}
+	return newBitWriter(w)
+}
+
+func newWishListReader(r io.ByteReader, format wishListFormat) wishListReader {
+	switch format {
+	case formatRunLength:
+		return &rleReader{r: r}
+	case formatIndex:
+		return &indexReader{r: r}
+	}
+	return newBitReader(r)
+}
+
+type rleWriter struct {
+	w       FlushWriter
+	bit     bool   // Value of the current run
+	run     int    // Length of the current run
+	literal []bool // Bits collected for the next literal
+	ones    bool   // Whether literal contains any one bits
+	dirty   bool   // Whether tokens have been written since the last flush
+	buf     []byte
+}
+
+func (w *rleWriter) WriteBit(b bool) error {
+	if w.run > 0 && b != w.bit {
+		if err := w.endRun(); err != nil {
+			return err
+		}
+	}
+	w.bit = b
+	w.run++
+	if b && w.run == rleMaxPending {
+		return w.endRun()
+	}
+	return nil
+}
+
+// Emits the current run, either as a run token or as part of a literal.
+func (w *rleWriter) endRun() error {
+	if w.run == 0 {
+		return nil
+	}
+	defer func() { w.run = 0 }()
+	if w.run < rleMinRun {
+		for i := 0; i < w.run; i++ {
+			w.literal = append(w.literal, w.bit)
+		}
+		w.ones = w.ones || w.bit
+		if len(w.literal) >= rleMaxPending {
+			return w.emitLiteral()
+		}
+		return nil
+	}
+	if err := w.emitLiteral(); err != nil {
+		return err
+	}
+	typ := rleZeros
+	if w.bit {
+		typ = rleOnes
+	}
+	w.buf = appendUvarint(w.buf[:0], uint64(w.run)<<2|uint64(typ))
+	return w.write()
+}
+
+func (w *rleWriter) emitLiteral() error {
+	if len(w.literal) == 0 {
+		return nil
+	}
+	w.buf = appendUvarint(w.buf[:0], uint64(len(w.literal))<<2|rleLiteral)
+	var b byte
+	for i, bit := range w.literal {
+		b <<= 1
+		if bit {
+			b |= 1
+		}
+		if i%8 == 7 {
+			w.buf = append(w.buf, b)
+			b = 0
+		}
+	}
+	if n := len(w.literal) % 8; n != 0 {
+		w.buf = append(w.buf, b<<(8-n))
+	}
+	w.literal, w.ones = w.literal[:0], false
+	return w.write()
+}
+
+// Writes a token. Tokens are flushed to the sender only by sync() and Flush().
+func (w *rleWriter) write() error {
+	if _, err := w.w.Write(w.buf); err != nil {
+		return err
+	}
+	w.dirty = true
+	return nil
+}
+
+func (w *rleWriter) sync() error {
+	if w.ones || (w.run > 0 && w.bit) {
+		return w.Flush()
+	}
+	w.flush()
+	return nil
+}
+
+func (w *rleWriter) Flush() error {
+	if err := w.endRun(); err != nil {
+		return err
+	}
+	if err := w.emitLiteral(); err != nil {
+		return err
+	}
+	w.flush()
+	return nil
+}
+
+func (w *rleWriter) flush() {
+	if w.dirty {
+		w.w.Flush()
+		w.dirty = false
+	}
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+type rleReader struct {
+	r   io.ByteReader
+	typ uint64 // Type of the current token
+	n   uint64 // Number of bits remaining in the current token
+	pos uint   // Position of the next bit within b, for literals
+	b   byte
+}
+
+func (r *rleReader) ReadBit() (bool, error) {
+	if r.n == 0 {
+		h, err := binary.ReadUvarint(r.r)
+		if err == io.ErrUnexpectedEOF {
+			return false, errInvalidRLE
+		} else if err != nil {
+			return false, err
+		}
+		r.typ, r.n, r.pos = h&3, h>>2, 0
+		if r.n == 0 || r.typ > rleLiteral {
+			return false, errInvalidRLE
+		}
+	}
+	r.n--
+	switch r.typ {
+	case rleZeros:
+		return false, nil
+	case rleOnes:
+		return true, nil
+	}
+	if r.pos == 0 {
+		var err error
+		if r.b, err = r.r.ReadByte(); err == io.EOF {
+			return false, errInvalidRLE
+		} else if err != nil {
+			return false, err
+		}
+	}
+	bit := 0 != (0x80 & (r.b << r.pos))
+	r.pos = (r.pos + 1) % 8
+	return bit, nil
+}
+
+func (r *rleReader) expectEnd() error {
+	if r.n != 0 {
+		return errors.New("Wishlist too long")
+	}
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return errors.New("Wishlist too long")
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/indyjo/cafs"
+)
+
+// Returned by WriteWishList and ReconstructFileFromRequestedChunks if the announced chunk list
+// doesn't match BuilderOptions.ExpectedRoot.
+var ErrRootMismatch = errors.New("Root hash mismatch")
+
+// Type RootHasher computes the root hash of a chunk list in a single pass, as a chain over the
+// chunks in file order: starting with 32 zero bytes, each step hashes the previous value, the
+// chunk's key and the chunk's length (as uvarint) using SHA-256. The zero value is ready to use.
+type RootHasher struct {
+	sum cafs.SKey
+}
+
+// Adds the next chunk of the list.
+func (h *RootHasher) Add(key cafs.SKey, length int64) {
+	buf := make([]byte, 0, 64+binary.MaxVarintLen64)
+	buf = append(buf, h.sum[:]...)
+	buf = append(buf, key[:]...)
+	buf = appendUvarint(buf, uint64(length))
+	h.sum = sha256.Sum256(buf)
+}
+
+// Returns the root hash of the chunks added so far.
+func (h *RootHasher) Sum() cafs.SKey {
+	return h.sum
+}
+
+// Returns the root hash of the chunk list of `file` as announced by WriteChunkHashesWithOptions
+// using `salt`, which may be nil. The root hash doesn't depend on the permutation.
+func RootHash(file cafs.File, salt []byte) cafs.SKey {
+	var h RootHasher
+	iter := file.Chunks()
+	defer iter.Dispose()
+	for iter.Next() {
+		h.Add(saltKey(salt, iter.Key()), iter.Size())
+	}
+	return h.Sum()
+}
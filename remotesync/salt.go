@@ -0,0 +1,99 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"github.com/indyjo/cafs"
+	"sync"
+)
+
+// Returned by WriteWishList if salted hashes are requested but the storage doesn't implement
+// cafs.KeyEnumerator.
+var ErrCannotEnumerate = errors.New("Storage can't enumerate keys")
+
+// Length of salts created by NewSalt
+const SaltSize = 32
+
+// Returns a new random salt to be used for a single transmission. Sender and receiver must
+// agree on the salt, e.g. by negotiating it as part of the session setup.
+//
+// When announcing salted hashes, the sender doesn't reveal the actual keys of the chunks it holds,
+// and, as long as salts are not re-used, a receiver can't correlate announcements across sessions.
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// Function saltKey computes the salted version of a key. Placeholders are never salted.
+func saltKey(salt []byte, key cafs.SKey) (result cafs.SKey) {
+	if len(salt) == 0 || key == emptyKey {
+		return key
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(key[:])
+	mac.Sum(result[:0])
+	return
+}
+
+// Type saltedIndex maps salted keys of a storage's content back to the original keys.
+type saltedIndex struct {
+	salt  []byte
+	mutex sync.Mutex
+	keys  map[cafs.SKey]cafs.SKey
+}
+
+// Creates an index of all keys in `storage`, salted with `salt`.
+func newSaltedIndex(storage cafs.FileStorage, salt []byte) (*saltedIndex, error) {
+	enumerator, ok := storage.(cafs.KeyEnumerator)
+	if !ok {
+		return nil, ErrCannotEnumerate
+	}
+	var keys []cafs.SKey
+	enumerator.EnumerateKeys(func(key cafs.SKey) bool {
+		keys = append(keys, key)
+		return true
+	})
+	idx := &saltedIndex{salt: salt, keys: make(map[cafs.SKey]cafs.SKey, len(keys))}
+	for _, key := range keys {
+		idx.keys[saltKey(salt, key)] = key
+	}
+	return idx, nil
+}
+
+// Returns the original key for a salted key, if known.
+func (idx *saltedIndex) lookup(salted cafs.SKey) (cafs.SKey, bool) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	key, ok := idx.keys[salted]
+	return key, ok
+}
+
+// Adds a key to the index and returns its salted version.
+func (idx *saltedIndex) add(key cafs.SKey) cafs.SKey {
+	salted := saltKey(idx.salt, key)
+	idx.mutex.Lock()
+	idx.keys[salted] = key
+	idx.mutex.Unlock()
+	return salted
+}
@@ -17,12 +17,17 @@
 package remotesync
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/indyjo/cafs"
 	"github.com/indyjo/cafs/remotesync/shuffle"
 	"io"
 	"log"
+	"sort"
+	"time"
 )
 
 // By passing a callback function to some of the transmissions functions,
@@ -31,7 +36,64 @@ type TransferStatusCallback func(bytesToTransfer, bytesTransferred int64)
 
 // Writes a stream of chunk hash/length pairs into an io.Writer. Length is encoded
 // as Varint. The original order of chunks is shuffled using permutation `perm`.
+// Returns ErrPeerClosed if the receiver closed the connection prematurely.
 func WriteChunkHashes(file cafs.File, perm shuffle.Permutation, w io.Writer) error {
+	return WriteChunkHashesWithOptions(file, perm, w, AnnounceOptions{})
+}
+
+// Type AnnounceOptions contains optional settings for WriteChunkHashesWithOptions.
+// The zero value selects the default behavior.
+type AnnounceOptions struct {
+	// If set, chunk hashes are salted with this value before being announced, so that the
+	// receiver doesn't learn the actual keys. The receiver must use the same salt (see BuilderOptions).
+	// A new salt should be used for each transmission (see NewSalt).
+	Salt []byte
+
+	// If set, the announcement is aborted with an error wrapping the context's error when the
+	// context is done, even while iterating the file's chunks is blocked by the storage.
+	Context context.Context
+
+	// If greater than 0, the first SkipEntries entries of the announcement (including placeholders)
+	// are not written, e.g. for resuming an interrupted announcement (see Builder.AnnouncedEntries).
+	// The entries are determined by the file and the permutation, which must not change.
+	SkipEntries int
+
+	// If set, the announcement ends with the file's key, which is the SHA-256 digest of its
+	// content, so that the receiver can verify the reconstructed file end to end. The receiver
+	// must expect the digest (see BuilderOptions.ExpectDigest).
+	Digest bool
+
+	// If greater than 0, entries are collected in a buffer of this size before being written,
+	// which saves write calls on connections without buffering of their own. The buffer is
+	// flushed when the announcement is complete. Note that the receiver can't start requesting
+	// chunks before it has received the first buffer.
+	BufferSize int
+
+	// If greater than 0, decoy placeholder entries are appended to the file's chunks, so that
+	// the number of entries, including the placeholders added by the shuffler, is a multiple of
+	// Padding. This hides the exact number of chunks, which may
+	// fingerprint the content, from observers of the announcement's size, e.g. on an encrypted
+	// connection. The receiver ignores decoys, but they occupy its window (see NewBuilder). The
+	// sender must use the same padding when serving the chunk data (see ServeOptions.Padding).
+	Padding int
+
+	// If set, receives the events of the shuffler permuting the announced entries, e.g. for
+	// diagnosing latency caused by the permutation (see shuffle.NewStreamShufflerWithMetrics).
+	ShuffleMetrics shuffle.Metrics
+}
+
+// Returns the number of decoys needed for padding the announcement of `numChunks` chunks to a
+// multiple of `padding` entries. The shuffler adds len(perm)-1 placeholders when flushed.
+func numDecoys(numChunks int, perm shuffle.Permutation, padding int) int {
+	entries := numChunks + len(perm) - 1
+	if padding <= 0 || entries%padding == 0 {
+		return 0
+	}
+	return padding - entries%padding
+}
+
+// Like WriteChunkHashes, but allows for specifying options.
+func WriteChunkHashesWithOptions(file cafs.File, perm shuffle.Permutation, w io.Writer, opts AnnounceOptions) error {
 	if LoggingEnabled {
 		log.Printf("Sender: Begin WriteChunkHashes")
 		defer log.Printf("Sender: End WriteChunkHashes")
@@ -47,8 +109,18 @@ func WriteChunkHashes(file cafs.File, perm shuffle.Permutation, w io.Writer) err
 		size: 0,
 	}
 
-	shuffler := shuffle.NewStreamShuffler(perm, emptyChunk, func(v interface{}) error {
+	var bw *bufio.Writer
+	if opts.BufferSize > 0 {
+		bw = bufio.NewWriterSize(w, opts.BufferSize)
+		w = bw
+	}
+
+	entries := 0
+	shuffler := shuffle.NewStreamShufflerWithMetrics(perm, emptyChunk, func(v interface{}) error {
 		c := v.(chunk)
+		if entries++; entries <= opts.SkipEntries {
+			return nil
+		}
 		if LoggingEnabled {
 			log.Printf("Sender: Write %v", c.key)
 		}
@@ -56,31 +128,153 @@ func WriteChunkHashes(file cafs.File, perm shuffle.Permutation, w io.Writer) err
 			return err
 		}
 		return writeVarint(w, c.size)
+	}, opts.ShuffleMetrics)
+
+	numChunks := 0
+	err := iterateChunks(opts.Context, file, func(key cafs.SKey, size int64) error {
+		numChunks++
+		return shuffler.Put(chunk{saltKey(opts.Salt, key), size})
 	})
+	if err != nil {
+		return checkPeerClosed(err)
+	}
+	for i := numDecoys(numChunks, perm, opts.Padding); i > 0; i-- {
+		if err := shuffler.Put(emptyChunk); err != nil {
+			return checkPeerClosed(err)
+		}
+	}
+	if err := shuffler.End(); err != nil {
+		return checkPeerClosed(err)
+	}
+	if opts.Digest {
+		// The zero key never appears as a chunk hash and marks the digest
+		key := file.Key()
+		if _, err := w.Write(append(zeroKey[:], key[:]...)); err != nil {
+			return checkPeerClosed(err)
+		}
+	}
+	if bw != nil {
+		return checkPeerClosed(bw.Flush())
+	}
+	return nil
+}
 
+// Calls f for the key and size of each chunk of `file`. If `ctx` is not nil, the iteration
+// happens in a separate goroutine, so that it can be abandoned when the context is done.
+func iterateChunks(ctx context.Context, file cafs.File, f func(key cafs.SKey, size int64) error) error {
+	if ctx == nil {
+		chunks := file.Chunks()
+		defer chunks.Dispose()
+		for chunks.Next() {
+			if err := f(chunks.Key(), chunks.Size()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	type info struct {
+		key  cafs.SKey
+		size int64
+	}
+	infos := make(chan info)
+	stop := make(chan struct{})
+	defer close(stop)
+	// The iterator is owned by the goroutine, which may outlive this function until Next returns
 	chunks := file.Chunks()
-	defer chunks.Dispose()
-	for chunks.Next() {
-		if err := shuffler.Put(chunk{chunks.Key(), chunks.Size()}); err != nil {
-			return err
+	go func() {
+		defer chunks.Dispose()
+		defer close(infos)
+		for chunks.Next() {
+			select {
+			case infos <- info{chunks.Key(), chunks.Size()}:
+			case <-stop:
+				return
+			}
 		}
+	}()
+	for idx := 0; ; idx++ {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Aborted while retrieving chunk #%d of %v: %w", idx, file.Key(), ctx.Err())
+		case c, ok := <-infos:
+			if !ok {
+				return nil
+			}
+			if err := f(c.key, c.size); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Type Announcement holds the chunk hashes of a file, as written by WriteChunkHashes.
+// It can be replayed to any number of receivers without iterating the file's chunks again.
+// Each receiver then proceeds with its own wishlist and data phase using the same permutation.
+type Announcement struct {
+	data []byte
+}
+
+// Captures the output of WriteChunkHashes for `file` and `perm` into a new Announcement.
+func NewAnnouncement(file cafs.File, perm shuffle.Permutation) (*Announcement, error) {
+	var buf bytes.Buffer
+	if err := WriteChunkHashes(file, perm, &buf); err != nil {
+		return nil, err
 	}
-	return shuffler.End()
+	return &Announcement{data: buf.Bytes()}, nil
+}
+
+// Returns the size of the announcement in bytes.
+func (a *Announcement) Len() int {
+	return len(a.data)
+}
+
+// Reads an announcement written by WriteChunkHashes from `r` until EOF, e.g. for caching it or for
+// decoding it without proceeding to the data phase (see Announcement.Chunks).
+func ReadAnnouncement(r io.Reader) (*Announcement, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Announcement{data: data}, nil
+}
+
+// Decodes the announcement, which must have been written using `perm` (see DecodeAnnouncement).
+func (a *Announcement) Chunks(perm shuffle.Permutation) ([]ChunkInfo, error) {
+	return DecodeAnnouncement(perm, a.Reader())
+}
+
+// Returns a reader over the announcement, to be passed to Builder.WriteWishList.
+func (a *Announcement) Reader() io.Reader {
+	return bytes.NewReader(a.data)
+}
+
+// Replays the announcement into `w`. Implements io.WriterTo.
+// Returns ErrPeerClosed if the receiver closed the connection prematurely.
+func (a *Announcement) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(a.data)
+	return int64(n), checkPeerClosed(err)
 }
 
 // Iterates over a wishlist (read from `r` and pertaining to a permuted order of hashes),
 // and calls `f` for each chunk of `file`, requested or not.
 // If `f` returns an error, aborts the iteration and also returns the error.
-func forEachChunk(storage cafs.FileStorage, file cafs.File, r io.ByteReader, perm shuffle.Permutation, f func(chunk cafs.File, requested bool) error) error {
+// Progress is recorded with `transfer`.
+func forEachChunk(storage cafs.FileStorage, file cafs.File, r io.ByteReader, perm shuffle.Permutation, format wishListFormat, padding int, transfer *transfer, f func(chunk cafs.File, requested bool) error) error {
 	iter := file.Chunks()
 	defer iter.Dispose()
 
-	bits := newBitReader(r)
+	bits := newWishListReader(r, format)
 
 	// Prepare shuffler for iterating the file's chunks in shuffled order, matching them with
 	// whishlist bits and calling `f` for each chunk, requested or not.
-	shuffler := shuffle.NewStreamShuffler(perm, emptyKey, func(v interface{}) error {
+	var shuffler shuffle.StreamShuffler
+	idx := 0
+	shuffler = shuffle.NewStreamShuffler(perm, emptyKey, func(v interface{}) error {
 		key := v.(cafs.SKey)
+		transfer.setProgress(idx, shuffler.Buffered())
+		idx++
+		transfer.setPhase("data", "reading wishlist")
 		if b, err := bits.ReadBit(); err != nil {
 			return fmt.Errorf("Wishlist too short: %v on chunk %v", err, iter.Key())
 		} else if key == emptyKey {
@@ -90,41 +284,182 @@ func forEachChunk(storage cafs.FileStorage, file cafs.File, r io.ByteReader, per
 				return errors.New("Receiver requested the empty chunk")
 			}
 			return nil // Skip this key, it's not part of the file
-		} else if chunk, err := storage.Get(&key); err != nil {
-			return err
 		} else {
 			// Both the wishlist bit, and the corresponding chunk have been received correctly.
 			// Now dispatch them to the delegate function.
-			err := f(chunk, b)
-			chunk.Dispose()
-			if err != nil {
-				return err
-			}
+			return withChunk(storage, key, func(chunk cafs.File) error {
+				return f(chunk, b)
+			})
 		}
-		return nil
 	})
 
-	// Iterate through the chunks of file and put their keys into the shuffler.
+	// Iterate through the chunks of file and put their keys into the shuffler, followed by decoys
+	// as announced.
+	numChunks := 0
 	for iter.Next() {
+		numChunks++
 		if err := shuffler.Put(iter.Key()); err != nil {
 			return err
 		}
 	}
+	for i := numDecoys(numChunks, perm, padding); i > 0; i-- {
+		if err := shuffler.Put(emptyKey); err != nil {
+			return err
+		}
+	}
 	if err := shuffler.End(); err != nil {
 		return err
 	}
 
 	// Expect whishlist byte stream to be read completely
-	if _, err := r.ReadByte(); err != io.EOF {
-		return errors.New("Wishlist too long")
+	return bits.expectEnd()
+}
+
+// Retrieves the chunk stored as `key` and calls f with it. The chunk is disposed when f returns,
+// however it returns, so that an aborted transmission doesn't keep it locked in the storage.
+func withChunk(storage cafs.FileStorage, key cafs.SKey, f func(chunk cafs.File) error) error {
+	chunk, err := storage.Get(&key)
+	if err != nil {
+		return err
 	}
-	return nil
+	defer chunk.Dispose()
+	return f(chunk)
+}
+
+// Type contextWriter fails writes once its context is done, so that an aborted transmission
+// stops within a chunk instead of after it.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w contextWriter) Write(b []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(b)
 }
 
 // Writes a stream of chunk length / data pairs, permuted by a shuffler corresponding to `perm`,
 // into an io.Writer, based on the chunks of a file and a matching permuted wishlist of requested chunks,
 // read from `r`.
+// Returns ErrPeerClosed if the receiver closed the connection prematurely.
+// If `w` is nil, nothing is written, but the callback reports the bytes that would have been
+// transferred. This allows for estimating the cost of a transmission.
 func WriteChunkData(storage cafs.FileStorage, file cafs.File, r io.ByteReader, perm shuffle.Permutation, w io.Writer, cb TransferStatusCallback) error {
+	return WriteChunkDataWithOptions(storage, file, r, perm, w, cb, ServeOptions{})
+}
+
+// Type ServeOptions contains optional settings for WriteChunkDataWithOptions.
+// The zero value selects the default behavior.
+type ServeOptions struct {
+	// The number of requested chunks to skip, in the order they would be transmitted. Used for
+	// resuming an interrupted transmission, in which the receiver has already received this
+	// number of chunks (see Builder.ReceivedChunks). The complete wishlist must be supplied again.
+	SkipRequested int
+
+	// The number of times retrieving a chunk from the storage is retried after a transient
+	// error, i.e. any error except cafs.ErrNotFound. Between attempts, the sender waits for
+	// RetryBackoff, doubling the duration after each attempt.
+	GetRetries   int
+	RetryBackoff time.Duration
+
+	// If set, the transmission is aborted with the context's error when the context is done.
+	// The context is checked before each write. The chunk being transmitted is released on abort.
+	Context context.Context
+
+	// If set, the transmission is registered under Name for the duration of the call,
+	// allowing it to be listed and cancelled.
+	Registry *Registry
+	Name     string
+
+	// If set, the wishlist is expected in the run-length encoded format, which is much more
+	// compact when long runs of chunks are requested or not requested. The receiver must use
+	// the same format (see BuilderOptions.RunLengthWishList), as agreed upon by the application.
+	RunLengthWishList bool
+
+	// If set, the wishlist is expected to list the positions of the requested chunks (see
+	// BuilderOptions.IndexWishList). Takes precedence over RunLengthWishList.
+	IndexWishList bool
+
+	// Called for each chunk of the file before anything is transmitted. If it returns false for
+	// any chunk, WriteChunkDataWithOptions fails with ErrChunkDenied, e.g. for enforcing a deny list.
+	AllowChunk func(key cafs.SKey) bool
+
+	// If set, a chunk is opened for transmission only once its size fits into the budget, which
+	// may be shared by any number of concurrent transmissions. Waiting is aborted when the
+	// Context is done.
+	MemoryBudget *MemoryBudget
+
+	// If set and the storage implements cafs.Localizer, the requested chunks are sent in the
+	// order they are located in the storage instead of the order of the wishlist, which reduces
+	// seeks on disk-based storages. The complete wishlist is read before any chunk is sent. The
+	// receiver must accept chunks in any order (see BuilderOptions.AnyChunkOrder).
+	LocalityOrder bool
+
+	// The padding used when announcing the file (see AnnounceOptions.Padding).
+	Padding int
+}
+
+// Sorts `keys` by ascending locality. Keys of unknown locality are moved to the end.
+func sortByLocality(localizer cafs.Localizer, keys []cafs.SKey) {
+	type located struct {
+		key      cafs.SKey
+		locality int64
+		known    bool
+	}
+	l := make([]located, len(keys))
+	for i, key := range keys {
+		l[i].key = key
+		l[i].locality, l[i].known = localizer.Locality(&l[i].key)
+	}
+	sort.SliceStable(l, func(i, j int) bool {
+		if l[i].known != l[j].known {
+			return l[i].known
+		}
+		return l[i].locality < l[j].locality
+	})
+	for i := range l {
+		keys[i] = l[i].key
+	}
+}
+
+// Returns ErrChunkDenied if `allow` rejects any chunk of `file`.
+func checkChunksAllowed(file cafs.File, allow func(key cafs.SKey) bool) error {
+	iter := file.Chunks()
+	defer iter.Dispose()
+	for iter.Next() {
+		if !allow(iter.Key()) {
+			return fmt.Errorf("%w: %v", ErrChunkDenied, iter.Key())
+		}
+	}
+	return nil
+}
+
+// Type retryingStorage retries Get on transient errors, as configured in ServeOptions.
+type retryingStorage struct {
+	cafs.FileStorage
+	retries int
+	backoff time.Duration
+}
+
+func (s retryingStorage) Get(key *cafs.SKey) (cafs.File, error) {
+	backoff := s.backoff
+	for attempt := 0; ; attempt++ {
+		file, err := s.FileStorage.Get(key)
+		if err == nil || errors.Is(err, cafs.ErrNotFound) || attempt == s.retries {
+			return file, err
+		}
+		if LoggingEnabled {
+			log.Printf("Sender: Retrying to get chunk %v in %v: %v", key, backoff, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Like WriteChunkData, but allows for specifying options.
+func WriteChunkDataWithOptions(storage cafs.FileStorage, file cafs.File, r io.ByteReader, perm shuffle.Permutation, w io.Writer, cb TransferStatusCallback, opts ServeOptions) error {
 	if LoggingEnabled {
 		log.Printf("Sender: Begin WriteChunkData")
 		defer log.Printf("Sender: End WriteChunkData")
@@ -137,28 +472,94 @@ func WriteChunkData(storage cafs.FileStorage, file cafs.File, r io.ByteReader, p
 		cb(bytesToTransfer, 0)
 	}
 
+	if opts.AllowChunk != nil {
+		if err := checkChunksAllowed(file, opts.AllowChunk); err != nil {
+			return err
+		}
+	}
+	localizer, _ := storage.(cafs.Localizer)
+	if localizer == nil {
+		opts.LocalityOrder = false
+	}
+	if opts.GetRetries > 0 {
+		storage = retryingStorage{storage, opts.GetRetries, opts.RetryBackoff}
+	}
+
+	transfer, ctx := opts.Registry.register(opts.Context, opts.Name, Sending)
+	defer transfer.done()
+	if w != nil {
+		w = contextWriter{ctx, w}
+	}
+
 	// Iterate requested chunks. Write the chunk's length (as varint) and the chunk data
 	// into the output writer. Update the number of bytes transferred on the go.
 	var bytesTransferred int64
-	return forEachChunk(storage, file, r, perm, func(chunk cafs.File, requested bool) error {
-		if requested {
+	skip := opts.SkipRequested
+	notify := func() {
+		if cb != nil {
+			// Notify callback of status
+			cb(bytesToTransfer, bytesTransferred)
+		}
+	}
+	send := func(chunk cafs.File) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if skip > 0 {
+			// Already transferred in a previous attempt
+			skip--
+			bytesTransferred += chunk.Size()
+		} else if w == nil {
+			// Dry run
+			bytesTransferred += chunk.Size()
+		} else {
+			if budget := opts.MemoryBudget; budget != nil {
+				transfer.setPhase("data", "waiting for memory budget")
+				if err := budget.acquire(ctx, chunk.Size()); err != nil {
+					return err
+				}
+				defer budget.release(chunk.Size())
+			}
+			transfer.setPhase("data", "writing chunk data")
 			if err := writeVarint(w, chunk.Size()); err != nil {
 				return err
 			}
 			r := chunk.Open()
 			defer r.Close()
-			if n, err := io.Copy(w, r); err != nil {
+			n, err := io.Copy(w, r)
+			bytesTransferred += n
+			transfer.addBytes(n)
+			if err != nil {
 				return err
-			} else {
-				bytesTransferred += n
 			}
+		}
+		notify()
+		return nil
+	}
+
+	// With LocalityOrder, the requested chunks are collected and sent after the wishlist is read
+	var collected []cafs.SKey
+	err := forEachChunk(storage, file, r, perm, wishListFormatOf(opts.RunLengthWishList, opts.IndexWishList), opts.Padding, transfer, func(chunk cafs.File, requested bool) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if requested && opts.LocalityOrder {
+			collected = append(collected, chunk.Key())
+		} else if requested {
+			return send(chunk)
 		} else {
 			bytesToTransfer -= chunk.Size()
-		}
-		if cb != nil {
-			// Notify callback of status
-			cb(bytesToTransfer, bytesTransferred)
+			notify()
 		}
 		return nil
 	})
+	if err == nil && opts.LocalityOrder {
+		sortByLocality(localizer, collected)
+		for _, key := range collected {
+			if err = withChunk(storage, key, send); err != nil {
+				break
+			}
+		}
+	}
+	return checkPeerClosed(err)
 }
@@ -0,0 +1,87 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"context"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"io"
+	"runtime"
+)
+
+// Type Server serves files from a storage to any number of concurrent receivers, while limiting
+// the number of transmissions in progress to the size of its pool, which bounds the CPU and I/O
+// contention of a busy sender. Excess transmissions wait for a free slot in the order they arrive.
+// A Server is safe for concurrent use.
+type Server struct {
+	storage cafs.FileStorage
+	slots   chan struct{}
+}
+
+// Returns a server for files of `storage` running at most `poolSize` transmissions at the same
+// time. A pool size less than 1 selects the number of CPUs usable by the process.
+func NewServer(storage cafs.FileStorage, poolSize int) *Server {
+	if poolSize < 1 {
+		poolSize = runtime.GOMAXPROCS(0)
+	}
+	return &Server{storage: storage, slots: make(chan struct{}, poolSize)}
+}
+
+// Returns the number of transmissions currently in progress.
+func (s *Server) Active() int {
+	return len(s.slots)
+}
+
+// Returns the maximum number of transmissions in progress at the same time.
+func (s *Server) PoolSize() int {
+	return cap(s.slots)
+}
+
+// Blocks until a slot is free, then occupies it. Returns the context's error if it is done first.
+func (s *Server) acquire(ctx context.Context) error {
+	if ctx == nil {
+		s.slots <- struct{}{}
+		return nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) release() {
+	<-s.slots
+}
+
+// Like WriteChunkDataWithOptions on the server's storage, but waits for a free slot first. Waiting
+// is aborted with the context's error when opts.Context is done.
+func (s *Server) WriteChunkData(file cafs.File, r io.ByteReader, perm shuffle.Permutation, w io.Writer, cb TransferStatusCallback, opts ServeOptions) error {
+	if err := s.acquire(opts.Context); err != nil {
+		return err
+	}
+	defer s.release()
+	return WriteChunkDataWithOptions(s.storage, file, r, perm, w, cb, opts)
+}
+
+// Like ServePull on the server's storage, but waits for a free slot after reading the request. The
+// slot is occupied until the receiver has confirmed the file.
+func (s *Server) ServePull(conn io.ReadWriter, perm shuffle.Permutation, opts PushOptions) error {
+	return servePull(s.storage, conn, perm, opts, s)
+}
@@ -0,0 +1,100 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package shuffle
+
+// Type blockShuffler permutes a stream in blocks of k data elements, where k is the length of the
+// permutation. Compared to streamShuffler, it buffers up to k elements before emitting a whole
+// block at once, instead of emitting one element per input element.
+type blockShuffler struct {
+	consume     ConsumeFunc
+	placeholder interface{}
+	order       []int // Position within the buffer of the next element to emit
+	inverse     bool  // Whether placeholders are removed from the output
+	buffer      []interface{}
+	n           int // Number of elements in the buffer
+}
+
+// Creates a StreamShuffler applying permutation `p` to consecutive blocks of len(p) data elements,
+// so that the j-th element of each output block is the p[j]-th element of the input block.
+// The last block is padded with `placeholder`. In contrast to NewStreamShuffler, Put calls
+// `consume` once for every element of a block when the block is complete.
+func NewBlockStreamShuffler(p Permutation, placeholder interface{}, consume ConsumeFunc) StreamShuffler {
+	order := make([]int, len(p))
+	copy(order, p)
+	return &blockShuffler{
+		consume:     consume,
+		placeholder: placeholder,
+		order:       order,
+		buffer:      make([]interface{}, len(p)),
+	}
+}
+
+// Creates a StreamShuffler restoring the original order of a stream permuted by a block shuffler
+// based on `p`. Values equal to `placeholder` are not forwarded to `consume`.
+func NewInverseBlockStreamShuffler(p Permutation, placeholder interface{}, consume ConsumeFunc) StreamShuffler {
+	order := make([]int, len(p))
+	for j, i := range p {
+		order[i] = j
+	}
+	return &blockShuffler{
+		consume:     consume,
+		placeholder: placeholder,
+		order:       order,
+		inverse:     true,
+		buffer:      make([]interface{}, len(p)),
+	}
+}
+
+func (s *blockShuffler) Put(v interface{}) error {
+	s.buffer[s.n] = v
+	s.n++
+	if s.n < len(s.buffer) {
+		return nil
+	}
+	s.n = 0
+	for _, i := range s.order {
+		v := s.buffer[i]
+		s.buffer[i] = nil
+		if s.inverse && v == s.placeholder {
+			continue
+		}
+		if err := s.consume(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pads an incomplete last block with placeholders and emits it.
+func (s *blockShuffler) End() error {
+	for s.n != 0 {
+		if err := s.Put(s.placeholder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *blockShuffler) WithFunc(consume ConsumeFunc) StreamShuffler {
+	r := *s
+	r.consume = consume
+	return &r
+}
+
+func (s *blockShuffler) Buffered() int {
+	return s.n
+}
@@ -0,0 +1,118 @@
+package shuffle
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// Type strategy describes a way of permuting a stream, for comparing shufflers.
+type strategy struct {
+	name    string
+	forward func(p Permutation, placeholder interface{}, consume ConsumeFunc) StreamShuffler
+	inverse func(p Permutation, placeholder interface{}, consume ConsumeFunc) StreamShuffler
+}
+
+// Type identity is a StreamShuffler that doesn't shuffle at all, serving as a baseline.
+type identity struct {
+	consume ConsumeFunc
+}
+
+func newIdentity(_ Permutation, _ interface{}, consume ConsumeFunc) StreamShuffler {
+	return identity{consume}
+}
+
+func (s identity) Put(v interface{}) error                     { return s.consume(v) }
+func (s identity) End() error                                  { return nil }
+func (s identity) WithFunc(consume ConsumeFunc) StreamShuffler { return identity{consume} }
+func (s identity) Buffered() int                               { return 0 }
+
+var strategies = []strategy{
+	{"stream", NewStreamShuffler, NewInverseStreamShuffler},
+	{"block", NewBlockStreamShuffler, NewInverseBlockStreamShuffler},
+	{"none", newIdentity, newIdentity},
+}
+
+func TestBlockShuffler(t *testing.T) {
+	perm := Permutation{3, 4, 2, 1, 0}
+	shuffled := shuffleString(t, "0123456789ab", NewBlockStreamShuffler(perm, '_', nil))
+	if expected := "3421089765___ba"; shuffled != expected {
+		t.Errorf("Expected %#v, got %#v", expected, shuffled)
+	}
+}
+
+func TestStrategies(t *testing.T) {
+	rgen := rand.New(rand.NewSource(1))
+	for _, permSize := range []int{1, 2, 3, 7, 31, 512} {
+		perm := Random(permSize, rgen)
+		for _, dataSize := range []int{0, 1, 2, 3, 7, 31, 57, 512, 1024} {
+			data := Random(dataSize, rgen)
+			for _, s := range strategies {
+				var result []int
+				inverse := s.inverse(perm, -1, func(v interface{}) error {
+					result = append(result, v.(int))
+					return nil
+				})
+				forward := s.forward(perm, -1, inverse.Put)
+				for _, v := range data {
+					if err := forward.Put(v); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := forward.End(); err != nil {
+					t.Fatal(err)
+				}
+				if err := inverse.End(); err != nil {
+					t.Fatal(err)
+				}
+				if fmt.Sprint(result) != fmt.Sprint(data) {
+					t.Fatalf("Strategy %v with permutation size %v and data size %v: got %v, expected %v",
+						s.name, permSize, dataSize, result, data)
+				}
+			}
+		}
+	}
+}
+
+// Benchmarks shuffling and unshuffling streams of different lengths with each strategy.
+// Reports the peak number of elements buffered by the shuffler alone, and by the shuffler and
+// unshuffler combined. Placeholders aren't counted.
+func BenchmarkStrategies(b *testing.B) {
+	perm := Random(1024, rand.New(rand.NewSource(1)))
+	for _, s := range strategies {
+		for _, n := range []int{100, 10000, 1000000} {
+			b.Run(fmt.Sprintf("%v/%v", s.name, n), func(b *testing.B) {
+				b.ReportAllocs()
+				var peakShuffled, peakTotal int
+				for i := 0; i < b.N; i++ {
+					var in, shuffled, out int
+					inverse := s.inverse(perm, -1, func(v interface{}) error {
+						out++
+						return nil
+					})
+					forward := s.forward(perm, -1, func(v interface{}) error {
+						if v != -1 {
+							shuffled++
+						}
+						return inverse.Put(v)
+					})
+					for j := 0; j < n; j++ {
+						in++
+						_ = forward.Put(j)
+						if buffered := in - shuffled; buffered > peakShuffled {
+							peakShuffled = buffered
+						}
+						if buffered := in - out; buffered > peakTotal {
+							peakTotal = buffered
+						}
+					}
+					_ = forward.End()
+					_ = inverse.End()
+				}
+				b.ReportMetric(float64(peakShuffled), "peak-buffered-shuffle")
+				b.ReportMetric(float64(peakTotal), "peak-buffered-total")
+				b.ReportMetric(float64(b.N*n)/b.Elapsed().Seconds(), "items/s")
+			})
+		}
+	}
+}
@@ -0,0 +1,48 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package shuffle
+
+import "time"
+
+// Type Metrics receives events from an instrumented StreamShuffler (see
+// NewStreamShufflerWithMetrics), e.g. for analyzing why certain permutations cause latency or
+// memory spikes. Implementations are called synchronously from Put and End and should be fast.
+type Metrics interface {
+	// Called after a data element has been put, with the number of data elements buffered
+	// afterwards (see StreamShuffler.Buffered). Not called for the placeholders put by End.
+	Put(buffered int)
+	// Called before a data element is passed to the ConsumeFunc, with the number of steps and the
+	// time it has been buffered. Elements passed on in the same step they were put have been
+	// buffered for 0 steps. Not called for placeholders.
+	Emit(steps int, held time.Duration)
+}
+
+// Records when and in which step each buffered element was put (see streamShuffler.metrics).
+type slotInfo struct {
+	step int
+	at   time.Time
+}
+
+// Like NewStreamShuffler, but reports to `metrics`. A nil Metrics disables reporting.
+func NewStreamShufflerWithMetrics(p Permutation, placeholder interface{}, consume ConsumeFunc, metrics Metrics) StreamShuffler {
+	s := NewStreamShuffler(p, placeholder, consume).(*streamShuffler)
+	if metrics != nil {
+		s.metrics = metrics
+		s.slots = make([]slotInfo, len(p))
+	}
+	return s
+}
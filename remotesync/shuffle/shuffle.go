@@ -18,7 +18,15 @@
 // cyclic permutation on a possibly infinite stream of data elements.
 package shuffle
 
-import "math/rand"
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+)
+
+var ErrInvalidPermutation = errors.New("Invalid permutation")
 
 // Type Permutation contains a permutation of integer numbers 0..k-1,
 // where k is the length of the permutation cycle.
@@ -41,12 +49,16 @@ type Shuffler struct {
 // Interface StreamShuffler is common for shufflers and unshufflers working on a
 // stream with a well-defined beginning and end.
 type StreamShuffler interface {
-	// Puts one data element into the StreamShuffler. Calls the ConsumeFunc exactly once.
+	// Puts one data element into the StreamShuffler. Calls the ConsumeFunc exactly once
+	// (for block shufflers, see NewBlockStreamShuffler, once per element of a completed block).
 	Put(interface{}) error
-	// Feeds remaining data from the buffer into the ConsumeFunc, calling it k-1 times.
+	// Feeds remaining data from the buffer into the ConsumeFunc, calling it k-1 times
+	// (for block shufflers, until the last block is complete).
 	End() error
 	// Returns a shallow copy of this StreamShuffler with a different ConsumeFunc.
 	WithFunc(consume ConsumeFunc) StreamShuffler
+	// Returns the number of data elements put and not yet passed on, including placeholders.
+	Buffered() int
 }
 
 // Type ConsumeFunc defines a function that accepts one parameter of
@@ -63,6 +75,12 @@ type streamShuffler struct {
 	consume  ConsumeFunc
 	shuffler *Shuffler
 	apply    applyFunc
+	buffered int // Number of elements held by shuffler
+
+	// Only set if instrumented (see NewStreamShufflerWithMetrics)
+	metrics Metrics
+	slots   []slotInfo // Indexed like the shuffler's buffer
+	step    int
 }
 
 // Creates a random permutation of given length.
@@ -70,6 +88,90 @@ func Random(size int, r *rand.Rand) Permutation {
 	return r.Perm(size)
 }
 
+// Creates a random permutation of given length using randomness from `src`. A source seeded
+// with a fixed value yields reproducible permutations.
+func RandomFromSource(size int, src rand.Source) Permutation {
+	return Random(size, rand.New(src))
+}
+
+// Creates a random permutation of given length using random bytes read from `r`, e.g.
+// crypto/rand.Reader for permutations that must not be predictable. The permutation is uniformly
+// distributed if the bytes read are. Returns an error if reading from `r` fails.
+func RandomFromReader(size int, r io.Reader) (Permutation, error) {
+	p := make(Permutation, size)
+	for i := range p {
+		p[i] = i
+	}
+	var buf [8]byte
+	// Fisher-Yates shuffle, drawing uniform indices by rejection sampling
+	for i := size - 1; i > 0; i-- {
+		n := uint64(i + 1)
+		limit := ^uint64(0) - (^uint64(0)%n+1)%n
+		for {
+			if _, err := io.ReadFull(r, buf[:]); err != nil {
+				return nil, err
+			}
+			if v := binary.BigEndian.Uint64(buf[:]); v <= limit {
+				j := int(v % n)
+				p[i], p[j] = p[j], p[i]
+				break
+			}
+		}
+	}
+	return p, nil
+}
+
+// Checks that p is a bijection on 0..k-1 with k > 0. Returns ErrInvalidPermutation otherwise.
+// Shufflers based on an invalid permutation misbehave, so permutations received from
+// untrusted sources should be validated before use.
+func (p Permutation) Validate() error {
+	if len(p) == 0 {
+		return ErrInvalidPermutation
+	}
+	seen := make([]bool, len(p))
+	for _, j := range p {
+		if j < 0 || j >= len(p) || seen[j] {
+			return ErrInvalidPermutation
+		}
+		seen[j] = true
+	}
+	return nil
+}
+
+// Returns the maximum number of data elements a stream shuffler based on p (see
+// NewStreamShuffler) holds at the same time, as reported by StreamShuffler.Buffered. Streams of
+// at least 2k-1 elements reach this maximum, shorter streams may stay below. Element i of each
+// cycle is held for (p[i]-i) mod k steps, so that permutations moving many elements far can make
+// the shuffler hold nearly all k elements. Receivers may check the cost of an untrusted
+// permutation, and of its inverse, before using it. Assumes that p is valid (see Validate).
+func (p Permutation) PeakBuffered() int {
+	k := len(p)
+	// Element i is held after steps i..i+d-1 of the cycle. Count held elements per step, modulo k,
+	// by adding 1 at the beginning and subtracting 1 after the end of each interval.
+	diff := make([]int, k+1)
+	for i, j := range p {
+		d := (j - i + k) % k
+		if d == 0 {
+			continue
+		}
+		if end := i + d; end <= k {
+			diff[i]++
+			diff[end]--
+		} else {
+			diff[i]++
+			diff[k]--
+			diff[0]++
+			diff[end-k]--
+		}
+	}
+	peak, n := 0, 0
+	for _, v := range diff[:k] {
+		n += v
+		peak = max(peak, n)
+	}
+	return peak
+}
+
 // Given a permutation p, creates a complimentary permutation p'
 // such that using the output of a Shuffler based on p as the input
 // of a Shuffler based on p' restores the original stream order
@@ -130,14 +232,49 @@ func NewStreamShuffler(p Permutation, placeholder interface{}, consume ConsumeFu
 }
 
 func (e *streamShuffler) Put(v interface{}) error {
+	return e.put(v)
+}
+
+func (e *streamShuffler) put(v interface{}) error {
+	if e.metrics != nil {
+		return e.putInstrumented(v)
+	}
+	if v != nil {
+		e.buffered++
+	}
 	r := e.shuffler.Put(v)
+	if r != nil {
+		e.buffered--
+	}
+	return e.apply(e.consume, r)
+}
+
+// Like put, but reports to the shuffler's metrics.
+func (e *streamShuffler) putInstrumented(v interface{}) error {
+	// Mirror the slots written and read by Shuffler.Put
+	i := e.shuffler.idx
+	now := time.Now()
+	if v != nil {
+		e.buffered++
+		e.slots[e.shuffler.perm[i]] = slotInfo{e.step, now}
+	}
+	r := e.shuffler.Put(v)
+	if r != nil {
+		e.buffered--
+	}
+	if v != nil {
+		e.metrics.Put(e.buffered)
+	}
+	if r != nil {
+		e.metrics.Emit(e.step-e.slots[i].step, now.Sub(e.slots[i].at))
+	}
+	e.step++
 	return e.apply(e.consume, r)
 }
 
 func (e *streamShuffler) End() error {
 	for i := 0; i < e.shuffler.Length()-1; i++ {
-		r := e.shuffler.Put(nil)
-		if err := e.apply(e.consume, r); err != nil {
+		if err := e.put(nil); err != nil {
 			return err
 		}
 	}
@@ -151,6 +288,10 @@ func (e *streamShuffler) WithFunc(consume ConsumeFunc) StreamShuffler {
 	return &s
 }
 
+func (e *streamShuffler) Buffered() int {
+	return e.buffered
+}
+
 // Creates a StreamShuffler applying the inverse permutation and thereby restoring
 // the original stream order. Argument `placeholder` specifies blank space inserted
 // into the stream by the original shuffler. Values equal to `placeholder` will not
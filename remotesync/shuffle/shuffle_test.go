@@ -1,8 +1,12 @@
 package shuffle
 
 import (
+	"bytes"
+	crand "crypto/rand"
+	"fmt"
 	"math/rand"
 	"testing"
+	"time"
 )
 
 func TestShuffler(t *testing.T) {
@@ -41,6 +45,149 @@ func TestShuffler(t *testing.T) {
 	}
 }
 
+func TestValidate(t *testing.T) {
+	for _, p := range []Permutation{{0}, {1, 0}, {3, 4, 2, 1, 0}, Random(100, rand.New(rand.NewSource(1)))} {
+		if err := p.Validate(); err != nil {
+			t.Errorf("Permutation %v: unexpected error %v", p, err)
+		}
+	}
+	for _, p := range []Permutation{nil, {1}, {0, 0}, {-1, 0}, {0, 2}, {3, 4, 2, 1, 1}} {
+		if err := p.Validate(); err != ErrInvalidPermutation {
+			t.Errorf("Permutation %v: expected ErrInvalidPermutation, got %v", p, err)
+		}
+	}
+}
+
+func TestPeakBuffered(t *testing.T) {
+	rgen := rand.New(rand.NewSource(1))
+	perms := []Permutation{{0}, {1, 0}, {0, 1, 2, 3}, {3, 2, 1, 0}, {1, 2, 3, 0}, {3, 0, 1, 2}}
+	for _, size := range []int{5, 10, 57, 512} {
+		perms = append(perms, Random(size, rgen))
+	}
+	for _, perm := range perms {
+		for _, p := range []Permutation{perm, perm.Inverse()} {
+			peak := 0
+			s := NewStreamShuffler(p, -1, func(interface{}) error { return nil })
+			for i := 0; i < 3*len(p); i++ {
+				if err := s.Put(i); err != nil {
+					t.Fatal(err)
+				}
+				peak = max(peak, s.Buffered())
+			}
+			if estimate := p.PeakBuffered(); estimate != peak {
+				t.Errorf("Permutation %v: estimated peak of %d, actual peak %d", p, estimate, peak)
+			}
+		}
+	}
+}
+
+func TestRandomSources(t *testing.T) {
+	for _, size := range []int{1, 2, 10, 1000} {
+		a, b := RandomFromSource(size, rand.NewSource(42)), RandomFromSource(size, rand.NewSource(42))
+		if fmt.Sprint(a) != fmt.Sprint(b) {
+			t.Errorf("Permutations from equally seeded sources differ")
+		}
+		randomBytes := make([]byte, 64*size)
+		rand.New(rand.NewSource(42)).Read(randomBytes)
+		c, err := RandomFromReader(size, bytes.NewReader(randomBytes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, _ := RandomFromReader(size, bytes.NewReader(randomBytes))
+		if fmt.Sprint(c) != fmt.Sprint(d) {
+			t.Errorf("Permutations from identical byte streams differ")
+		}
+		for _, p := range []Permutation{a, c} {
+			if err := p.Validate(); err != nil {
+				t.Errorf("Invalid permutation %v: %v", p, err)
+			}
+		}
+	}
+
+	// Cryptographically strong permutations are valid and differ between calls
+	p, err := RandomFromReader(1000, crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, _ := RandomFromReader(1000, crand.Reader)
+	if err := p.Validate(); err != nil {
+		t.Errorf("Invalid permutation: %v", err)
+	} else if fmt.Sprint(p) == fmt.Sprint(q) {
+		t.Errorf("Expected different permutations")
+	}
+
+	// All permutations of three elements occur
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		p, _ := RandomFromReader(3, crand.Reader)
+		seen[fmt.Sprint(p)] = true
+	}
+	if len(seen) != 6 {
+		t.Errorf("Expected all 6 permutations, got %v", seen)
+	}
+
+	if _, err := RandomFromReader(10, bytes.NewReader(make([]byte, 8))); err == nil {
+		t.Errorf("Expected error when running out of random bytes")
+	}
+}
+
+// Type capturingMetrics records the events of an instrumented shuffler.
+type capturingMetrics struct {
+	puts, emits int
+	peak        int
+	lastSteps   int
+	held        time.Duration
+}
+
+func (m *capturingMetrics) Put(buffered int) {
+	m.puts++
+	m.peak = max(m.peak, buffered)
+}
+
+func (m *capturingMetrics) Emit(steps int, held time.Duration) {
+	m.emits++
+	m.lastSteps = steps
+	m.held += held
+}
+
+func TestMetrics(t *testing.T) {
+	rgen := rand.New(rand.NewSource(1))
+	perms := []Permutation{{0}, {1, 0}, {3, 2, 1, 0}, Random(57, rgen)}
+	for _, p := range perms {
+		for _, n := range []int{0, 1, len(p), 3 * len(p)} {
+			m := &capturingMetrics{}
+			s := NewStreamShufflerWithMetrics(p, -1, func(v interface{}) error {
+				if v == -1 {
+					return nil
+				}
+				// Element i of each cycle is held for (p[i]-i) mod k steps
+				i, k := v.(int)%len(p), len(p)
+				if expected := (p[i] - i + k) % k; m.lastSteps != expected {
+					t.Errorf("Permutation %v: element %v held for %d steps, expected %d", p, v, m.lastSteps, expected)
+				}
+				return nil
+			}, m)
+			for i := 0; i < n; i++ {
+				if err := s.Put(i); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.End(); err != nil {
+				t.Fatal(err)
+			}
+			if m.puts != n || m.emits != n {
+				t.Errorf("Permutation %v, %d elements: got %d puts and %d emits", p, n, m.puts, m.emits)
+			}
+			if n >= 2*len(p)-1 && m.peak != p.PeakBuffered() {
+				t.Errorf("Permutation %v: peak of %d buffered, expected %d", p, m.peak, p.PeakBuffered())
+			}
+			if m.held < 0 {
+				t.Errorf("Permutation %v: negative time held: %v", p, m.held)
+			}
+		}
+	}
+}
+
 func TestStreamShuffler(t *testing.T) {
 	permutations := []Permutation{
 		{0},
@@ -90,10 +237,18 @@ func shuffleString(t *testing.T, in string, s StreamShuffler) (out string) {
 		return nil
 	}
 	s = s.WithFunc(f)
+	n := 0
 	for _, c := range in {
 		s.Put(c)
+		n++
+		if b := s.Buffered(); b < 0 || b > n {
+			t.Fatalf("Implausible number of buffered elements after %d puts: %d", n, b)
+		}
 	}
 	s.End()
+	if b := s.Buffered(); b != 0 {
+		t.Fatalf("Expected empty buffer after End, got %d elements", b)
+	}
 	return
 }
 
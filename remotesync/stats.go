@@ -0,0 +1,101 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Names of the wishlist encodings as reported in TransferStats.
+const (
+	CodecBitmap = "bitmap"
+	CodecRLE    = "rle"
+	CodecIndex  = "index"
+)
+
+// Type TransferStats summarizes a transfer received by a Builder (see Builder.Stats).
+//
+// TransferStats implements json.Marshaler. The field names of the JSON object are stable:
+//
+//	chunks               number of chunks announced by the sender
+//	chunks_received      number of chunks received from the sender
+//	bytes                number of bytes announced, i.e. the size of the file
+//	bytes_received       number of bytes of chunk data received from the sender
+//	dedup_ratio          fraction of bytes that needn't be transferred, between 0 and 1
+//	duration_seconds     time from creating the Builder until the reconstruction ended
+//	codec                encoding of the wishlist, "bitmap", "rle" or "index"
+type TransferStats struct {
+	Chunks         int
+	ChunksReceived int
+	Bytes          int64
+	BytesReceived  int64
+	Duration       time.Duration
+	Codec          string
+}
+
+// Returns the fraction of announced bytes that were already present at the receiver, i.e. one minus
+// the ratio of the bytes transferred to the bytes that would have been transferred without
+// deduplication. Chunks announced repeatedly are only transferred once.
+func (s TransferStats) DedupRatio() float64 {
+	if s.Bytes == 0 {
+		return 0
+	}
+	return 1 - float64(s.BytesReceived)/float64(s.Bytes)
+}
+
+func (s TransferStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Chunks          int     `json:"chunks"`
+		ChunksReceived  int     `json:"chunks_received"`
+		Bytes           int64   `json:"bytes"`
+		BytesReceived   int64   `json:"bytes_received"`
+		DedupRatio      float64 `json:"dedup_ratio"`
+		DurationSeconds float64 `json:"duration_seconds"`
+		Codec           string  `json:"codec"`
+	}{
+		Chunks:          s.Chunks,
+		ChunksReceived:  s.ChunksReceived,
+		Bytes:           s.Bytes,
+		BytesReceived:   s.BytesReceived,
+		DedupRatio:      s.DedupRatio(),
+		DurationSeconds: s.Duration.Seconds(),
+		Codec:           s.Codec,
+	})
+}
+
+// Returns statistics about the transfer so far. After ReconstructFileFromRequestedChunks has
+// finished, successfully or not, the statistics are final.
+func (b *Builder) Stats() TransferStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	stats := b.stats
+	if b.recon != nil {
+		stats.ChunksReceived += b.recon.received
+	}
+	if b.recon == nil || !b.recon.finished {
+		stats.Duration = time.Since(b.transfer.info.Started)
+	}
+	stats.Codec = CodecBitmap
+	switch wishListFormatOf(b.opts.RunLengthWishList, b.opts.IndexWishList) {
+	case formatRunLength:
+		stats.Codec = CodecRLE
+	case formatIndex:
+		stats.Codec = CodecIndex
+	}
+	return stats
+}
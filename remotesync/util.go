@@ -19,10 +19,12 @@ package remotesync
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/indyjo/cafs"
 	"github.com/indyjo/cafs/chunking/adler32"
 	"io"
+	"syscall"
 )
 
 // The zero key is used to mark the end of a stream of chunk infos.
@@ -32,6 +34,28 @@ var zeroKey cafs.SKey = cafs.SKey{}
 // for empty slots generated by shuffled transmissions.
 var emptyKey cafs.SKey = *cafs.MustParseKey("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
 
+// Function checkPeerClosed translates errors signalling that the remote end of a connection
+// has gone away into ErrPeerClosed. All other errors (including nil) are returned unchanged.
+func checkPeerClosed(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, io.ErrClosedPipe) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
+		return ErrPeerClosed
+	}
+	return err
+}
+
+// Function checkTruncated translates an unexpected end of a stream read from the peer into an
+// error matching both ErrPeerClosed and io.ErrUnexpectedEOF. All other errors are passed on to
+// checkPeerClosed.
+func checkTruncated(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, ErrPeerClosed) {
+		return fmt.Errorf("%w: %w", ErrPeerClosed, err)
+	}
+	return checkPeerClosed(err)
+}
+
 func readChunkLength(r *bufio.Reader) (int64, error) {
 	if l, err := binary.ReadVarint(r); err != nil {
 		return 0, err
@@ -75,6 +99,11 @@ func (w *bitWriter) WriteBit(b bool) (err error) {
 	return
 }
 
+// Nothing to do, as the sender already blocks for at most 8 pending bits.
+func (w *bitWriter) sync() error {
+	return nil
+}
+
 func (w *bitWriter) Flush() (err error) {
 	for err == nil && w.n != 0 {
 		err = w.WriteBit(false)
@@ -108,6 +137,13 @@ func (r *bitReader) ReadBit() (bit bool, err error) {
 	return
 }
 
+func (r *bitReader) expectEnd() error {
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return errors.New("Wishlist too long")
+	}
+	return nil
+}
+
 // Function readChunk reads a single chunk worth of data from stream `r` into a new
 // file on FileStorage `s`.
 // The expected encoding is (varint, data...).
@@ -121,6 +157,11 @@ func readChunk(s cafs.FileStorage, r *bufio.Reader, info string) (cafs.File, err
 	if length < 0 || length > adler32.MAX_CHUNK {
 		return nil, fmt.Errorf("Invalid chunk length: %v", length)
 	}
+	return copyChunk(s, r, length, info)
+}
+
+// Function copyChunk copies `length` bytes from `r` into a new file on FileStorage `s`.
+func copyChunk(s cafs.FileStorage, r io.Reader, length int64, info string) (cafs.File, error) {
 	tempChunk := s.Create(info)
 	defer tempChunk.Dispose()
 	if _, err := io.CopyN(tempChunk, r, length); err != nil {
@@ -0,0 +1,211 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"bytes"
+	"errors"
+	"github.com/indyjo/cafs"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Reported by VerifyReplica for keys whose content differs between the storages.
+var ErrContentMismatch = errors.New("Content mismatch")
+
+// Returned by VerifyReplica if repairing is requested, but the replica doesn't implement cafs.Repairer.
+var ErrCannotRepair = errors.New("Storage can't repair content")
+
+// Type VerifyOptions contains optional settings for VerifyReplica.
+// The zero value selects the default behavior.
+type VerifyOptions struct {
+	// The number of keys verified concurrently. Defaults to 4.
+	Workers int
+
+	// If set, called after each key has been verified with the number of keys verified so far
+	// and the total number of keys. May be called concurrently.
+	Progress func(verified, total int)
+
+	// If set, chunks and unchunked files whose content differs are overwritten in the replica with
+	// the content read from the source, which requires the replica to implement cafs.Repairer.
+	// Mismatching lists of chunks and missing keys are only reported.
+	Repair bool
+}
+
+// Type Mismatch describes a key for which a replica doesn't match its source.
+type Mismatch struct {
+	Key cafs.SKey
+	Err error // cafs.ErrNotFound if missing from the replica, ErrContentMismatch, or a read error
+	// Set if the replica has been repaired (see VerifyOptions.Repair). If repairing failed, Err
+	// holds the reason instead of ErrContentMismatch, e.g. cafs.ErrKeyMismatch if the source's
+	// content is corrupt as well.
+	Repaired bool
+}
+
+// Function VerifyReplica checks that storage `b` holds everything storage `a` holds, byte for byte.
+// For every key in `a`, which must implement cafs.KeyEnumerator, the data of chunks and unchunked
+// files is read from both storages and compared. For chunked files, the lists of chunks are compared.
+// This detects storages holding wrong content under the right key, which can be healed in the same
+// pass (see VerifyOptions.Repair). Returns the mismatches found, ordered by key. Keys evicted from
+// `a` while verifying are skipped.
+func VerifyReplica(a, b cafs.FileStorage, opts VerifyOptions) ([]Mismatch, error) {
+	enumerator, ok := a.(cafs.KeyEnumerator)
+	if !ok {
+		return nil, ErrCannotEnumerate
+	}
+	repairer, ok := b.(cafs.Repairer)
+	if opts.Repair && !ok {
+		return nil, ErrCannotRepair
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	var keys []cafs.SKey
+	enumerator.EnumerateKeys(func(key cafs.SKey) bool {
+		keys = append(keys, key)
+		return true
+	})
+
+	var mutex sync.Mutex
+	var mismatches []Mismatch
+	verified := 0
+	work := make(chan cafs.SKey)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				err := verifyKey(a, b, key)
+				repaired := false
+				if opts.Repair && err == ErrContentMismatch {
+					var repairErr error
+					if repaired, repairErr = repairKey(a, b, repairer, key); repairErr != nil {
+						err = repairErr
+					}
+				}
+				mutex.Lock()
+				if err != nil {
+					mismatches = append(mismatches, Mismatch{key, err, repaired})
+				}
+				verified++
+				n := verified
+				mutex.Unlock()
+				if opts.Progress != nil {
+					opts.Progress(n, len(keys))
+				}
+			}
+		}()
+	}
+	for _, key := range keys {
+		work <- key
+	}
+	close(work)
+	wg.Wait()
+
+	sort.Slice(mismatches, func(i, j int) bool {
+		return bytes.Compare(mismatches[i].Key[:], mismatches[j].Key[:]) < 0
+	})
+	return mismatches, nil
+}
+
+// Compares the file or chunk stored as `key` in both storages.
+func verifyKey(a, b cafs.FileStorage, key cafs.SKey) error {
+	fa, err := a.Get(&key)
+	if err == cafs.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fa.Dispose()
+	fb, err := b.Get(&key)
+	if err != nil {
+		return err
+	}
+	defer fb.Dispose()
+
+	if fa.Size() != fb.Size() || fa.IsChunked() != fb.IsChunked() {
+		return ErrContentMismatch
+	}
+	if fa.IsChunked() {
+		ca, cb := ListChunks(fa), ListChunks(fb)
+		if len(ca) != len(cb) {
+			return ErrContentMismatch
+		}
+		for i := range ca {
+			if ca[i] != cb[i] {
+				return ErrContentMismatch
+			}
+		}
+		return nil
+	}
+
+	ra, rb := fa.Open(), fb.Open()
+	defer ra.Close()
+	defer rb.Close()
+	return compareStreams(ra, rb)
+}
+
+// Overwrites the content stored as `key` in replica `b` with the content read from `a`, then
+// verifies it again. Returns false if the key refers to a list of chunks, which can't be repaired.
+func repairKey(a, b cafs.FileStorage, repairer cafs.Repairer, key cafs.SKey) (bool, error) {
+	fa, err := a.Get(&key)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Dispose()
+	if fa.IsChunked() {
+		return false, nil
+	}
+	r := fa.Open()
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return false, err
+	}
+	if err := repairer.Repair(&key, data); err != nil {
+		return false, err
+	}
+	if err := verifyKey(a, b, key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func compareStreams(a, b io.Reader) error {
+	bufA, bufB := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		na, errA := io.ReadFull(a, bufA)
+		nb, errB := io.ReadFull(b, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return ErrContentMismatch
+		}
+		endA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		endB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		if errA != nil && !endA {
+			return errA
+		} else if errB != nil && !endB {
+			return errB
+		} else if endA || endB {
+			if endA != endB {
+				return ErrContentMismatch
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,345 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"io"
+	"sync"
+)
+
+// Function WriteRootsChunkHashes is the sender's part of warming a storage with a set of files
+// identified by their root keys (see Warmer). For every root, the root key and the number of
+// chunks (varint, or -1 if the file isn't available) is written, followed by the chunks' hashes
+// and lengths, as in the announcement written by WriteChunkHashes. Chunks are not shuffled.
+func WriteRootsChunkHashes(storage cafs.FileStorage, roots []cafs.SKey, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, root := range roots {
+		bw.Write(root[:])
+		file, err := storage.Get(&root)
+		if err == cafs.ErrNotFound {
+			if err := writeVarint(bw, -1); err != nil {
+				return checkPeerClosed(err)
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		chunks := ListChunks(file)
+		file.Dispose()
+		if err := writeVarint(bw, int64(len(chunks))); err != nil {
+			return checkPeerClosed(err)
+		}
+		for _, c := range chunks {
+			bw.Write(c.Key[:])
+			if err := writeVarint(bw, c.Size); err != nil {
+				return checkPeerClosed(err)
+			}
+		}
+	}
+	return checkPeerClosed(bw.Flush())
+}
+
+// Function WriteRootsChunkData writes the data of the chunks requested by a Warmer's wishlist,
+// read from `r`, to `w`. The roots must be the same as those passed to WriteRootsChunkHashes, and
+// must still be available.
+func WriteRootsChunkData(storage cafs.FileStorage, roots []cafs.SKey, r io.ByteReader, w io.Writer) error {
+	bits := newBitReader(r)
+	for _, root := range roots {
+		file, err := storage.Get(&root)
+		if err == cafs.ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = forEachChunkOf(file, func(chunk cafs.File) error {
+			if requested, err := bits.ReadBit(); err != nil {
+				return fmt.Errorf("Wishlist too short: %v on chunk %v", err, chunk.Key())
+			} else if !requested {
+				return nil
+			}
+			if err := writeVarint(w, chunk.Size()); err != nil {
+				return err
+			}
+			return copyChunkData(w, chunk.Duplicate())
+		})
+		file.Dispose()
+		if err != nil {
+			return checkPeerClosed(err)
+		}
+	}
+	return nil
+}
+
+// Calls `f` for every chunk of `file`, in order.
+func forEachChunkOf(file cafs.File, f func(chunk cafs.File) error) error {
+	iter := file.Chunks()
+	defer iter.Dispose()
+	for iter.Next() {
+		chunk := iter.File()
+		err := f(chunk)
+		chunk.Dispose()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Type Warmer pulls a set of files identified by their root keys into a storage, e.g. for
+// pre-warming a cache. All chunks missing from the storage are requested in a single exchange,
+// and chunks shared between the files are requested only once. The exchange is:
+//   - the sender writes an announcement using WriteRootsChunkHashes
+//   - the Warmer reads it in WriteWishList and writes a wishlist of missing chunks
+//   - the sender writes the chunk data using WriteRootsChunkData
+//   - the Warmer reads it in ReceiveChunks and reconstructs the files
+//
+// WriteWishList and ReceiveChunks may run concurrently.
+type Warmer struct {
+	storage cafs.FileStorage
+	info    string
+
+	mutex     sync.Mutex // Guards subsequent variables
+	cond      *sync.Cond // Signalled when requested grows or the wishlist is done
+	roots     []warmRoot
+	chunks    map[cafs.SKey]cafs.File // Chunks available for reconstruction
+	sizes     map[cafs.SKey]int64     // Lengths of all announced chunks
+	requested []cafs.SKey             // Chunks requested so far, in order
+	done      bool                    // Set when WriteWishList has returned
+	err       error                   // The error WriteWishList returned
+	disposed  bool
+}
+
+type warmRoot struct {
+	key       cafs.SKey
+	available bool // Whether the sender has the file
+	chunks    []cafs.SKey
+}
+
+// Returns a Warmer pulling files into `storage`. Must eventually be disposed.
+func NewWarmer(storage cafs.FileStorage, info string) *Warmer {
+	w := &Warmer{
+		storage: storage,
+		info:    info,
+		chunks:  make(map[cafs.SKey]cafs.File),
+		sizes:   make(map[cafs.SKey]int64),
+	}
+	w.cond = sync.NewCond(&w.mutex)
+	return w
+}
+
+// Releases the chunks held by the Warmer.
+func (w *Warmer) Dispose() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.disposed = true
+	for _, chunk := range w.chunks {
+		chunk.Dispose()
+	}
+	w.chunks = nil
+	w.cond.Broadcast()
+}
+
+// Returns the number of chunks requested from the sender so far.
+func (w *Warmer) RequestedChunks() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.requested)
+}
+
+// Reads an announcement written by WriteRootsChunkHashes and writes a wishlist with one bit per
+// announced chunk, requesting every chunk missing from the storage exactly once. Chunks already
+// present are kept from being evicted until the Warmer is disposed.
+// Returns ErrPeerClosed if the sender stopped reading the wishlist prematurely.
+func (w *Warmer) WriteWishList(_r io.Reader, fw FlushWriter) (err error) {
+	defer func() {
+		w.mutex.Lock()
+		w.done, w.err = true, err
+		w.cond.Broadcast()
+		w.mutex.Unlock()
+	}()
+	r := bufio.NewReader(_r)
+	bits := newBitWriter(fw)
+	for idx := 0; ; idx++ {
+		var root warmRoot
+		if _, err := io.ReadFull(r, root.key[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Error reading root #%d: %v", idx, err)
+		}
+		n, err := readChunkCount(r)
+		if err != nil {
+			return fmt.Errorf("Error reading number of chunks of root #%d: %v", idx, err)
+		}
+		root.available = n >= 0
+		for i := int64(0); i < n; i++ {
+			var key cafs.SKey
+			if _, err := io.ReadFull(r, key[:]); err != nil {
+				return fmt.Errorf("Error reading hash of chunk #%d of root #%d: %v", i, idx, err)
+			}
+			length, err := readChunkLength(r)
+			if err != nil {
+				return fmt.Errorf("Error reading length of chunk #%d of root #%d: %v", i, idx, err)
+			}
+			root.chunks = append(root.chunks, key)
+			if err := bits.WriteBit(w.request(key, length)); err != nil {
+				return checkPeerClosed(err)
+			}
+		}
+		w.mutex.Lock()
+		w.roots = append(w.roots, root)
+		w.mutex.Unlock()
+	}
+	return checkPeerClosed(bits.Flush())
+}
+
+// Reads the number of chunks of a root, which is -1 if the root isn't available.
+func readChunkCount(r *bufio.Reader) (int64, error) {
+	if n, err := binary.ReadVarint(r); err != nil {
+		return 0, err
+	} else if n < -1 {
+		return 0, fmt.Errorf("Illegal number of chunks: %v", n)
+	} else {
+		return n, nil
+	}
+}
+
+// Returns whether the chunk must be requested, and remembers it.
+func (w *Warmer) request(key cafs.SKey, length int64) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.sizes[key]; ok || w.disposed {
+		return false
+	}
+	w.sizes[key] = length
+	if chunk, err := w.storage.Get(&key); err == nil {
+		w.chunks[key] = chunk
+		return false
+	}
+	w.requested = append(w.requested, key)
+	w.cond.Broadcast()
+	return true
+}
+
+// Reads the chunk data written by WriteRootsChunkData and reconstructs the files. Returns the files
+// in the order of the announced roots, or nil for roots not available at the sender. The files
+// must be disposed by the caller. Returns ErrUnexpectedChunk if the data doesn't match the
+// announcement, and ErrContentMismatch if a reconstructed file doesn't match its root key.
+func (w *Warmer) ReceiveChunks(_r io.Reader) ([]cafs.File, error) {
+	r := bufio.NewReader(_r)
+	for idx := 0; ; idx++ {
+		key, ok, err := w.nextRequested(idx)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			break
+		}
+		chunk, err := readChunk(w.storage, r, fmt.Sprintf("%v #%d", w.info, idx))
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		w.mutex.Lock()
+		if chunk.Key() != key || chunk.Size() != w.sizes[key] {
+			w.mutex.Unlock()
+			chunk.Dispose()
+			return nil, ErrUnexpectedChunk
+		} else if w.disposed {
+			w.mutex.Unlock()
+			chunk.Dispose()
+			return nil, ErrDisposed
+		}
+		w.chunks[key] = chunk
+		w.mutex.Unlock()
+	}
+
+	w.mutex.Lock()
+	roots := w.roots
+	w.mutex.Unlock()
+	files := make([]cafs.File, 0, len(roots))
+	disposeAll := func() {
+		for _, f := range files {
+			if f != nil {
+				f.Dispose()
+			}
+		}
+	}
+	for _, root := range roots {
+		if !root.available {
+			files = append(files, nil)
+			continue
+		}
+		file, err := w.reconstruct(root)
+		if err != nil {
+			disposeAll()
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Waits until the chunk requested as number `idx` is known and returns it. Returns false if
+// WriteWishList has finished and requested fewer chunks.
+func (w *Warmer) nextRequested(idx int) (cafs.SKey, bool, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for idx >= len(w.requested) && !w.done && !w.disposed {
+		w.cond.Wait()
+	}
+	if w.disposed {
+		return cafs.SKey{}, false, ErrDisposed
+	} else if idx < len(w.requested) {
+		return w.requested[idx], true, nil
+	} else if w.err != nil {
+		return cafs.SKey{}, false, w.err
+	}
+	return cafs.SKey{}, false, nil
+}
+
+func (w *Warmer) reconstruct(root warmRoot) (cafs.File, error) {
+	if file, err := w.storage.Get(&root.key); err == nil {
+		return file, nil
+	}
+	temp := w.storage.Create(fmt.Sprintf("%v %v", w.info, root.key))
+	defer temp.Dispose()
+	for _, key := range root.chunks {
+		w.mutex.Lock()
+		chunk := w.chunks[key]
+		w.mutex.Unlock()
+		if chunk == nil {
+			return nil, ErrDisposed
+		}
+		if err := appendChunk(temp, chunk); err != nil {
+			return nil, err
+		}
+	}
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	file := temp.File()
+	if file.Key() != root.key {
+		file.Dispose()
+		return nil, ErrContentMismatch
+	}
+	return file, nil
+}
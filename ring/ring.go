@@ -0,0 +1,750 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package ring implements a storage that distributes chunks across several backing storages by
+// consistent hashing on their keys. Adding a backend only moves the share of keys assigned to it.
+package ring
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	. "github.com/indyjo/cafs"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Returned by AddBackend if a backend of the same name exists already.
+var ErrDuplicateBackend = errors.New("Duplicate backend name")
+
+// Returned when content needs to be stored but there is no backend.
+var ErrNoBackend = errors.New("No backend")
+
+// Number of eviction events buffered per backend until the ring is accessed next
+const eventBufferSize = 1024
+
+// Type BackendError is returned when a backing storage fails for a reason other than
+// cafs.ErrNotFound, e.g. because it is unreachable.
+type BackendError struct {
+	Backend string // The name of the failing backend
+	Err     error
+}
+
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("Backend %v: %v", e.Backend, e.Err)
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// Interface RingStorage is a FileStorage that stores every chunk in the backend owning its key.
+// Files consisting of more than one chunk are indexed in memory, so they are available only
+// from the RingStorage they were created in. A file is removed from the index when one of its
+// chunks is evicted by a backend.
+type RingStorage interface {
+	FileStorage
+	KeyEnumerator
+
+	// Adds a backing storage under a unique name. Content stored before remains readable,
+	// even if its key is now owned by the new backend.
+	AddBackend(name string, storage FileStorage) error
+
+	// Returns the name of the backend owning `key`, or the empty string if there is no backend.
+	Owner(key *SKey) string
+}
+
+// Type Options contains optional settings for a RingStorage.
+// The zero value selects the default behavior.
+type Options struct {
+	// The number of positions each backend occupies on the ring. More positions distribute keys
+	// more evenly. Defaults to 64.
+	VirtualNodes int
+	// Named chunker configurations which can be selected through CreateOptions.Profile.
+	Profiles ChunkingProfiles
+}
+
+type backend struct {
+	name    string
+	storage FileStorage
+	events  *Subscription // Reports evicted chunks
+	dropped int64         // Number of events dropped as of the last check
+}
+
+type point struct {
+	pos     uint64
+	backend *backend
+}
+
+type chunkRef struct {
+	key  SKey
+	size int64
+}
+
+type fileEntry struct {
+	size        int64
+	contentType string
+	chunks      []chunkRef
+}
+
+// Type heldEntry holds the references acquired through ringChunkStore to a chunk or file.
+type heldEntry struct {
+	refs   int
+	chunk  File       // Handle to the chunk in its backend, unless a file of several chunks
+	entry  *fileEntry // The index entry of such a file
+	chunks []ChunkRef // The chunks of such a file, which are held along with it
+}
+
+type ringStorage struct {
+	opts   Options
+	events EventBroker
+
+	mutex      sync.Mutex
+	backends   []*backend
+	points     []point             // Positions of the backends, ordered by pos
+	files      map[SKey]*fileEntry // Files consisting of more than one chunk
+	chunkFiles map[SKey][]SKey     // Keys of the files referencing each chunk
+	held       map[SKey]*heldEntry // Entries referenced by temporaries and the files created by them
+}
+
+// Returns a new ring over the given backends, keyed by name. Backends can be added later.
+func NewRingStorage(backends map[string]FileStorage, opts Options) (RingStorage, error) {
+	if opts.VirtualNodes <= 0 {
+		opts.VirtualNodes = 64
+	}
+	s := &ringStorage{
+		opts:       opts,
+		files:      make(map[SKey]*fileEntry),
+		chunkFiles: make(map[SKey][]SKey),
+		held:       make(map[SKey]*heldEntry),
+	}
+	for name, storage := range backends {
+		if err := s.AddBackend(name, storage); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func position(key *SKey) uint64 {
+	return binary.BigEndian.Uint64(key[:8])
+}
+
+func (s *ringStorage) AddBackend(name string, storage FileStorage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, b := range s.backends {
+		if b.name == name {
+			return ErrDuplicateBackend
+		}
+	}
+	b := &backend{name: name, storage: storage, events: storage.Subscribe(eventBufferSize)}
+	s.backends = append(s.backends, b)
+	for i := 0; i < s.opts.VirtualNodes; i++ {
+		key := SKey(sha256.Sum256([]byte(fmt.Sprintf("%v#%d", name, i))))
+		s.points = append(s.points, point{position(&key), b})
+	}
+	sort.Slice(s.points, func(i, j int) bool {
+		return s.points[i].pos < s.points[j].pos
+	})
+	return nil
+}
+
+// Returns the backends in the order they are asked for `key`, starting with its owner and
+// continuing clockwise on the ring. Must be called with the mutex held.
+func (s *ringStorage) lookupOrderL(key *SKey) []*backend {
+	if len(s.points) == 0 {
+		return nil
+	}
+	pos := position(key)
+	start := sort.Search(len(s.points), func(i int) bool {
+		return s.points[i].pos >= pos
+	})
+	result := make([]*backend, 0, len(s.backends))
+	for i := 0; i < len(s.points) && len(result) < len(s.backends); i++ {
+		b := s.points[(start+i)%len(s.points)].backend
+		seen := false
+		for _, r := range result {
+			seen = seen || r == b
+		}
+		if !seen {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+func (s *ringStorage) lookupOrder(key *SKey) []*backend {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lookupOrderL(key)
+}
+
+func (s *ringStorage) Owner(key *SKey) string {
+	if order := s.lookupOrder(key); len(order) > 0 {
+		return order[0].name
+	}
+	return ""
+}
+
+func (s *ringStorage) getEntry(key *SKey) *fileEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pruneL()
+	return s.files[*key]
+}
+
+// Removes the files from the index whose chunks have been evicted by the backends, as reported
+// by their events. If events have been dropped, all chunks are checked. Must be called with the
+// mutex held.
+func (s *ringStorage) pruneL() {
+	lost := false
+	for _, b := range s.backends {
+	drain:
+		for {
+			select {
+			case e := <-b.events.C:
+				if e.Type == EventEvicted && len(s.chunkFiles[e.Key]) > 0 {
+					s.checkChunkL(e.Key)
+				}
+			default:
+				break drain
+			}
+		}
+		if dropped := b.events.Dropped(); dropped != b.dropped {
+			b.dropped, lost = dropped, true
+		}
+	}
+	if lost {
+		for key := range s.chunkFiles {
+			s.checkChunkL(key)
+		}
+	}
+}
+
+// Removes the files referencing a chunk from the index, unless a backend still has the chunk,
+// e.g. because it has been stored again since being evicted. Must be called with the mutex held.
+func (s *ringStorage) checkChunkL(key SKey) {
+	for _, b := range s.lookupOrderL(&key) {
+		if _, err := b.storage.StatByKey(&key); err == nil {
+			return
+		}
+	}
+	s.removeFilesL(key)
+}
+
+// Removes the files referencing a chunk from the index. Must be called with the mutex held.
+func (s *ringStorage) removeFilesL(chunk SKey) {
+	for _, key := range s.chunkFiles[chunk] {
+		entry := s.files[key]
+		if entry == nil {
+			continue
+		}
+		delete(s.files, key)
+		for _, c := range entry.chunks {
+			files := s.chunkFiles[c.key]
+			for i := range files {
+				if files[i] == key {
+					files = append(files[:i], files[i+1:]...)
+					break
+				}
+			}
+			if len(files) == 0 {
+				delete(s.chunkFiles, c.key)
+			} else {
+				s.chunkFiles[c.key] = files
+			}
+		}
+	}
+	delete(s.chunkFiles, chunk)
+}
+
+// Removes the files referencing a chunk found missing from the index.
+func (s *ringStorage) chunkMissing(chunk *SKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removeFilesL(*chunk)
+}
+
+func (s *ringStorage) Create(info string) Temporary {
+	return s.CreateWithOptions(info, CreateOptions{})
+}
+
+// Creates a temporary that chunks the content and stores each chunk in the backend owning it.
+// Chunks stored before a chunk is rejected by Scan are released, but left to the backends to evict.
+func (s *ringStorage) CreateWithOptions(info string, opts CreateOptions) Temporary {
+	return NewChunkingTemporary(ringChunkStore{s}, sha256.New, s.opts.Profiles, info, opts)
+}
+
+// Queries the backends in ring order, starting with the owner of the key. Content stored before
+// a backend was added is thereby found at its previous owner. A failing backend causes a
+// BackendError only if no other backend has the content.
+func (s *ringStorage) Get(key *SKey) (File, error) {
+	entry := s.getEntry(key)
+	if entry == nil {
+		return s.getChunk(key)
+	}
+	f := &ringFile{key: *key, entry: entry, chunks: make([]File, 0, len(entry.chunks))}
+	for _, c := range entry.chunks {
+		chunk, err := s.getChunk(&c.key)
+		if err == ErrNotFound {
+			s.chunkMissing(&c.key)
+		}
+		if err != nil {
+			f.Dispose()
+			return nil, err
+		}
+		f.chunks = append(f.chunks, chunk)
+	}
+	return f, nil
+}
+
+func (s *ringStorage) getChunk(key *SKey) (File, error) {
+	var result error = ErrNotFound
+	for _, b := range s.lookupOrder(key) {
+		f, err := b.storage.Get(key)
+		if err == nil {
+			return f, nil
+		} else if err != ErrNotFound && result == ErrNotFound {
+			result = &BackendError{b.name, err}
+		}
+	}
+	return nil, result
+}
+
+func (s *ringStorage) StatByKey(key *SKey) (FileStat, error) {
+	entry := s.getEntry(key)
+	if entry == nil {
+		return s.statChunk(key)
+	}
+	stat := FileStat{Size: entry.size, NumChunks: int64(len(entry.chunks)), Resident: true}
+	for _, c := range entry.chunks {
+		if chunkStat, err := s.statChunk(&c.key); err != nil {
+			if err == ErrNotFound {
+				s.chunkMissing(&c.key)
+			}
+			return FileStat{}, err
+		} else if !chunkStat.Resident {
+			stat.Resident = false
+		}
+	}
+	return stat, nil
+}
+
+func (s *ringStorage) statChunk(key *SKey) (FileStat, error) {
+	var result error = ErrNotFound
+	for _, b := range s.lookupOrder(key) {
+		stat, err := b.storage.StatByKey(key)
+		if err == nil {
+			return stat, nil
+		} else if err != ErrNotFound && result == ErrNotFound {
+			result = &BackendError{b.name, err}
+		}
+	}
+	return FileStat{}, result
+}
+
+// Pins the file's chunks in the backends they were retrieved from.
+func (s *ringStorage) Pin(file File) error {
+	chunks := []File{file}
+	if f, ok := file.(*ringFile); ok {
+		chunks = f.chunks
+	}
+	for i, chunk := range chunks {
+		if err := s.forChunk(chunk, FileStorage.Pin); err != nil {
+			for _, pinned := range chunks[:i] {
+				_ = s.forChunk(pinned, FileStorage.Unpin)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ringStorage) Unpin(file File) error {
+	chunks := []File{file}
+	if f, ok := file.(*ringFile); ok {
+		chunks = f.chunks
+	}
+	for _, chunk := range chunks {
+		if err := s.forChunk(chunk, FileStorage.Unpin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls `f` with the backend the chunk belongs to, which is the first one not returning ErrForeignFile.
+func (s *ringStorage) forChunk(chunk File, f func(FileStorage, File) error) error {
+	key := chunk.Key()
+	for _, b := range s.lookupOrder(&key) {
+		if err := f(b.storage, chunk); err != ErrForeignFile {
+			return err
+		}
+	}
+	return ErrForeignFile
+}
+
+// Enumerates the keys of files consisting of more than one chunk and the keys of all backends
+// implementing KeyEnumerator.
+func (s *ringStorage) EnumerateKeys(f func(key SKey) bool) {
+	s.mutex.Lock()
+	s.pruneL()
+	keys := make([]SKey, 0, len(s.files))
+	for key := range s.files {
+		keys = append(keys, key)
+	}
+	backends := append([]*backend(nil), s.backends...)
+	s.mutex.Unlock()
+
+	for _, b := range backends {
+		if e, ok := b.storage.(KeyEnumerator); ok {
+			e.EnumerateKeys(func(key SKey) bool {
+				keys = append(keys, key)
+				return true
+			})
+		}
+	}
+	for _, key := range SortKeys(keys) {
+		if !f(key) {
+			return
+		}
+	}
+}
+
+func (s *ringStorage) DumpStatistics(log Printer) {
+	s.mutex.Lock()
+	s.pruneL()
+	backends := append([]*backend(nil), s.backends...)
+	log.Printf("Ring: %d backends, %d files indexed", len(backends), len(s.files))
+	s.mutex.Unlock()
+	for _, b := range backends {
+		log.Printf("Backend %v:", b.name)
+		b.storage.DumpStatistics(log)
+	}
+}
+
+// Subscribes to the events of the ring itself, which reports files consisting of more than one
+// chunk as they are stored. Events concerning chunks are published by the backends.
+func (s *ringStorage) Subscribe(bufferSize int) *Subscription {
+	return s.events.Subscribe(bufferSize)
+}
+
+// Stores a chunk in the backend owning it and returns a handle to it.
+func (s *ringStorage) storeChunk(key *SKey, data []byte, info string, sniff bool) (File, error) {
+	order := s.lookupOrder(key)
+	if len(order) == 0 {
+		return nil, ErrNoBackend
+	}
+	b := order[0]
+	// Prevent the backend from splitting the chunk
+	temp := b.storage.CreateWithOptions(info, CreateOptions{InlineThreshold: int64(len(data)), SniffContentType: sniff})
+	defer temp.Dispose()
+	if _, err := temp.Write(data); err != nil {
+		return nil, &BackendError{b.name, err}
+	}
+	if err := temp.Close(); err != nil {
+		return nil, &BackendError{b.name, err}
+	}
+	return temp.File(), nil
+}
+
+// Registers a file consisting of more than one chunk, unless it's known already. Must be called
+// with the mutex held.
+func (s *ringStorage) storeEntryL(key *SKey, entry *fileEntry, info string) *fileEntry {
+	s.pruneL()
+	if existing := s.files[*key]; existing != nil {
+		return existing
+	}
+	s.files[*key] = entry
+	for _, c := range entry.chunks {
+		s.chunkFiles[c.key] = append(s.chunkFiles[c.key], *key)
+	}
+	s.events.Publish(Event{Type: EventStored, Key: *key, Size: entry.size, Info: info})
+	return entry
+}
+
+// Type ringChunkStore lets a ChunkingTemporary store into a ring. Every chunk is stored as an
+// unchunked file in the backend owning it. The references acquired are kept as handles to these
+// files, and files consisting of several chunks are registered in the index.
+type ringChunkStore struct {
+	*ringStorage
+}
+
+func (s ringChunkStore) StoreData(key *SKey, data []byte, info, contentType string) (bool, error) {
+	if s.lockHeld(key) {
+		return true, nil
+	}
+	_, statErr := s.statChunk(key)
+	chunk, err := s.storeChunk(key, data, info, contentType != "")
+	if err != nil {
+		return false, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if h := s.held[*key]; h != nil {
+		// Stored concurrently
+		h.refs++
+		chunk.Dispose()
+		return true, nil
+	}
+	s.held[*key] = &heldEntry{refs: 1, chunk: chunk}
+	return statErr == nil, nil
+}
+
+func (s ringChunkStore) StoreChunks(key *SKey, chunks []ChunkRef, info, contentType string) error {
+	refs := make([]chunkRef, len(chunks))
+	var pos int64
+	for i, chunk := range chunks {
+		refs[i] = chunkRef{key: chunk.Key, size: chunk.NextPos - pos}
+		pos = chunk.NextPos
+	}
+	s.mutex.Lock()
+	entry := s.storeEntryL(key, &fileEntry{size: pos, contentType: contentType, chunks: refs}, info)
+	h := s.held[*key]
+	if h == nil {
+		s.held[*key] = &heldEntry{refs: 1, entry: entry, chunks: chunks}
+		s.mutex.Unlock()
+		return nil
+	}
+	// The existing entry holds its chunks already
+	h.refs++
+	s.mutex.Unlock()
+	for i := range chunks {
+		s.Release(&chunks[i].Key)
+	}
+	return nil
+}
+
+func (s ringChunkStore) LockChunk(key *SKey) (int64, error) {
+	s.mutex.Lock()
+	if h := s.held[*key]; h != nil && h.chunk != nil {
+		h.refs++
+		s.mutex.Unlock()
+		return h.chunk.Size(), nil
+	}
+	s.mutex.Unlock()
+	chunk, err := s.getChunk(key)
+	if err != nil {
+		return 0, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if h := s.held[*key]; h != nil {
+		h.refs++
+		chunk.Dispose()
+		return h.chunk.Size(), nil
+	}
+	s.held[*key] = &heldEntry{refs: 1, chunk: chunk}
+	return chunk.Size(), nil
+}
+
+// Acquires another reference to a chunk held already, if any.
+func (s ringChunkStore) lockHeld(key *SKey) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if h := s.held[*key]; h != nil && h.chunk != nil {
+		h.refs++
+		return true
+	}
+	return false
+}
+
+func (s ringChunkStore) Release(key *SKey) {
+	s.mutex.Lock()
+	h := s.held[*key]
+	h.refs--
+	if h.refs > 0 {
+		s.mutex.Unlock()
+		return
+	}
+	delete(s.held, *key)
+	s.mutex.Unlock()
+	if h.chunk != nil {
+		h.chunk.Dispose()
+	}
+	for i := range h.chunks {
+		s.Release(&h.chunks[i].Key)
+	}
+}
+
+// Chunks are never removed from the backends, which evict them once they are released.
+func (s ringChunkStore) Remove(key *SKey) {
+}
+
+func (s ringChunkStore) File(key *SKey) (File, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	h := s.held[*key]
+	if h == nil {
+		return nil, ErrNotFound
+	}
+	if h.chunk != nil {
+		return h.chunk.Duplicate(), nil
+	}
+	f := &ringFile{key: *key, entry: h.entry, chunks: make([]File, len(h.chunks))}
+	for i := range h.chunks {
+		f.chunks[i] = s.held[h.chunks[i].Key].chunk.Duplicate()
+	}
+	return f, nil
+}
+
+// Type ringFile is a file consisting of chunks held by the backends.
+type ringFile struct {
+	key      SKey
+	entry    *fileEntry
+	chunks   []File
+	disposed bool
+}
+
+func (f *ringFile) Dispose() {
+	if f.disposed {
+		return
+	}
+	f.disposed = true
+	for _, chunk := range f.chunks {
+		chunk.Dispose()
+	}
+}
+
+func (f *ringFile) checkValid() {
+	if f.disposed {
+		panic("Already disposed")
+	}
+}
+
+func (f *ringFile) Key() SKey {
+	return f.key
+}
+
+func (f *ringFile) Open() io.ReadCloser {
+	f.checkValid()
+	return &ringReader{chunks: f.Chunks()}
+}
+
+func (f *ringFile) OpenTransformed(transform TransformFunc) io.ReadCloser {
+	return OpenTransformed(f, transform)
+}
+
+func (f *ringFile) Size() int64 {
+	return f.entry.size
+}
+
+func (f *ringFile) Duplicate() File {
+	f.checkValid()
+	chunks := make([]File, len(f.chunks))
+	for i, chunk := range f.chunks {
+		chunks[i] = chunk.Duplicate()
+	}
+	return &ringFile{key: f.key, entry: f.entry, chunks: chunks}
+}
+
+func (f *ringFile) IsChunked() bool {
+	f.checkValid()
+	return true
+}
+
+func (f *ringFile) Chunks() FileIterator {
+	f.checkValid()
+	return &ringChunksIter{file: f.Duplicate().(*ringFile), idx: -1}
+}
+
+func (f *ringFile) NumChunks() int64 {
+	return int64(len(f.entry.chunks))
+}
+
+func (f *ringFile) ContentType() string {
+	return f.entry.contentType
+}
+
+type ringChunksIter struct {
+	file *ringFile
+	idx  int
+}
+
+func (ci *ringChunksIter) Dispose() {
+	ci.file.Dispose()
+}
+
+func (ci *ringChunksIter) Duplicate() FileIterator {
+	return &ringChunksIter{file: ci.file.Duplicate().(*ringFile), idx: ci.idx}
+}
+
+func (ci *ringChunksIter) Next() bool {
+	ci.file.checkValid()
+	if ci.idx+1 >= len(ci.file.chunks) {
+		ci.idx = len(ci.file.chunks)
+		return false
+	}
+	ci.idx++
+	return true
+}
+
+func (ci *ringChunksIter) Key() SKey {
+	return ci.file.entry.chunks[ci.idx].key
+}
+
+func (ci *ringChunksIter) Size() int64 {
+	return ci.file.entry.chunks[ci.idx].size
+}
+
+func (ci *ringChunksIter) File() File {
+	return ci.file.chunks[ci.idx].Duplicate()
+}
+
+// Type ringReader reads the chunks of a file one after the other.
+type ringReader struct {
+	chunks  FileIterator
+	chunk   File // The chunk being read, if any
+	current io.ReadCloser
+}
+
+func (r *ringReader) Read(b []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if !r.chunks.Next() {
+				return 0, io.EOF
+			}
+			r.chunk = r.chunks.File()
+			r.current = r.chunk.Open()
+		}
+		n, err := r.current.Read(b)
+		if err == io.EOF {
+			r.closeChunk()
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *ringReader) closeChunk() {
+	r.current.Close()
+	r.chunk.Dispose()
+	r.current, r.chunk = nil, nil
+}
+
+func (r *ringReader) Close() error {
+	if r.current != nil {
+		r.closeChunk()
+	}
+	r.chunks.Dispose()
+	return nil
+}
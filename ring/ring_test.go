@@ -0,0 +1,211 @@
+package ring
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func addData(t *testing.T, s FileStorage, data []byte) SKey {
+	temp := s.Create("test data")
+	defer temp.Dispose()
+	if _, err := temp.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := temp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f := temp.File()
+	defer f.Dispose()
+	return f.Key()
+}
+
+func assertContent(t *testing.T, s FileStorage, key SKey, data []byte) {
+	f, err := s.Get(&key)
+	if err != nil {
+		t.Fatalf("Error getting %v: %v", key, err)
+	}
+	defer f.Dispose()
+	r := f.Open()
+	defer r.Close()
+	if content, err := io.ReadAll(r); err != nil {
+		t.Fatalf("Error reading %v: %v", key, err)
+	} else if !bytes.Equal(content, data) {
+		t.Fatalf("Content mismatch for %v", key)
+	}
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(rand.Int())
+	}
+	return data
+}
+
+// Type failingStorage simulates a backend that is unreachable while `down` is set.
+type failingStorage struct {
+	BoundedStorage
+	down bool
+}
+
+var errDown = errors.New("Backend down")
+
+func (s *failingStorage) Get(key *SKey) (File, error) {
+	if s.down {
+		return nil, errDown
+	}
+	return s.BoundedStorage.Get(key)
+}
+
+func (s *failingStorage) EnumerateKeys(f func(key SKey) bool) {
+	s.BoundedStorage.(KeyEnumerator).EnumerateKeys(f)
+}
+
+func TestRing(t *testing.T) {
+	backends := map[string]BoundedStorage{
+		"a": ram.NewRamStorage(4 * 1024 * 1024),
+		"b": ram.NewRamStorage(4 * 1024 * 1024),
+		"c": ram.NewRamStorage(4 * 1024 * 1024),
+	}
+	failing := &failingStorage{BoundedStorage: backends["b"]}
+	s, err := NewRingStorage(map[string]FileStorage{"a": backends["a"], "b": failing, "c": backends["c"]}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := randomData(1000000)
+	key := addData(t, s, data)
+	assertContent(t, s, key, data)
+
+	// Every chunk is stored in the backend owning it, and every backend received chunks
+	f, err := s.Get(&key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.NumChunks() < 10 {
+		t.Fatalf("Expected file to be chunked, got %d chunks", f.NumChunks())
+	}
+	chunks := make(map[SKey]bool)
+	iter := f.Chunks()
+	for iter.Next() {
+		chunkKey := iter.Key()
+		chunks[chunkKey] = true
+		if _, err := backends[s.Owner(&chunkKey)].StatByKey(&chunkKey); err != nil {
+			t.Errorf("Chunk %v not found in owner %v: %v", chunkKey, s.Owner(&chunkKey), err)
+		}
+	}
+	iter.Dispose()
+	f.Dispose()
+	for name, b := range backends {
+		if b.GetUsageInfo().Used == 0 {
+			t.Errorf("Backend %v received no chunks", name)
+		}
+	}
+
+	// Keys are enumerated across the ring
+	enumerated := make(map[SKey]bool)
+	s.EnumerateKeys(func(key SKey) bool {
+		enumerated[key] = true
+		return true
+	})
+	if !enumerated[key] {
+		t.Error("File key not enumerated")
+	}
+	for chunkKey := range chunks {
+		if !enumerated[chunkKey] {
+			t.Errorf("Chunk %v not enumerated", chunkKey)
+		}
+	}
+
+	// A failing backend causes a typed error
+	failing.down = true
+	var backendErr *BackendError
+	if _, err := s.Get(&key); !errors.As(err, &backendErr) || backendErr.Backend != "b" || !errors.Is(err, errDown) {
+		t.Errorf("Expected error of backend b, got %v", err)
+	}
+	failing.down = false
+
+	// Adding a backend only remaps the keys it becomes the owner of
+	const numKeys = 10000
+	owners := make([]string, numKeys)
+	for i := range owners {
+		k := SKey(sha256.Sum256([]byte{byte(i), byte(i >> 8)}))
+		owners[i] = s.Owner(&k)
+	}
+	if err := s.AddBackend("d", ram.NewRamStorage(4*1024*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBackend("d", ram.NewRamStorage(4*1024*1024)); err != ErrDuplicateBackend {
+		t.Errorf("Expected ErrDuplicateBackend, got %v", err)
+	}
+	moved := 0
+	for i := range owners {
+		k := SKey(sha256.Sum256([]byte{byte(i), byte(i >> 8)}))
+		if owner := s.Owner(&k); owner != owners[i] {
+			moved++
+			if owner != "d" {
+				t.Fatalf("Key %v moved from %v to %v", k, owners[i], owner)
+			}
+		}
+	}
+	if fraction := float64(moved) / numKeys; fraction < 0.1 || fraction > 0.4 {
+		t.Errorf("Expected about a quarter of the keys to move, got %.2f", fraction)
+	}
+	t.Logf("Moved %d of %d keys after adding a backend", moved, numKeys)
+
+	// Content stored before is still found at its previous owner
+	assertContent(t, s, key, data)
+
+	for name, b := range backends {
+		if locked := b.GetUsageInfo().Locked; locked != 0 {
+			t.Errorf("Backend %v: expected no locked bytes, got %d", name, locked)
+		}
+	}
+}
+
+func TestEvictedFiles(t *testing.T) {
+	s, err := NewRingStorage(map[string]FileStorage{
+		"a": ram.NewRamStorage(1024 * 1024),
+		"b": ram.NewRamStorage(1024 * 1024),
+	}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := randomData(500000)
+	key := addData(t, s, data)
+	assertContent(t, s, key, data)
+
+	// Storing more data than fits evicts the chunks of the first file, which is then forgotten
+	for i := 0; i < 8; i++ {
+		addData(t, s, randomData(500000))
+	}
+	s.EnumerateKeys(func(k SKey) bool {
+		if k == key {
+			t.Errorf("Expected evicted file %v not to be enumerated", key)
+		}
+		return true
+	})
+	if _, err := s.Get(&key); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for evicted file, got %v", err)
+	}
+	rs := s.(*ringStorage)
+	if len(rs.files) > 4 {
+		t.Errorf("Expected evicted files to be removed from the index, %d remain", len(rs.files))
+	}
+	for chunk, files := range rs.chunkFiles {
+		for _, f := range files {
+			if rs.files[f] == nil {
+				t.Errorf("Chunk %v refers to unindexed file %v", chunk, f)
+			}
+		}
+	}
+	if len(rs.held) != 0 {
+		t.Errorf("Expected no references to be held, got %d", len(rs.held))
+	}
+}
@@ -0,0 +1,535 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"github.com/indyjo/cafs/chunking"
+	"hash"
+	"log"
+	"net/http"
+)
+
+// Number of bytes considered by http.DetectContentType
+const sniffLen = 512
+
+// Type ChunkRef describes one chunk of a chunked file.
+type ChunkRef struct {
+	Key SKey
+	// Points to the byte position within the file immediately after this chunk
+	NextPos int64
+}
+
+// Interface ChunkStore is implemented by storages using ChunkingTemporary for their temporaries.
+// Each entry stored acquires a reference to it, which is held until released using Release.
+type ChunkStore interface {
+	// Stores `data` as an unchunked entry under `key`. The storage may retain `data` and truncate
+	// `key` to the length of its keys. Returns whether such an entry existed already.
+	StoreData(key *SKey, data []byte, info, contentType string) (recycled bool, err error)
+	// Stores a chunked entry consisting of `chunks` under `key`. The storage may retain `chunks`.
+	StoreChunks(key *SKey, chunks []ChunkRef, info, contentType string) error
+	// Acquires a reference to the unchunked entry stored under `key` and returns its size.
+	// Returns ErrNotFound if there is no such entry.
+	LockChunk(key *SKey) (int64, error)
+	// Releases a reference to the entry stored under `key`.
+	Release(key *SKey)
+	// Removes the entry stored under `key` if it is no longer referenced.
+	Remove(key *SKey)
+	// Returns the file stored under `key`, without counting this as an access.
+	File(key *SKey) (File, error)
+}
+
+// Type ChunkingTemporary implements Temporary (as well as Pauser, Snapshotter and Finalizer) by
+// splitting the data written into chunks and storing them into a ChunkStore, applying the
+// CreateOptions on the way. It is meant to be used by storage implementations.
+type ChunkingTemporary struct {
+	store     ChunkStore
+	newHash   func() hash.Hash   // Returns a hash computing keys of the store
+	info      string             // Info text given by user identifying the current file
+	buffer    bytes.Buffer       // Stores bytes since beginning of current chunk
+	fileHash  hash.Hash          // hash since the beginning of the file
+	chunkHash hash.Hash          // hash since the beginning of the current chunk
+	valid     bool               // If false, something has gone wrong
+	open      bool               // Set to false on Close()
+	chunker   chunking.Chunker   // Determines chunk boundaries
+	chunks    []ChunkRef         // Grows every time a chunk boundary is encountered
+	sniff     []byte             // Collects the beginning of the file for content type detection, if requested
+	dedup     *DedupCounter      // Applies the dedup guard, if requested
+	hasher    *ChunkHasher       // Hashes chunks in parallel, if requested
+	inline    int64              // If > 0, data is buffered without chunking up to this size
+	err       error              // If set, returned by Write and Close
+	scan      func([]byte) error // Decides whether chunks may be stored, if requested
+	stored    []SKey             // Chunks newly stored by this temporary, if scanning
+	hinted    bool               // Whether chunk boundaries are placed at hints, which prevents pausing
+}
+
+// Returns a temporary storing into `store` the file identified by `info`, using `newHash` for
+// computing keys and `profiles` for resolving the chunking profile requested by `opts`.
+func NewChunkingTemporary(store ChunkStore, newHash func() hash.Hash, profiles ChunkingProfiles, info string, opts CreateOptions) *ChunkingTemporary {
+	t := &ChunkingTemporary{
+		store:     store,
+		newHash:   newHash,
+		info:      info,
+		fileHash:  newHash(),
+		chunkHash: newHash(),
+		valid:     true,
+		open:      true,
+		chunks:    make([]ChunkRef, 0, 16),
+	}
+	if opts.SniffContentType {
+		t.sniff = make([]byte, 0, sniffLen)
+	}
+	t.dedup = NewDedupCounter(opts.DedupGuard, info)
+	t.hasher = NewChunkHasher(opts.HashWorkers, t.hashKey)
+	t.inline = opts.InlineThreshold
+	t.scan = opts.Scan
+	t.hinted = len(opts.BoundaryHints) > 0
+	t.chunker, t.err = profiles.NewChunker(opts)
+	return t
+}
+
+// Writes the current buffer into a new chunk and resets the buffer.
+// Assumes that chunkHash has already been updated, unless chunks are hashed in parallel.
+func (t *ChunkingTemporary) flushBufferIntoChunk() error {
+	if t.buffer.Len() == 0 {
+		return nil
+	}
+
+	// Copy the chunk's data
+	chunkData := make([]byte, t.buffer.Len())
+	copy(chunkData, t.buffer.Bytes())
+	t.buffer.Reset()
+
+	if t.hasher != nil {
+		// The chunk is stored once it has been hashed, in order
+		t.hasher.Submit(chunkData)
+		for t.hasher.Full() {
+			if err := t.storeChunk(t.hasher.Next()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Get the chunk hash
+	var key SKey
+	t.chunkHash.Sum(key[:0])
+	t.chunkHash.Reset()
+	return t.storeChunk(key, chunkData)
+}
+
+// Stores the chunks still being hashed in parallel.
+func (t *ChunkingTemporary) drainHasher() error {
+	for t.hasher.Pending() > 0 {
+		if err := t.storeChunk(t.hasher.Next()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stores a chunk with the given key and appends it to the list of chunks.
+func (t *ChunkingTemporary) storeChunk(key SKey, data []byte) error {
+	if err := t.scanChunk(data); err != nil {
+		return err
+	}
+	chunkInfo := fmt.Sprintf("%v #%d", t.info, len(t.chunks))
+	recycled, err := t.store.StoreData(&key, data, chunkInfo, "")
+	if err != nil {
+		return err
+	}
+	if t.scan != nil && !recycled {
+		t.stored = append(t.stored, key)
+	}
+	t.appendChunk(key, int64(len(data)))
+	return t.dedup.Count(recycled)
+}
+
+// Appends a chunk of the given size to the list of chunks.
+func (t *ChunkingTemporary) appendChunk(key SKey, size int64) {
+	chunk := ChunkRef{
+		Key:     key,
+		NextPos: size,
+	}
+	if len(t.chunks) > 0 {
+		chunk.NextPos += t.chunks[len(t.chunks)-1].NextPos
+	}
+	t.chunks = append(t.chunks, chunk)
+}
+
+// Passes chunk data to the scan hook, if any. If the chunk is rejected, the chunks stored so far
+// are released and those stored by this temporary are removed from the storage.
+func (t *ChunkingTemporary) scanChunk(data []byte) error {
+	if t.scan == nil {
+		return nil
+	}
+	err := t.scan(data)
+	if err == nil {
+		return nil
+	}
+	t.releaseChunks(t.chunks)
+	for i := range t.stored {
+		t.store.Remove(&t.stored[i])
+	}
+	t.chunks, t.stored = t.chunks[:0], nil
+	return err
+}
+
+// Releases a reference to each of the chunks.
+func (t *ChunkingTemporary) releaseChunks(chunks []ChunkRef) {
+	for i := range chunks {
+		t.store.Release(&chunks[i].Key)
+	}
+}
+
+func (t *ChunkingTemporary) Write(b []byte) (int, error) {
+	if t.err != nil {
+		return 0, t.err
+	}
+	if !t.valid || !t.open {
+		return 0, ErrInvalidState
+	}
+	t.valid = false // only temporary -> set to true on successful end of function
+
+	nBytes := len(b)
+
+	if t.sniff != nil && len(t.sniff) < sniffLen {
+		n := sniffLen - len(t.sniff)
+		if n > len(b) {
+			n = len(b)
+		}
+		t.sniff = append(t.sniff, b[:n]...)
+	}
+
+	if t.inline > 0 {
+		if int64(t.buffer.Len()+len(b)) <= t.inline {
+			// Small enough to be stored inline
+			t.buffer.Write(b)
+			t.valid = true
+			return nBytes, nil
+		}
+		// Too large to be stored inline: chunk the data buffered so far, then continue normally
+		buffered := make([]byte, t.buffer.Len(), t.buffer.Len()+len(b))
+		copy(buffered, t.buffer.Bytes())
+		t.buffer.Reset()
+		t.inline = 0
+		b = append(buffered, b...)
+	}
+
+	if err := t.writeChunked(b, true); err != nil {
+		return 0, err
+	}
+	t.valid = true
+	return nBytes, nil
+}
+
+// Passes `b` through the chunker, storing each chunk completed. Unless `hashFile` is false,
+// which is the case when writing data already hashed before pausing, the file's hash is updated.
+func (t *ChunkingTemporary) writeChunked(b []byte, hashFile bool) error {
+	for len(b) > 0 {
+		nBoundary := t.chunker.Scan(b)
+		if _, err := t.buffer.Write(b[:nBoundary]); err != nil {
+			return err
+		}
+		if t.hasher == nil {
+			t.chunkHash.Write(b[:nBoundary])
+		}
+		if hashFile {
+			t.fileHash.Write(b[:nBoundary])
+		}
+		if nBoundary < len(b) {
+			// a chunk boundary was detected
+			if err := t.flushBufferIntoChunk(); err != nil {
+				return err
+			}
+			b = b[nBoundary:]
+		} else {
+			b = nil
+		}
+	}
+	return nil
+}
+
+// Implements Pauser. The checkpoint omits the chunker's state, which is reset at every chunk
+// boundary and can therefore be restored by passing Tail through a fresh chunker.
+func (t *ChunkingTemporary) Pause() (*Checkpoint, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	if !t.valid || !t.open {
+		return nil, ErrInvalidState
+	}
+	if t.hinted {
+		return nil, ErrCannotPause
+	}
+	if err := t.drainHasher(); err != nil {
+		t.valid = false
+		return nil, err
+	}
+	state, err := t.fileHash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	cp := &Checkpoint{
+		Chunks: make([]SKey, len(t.chunks)),
+		Tail:   bytes.Clone(t.buffer.Bytes()),
+		Hash:   state,
+		Sniff:  bytes.Clone(t.sniff),
+		Inline: t.inline > 0,
+	}
+	for i, chunk := range t.chunks {
+		cp.Chunks[i] = chunk.Key
+	}
+
+	// Only the chunks are kept, released on Dispose()
+	t.valid = false
+	t.buffer = bytes.Buffer{}
+	t.chunker = nil
+	t.sniff = nil
+	if LoggingEnabled {
+		log.Printf("[%v] Temporary paused after %d chunks", t.info, len(t.chunks))
+	}
+	return cp, nil
+}
+
+// Function Restore continues the ingest paused at `cp` in a temporary that hasn't been written to.
+// Meant for implementing Resumer. The temporary must be disposed if an error is returned.
+func (t *ChunkingTemporary) Restore(cp *Checkpoint) error {
+	if t.hinted {
+		return ErrCannotPause
+	}
+	if t.err != nil {
+		return t.err
+	}
+	if cp.Inline {
+		// Nothing has been hashed or chunked yet
+		_, err := t.Write(cp.Tail)
+		return err
+	}
+
+	if err := t.fileHash.(encoding.BinaryUnmarshaler).UnmarshalBinary(cp.Hash); err != nil {
+		return ErrInvalidCheckpoint
+	}
+	for i := range cp.Chunks {
+		key := cp.Chunks[i]
+		size, err := t.store.LockChunk(&key)
+		if err != nil {
+			return err
+		}
+		t.appendChunk(key, size)
+	}
+	if t.sniff != nil {
+		t.sniff = append(t.sniff, cp.Sniff...)
+	}
+	t.inline = 0
+	if err := t.writeChunked(cp.Tail, false); err != nil {
+		return err
+	}
+	if LoggingEnabled {
+		log.Printf("[%v] Temporary resumed after %d chunks", t.info, len(t.chunks))
+	}
+	return nil
+}
+
+func (t *ChunkingTemporary) Close() error {
+	if t.err != nil {
+		return t.err
+	}
+	if !t.valid || !t.open {
+		return ErrInvalidState
+	}
+	t.open = false
+	t.valid = false // only temporary -> set to true on successful end of function
+	if t.inline > 0 {
+		// The data is stored as a single chunk, which has yet to be hashed
+		t.fileHash.Write(t.buffer.Bytes())
+	}
+	var key SKey
+	t.fileHash.Sum(key[:0])
+	if err := t.drainHasher(); err != nil {
+		return err
+	}
+
+	var contentType string
+	if t.sniff != nil {
+		contentType = http.DetectContentType(t.sniff)
+	}
+
+	if len(t.chunks) == 0 {
+		// File is single-chunk
+		if err := t.scanChunk(t.buffer.Bytes()); err != nil {
+			return err
+		}
+		data := make([]byte, t.buffer.Len())
+		copy(data, t.buffer.Bytes())
+		if _, err := t.store.StoreData(&key, data, t.info, contentType); err != nil {
+			return err
+		}
+	} else {
+		// Flush buffer contents into one last chunk
+		if err := t.flushBufferIntoChunk(); err != nil {
+			return err
+		}
+		if err := t.drainHasher(); err != nil {
+			return err
+		}
+		finalChunks := make([]ChunkRef, len(t.chunks))
+		copy(finalChunks, t.chunks)
+		if err := t.store.StoreChunks(&key, finalChunks, t.info, contentType); err != nil {
+			return err
+		}
+	}
+	t.valid = true
+	return nil
+}
+
+// Stores the data written so far as a file without closing the temporary. Implements Snapshotter.
+func (t *ChunkingTemporary) Snapshot() (File, error) {
+	if !t.valid || !t.open {
+		return nil, ErrInvalidState
+	}
+	if err := t.drainHasher(); err != nil {
+		t.valid = false
+		return nil, err
+	}
+	tail := t.buffer.Bytes()
+	if err := t.scanChunk(tail); err != nil {
+		t.valid = false
+		return nil, err
+	}
+	var key SKey
+	if t.inline > 0 {
+		// Nothing has been hashed yet
+		key = t.hashKey(tail)
+	} else {
+		t.fileHash.Sum(key[:0])
+	}
+
+	if len(t.chunks) == 0 {
+		if _, err := t.store.StoreData(&key, append([]byte(nil), tail...), t.info, ""); err != nil {
+			return nil, err
+		}
+	} else {
+		// The snapshot references the chunks stored so far in addition to the temporary,
+		// plus one chunk containing the data of the current, incomplete chunk.
+		chunks := make([]ChunkRef, len(t.chunks), len(t.chunks)+1)
+		copy(chunks, t.chunks)
+		for i := range chunks {
+			if _, err := t.store.LockChunk(&chunks[i].Key); err != nil {
+				// Shouldn't happen, as the temporary holds references to its chunks
+				panic(err)
+			}
+		}
+		if len(tail) > 0 {
+			tailKey := t.hashKey(tail)
+			if _, err := t.store.StoreData(&tailKey, append([]byte(nil), tail...), fmt.Sprintf("%v #%d", t.info, len(chunks)), ""); err != nil {
+				t.releaseChunks(chunks)
+				return nil, err
+			}
+			chunks = append(chunks, ChunkRef{Key: tailKey, NextPos: chunks[len(chunks)-1].NextPos + int64(len(tail))})
+		}
+		if err := t.store.StoreChunks(&key, chunks, t.info, ""); err != nil {
+			t.releaseChunks(chunks)
+			return nil, err
+		}
+	}
+
+	// Hand the reference acquired by storing the file over to the file
+	file, err := t.store.File(&key)
+	if err != nil {
+		panic(err)
+	}
+	t.store.Release(&key)
+	return file, nil
+}
+
+// Returns the key of `data` in the store.
+func (t *ChunkingTemporary) hashKey(data []byte) SKey {
+	var key SKey
+	h := t.newHash()
+	h.Write(data)
+	h.Sum(key[:0])
+	return key
+}
+
+// Closes the temporary and returns the key of the stored file. Implements Finalizer.
+func (t *ChunkingTemporary) Finalize() (SKey, error) {
+	if err := t.Close(); err != nil {
+		return SKey{}, err
+	}
+	var key SKey
+	t.fileHash.Sum(key[:0])
+	return key, nil
+}
+
+func (t *ChunkingTemporary) File() File {
+	if !t.valid {
+		panic(ErrInvalidState)
+	}
+	if t.open {
+		panic(ErrStillOpen)
+	}
+
+	var key SKey
+	t.fileHash.Sum(key[:0])
+
+	file, err := t.store.File(&key)
+	if err != nil {
+		// Shouldn't happen
+		panic(err)
+	}
+	return file
+}
+
+func (t *ChunkingTemporary) Dispose() {
+	if t.chunks == nil {
+		// temporary was already disposed, we allow this
+		return
+	}
+
+	t.releaseFromStorage()
+
+	t.valid = false
+	wasOpen := t.open
+	t.open = false
+	t.buffer = bytes.Buffer{}
+	t.chunker = nil
+	t.chunks = nil
+	if LoggingEnabled {
+		if wasOpen {
+			log.Printf("[%v] Temporary canceled", t.info)
+		} else {
+			log.Printf("[%v] Temporary disposed", t.info)
+		}
+	}
+}
+
+// Releases the references held by this temporary.
+func (t *ChunkingTemporary) releaseFromStorage() {
+	// dereference single-chunk entry if successfully closed
+	if !t.open && t.valid {
+		var key SKey
+		t.fileHash.Sum(key[:0])
+		t.store.Release(&key)
+	} else {
+		// dereference all locked chunks otherwise
+		// (they have been locked once just by storing them)
+		t.releaseChunks(t.chunks)
+	}
+}
@@ -0,0 +1,48 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import "io"
+
+// Type TransformFunc wraps a reader over a file's content, e.g. for decompressing or
+// decrypting it on the fly.
+type TransformFunc func(io.Reader) io.Reader
+
+type transformedReader struct {
+	io.Reader
+	underlying io.ReadCloser
+}
+
+// Function OpenTransformed opens `file` and returns a reader over its content as
+// transformed by `transform`. Closing the returned reader first closes the transformed
+// reader, if it implements io.Closer, and then the reader it is based on.
+// File implementations may use this function to implement File.OpenTransformed.
+func OpenTransformed(file File, transform TransformFunc) io.ReadCloser {
+	r := file.Open()
+	return &transformedReader{transform(r), r}
+}
+
+func (r *transformedReader) Close() error {
+	var err error
+	if c, ok := r.Reader.(io.Closer); ok && r.Reader != io.Reader(r.underlying) {
+		err = c.Close()
+	}
+	if e := r.underlying.Close(); err == nil {
+		err = e
+	}
+	return err
+}
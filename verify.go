@@ -0,0 +1,137 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Type ChunkError is returned by Verify for the first chunk found to be damaged.
+type ChunkError struct {
+	Index int64 // The position of the chunk within the file
+	Key   SKey  // The key of the chunk
+	Err   error // ErrKeyMismatch if the data doesn't match the key, or the error reading the data
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("Chunk #%d (%v): %v", e.Index, e.Key, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// Type VerifyOptions contains optional settings for Verify.
+// The zero value selects the default behavior.
+type VerifyOptions struct {
+	// If greater than 1, chunks are read and hashed by this many goroutines in parallel, which
+	// speeds up verifying large files on multiple cores.
+	Workers int
+	// The number of chunks read ahead of the chunk being hashed by the slowest worker.
+	// Defaults to twice the number of workers.
+	ReadAhead int
+}
+
+// Function Verify reads every chunk of `file` and checks that its data matches its key and size.
+// Returns a *ChunkError for the damaged chunk with the lowest index, regardless of the order in which
+// chunks are verified, or nil if all chunks are intact. The file's key isn't recomputed, as this
+// would require hashing the whole content sequentially. For files consisting of a single chunk,
+// it is checked nevertheless.
+func Verify(file File, opts VerifyOptions) error {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.ReadAhead <= 0 {
+		opts.ReadAhead = 2 * opts.Workers
+	}
+
+	type job struct {
+		index int64
+		key   SKey
+		size  int64
+		chunk File
+	}
+	jobs := make(chan job, opts.ReadAhead)
+
+	var mutex sync.Mutex
+	var first *ChunkError // The damaged chunk with the lowest index found so far
+	failedBefore := func(index int64) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return first != nil && first.Index < index
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				// Chunks after a damaged one can't change the result
+				if failedBefore(j.index) {
+					j.chunk.Dispose()
+					continue
+				}
+				err := verifyChunk(j.chunk, j.key, j.size)
+				j.chunk.Dispose()
+				if err == nil {
+					continue
+				}
+				mutex.Lock()
+				if first == nil || j.index < first.Index {
+					first = &ChunkError{j.index, j.key, err}
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	iter := file.Chunks()
+	var index int64
+	for iter.Next() && !failedBefore(index) {
+		jobs <- job{index, iter.Key(), iter.Size(), iter.File()}
+		index++
+	}
+	iter.Dispose()
+	close(jobs)
+	wg.Wait()
+
+	if first != nil {
+		return first
+	}
+	return nil
+}
+
+// Hashes the data of `chunk` and compares it with the expected key and size.
+func verifyChunk(chunk File, key SKey, size int64) error {
+	h := sha256.New()
+	r := chunk.Open()
+	n, err := io.Copy(h, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	var actual SKey
+	h.Sum(actual[:0])
+	if actual != key || n != size {
+		return ErrKeyMismatch
+	}
+	return nil
+}
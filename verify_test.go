@@ -0,0 +1,109 @@
+package cafs_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"io"
+	"testing"
+	"time"
+)
+
+// Type damagedFile returns altered data for some of its chunks. Chunks with a low index are
+// slow to open, so that damaged chunks with higher indices are found first.
+type damagedFile struct {
+	File
+	damaged map[int]bool
+}
+
+func (f damagedFile) Chunks() FileIterator {
+	return &damagedIterator{FileIterator: f.File.Chunks(), damaged: f.damaged, index: -1}
+}
+
+type damagedIterator struct {
+	FileIterator
+	damaged map[int]bool
+	index   int
+}
+
+func (i *damagedIterator) Next() bool {
+	i.index++
+	return i.FileIterator.Next()
+}
+
+func (i *damagedIterator) File() File {
+	return damagedChunk{i.FileIterator.File(), i.damaged[i.index], time.Duration(20-i.index) * time.Millisecond}
+}
+
+type damagedChunk struct {
+	File
+	damaged bool
+	delay   time.Duration
+}
+
+func (c damagedChunk) Open() io.ReadCloser {
+	time.Sleep(c.delay)
+	r := c.File.Open()
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		panic(err)
+	}
+	if c.damaged {
+		data[len(data)/2] ^= 1
+	}
+	return io.NopCloser(bytes.NewReader(data))
+}
+
+func TestVerify(t *testing.T) {
+	s := ram.NewRamStorage(8 * 1024 * 1024)
+	f := createRandomFile(t, s, 1024*1024)
+	if f.NumChunks() < 30 {
+		t.Fatalf("Expected many chunks, got %d", f.NumChunks())
+	}
+
+	for _, workers := range []int{0, 1, 4, 16} {
+		opts := VerifyOptions{Workers: workers}
+		if err := Verify(f, opts); err != nil {
+			t.Errorf("Verifying intact file with %d workers: %v", workers, err)
+		}
+
+		// The damaged chunk with the lowest index is reported
+		err := Verify(damagedFile{f, map[int]bool{3: true, 7: true, 25: true}}, opts)
+		var chunkErr *ChunkError
+		if !errors.As(err, &chunkErr) || !errors.Is(err, ErrKeyMismatch) {
+			t.Fatalf("Expected ChunkError with %d workers, got %v", workers, err)
+		}
+		iter := f.Chunks()
+		for i := 0; i <= 3; i++ {
+			iter.Next()
+		}
+		if chunkErr.Index != 3 || chunkErr.Key != iter.Key() {
+			t.Errorf("Expected chunk #3 (%v) to be reported with %d workers, got %v", iter.Key(), workers, err)
+		}
+		iter.Dispose()
+	}
+	f.Dispose()
+	s.FreeCache()
+	if ui := s.GetUsageInfo(); ui.Used != 0 {
+		t.Errorf("Chunks remain locked after verifying: %v", ui)
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	s := ram.NewRamStorage(64 * 1024 * 1024)
+	f := createRandomFile(b, s, 32*1024*1024)
+	defer f.Dispose()
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(f.Size())
+			for i := 0; i < b.N; i++ {
+				if err := Verify(f, VerifyOptions{Workers: workers}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}